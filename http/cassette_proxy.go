@@ -0,0 +1,212 @@
+package http
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
+)
+
+const cassetteKind = "http"
+
+// cassetteProxy records responses to a cassette or replays them from it,
+// the mode is chosen by "cassette_mode", put it last so the other proxies still run.
+type cassetteProxy struct {
+	name string
+
+	nextTransport http.RoundTripper
+
+	conf config.Config
+
+	logger log.Logger
+
+	cassette *cassette.Cassette
+}
+
+// httpCassette is the recorded response of a request.
+type httpCassette struct {
+	StatusCode int `json:"status_code"`
+
+	Header http.Header `json:"header,omitempty"`
+
+	//the text of a binary body is base64
+	Body cassette.Value `json:"body"`
+}
+
+type CassetteProxyOption func(c *cassetteProxy)
+
+type CassetteProxyOptions struct{}
+
+func NewCassetteProxy(options ...CassetteProxyOption) *cassetteProxy {
+	cassetteProxy := &cassetteProxy{}
+
+	for _, option := range options {
+		option(cassetteProxy)
+	}
+
+	if cassetteProxy.conf == nil {
+		cassetteProxy.conf = config.NewNullConfig()
+	}
+
+	if cassetteProxy.logger == nil {
+		cassetteProxy.logger = log.NewLogger()
+	}
+
+	if cassetteProxy.cassette == nil {
+		cas, err := cassette.OpenWithConf(cassetteProxy.conf)
+		if err != nil {
+			cassetteProxy.logger.Panicf("[http] open cassette error : %s", err.Error())
+		}
+		cassetteProxy.cassette = cas
+	}
+
+	cassetteProxy.name = "cassette_proxy"
+
+	return cassetteProxy
+}
+
+func (CassetteProxyOptions) WithConf(conf config.Config) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.conf = conf
+	}
+}
+
+func (CassetteProxyOptions) WithLogger(logger log.Logger) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.logger = logger
+	}
+}
+
+func (CassetteProxyOptions) WithCassette(cas *cassette.Cassette) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.cassette = cas
+	}
+}
+
+func (this *cassetteProxy) NextProxy(tripper interface{}) {
+	this.nextTransport = tripper.(http.RoundTripper)
+}
+
+func (this *cassetteProxy) ProxyName() string {
+	return this.name
+}
+
+// RoundTrip implements the RoundTripper interface.
+func (this *cassetteProxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	if this.nextTransport == nil {
+		this.nextTransport = http.DefaultTransport
+	}
+
+	if this.cassette == nil {
+		return this.nextTransport.RoundTrip(req)
+	}
+
+	request, err := cassetteRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	recorded := httpCassette{}
+	if this.cassette.Mode() == cassette.ModeReplay {
+		err = this.cassette.Replay(cassetteKind, request, &recorded)
+		if errors.Is(err, cassette.ErrUnmatched) {
+			this.logger.Errorf("[http] %s", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return recorded.response(req)
+	}
+
+	resp, err := this.nextTransport.RoundTrip(req)
+	if err != nil {
+		this.record(request, nil, err)
+		return resp, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	recorded.StatusCode = resp.StatusCode
+	recorded.Header = resp.Header
+	recorded.Body, err = cassette.EncodeValue(body)
+	if err != nil {
+		return nil, err
+	}
+	this.record(request, recorded, nil)
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return resp, nil
+}
+
+func (this *cassetteProxy) record(request string, recorded interface{}, err error) {
+	recErr := this.cassette.Record(cassetteKind, request, recorded, err)
+	if recErr != nil {
+		this.logger.Errorf("[http] record %s error : %s", request, recErr.Error())
+	}
+}
+
+func (this httpCassette) response(req *http.Request) (*http.Response, error) {
+	value, err := cassette.DecodeValue(this.Body, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body, ok := value.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("http: cassette body of kind %s", this.Body.Kind)
+	}
+
+	header := this.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", this.StatusCode, http.StatusText(this.StatusCode)),
+		StatusCode:    this.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// cassetteRequest is method, url and body, the body is put back to req,
+// a binary body is base64 so it is kept by the json of the cassette.
+func cassetteRequest(req *http.Request) (string, error) {
+	request := req.Method + " " + req.URL.String()
+	if req.Body == nil || req.Body == http.NoBody {
+		return request, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if len(body) > 0 && utf8.Valid(body) {
+		request += " " + string(body)
+	} else if len(body) > 0 {
+		request += " " + base64.StdEncoding.EncodeToString(body)
+	}
+
+	return request, nil
+}
@@ -3,13 +3,17 @@ package http
 import (
 	"bytes"
 	"context"
+	"errors"
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -191,3 +195,94 @@ func TestTimeoutProxy(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, resp.StatusCode, 200)
 }
+
+func TestCassetteProxy(t *testing.T) {
+	binaryBody := []byte{0xff, 0x00, 0xfe, 'a'}
+
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	memConfig := config.NewMemConfig()
+	memConfig.Set("cassette_mode", cassette.ModeRecord)
+	memConfig.Set("cassette_file", filepath.Join(dir, "http.json"))
+
+	stubsProxyOptions := StubsProxyOptions{}
+	cassetteProxyOptions := CassetteProxyOptions{}
+	clientOptions := ClientOptions{}
+
+	recordProxy := NewCassetteProxy(
+		cassetteProxyOptions.WithConf(memConfig),
+		cassetteProxyOptions.WithLogger(logger))
+	httpClient := NewHttpClient(
+		clientOptions.WithLogger(logger),
+		clientOptions.WithProxy(
+			func() interface{} {
+				return recordProxy
+			},
+			func() interface{} {
+				return NewStubsProxy(
+					stubsProxyOptions.WithRespFunc(func(request *http.Request) *http.Response {
+						resp := &http.Response{}
+						resp.StatusCode = 200
+						resp.Body = ioutil.NopCloser(bytes.NewReader([]byte("hello")))
+						if request.Method == http.MethodPost {
+							resp.Body = ioutil.NopCloser(bytes.NewReader(binaryBody))
+						}
+						return resp
+					}),
+					stubsProxyOptions.WithName("stubsProxy"),
+					stubsProxyOptions.WithLogger(logger),
+				)
+			},
+		),
+	)
+
+	ctx := context.Background()
+	resp, err := httpClient.Get(ctx, "127.0.0.1")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "hello", string(body))
+
+	resp, err = httpClient.Post(ctx, "127.0.0.1", "application/octet-stream", bytes.NewReader(binaryBody))
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, binaryBody, body)
+
+	recordProxy.cassette.Eject()
+	memConfig.Set("cassette_mode", cassette.ModeReplay)
+	spyProxy := NewSpyProxy(logger, "spyProxy")
+	httpClient = NewHttpClient(
+		clientOptions.WithLogger(logger),
+		clientOptions.WithProxy(
+			func() interface{} {
+				return NewCassetteProxy(
+					cassetteProxyOptions.WithConf(memConfig),
+					cassetteProxyOptions.WithLogger(logger))
+			},
+			func() interface{} {
+				return spyProxy
+			},
+		),
+	)
+
+	resp, err = httpClient.Get(ctx, "127.0.0.1")
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.False(t, spyProxy.RoundTripWasCalled)
+
+	//binary bodies are kept by the json
+	resp, err = httpClient.Post(ctx, "127.0.0.1", "application/octet-stream", bytes.NewReader(binaryBody))
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, binaryBody, body)
+
+	_, err = httpClient.Get(ctx, "127.0.0.2")
+	assert.True(t, errors.Is(err, cassette.ErrUnmatched))
+}
@@ -0,0 +1,435 @@
+package mongodb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/transports"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var _ transports.Transports = (*changeStreamWorker)(nil)
+
+// ChangeEvent is an event of the change stream, see the change events of mongodb.
+type ChangeEvent struct {
+	//the resume token
+	ID bson.Raw `bson:"_id"`
+
+	//insert, update, replace, delete, drop, rename, dropDatabase or invalidate
+	OperationType string `bson:"operationType"`
+
+	Ns struct {
+		Db string `bson:"db"`
+
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+
+	DocumentKey bson.Raw `bson:"documentKey"`
+
+	//of insert and replace, and update if options.UpdateLookup
+	FullDocument bson.Raw `bson:"fullDocument"`
+
+	UpdateDescription bson.Raw `bson:"updateDescription"`
+
+	ClusterTime primitive.Timestamp `bson:"clusterTime"`
+}
+
+// ChangeHandler handles an event, the event is delivered again after an error.
+type ChangeHandler func(ctx context.Context, event ChangeEvent) error
+
+// the codes of the server errors of change streams
+const (
+	//the token of an invalidate event is resumed with ResumeAfter
+	invalidResumeToken = 260
+
+	//can't be resumed, like the token is gone from the oplog
+	changeStreamFatalError = 280
+
+	changeStreamHistoryLost = 286
+)
+
+// changeStream is what changeStreamWorker uses of *mongo.ChangeStream.
+type changeStream interface {
+	TryNext(ctx context.Context) bool
+
+	ID() int64
+
+	Decode(val interface{}) error
+
+	ResumeToken() bson.Raw
+
+	Err() error
+
+	Close(ctx context.Context) error
+}
+
+type watchFunc func(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (changeStream, error)
+
+// changeStreamWorker watches a collection or a database and passes the events to the handler one by one.
+// The resume token of an event is saved after it is handled, so the events are delivered at least once:
+// after a handler error, a network error or a restart the worker resumes from the last saved token.
+// The token of an empty batch is saved too, so a pipeline which filters most events doesn't fall
+// behind the oplog. After an invalidate event the worker starts after it, a dropped collection
+// is watched again once it is recreated.
+// The retries wait from 100ms to "mgo_change_stream_max_backoff" ms (default 30000). The worker
+// stops if the token is gone from the oplog, see Err.
+//  worker := NewChangeStreamWorker("user_sync",
+//      changeStreamWorkerOptions.WithColl(mgoClient.GetCtxColl("test", "", "user")),
+//      changeStreamWorkerOptions.WithHandler(handler),
+//      changeStreamWorkerOptions.WithTokenStore(NewRedisTokenStore(redisClient)))
+//  worker.Start()
+type changeStreamWorker struct {
+	name string
+
+	conf config.Config
+
+	logger log.Logger
+
+	watch watchFunc
+
+	pipeline interface{}
+
+	streamOptions *options.ChangeStreamOptions
+
+	handler ChangeHandler
+
+	store ResumeTokenStore
+
+	//the token of the last handled event or empty batch
+	lastToken bson.Raw
+
+	//lastToken is of an invalidate event, it is resumed with StartAfter
+	invalidated bool
+
+	//the error which stopped run
+	err error
+
+	errLock sync.Mutex
+
+	cancel context.CancelFunc
+
+	done chan struct{}
+
+	stopOnce sync.Once
+}
+
+type ChangeStreamWorkerOption func(c *changeStreamWorker)
+
+type ChangeStreamWorkerOptions struct{}
+
+func NewChangeStreamWorker(name string, options ...ChangeStreamWorkerOption) *changeStreamWorker {
+	changeStreamWorker := &changeStreamWorker{}
+
+	for _, option := range options {
+		option(changeStreamWorker)
+	}
+
+	if changeStreamWorker.conf == nil {
+		changeStreamWorker.conf = config.NewNullConfig()
+	}
+
+	if changeStreamWorker.logger == nil {
+		changeStreamWorker.logger = log.NewLogger()
+	}
+
+	if changeStreamWorker.pipeline == nil {
+		changeStreamWorker.pipeline = mongo.Pipeline{}
+	}
+
+	if changeStreamWorker.store == nil {
+		changeStreamWorker.store = nullTokenStore{}
+	}
+
+	changeStreamWorker.name = name
+	changeStreamWorker.done = make(chan struct{})
+
+	return changeStreamWorker
+}
+
+func (ChangeStreamWorkerOptions) WithConf(conf config.Config) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.conf = conf
+	}
+}
+
+func (ChangeStreamWorkerOptions) WithLogger(logger log.Logger) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.logger = logger
+	}
+}
+
+// WithColl watches coll.
+func (ChangeStreamWorkerOptions) WithColl(coll Mongo) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.watch = func(ctx context.Context, pipeline interface{},
+			opts ...*options.ChangeStreamOptions) (changeStream, error) {
+			stream, err := coll.Watch(ctx, pipeline, opts...)
+			if err != nil {
+				return nil, err
+			}
+
+			return stream, nil
+		}
+	}
+}
+
+// WithDatabase watches all collections of db.
+func (ChangeStreamWorkerOptions) WithDatabase(db *mongo.Database) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.watch = func(ctx context.Context, pipeline interface{},
+			opts ...*options.ChangeStreamOptions) (changeStream, error) {
+			stream, err := db.Watch(ctx, pipeline, opts...)
+			if err != nil {
+				return nil, err
+			}
+
+			return stream, nil
+		}
+	}
+}
+
+// WithPipeline filters or changes the events, like mongo.Pipeline{{{"$match", bson.M{"operationType": "insert"}}}}.
+func (ChangeStreamWorkerOptions) WithPipeline(pipeline interface{}) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.pipeline = pipeline
+	}
+}
+
+// WithStreamOptions sets the options of Watch, the resume token replaces
+// ResumeAfter, StartAfter and StartAtOperationTime if there is one.
+func (ChangeStreamWorkerOptions) WithStreamOptions(opts *options.ChangeStreamOptions) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.streamOptions = opts
+	}
+}
+
+func (ChangeStreamWorkerOptions) WithHandler(handler ChangeHandler) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.handler = handler
+	}
+}
+
+// WithTokenStore saves the resume tokens in store, they are only kept in memory without it.
+func (ChangeStreamWorkerOptions) WithTokenStore(store ResumeTokenStore) ChangeStreamWorkerOption {
+	return func(c *changeStreamWorker) {
+		c.store = store
+	}
+}
+
+type nullTokenStore struct{}
+
+func (nullTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) { return nil, nil }
+
+func (nullTokenStore) Save(ctx context.Context, name string, token bson.Raw) error { return nil }
+
+//implement Transports interface
+func (this *changeStreamWorker) Start() {
+	if this.watch == nil {
+		this.logger.Panicf("[mongodb] change stream %s has nothing to watch", this.name)
+	}
+
+	if this.handler == nil {
+		this.logger.Panicf("[mongodb] change stream %s has no handler", this.name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	this.cancel = cancel
+
+	this.logger.Infof("[mongodb] change stream %s starting", this.name)
+	go this.run(ctx)
+}
+
+// Err returns the error which stopped the worker, like ChangeStreamHistoryLost, or nil.
+// Such a worker is not resumed, its token must be removed from the store to start it again.
+func (this *changeStreamWorker) Err() error {
+	this.errLock.Lock()
+	defer this.errLock.Unlock()
+
+	return this.err
+}
+
+//implement Transports interface
+func (this *changeStreamWorker) GracefulShutDown() {
+	this.stopOnce.Do(func() {
+		if this.cancel == nil {
+			close(this.done)
+			return
+		}
+
+		this.cancel()
+		<-this.done
+		this.logger.Infof("[mongodb] change stream %s stopped", this.name)
+	})
+}
+
+func (this *changeStreamWorker) run(ctx context.Context) {
+	defer close(this.done)
+
+	maxBackoff := time.Duration(this.conf.GetInt64("mgo_change_stream_max_backoff")) * time.Millisecond
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+
+	backoff := 100 * time.Millisecond
+	for {
+		handled, err := this.watchOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if handled > 0 {
+			backoff = 100 * time.Millisecond
+		}
+
+		if isHistoryLost(err) {
+			this.errLock.Lock()
+			this.err = err
+			this.errLock.Unlock()
+			this.logger.Errorf("[mongodb] change stream %s stopped, the resume token is lost : %s",
+				this.name, err.Error())
+			return
+		}
+
+		lab := prometheus.Labels{"name": this.name}
+		mongodbChangeStreamRestartTotal.With(lab).Inc()
+		if err != nil {
+			this.logger.Errorf("[mongodb] change stream %s resume in %v : %s", this.name, backoff, err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// watchOnce opens the stream from the last token and handles the events until an error,
+// it returns the number of the handled events.
+func (this *changeStreamWorker) watchOnce(ctx context.Context) (int, error) {
+	token := this.lastToken
+	if token == nil {
+		var err error
+		token, err = this.store.Load(ctx, this.name)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	streamOptions := options.MergeChangeStreamOptions(this.streamOptions)
+	if token != nil {
+		streamOptions.ResumeAfter = nil
+		streamOptions.StartAfter = nil
+		streamOptions.StartAtOperationTime = nil
+		if this.invalidated {
+			streamOptions.SetStartAfter(token)
+		} else {
+			streamOptions.SetResumeAfter(token)
+		}
+	}
+
+	stream, err := this.watch(ctx, this.pipeline, streamOptions)
+	if err != nil {
+		//a stored token of an invalidate event, not known after a restart
+		if token != nil && !this.invalidated && hasErrorCode(err, invalidResumeToken) {
+			this.lastToken, this.invalidated = token, true
+		}
+		return 0, err
+	}
+	defer stream.Close(context.Background())
+
+	handled := 0
+	for {
+		if !stream.TryNext(ctx) {
+			if stream.Err() != nil || stream.ID() == 0 || ctx.Err() != nil {
+				break
+			}
+
+			//an empty batch, its token is after the events filtered by the pipeline
+			this.saveToken(stream.ResumeToken(), false)
+			continue
+		}
+
+		event := ChangeEvent{}
+		if err = stream.Decode(&event); err != nil {
+			return handled, err
+		}
+
+		//the handler is not canceled by GracefulShutDown
+		if err = this.handle(context.Background(), event); err != nil {
+			return handled, err
+		}
+		handled++
+
+		this.saveToken(stream.ResumeToken(), event.OperationType == "invalidate")
+	}
+
+	if err = stream.Err(); err == nil && ctx.Err() == nil {
+		err = errors.New("mongodb: change stream closed")
+	}
+
+	return handled, err
+}
+
+// saveToken keeps token as the last one and saves it if it has changed.
+func (this *changeStreamWorker) saveToken(token bson.Raw, invalidated bool) {
+	if token == nil || bytes.Equal(token, this.lastToken) && invalidated == this.invalidated {
+		return
+	}
+
+	this.lastToken, this.invalidated = token, invalidated
+	if err := this.store.Save(context.Background(), this.name, token); err != nil {
+		this.logger.Errorf("[mongodb] change stream %s save token : %s", this.name, err.Error())
+	}
+}
+
+func isHistoryLost(err error) bool {
+	return hasErrorCode(err, changeStreamHistoryLost) || hasErrorCode(err, changeStreamFatalError)
+}
+
+func hasErrorCode(err error, code int) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(code)
+}
+
+func (this *changeStreamWorker) handle(ctx context.Context, event ChangeEvent) error {
+	startTime := time.Now()
+	err := this.handler(ctx, event)
+
+	result := "success"
+	if err != nil {
+		result = "fail"
+	}
+
+	lab := prometheus.Labels{"name": this.name, "operation": event.OperationType, "result": result}
+	mongodbChangeStreamEventTotal.With(lab).Inc()
+	mongodbChangeStreamHandleDuration.With(prometheus.Labels{"name": this.name}).
+		Observe(time.Since(startTime).Seconds())
+
+	if event.ClusterTime.T != 0 {
+		lag := startTime.Sub(time.Unix(int64(event.ClusterTime.T), 0))
+		mongodbChangeStreamLag.With(prometheus.Labels{"name": this.name}).Set(lag.Seconds())
+	}
+
+	if err != nil {
+		this.logger.Errorf("[mongodb] change stream %s handle %s : %s", this.name,
+			event.OperationType, err.Error())
+	}
+
+	return err
+}
@@ -0,0 +1,177 @@
+package mongodb
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// the started commands older than it are dropped when commandStore is full,
+// a command always succeeds or fails, so they are lost events
+const maxCommandAge = 10 * time.Minute
+
+// startedCommand is what monitorEvent knows of a command when it is started.
+type startedCommand struct {
+	name string
+
+	database string
+
+	collection string
+
+	//the filter with values replaced by ?, see redact
+	filter string
+
+	//the txnNumber of the commands in a transaction, 0 if not
+	txnNumber int64
+
+	startTime time.Time
+}
+
+// commandStore keeps the started commands by RequestID until they succeed or fail,
+// so concurrent commands of the same ctx are told apart.
+type commandStore struct {
+	lock sync.Mutex
+
+	max int
+
+	commands map[int64]*startedCommand
+}
+
+func newCommandStore(max int) *commandStore {
+	return &commandStore{
+		max:      max,
+		commands: make(map[int64]*startedCommand),
+	}
+}
+
+func (this *commandStore) start(startEvent *event.CommandStartedEvent) {
+	command := newStartedCommand(startEvent)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if len(this.commands) >= this.max {
+		for requestID, started := range this.commands {
+			if command.startTime.Sub(started.startTime) > maxCommandAge {
+				delete(this.commands, requestID)
+			}
+		}
+
+		if len(this.commands) >= this.max {
+			return
+		}
+	}
+
+	this.commands[startEvent.RequestID] = command
+}
+
+// finish removes and returns the command of requestID, nil if it is not started or dropped.
+func (this *commandStore) finish(requestID int64) *startedCommand {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	command, ok := this.commands[requestID]
+	if ok {
+		delete(this.commands, requestID)
+	}
+
+	return command
+}
+
+func (this *commandStore) len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.commands)
+}
+
+// the fields of the filter of commands
+var filterFields = map[string]string{
+	"find":          "filter",
+	"count":         "query",
+	"distinct":      "query",
+	"findAndModify": "query",
+	"aggregate":     "pipeline",
+}
+
+// the fields of the statements of commands, the filter is "q" of the first statement
+var statementFields = map[string]string{
+	"update": "updates",
+	"delete": "deletes",
+}
+
+func newStartedCommand(startEvent *event.CommandStartedEvent) *startedCommand {
+	command := &startedCommand{
+		name:      startEvent.CommandName,
+		database:  startEvent.DatabaseName,
+		startTime: time.Now(),
+	}
+
+	//the first element is the command and its collection, getMore has "collection"
+	if elem, err := startEvent.Command.IndexErr(0); err == nil {
+		command.collection, _ = elem.Value().StringValueOK()
+	}
+	if value, err := startEvent.Command.LookupErr("collection"); err == nil && command.collection == "" {
+		command.collection, _ = value.StringValueOK()
+	}
+
+	if value, err := startEvent.Command.LookupErr("txnNumber"); err == nil {
+		command.txnNumber, _ = value.Int64OK()
+	}
+
+	if field, ok := filterFields[command.name]; ok {
+		if value, err := startEvent.Command.LookupErr(field); err == nil {
+			command.filter = redact(value)
+		}
+	} else if field, ok := statementFields[command.name]; ok {
+		if value, err := startEvent.Command.LookupErr(field, "0", "q"); err == nil {
+			command.filter = redact(value)
+		}
+	}
+
+	return command
+}
+
+// redact returns value in JSON with the values replaced by ?,
+// the keys and the operators are kept, a list of values like $in is one ?.
+func redact(value bson.RawValue) string {
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		elems, err := value.Document().Elements()
+		if err != nil {
+			return "?"
+		}
+
+		fields := make([]string, 0, len(elems))
+		for _, elem := range elems {
+			fields = append(fields, `"`+elem.Key()+`": `+redact(elem.Value()))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case bsontype.Array:
+		values, err := value.Array().Values()
+		if err != nil {
+			return "?"
+		}
+
+		items := make([]string, 0, len(values))
+		scalars := true
+		for _, value := range values {
+			item := redact(value)
+			if item != "?" {
+				scalars = false
+			}
+			items = append(items, item)
+		}
+
+		if scalars {
+			return "?"
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+
+	return "?"
+}
@@ -0,0 +1,146 @@
+package mongodb
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jukylin/esim/log"
+)
+
+// Fault is injected into the calls of Method, "*" is all methods with ctx.
+type Fault struct {
+	Method string
+
+	//returned without calling the next proxy, nil only delays
+	Err error
+
+	Delay time.Duration
+
+	//the probability of injecting, 0 is always
+	Rate float64
+}
+
+// faultProxy injects delays and errors into the calls of the collection,
+// to see how the callers behave when mongodb is slow or down.
+//  faultProxyOptions := FaultProxyOptions{}
+//  NewFaultProxy(faultProxyOptions.WithFault(
+//      Fault{Method: "FindOne", Err: context.DeadlineExceeded, Delay: time.Second, Rate: 0.1}))
+type faultProxy struct {
+	*collInterceptor
+
+	name string
+
+	logger log.Logger
+
+	lock sync.RWMutex
+
+	//method => fault
+	faults map[string]Fault
+}
+
+type FaultProxyOption func(c *faultProxy)
+
+type FaultProxyOptions struct{}
+
+func NewFaultProxy(options ...FaultProxyOption) *faultProxy {
+	faultProxy := &faultProxy{faults: make(map[string]Fault)}
+
+	for _, option := range options {
+		option(faultProxy)
+	}
+
+	if faultProxy.logger == nil {
+		faultProxy.logger = log.NewLogger()
+	}
+
+	faultProxy.name = "fault_proxy"
+	faultProxy.collInterceptor = &collInterceptor{around: faultProxy.around}
+
+	return faultProxy
+}
+
+func (FaultProxyOptions) WithLogger(logger log.Logger) FaultProxyOption {
+	return func(f *faultProxy) {
+		f.logger = logger
+	}
+}
+
+func (FaultProxyOptions) WithFault(faults ...Fault) FaultProxyOption {
+	return func(f *faultProxy) {
+		for _, fault := range faults {
+			f.faults[fault.Method] = fault
+		}
+	}
+}
+
+//implement Proxy interface
+func (this *faultProxy) NextProxy(coll interface{}) {
+	this.nextColl = coll.(Mongo)
+}
+
+//implement Proxy interface
+func (this *faultProxy) ProxyName() string {
+	return this.name
+}
+
+// SetFault replaces the fault of fault.Method.
+func (this *faultProxy) SetFault(fault Fault) {
+	this.lock.Lock()
+	this.faults[fault.Method] = fault
+	this.lock.Unlock()
+}
+
+// RemoveFault stops injecting into method.
+func (this *faultProxy) RemoveFault(method string) {
+	this.lock.Lock()
+	delete(this.faults, method)
+	this.lock.Unlock()
+}
+
+func (this *faultProxy) around(ctx context.Context, coll Mongo, method string,
+	call func(ctx context.Context) error) error {
+	fault, ok := this.fault(method)
+	if !ok {
+		return call(ctx)
+	}
+
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	if fault.Err != nil {
+		this.logger.Warnc(ctx, "[mongodb] %s inject %s : %s", this.name, method, fault.Err.Error())
+		return fault.Err
+	}
+
+	return call(ctx)
+}
+
+// fault returns the fault of method if it is injected this time.
+func (this *faultProxy) fault(method string) (Fault, bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	fault, ok := this.faults[method]
+	if !ok {
+		fault, ok = this.faults["*"]
+	}
+
+	if !ok {
+		return fault, false
+	}
+
+	if fault.Rate > 0 && fault.Rate < 1 && rand.Float64() >= fault.Rate {
+		return fault, false
+	}
+
+	return fault, true
+}
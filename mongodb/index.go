@@ -0,0 +1,419 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec is an index declared for Coll of Database on Client, in Go by WithIndexes
+// or in "mgo_indexes". Keys are like "phone", "-created_at" (descending) or "title:text".
+//  mgo_indexes:
+//  - {client: 'test', coll: 'user', keys: ['phone'], unique: true,
+//     partialfilter: {phone: {$exists: true}}, collation: {locale: 'en', strength: 2}}
+//  - {client: 'test', database: 'log', coll: 'session', keys: ['expire_at'], expireafter: '0s'}
+type IndexSpec struct {
+	Client string `json:"client" yaml:"client"`
+
+	//default the database of the client
+	Database string `json:"database" yaml:"database"`
+
+	Coll string `json:"coll" yaml:"coll"`
+
+	//default the name of mongodb, like "phone_1_created_at_-1"
+	Name string `json:"name" yaml:"name"`
+
+	Keys []string `json:"keys" yaml:"keys"`
+
+	Unique bool `json:"unique" yaml:"unique"`
+
+	Sparse bool `json:"sparse" yaml:"sparse"`
+
+	//a TTL index if not nil, in seconds
+	ExpireAfter *time.Duration `json:"expire_after" yaml:"expireafter"`
+
+	PartialFilter bson.M `json:"partial_filter" yaml:"partialfilter"`
+
+	Collation *options.Collation `json:"collation" yaml:"collation"`
+}
+
+// LoadIndexSpecs reads "mgo_indexes" of conf.
+func LoadIndexSpecs(conf config.Config) ([]IndexSpec, error) {
+	specs := []IndexSpec{}
+	err := conf.UnmarshalKey("mgo_indexes", &specs, viper.DecodeHook(
+		mapstructure.StringToTimeDurationHookFunc(),
+	))
+
+	return specs, err
+}
+
+func (this IndexSpec) keys() bson.D {
+	keys := make(bson.D, 0, len(this.Keys))
+	for _, key := range this.Keys {
+		var value interface{} = int32(1)
+		if strings.HasPrefix(key, "-") {
+			key = key[1:]
+			value = int32(-1)
+		} else if i := strings.LastIndex(key, ":"); i > 0 {
+			key, value = key[:i], key[i+1:]
+		}
+		keys = append(keys, bson.E{Key: key, Value: value})
+	}
+
+	return keys
+}
+
+func (this IndexSpec) name() string {
+	if this.Name != "" {
+		return this.Name
+	}
+
+	names := make([]string, 0, len(this.Keys))
+	for _, key := range this.keys() {
+		names = append(names, fmt.Sprintf("%s_%v", key.Key, key.Value))
+	}
+
+	return strings.Join(names, "_")
+}
+
+// String is like "test.user phone_1 {unique}".
+func (this IndexSpec) String() string {
+	var attrs []string
+	if this.Unique {
+		attrs = append(attrs, "unique")
+	}
+	if this.Sparse {
+		attrs = append(attrs, "sparse")
+	}
+	if this.ExpireAfter != nil {
+		attrs = append(attrs, "ttl "+this.ExpireAfter.String())
+	}
+	if this.PartialFilter != nil {
+		attrs = append(attrs, "partial")
+	}
+	if this.Collation != nil {
+		attrs = append(attrs, "collation "+this.Collation.Locale)
+	}
+
+	s := this.Database + "." + this.Coll + " " + this.name()
+	if len(attrs) > 0 {
+		s += " {" + strings.Join(attrs, ", ") + "}"
+	}
+
+	return s
+}
+
+func (this IndexSpec) model() mongo.IndexModel {
+	indexOptions := options.Index().SetName(this.name())
+	if this.Unique {
+		indexOptions.SetUnique(true)
+	}
+
+	if this.Sparse {
+		indexOptions.SetSparse(true)
+	}
+
+	if this.ExpireAfter != nil {
+		indexOptions.SetExpireAfterSeconds(int32(*this.ExpireAfter / time.Second))
+	}
+
+	if this.PartialFilter != nil {
+		indexOptions.SetPartialFilterExpression(this.PartialFilter)
+	}
+
+	if this.Collation != nil {
+		indexOptions.SetCollation(this.Collation)
+	}
+
+	return mongo.IndexModel{Keys: this.keys(), Options: indexOptions}
+}
+
+// existingIndex is an index listed by mongodb.
+type existingIndex struct {
+	Name string `bson:"name"`
+
+	Key bson.D `bson:"key"`
+
+	Unique bool `bson:"unique"`
+
+	Sparse bool `bson:"sparse"`
+
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+
+	PartialFilterExpression bson.D `bson:"partialFilterExpression"`
+
+	Collation *struct {
+		Locale string `bson:"locale"`
+
+		Strength int `bson:"strength"`
+	} `bson:"collation"`
+}
+
+func (this existingIndex) text() bool {
+	for _, key := range this.Key {
+		if key.Key == "_fts" && key.Value == "text" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameKeys reports whether index has the key pattern of spec, the keys of text indexes
+// are not compared, mongodb lists them as _fts and _ftsx and allows one per collection.
+func (this IndexSpec) sameKeys(index existingIndex) bool {
+	keys := this.keys()
+	for _, key := range keys {
+		if key.Value == "text" {
+			return index.text()
+		}
+	}
+
+	return !index.text() && equal(keys, index.Key)
+}
+
+// same reports whether index is the one of spec except its name.
+func (this IndexSpec) same(index existingIndex) bool {
+	if !this.sameKeys(index) {
+		return false
+	}
+
+	if this.Unique != index.Unique || this.Sparse != index.Sparse {
+		return false
+	}
+
+	if (this.ExpireAfter == nil) != (index.ExpireAfterSeconds == nil) {
+		return false
+	}
+	if this.ExpireAfter != nil && int64(*this.ExpireAfter/time.Second) != *index.ExpireAfterSeconds {
+		return false
+	}
+
+	if (this.PartialFilter == nil) != (index.PartialFilterExpression == nil) {
+		return false
+	}
+	if this.PartialFilter != nil {
+		partialFilter, err := toDoc(this.PartialFilter)
+		if err != nil || !equal(partialFilter, index.PartialFilterExpression) {
+			return false
+		}
+	}
+
+	if (this.Collation == nil) != (index.Collation == nil) {
+		return false
+	}
+	if this.Collation != nil && (this.Collation.Locale != index.Collation.Locale ||
+		this.Collation.Strength != 0 && this.Collation.Strength != index.Collation.Strength) {
+		return false
+	}
+
+	return true
+}
+
+// IndexChange is a declared index whose existing one has another name, keys or options.
+type IndexChange struct {
+	Spec IndexSpec
+
+	//of the existing index
+	Name string
+}
+
+// String is like "test.user phone_1 {unique}", with " (was phone)" if renamed.
+func (this IndexChange) String() string {
+	if this.Name != this.Spec.name() {
+		return this.Spec.String() + " (was " + this.Name + ")"
+	}
+
+	return this.Spec.String()
+}
+
+// IndexDiff is the difference between the declared and the existing indexes of a collection.
+type IndexDiff struct {
+	Client string
+
+	Database string
+
+	Coll string
+
+	//declared, not existing
+	Missing []IndexSpec
+
+	//existing with the same name or key pattern, but another name, keys or options
+	Changed []IndexChange
+
+	//existing, not declared, except _id_
+	Unexpected []string
+}
+
+// Empty reports whether the indexes are the declared ones.
+func (this IndexDiff) Empty() bool {
+	return len(this.Missing) == 0 && len(this.Changed) == 0 && len(this.Unexpected) == 0
+}
+
+// indexView is what the sync uses of mongo.IndexView.
+type indexView interface {
+	List(ctx context.Context, opts ...*options.ListIndexesOptions) (*mongo.Cursor, error)
+
+	CreateOne(ctx context.Context, model mongo.IndexModel, opts ...*options.CreateIndexesOptions) (string, error)
+
+	DropOne(ctx context.Context, name string, opts ...*options.DropIndexesOptions) (bson.Raw, error)
+}
+
+// diffIndexes compares the specs of a collection with its indexes in view.
+func diffIndexes(ctx context.Context, view indexView, specs []IndexSpec) (IndexDiff, error) {
+	diff := IndexDiff{}
+
+	cursor, err := view.List(ctx)
+	if err != nil {
+		return diff, err
+	}
+
+	var indexes []existingIndex
+	if err = cursor.All(ctx, &indexes); err != nil {
+		return diff, err
+	}
+
+	//an index matches one spec, the unchanged ones first, then by the keys and options,
+	//mongodb refuses to create an index whose keys and options exist under another name
+	matches := []func(spec IndexSpec, index existingIndex) bool{
+		func(spec IndexSpec, index existingIndex) bool { return index.Name == spec.name() && spec.same(index) },
+		func(spec IndexSpec, index existingIndex) bool { return spec.same(index) },
+		func(spec IndexSpec, index existingIndex) bool { return index.Name == spec.name() },
+		func(spec IndexSpec, index existingIndex) bool { return spec.sameKeys(index) },
+	}
+
+	matched := make([]bool, len(indexes))
+	unmatched := specs
+	for m, match := range matches {
+		specs, unmatched = unmatched, nil
+		for _, spec := range specs {
+			found := false
+			for k, index := range indexes {
+				if matched[k] || index.Name == "_id_" || !match(spec, index) {
+					continue
+				}
+
+				matched[k], found = true, true
+				if m > 0 {
+					diff.Changed = append(diff.Changed, IndexChange{Spec: spec, Name: index.Name})
+				}
+				break
+			}
+
+			if !found {
+				unmatched = append(unmatched, spec)
+			}
+		}
+	}
+	diff.Missing = unmatched
+
+	for k, index := range indexes {
+		if index.Name != "_id_" && !matched[k] {
+			diff.Unexpected = append(diff.Unexpected, index.Name)
+		}
+	}
+
+	return diff, nil
+}
+
+// syncIndexes creates the missing indexes of diff, if drop it recreates the changed
+// and drops the unexpected ones.
+func syncIndexes(ctx context.Context, view indexView, diff IndexDiff, drop bool, logger log.Logger) error {
+	if drop {
+		for _, name := range diff.Unexpected {
+			if _, err := view.DropOne(ctx, name); err != nil {
+				return err
+			}
+			logger.Infof("[mongodb] drop index %s.%s %s", diff.Database, diff.Coll, name)
+		}
+
+		for _, change := range diff.Changed {
+			if _, err := view.DropOne(ctx, change.Name); err != nil {
+				return err
+			}
+			logger.Infof("[mongodb] drop changed index %s", change.String())
+		}
+	} else {
+		for _, name := range diff.Unexpected {
+			logger.Warnf("[mongodb] unexpected index %s.%s %s", diff.Database, diff.Coll, name)
+		}
+
+		for _, change := range diff.Changed {
+			logger.Warnf("[mongodb] changed index %s", change.String())
+		}
+	}
+
+	create := append([]IndexSpec{}, diff.Missing...)
+	if drop {
+		for _, change := range diff.Changed {
+			create = append(create, change.Spec)
+		}
+	}
+
+	for _, spec := range create {
+		if _, err := view.CreateOne(ctx, spec.model()); err != nil {
+			return fmt.Errorf("create index %s : %s", spec.String(), err.Error())
+		}
+		logger.Infof("[mongodb] create index %s", spec.String())
+	}
+
+	return nil
+}
+
+// SyncIndexes compares the indexes of "mgo_indexes" and WithIndexes with the existing ones,
+// if not dryRun it creates the missing ones, if drop it also recreates the changed
+// and drops the unexpected ones. Only the collections with declared indexes are synced.
+func (this *MgoClient) SyncIndexes(ctx context.Context, dryRun bool, drop bool) ([]IndexDiff, error) {
+	//client.db.coll => specs
+	collSpecs := make(map[string][]IndexSpec)
+	var collKeys []string
+	for _, spec := range this.indexSpecs {
+		if spec.Database == "" {
+			spec.Database = this.databases[strings.ToLower(spec.Client)]
+		}
+
+		key := strings.ToLower(spec.Client) + "." + spec.Database + "." + spec.Coll
+		if _, ok := collSpecs[key]; !ok {
+			collKeys = append(collKeys, key)
+		}
+		collSpecs[key] = append(collSpecs[key], spec)
+	}
+	sort.Strings(collKeys)
+
+	var diffs []IndexDiff
+	for _, key := range collKeys {
+		specs := collSpecs[key]
+		coll := this.GetColl(specs[0].Client, specs[0].Database, specs[0].Coll)
+		if coll == nil {
+			return diffs, fmt.Errorf("[mongodb] client %s not found", specs[0].Client)
+		}
+
+		view := coll.Indexes()
+		diff, err := diffIndexes(ctx, view, specs)
+		if err != nil {
+			return diffs, err
+		}
+		diff.Client, diff.Database, diff.Coll = specs[0].Client, specs[0].Database, specs[0].Coll
+		diffs = append(diffs, diff)
+
+		if dryRun || diff.Empty() {
+			continue
+		}
+
+		if err = syncIndexes(ctx, view, diff, drop, this.logger); err != nil {
+			return diffs, err
+		}
+	}
+
+	return diffs, nil
+}
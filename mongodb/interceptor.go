@@ -0,0 +1,263 @@
+package mongodb
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// implemented by *mongo.Collection and the proxies of GetCtxColl
+var _ Mongo = (*mongo.Collection)(nil)
+
+// collInterceptor implements Mongo by passing the methods with ctx to nextColl through around,
+// so a proxy embedding it only implements around, NextProxy and ProxyName.
+// The methods without ctx go to nextColl directly.
+type collInterceptor struct {
+	nextColl Mongo
+
+	//call is the method of coll, its error is returned to the caller
+	around func(ctx context.Context, coll Mongo, method string, call func(ctx context.Context) error) error
+}
+
+//implement CollBinder interface, around is shared with the proxy
+func (this *collInterceptor) Bind(coll Mongo) Mongo {
+	return &collInterceptor{nextColl: coll, around: this.around}
+}
+
+// singleResultErr is the error of result, not found is not an error.
+func singleResultErr(result *mongo.SingleResult) error {
+	if err := result.Err(); err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	return nil
+}
+
+// errSingleResult returns *mongo.SingleResult whose Decode and Err return err.
+func errSingleResult(err error) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+}
+
+func (this *collInterceptor) Clone(opts ...*options.CollectionOptions) (*mongo.Collection, error) {
+	return this.nextColl.Clone(opts...)
+}
+
+func (this *collInterceptor) Name() string {
+	return this.nextColl.Name()
+}
+
+func (this *collInterceptor) Database() *mongo.Database {
+	return this.nextColl.Database()
+}
+
+func (this *collInterceptor) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (result *mongo.BulkWriteResult, err error) {
+	err = this.around(ctx, this.nextColl, "BulkWrite", func(ctx context.Context) error {
+		result, err = this.nextColl.BulkWrite(ctx, models, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) InsertOne(ctx context.Context, document interface{},
+	opts ...*options.InsertOneOptions) (result *mongo.InsertOneResult, err error) {
+	err = this.around(ctx, this.nextColl, "InsertOne", func(ctx context.Context) error {
+		result, err = this.nextColl.InsertOne(ctx, document, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (result *mongo.InsertManyResult, err error) {
+	err = this.around(ctx, this.nextColl, "InsertMany", func(ctx context.Context) error {
+		result, err = this.nextColl.InsertMany(ctx, documents, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (result *mongo.DeleteResult, err error) {
+	err = this.around(ctx, this.nextColl, "DeleteOne", func(ctx context.Context) error {
+		result, err = this.nextColl.DeleteOne(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) DeleteMany(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (result *mongo.DeleteResult, err error) {
+	err = this.around(ctx, this.nextColl, "DeleteMany", func(ctx context.Context) error {
+		result, err = this.nextColl.DeleteMany(ctx, filter, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (result *mongo.UpdateResult, err error) {
+	err = this.around(ctx, this.nextColl, "UpdateOne", func(ctx context.Context) error {
+		result, err = this.nextColl.UpdateOne(ctx, filter, update, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) UpdateMany(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (result *mongo.UpdateResult, err error) {
+	err = this.around(ctx, this.nextColl, "UpdateMany", func(ctx context.Context) error {
+		result, err = this.nextColl.UpdateMany(ctx, filter, update, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) ReplaceOne(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.ReplaceOptions) (result *mongo.UpdateResult, err error) {
+	err = this.around(ctx, this.nextColl, "ReplaceOne", func(ctx context.Context) error {
+		result, err = this.nextColl.ReplaceOne(ctx, filter, replacement, opts...)
+		return err
+	})
+
+	return result, err
+}
+
+func (this *collInterceptor) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (cursor *mongo.Cursor, err error) {
+	err = this.around(ctx, this.nextColl, "Aggregate", func(ctx context.Context) error {
+		cursor, err = this.nextColl.Aggregate(ctx, pipeline, opts...)
+		return err
+	})
+
+	return cursor, err
+}
+
+func (this *collInterceptor) CountDocuments(ctx context.Context, filter interface{},
+	opts ...*options.CountOptions) (count int64, err error) {
+	err = this.around(ctx, this.nextColl, "CountDocuments", func(ctx context.Context) error {
+		count, err = this.nextColl.CountDocuments(ctx, filter, opts...)
+		return err
+	})
+
+	return count, err
+}
+
+func (this *collInterceptor) EstimatedDocumentCount(ctx context.Context,
+	opts ...*options.EstimatedDocumentCountOptions) (count int64, err error) {
+	err = this.around(ctx, this.nextColl, "EstimatedDocumentCount", func(ctx context.Context) error {
+		count, err = this.nextColl.EstimatedDocumentCount(ctx, opts...)
+		return err
+	})
+
+	return count, err
+}
+
+func (this *collInterceptor) Distinct(ctx context.Context, fieldName string, filter interface{},
+	opts ...*options.DistinctOptions) (values []interface{}, err error) {
+	err = this.around(ctx, this.nextColl, "Distinct", func(ctx context.Context) error {
+		values, err = this.nextColl.Distinct(ctx, fieldName, filter, opts...)
+		return err
+	})
+
+	return values, err
+}
+
+func (this *collInterceptor) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (cursor *mongo.Cursor, err error) {
+	err = this.around(ctx, this.nextColl, "Find", func(ctx context.Context) error {
+		cursor, err = this.nextColl.Find(ctx, filter, opts...)
+		return err
+	})
+
+	return cursor, err
+}
+
+func (this *collInterceptor) FindOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) *mongo.SingleResult {
+	var result *mongo.SingleResult
+	err := this.around(ctx, this.nextColl, "FindOne", func(ctx context.Context) error {
+		result = this.nextColl.FindOne(ctx, filter, opts...)
+		return singleResultErr(result)
+	})
+
+	if result == nil {
+		return errSingleResult(err)
+	}
+
+	return result
+}
+
+func (this *collInterceptor) FindOneAndDelete(ctx context.Context, filter interface{},
+	opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	var result *mongo.SingleResult
+	err := this.around(ctx, this.nextColl, "FindOneAndDelete", func(ctx context.Context) error {
+		result = this.nextColl.FindOneAndDelete(ctx, filter, opts...)
+		return singleResultErr(result)
+	})
+
+	if result == nil {
+		return errSingleResult(err)
+	}
+
+	return result
+}
+
+func (this *collInterceptor) FindOneAndReplace(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	var result *mongo.SingleResult
+	err := this.around(ctx, this.nextColl, "FindOneAndReplace", func(ctx context.Context) error {
+		result = this.nextColl.FindOneAndReplace(ctx, filter, replacement, opts...)
+		return singleResultErr(result)
+	})
+
+	if result == nil {
+		return errSingleResult(err)
+	}
+
+	return result
+}
+
+func (this *collInterceptor) FindOneAndUpdate(ctx context.Context, filter interface{},
+	update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	var result *mongo.SingleResult
+	err := this.around(ctx, this.nextColl, "FindOneAndUpdate", func(ctx context.Context) error {
+		result = this.nextColl.FindOneAndUpdate(ctx, filter, update, opts...)
+		return singleResultErr(result)
+	})
+
+	if result == nil {
+		return errSingleResult(err)
+	}
+
+	return result
+}
+
+func (this *collInterceptor) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (stream *mongo.ChangeStream, err error) {
+	err = this.around(ctx, this.nextColl, "Watch", func(ctx context.Context) error {
+		stream, err = this.nextColl.Watch(ctx, pipeline, opts...)
+		return err
+	})
+
+	return stream, err
+}
+
+func (this *collInterceptor) Indexes() mongo.IndexView {
+	return this.nextColl.Indexes()
+}
+
+func (this *collInterceptor) Drop(ctx context.Context) error {
+	return this.around(ctx, this.nextColl, "Drop", func(ctx context.Context) error {
+		return this.nextColl.Drop(ctx)
+	})
+}
@@ -19,6 +19,12 @@ type MonitorEvent interface {
 	FailedEvent(context.Context, *event.CommandFailedEvent)
 }
 
+// CollBinder is implemented by proxies which are created once and shared by all collections of GetCtxColl.
+// Bind returns a proxy for one collection whose next is coll, it must not change the receiver.
+type CollBinder interface {
+	Bind(coll Mongo) Mongo
+}
+
 type Mongo interface {
 	Clone(opts ...*options.CollectionOptions) (*mongo.Collection, error)
 
@@ -0,0 +1,813 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jukylin/esim/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrMemNotSupported is returned by memColl for the methods it can't fake.
+var ErrMemNotSupported = errors.New("mongodb: not supported by the memory collection")
+
+// the code of the duplicate key error of mongodb, see mongo.IsDuplicateKeyError
+const duplicateKeyCode = 11000
+
+var _ Mongo = (*memColl)(nil)
+
+// memColl is a Mongo in memory for the tests of repositories, the documents are decoded
+// into structs like the driver does. It supports:
+// InsertOne/Many, Find, FindOne and FindOneAnd* with $eq, $ne, $in, $nin, $gt, $gte, $lt, $lte,
+// $exists, $and, $or and $nor, sort, skip and limit, UpdateOne/Many and ReplaceOne
+// with $set, $inc, $push, $unset and upsert, DeleteOne/Many, CountDocuments, Distinct
+// and the unique indexes of CreateIndex. Projections are ignored,
+// the other methods return ErrMemNotSupported.
+//  coll := NewMemColl("user")
+//  coll.CreateIndex(mongo.IndexModel{Keys: bson.D{{"phone", 1}}, Options: options.Index().SetUnique(true)})
+type memColl struct {
+	name string
+
+	logger log.Logger
+
+	lock sync.RWMutex
+
+	//in the order of insertion
+	docs []bson.D
+
+	indexes []memIndex
+}
+
+type memIndex struct {
+	name string
+
+	keys bson.D
+
+	unique bool
+
+	sparse bool
+}
+
+type MemCollOption func(c *memColl)
+
+type MemCollOptions struct{}
+
+func NewMemColl(name string, options ...MemCollOption) *memColl {
+	memColl := &memColl{}
+
+	for _, option := range options {
+		option(memColl)
+	}
+
+	if memColl.logger == nil {
+		memColl.logger = log.NewLogger()
+	}
+
+	memColl.name = name
+	memColl.indexes = []memIndex{{name: "_id_", keys: bson.D{{Key: "_id", Value: 1}}, unique: true}}
+
+	return memColl
+}
+
+func (MemCollOptions) WithLogger(logger log.Logger) MemCollOption {
+	return func(m *memColl) {
+		m.logger = logger
+	}
+}
+
+// CreateIndex is CreateOne of IndexView, only the unique indexes are checked.
+// The documents already in the collection must not violate it.
+func (this *memColl) CreateIndex(model mongo.IndexModel) (string, error) {
+	keys, err := toDoc(model.Keys)
+	if err != nil {
+		return "", err
+	}
+
+	if len(keys) == 0 {
+		return "", errors.New("mongodb: index keys must not be empty")
+	}
+
+	index := memIndex{keys: keys}
+	if model.Options != nil {
+		if model.Options.Name != nil {
+			index.name = *model.Options.Name
+		}
+		index.unique = model.Options.Unique != nil && *model.Options.Unique
+		index.sparse = model.Options.Sparse != nil && *model.Options.Sparse
+	}
+
+	if index.name == "" {
+		names := make([]string, 0, len(keys))
+		for _, key := range keys {
+			names = append(names, fmt.Sprintf("%s_%v", key.Key, key.Value))
+		}
+		index.name = strings.Join(names, "_")
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, exists := range this.indexes {
+		if exists.name == index.name {
+			return index.name, nil
+		}
+	}
+
+	if index.unique {
+		seen := make([]bson.A, 0, len(this.docs))
+		for _, doc := range this.docs {
+			key, ok := index.key(doc)
+			if !ok {
+				continue
+			}
+
+			for _, seenKey := range seen {
+				if equal(seenKey, key) {
+					return "", this.duplicateKeyError(index, key)
+				}
+			}
+			seen = append(seen, key)
+		}
+	}
+
+	this.indexes = append(this.indexes, index)
+
+	return index.name, nil
+}
+
+// key returns the values of the keys of the index in doc, null if missing.
+// It is false if the index is sparse and doc has none of the keys.
+func (this memIndex) key(doc bson.D) (bson.A, bool) {
+	key := make(bson.A, 0, len(this.keys))
+	found := false
+	for _, elem := range this.keys {
+		value, ok := getValue(doc, strings.Split(elem.Key, "."))
+		found = found || ok
+		key = append(key, value)
+	}
+
+	return key, found || !this.sparse
+}
+
+func (this *memColl) duplicateKeyError(index memIndex, key bson.A) mongo.WriteError {
+	return mongo.WriteError{
+		Code: duplicateKeyCode,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: %s dup key: %v",
+			this.name, index.name, key),
+	}
+}
+
+// checkUnique returns the duplicate key error if doc at pos violates a unique index, -1 is a new doc.
+func (this *memColl) checkUnique(doc bson.D, pos int) *mongo.WriteError {
+	for _, index := range this.indexes {
+		if !index.unique {
+			continue
+		}
+
+		key, ok := index.key(doc)
+		if !ok {
+			continue
+		}
+
+		for i, other := range this.docs {
+			if i == pos {
+				continue
+			}
+
+			if otherKey, ok := index.key(other); ok && equal(key, otherKey) {
+				writeErr := this.duplicateKeyError(index, key)
+				return &writeErr
+			}
+		}
+	}
+
+	return nil
+}
+
+// insert adds document with a new ObjectID if it has no _id.
+func (this *memColl) insert(document interface{}) (interface{}, error) {
+	doc, err := toDoc(document)
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := getValue(doc, []string{"_id"})
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+
+	if writeErr := this.checkUnique(doc, -1); writeErr != nil {
+		return nil, *writeErr
+	}
+
+	this.docs = append(this.docs, doc)
+
+	return id, nil
+}
+
+// matches returns the positions of the documents matching filter ordered by sortSpec,
+// in the order of insertion if sortSpec is nil.
+func (this *memColl) matches(filter interface{}, sortSpec interface{}) ([]int, error) {
+	filterDoc, err := toDoc(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var positions []int
+	for i, doc := range this.docs {
+		matched, err := match(doc, filterDoc)
+		if err != nil {
+			return nil, err
+		}
+
+		if matched {
+			positions = append(positions, i)
+		}
+	}
+
+	if sortSpec != nil {
+		spec, err := toDoc(sortSpec)
+		if err != nil {
+			return nil, err
+		}
+
+		sort.SliceStable(positions, func(i, j int) bool {
+			return lessDoc(this.docs[positions[i]], this.docs[positions[j]], spec)
+		})
+	}
+
+	return positions, nil
+}
+
+// window returns positions after skip and limit, a negative limit is the same as positive.
+func window(positions []int, skip, limit *int64) []int {
+	if skip != nil && *skip > 0 {
+		if *skip >= int64(len(positions)) {
+			return nil
+		}
+		positions = positions[*skip:]
+	}
+
+	if limit != nil && *limit != 0 {
+		n := *limit
+		if n < 0 {
+			n = -n
+		}
+
+		if n < int64(len(positions)) {
+			positions = positions[:n]
+		}
+	}
+
+	return positions
+}
+
+// deleteAt removes the documents at positions.
+func (this *memColl) deleteAt(positions ...int) {
+	deleted := make(map[int]bool, len(positions))
+	for _, pos := range positions {
+		deleted[pos] = true
+	}
+
+	docs := this.docs[:0]
+	for i, doc := range this.docs {
+		if !deleted[i] {
+			docs = append(docs, doc)
+		}
+	}
+
+	for i := len(docs); i < len(this.docs); i++ {
+		this.docs[i] = nil
+	}
+	this.docs = docs
+}
+
+// replaceAt replaces the document at pos with doc, it keeps the _id.
+func (this *memColl) replaceAt(pos int, doc bson.D) error {
+	id, _ := getValue(this.docs[pos], []string{"_id"})
+	if newID, ok := getValue(doc, []string{"_id"}); ok {
+		if !equal(id, newID) {
+			return errors.New("mongodb: the field _id is immutable")
+		}
+	} else {
+		doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+	}
+
+	if writeErr := this.checkUnique(doc, pos); writeErr != nil {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{*writeErr}}
+	}
+
+	this.docs[pos] = doc
+
+	return nil
+}
+
+// update applies update to the first or all documents matching filter, update without
+// operators is a replacement. It inserts a document if upsert and nothing matches.
+func (this *memColl) update(filter interface{}, update interface{}, sortSpec interface{},
+	upsert bool, many bool) (*mongo.UpdateResult, []int, error) {
+	updateDoc, err := toDoc(update)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	positions, err := this.matches(filter, sortSpec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !many && len(positions) > 1 {
+		positions = positions[:1]
+	}
+
+	result := &mongo.UpdateResult{MatchedCount: int64(len(positions))}
+	if len(positions) == 0 {
+		if !upsert {
+			return result, nil, nil
+		}
+
+		filterDoc, err := toDoc(filter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		doc, err := upsertDoc(filterDoc, updateDoc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		result.UpsertedID, err = this.insert(doc)
+		if err != nil {
+			if writeErr, ok := err.(mongo.WriteError); ok {
+				err = mongo.WriteException{WriteErrors: mongo.WriteErrors{writeErr}}
+			}
+			return nil, nil, err
+		}
+		result.UpsertedCount = 1
+
+		return result, []int{len(this.docs) - 1}, nil
+	}
+
+	for _, pos := range positions {
+		doc := updateDoc
+		if isOperatorDoc(updateDoc) {
+			if doc, err = applyUpdate(this.docs[pos], updateDoc); err != nil {
+				return nil, nil, err
+			}
+		} else if doc, err = toDoc(updateDoc); err != nil {
+			return nil, nil, err
+		}
+
+		if equal(doc, this.docs[pos]) {
+			continue
+		}
+
+		if err = this.replaceAt(pos, doc); err != nil {
+			return nil, nil, err
+		}
+		result.ModifiedCount++
+	}
+
+	return result, positions, nil
+}
+
+// Clone is not supported.
+func (this *memColl) Clone(opts ...*options.CollectionOptions) (*mongo.Collection, error) {
+	return nil, ErrMemNotSupported
+}
+
+func (this *memColl) Name() string {
+	return this.name
+}
+
+// Database is nil.
+func (this *memColl) Database() *mongo.Database {
+	return nil
+}
+
+// BulkWrite is not supported.
+func (this *memColl) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	this.logger.Errorc(ctx, "[mongodb] BulkWrite of %s not supported", this.name)
+	return nil, ErrMemNotSupported
+}
+
+func (this *memColl) InsertOne(ctx context.Context, document interface{},
+	opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	id, err := this.insert(document)
+	if err != nil {
+		if writeErr, ok := err.(mongo.WriteError); ok {
+			err = mongo.WriteException{WriteErrors: mongo.WriteErrors{writeErr}}
+		}
+		return nil, err
+	}
+
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// InsertMany stops at the first error if ordered (default), otherwise it inserts the others.
+func (this *memColl) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	insertManyOptions := options.MergeInsertManyOptions(opts...)
+	ordered := insertManyOptions.Ordered == nil || *insertManyOptions.Ordered
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	result := &mongo.InsertManyResult{}
+	var bulkErr mongo.BulkWriteException
+	for i, document := range documents {
+		id, err := this.insert(document)
+		if err == nil {
+			result.InsertedIDs = append(result.InsertedIDs, id)
+			continue
+		}
+
+		writeErr, ok := err.(mongo.WriteError)
+		if !ok {
+			return result, err
+		}
+
+		writeErr.Index = i
+		bulkErr.WriteErrors = append(bulkErr.WriteErrors, mongo.BulkWriteError{
+			WriteError: writeErr,
+			Request:    mongo.NewInsertOneModel().SetDocument(document),
+		})
+		if ordered {
+			break
+		}
+	}
+
+	if len(bulkErr.WriteErrors) > 0 {
+		return result, bulkErr
+	}
+
+	return result, nil
+}
+
+func (this *memColl) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return this.delete(ctx, filter, false)
+}
+
+func (this *memColl) DeleteMany(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return this.delete(ctx, filter, true)
+}
+
+func (this *memColl) delete(ctx context.Context, filter interface{}, many bool) (*mongo.DeleteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	positions, err := this.matches(filter, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if !many && len(positions) > 1 {
+		positions = positions[:1]
+	}
+	this.deleteAt(positions...)
+
+	return &mongo.DeleteResult{DeletedCount: int64(len(positions))}, nil
+}
+
+func (this *memColl) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return this.updateWithOptions(ctx, filter, update, false, opts...)
+}
+
+func (this *memColl) UpdateMany(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return this.updateWithOptions(ctx, filter, update, true, opts...)
+}
+
+func (this *memColl) updateWithOptions(ctx context.Context, filter interface{}, update interface{},
+	many bool, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	updateDoc, err := toDoc(update)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isOperatorDoc(updateDoc) {
+		return nil, errors.New("mongodb: update document must contain key beginning with '$'")
+	}
+
+	updateOptions := options.MergeUpdateOptions(opts...)
+	upsert := updateOptions.Upsert != nil && *updateOptions.Upsert
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	result, _, err := this.update(filter, updateDoc, nil, upsert, many)
+
+	return result, err
+}
+
+func (this *memColl) ReplaceOne(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	replacementDoc, err := toDoc(replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	if isOperatorDoc(replacementDoc) {
+		return nil, errors.New("mongodb: replacement document cannot contain keys beginning with '$'")
+	}
+
+	replaceOptions := options.MergeReplaceOptions(opts...)
+	upsert := replaceOptions.Upsert != nil && *replaceOptions.Upsert
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	result, _, err := this.update(filter, replacementDoc, nil, upsert, false)
+
+	return result, err
+}
+
+// Aggregate is not supported.
+func (this *memColl) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	this.logger.Errorc(ctx, "[mongodb] Aggregate of %s not supported", this.name)
+	return nil, ErrMemNotSupported
+}
+
+func (this *memColl) CountDocuments(ctx context.Context, filter interface{},
+	opts ...*options.CountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	countOptions := options.MergeCountOptions(opts...)
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	positions, err := this.matches(filter, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(window(positions, countOptions.Skip, countOptions.Limit))), nil
+}
+
+func (this *memColl) EstimatedDocumentCount(ctx context.Context,
+	opts ...*options.EstimatedDocumentCountOptions) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return int64(len(this.docs)), nil
+}
+
+func (this *memColl) Distinct(ctx context.Context, fieldName string, filter interface{},
+	opts ...*options.DistinctOptions) ([]interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	positions, err := this.matches(filter, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []interface{}
+	for _, pos := range positions {
+		for _, value := range lookup(this.docs[pos], fieldName) {
+			items, ok := value.(bson.A)
+			if !ok {
+				items = bson.A{value}
+			}
+
+			for _, item := range items {
+				exists := false
+				for _, v := range values {
+					if equal(v, item) {
+						exists = true
+						break
+					}
+				}
+
+				if !exists {
+					values = append(values, item)
+				}
+			}
+		}
+	}
+
+	return values, nil
+}
+
+func (this *memColl) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	findOptions := options.MergeFindOptions(opts...)
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	positions, err := this.matches(filter, findOptions.Sort)
+	if err != nil {
+		return nil, err
+	}
+
+	positions = window(positions, findOptions.Skip, findOptions.Limit)
+	documents := make([]interface{}, 0, len(positions))
+	for _, pos := range positions {
+		documents = append(documents, this.docs[pos])
+	}
+
+	return mongo.NewCursorFromDocuments(documents, nil, nil)
+}
+
+func (this *memColl) FindOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return errSingleResult(err)
+	}
+
+	findOneOptions := options.MergeFindOneOptions(opts...)
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	positions, err := this.matches(filter, findOneOptions.Sort)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	positions = window(positions, findOneOptions.Skip, nil)
+	if len(positions) == 0 {
+		return errSingleResult(mongo.ErrNoDocuments)
+	}
+
+	return mongo.NewSingleResultFromDocument(this.docs[positions[0]], nil, nil)
+}
+
+func (this *memColl) FindOneAndDelete(ctx context.Context, filter interface{},
+	opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return errSingleResult(err)
+	}
+
+	findOneAndDeleteOptions := options.MergeFindOneAndDeleteOptions(opts...)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	positions, err := this.matches(filter, findOneAndDeleteOptions.Sort)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	if len(positions) == 0 {
+		return errSingleResult(mongo.ErrNoDocuments)
+	}
+
+	doc := this.docs[positions[0]]
+	this.deleteAt(positions[0])
+
+	return mongo.NewSingleResultFromDocument(doc, nil, nil)
+}
+
+func (this *memColl) FindOneAndReplace(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return errSingleResult(err)
+	}
+
+	replacementDoc, err := toDoc(replacement)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	if isOperatorDoc(replacementDoc) {
+		return errSingleResult(errors.New("mongodb: replacement document cannot contain keys beginning with '$'"))
+	}
+
+	findOneAndReplaceOptions := options.MergeFindOneAndReplaceOptions(opts...)
+
+	return this.findOneAndUpdate(filter, replacementDoc, findOneAndReplaceOptions.Sort,
+		findOneAndReplaceOptions.Upsert, findOneAndReplaceOptions.ReturnDocument)
+}
+
+func (this *memColl) FindOneAndUpdate(ctx context.Context, filter interface{},
+	update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	if err := ctx.Err(); err != nil {
+		return errSingleResult(err)
+	}
+
+	updateDoc, err := toDoc(update)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	if !isOperatorDoc(updateDoc) {
+		return errSingleResult(errors.New("mongodb: update document must contain key beginning with '$'"))
+	}
+
+	findOneAndUpdateOptions := options.MergeFindOneAndUpdateOptions(opts...)
+
+	return this.findOneAndUpdate(filter, updateDoc, findOneAndUpdateOptions.Sort,
+		findOneAndUpdateOptions.Upsert, findOneAndUpdateOptions.ReturnDocument)
+}
+
+// findOneAndUpdate returns the document before the update, after if returnDocument is options.After.
+func (this *memColl) findOneAndUpdate(filter interface{}, update bson.D, sortSpec interface{},
+	upsert *bool, returnDocument *options.ReturnDocument) *mongo.SingleResult {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	positions, err := this.matches(filter, sortSpec)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	var before bson.D
+	if len(positions) > 0 {
+		before = this.docs[positions[0]]
+	}
+
+	_, positions, err = this.update(filter, update, sortSpec, upsert != nil && *upsert, false)
+	if err != nil {
+		return errSingleResult(err)
+	}
+
+	if returnDocument != nil && *returnDocument == options.After && len(positions) > 0 {
+		return mongo.NewSingleResultFromDocument(this.docs[positions[0]], nil, nil)
+	}
+
+	if before == nil {
+		return errSingleResult(mongo.ErrNoDocuments)
+	}
+
+	return mongo.NewSingleResultFromDocument(before, nil, nil)
+}
+
+// Watch is not supported.
+func (this *memColl) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	this.logger.Errorc(ctx, "[mongodb] Watch of %s not supported", this.name)
+	return nil, ErrMemNotSupported
+}
+
+// Indexes is empty, use CreateIndex.
+func (this *memColl) Indexes() mongo.IndexView {
+	return mongo.IndexView{}
+}
+
+// Drop removes the documents and the indexes.
+func (this *memColl) Drop(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.docs = nil
+	this.indexes = this.indexes[:1]
+
+	return nil
+}
@@ -0,0 +1,635 @@
+package mongodb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The documents of memColl are bson.D, their embedded documents are bson.D
+// and their arrays bson.A, like the driver decodes into bson.D.
+
+// toDoc converts v like bson.M, bson.D or a struct to bson.D, nil is an empty document.
+// It is also a deep copy of a bson.D.
+func toDoc(v interface{}) (bson.D, error) {
+	doc := bson.D{}
+	if v == nil {
+		return doc, nil
+	}
+
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// lookup returns the values of the dotted path in doc, the arrays on the path are walked into,
+// empty if the path is missing.
+func lookup(doc bson.D, path string) []interface{} {
+	return lookupParts(doc, strings.Split(path, "."))
+}
+
+func lookupParts(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{value}
+	}
+
+	switch value := value.(type) {
+	case bson.D:
+		for _, elem := range value {
+			if elem.Key == parts[0] {
+				return lookupParts(elem.Value, parts[1:])
+			}
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil {
+			if i >= 0 && i < len(value) {
+				return lookupParts(value[i], parts[1:])
+			}
+			return nil
+		}
+
+		var values []interface{}
+		for _, item := range value {
+			if _, ok := item.(bson.D); ok {
+				values = append(values, lookupParts(item, parts)...)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// expand adds the items of the arrays in values, a condition on an array matches its items.
+func expand(values []interface{}) []interface{} {
+	expanded := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		expanded = append(expanded, value)
+		if items, ok := value.(bson.A); ok {
+			expanded = append(expanded, items...)
+		}
+	}
+
+	return expanded
+}
+
+func isOperatorDoc(doc bson.D) bool {
+	return len(doc) > 0 && strings.HasPrefix(doc[0].Key, "$")
+}
+
+// match reports whether doc matches filter.
+func match(doc bson.D, filter bson.D) (bool, error) {
+	for _, elem := range filter {
+		matched, err := matchElem(doc, elem)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchElem(doc bson.D, elem bson.E) (bool, error) {
+	switch elem.Key {
+	case "$and", "$or", "$nor":
+		filters, ok := elem.Value.(bson.A)
+		if !ok || len(filters) == 0 {
+			return false, fmt.Errorf("mongodb: %s needs a nonempty array", elem.Key)
+		}
+
+		for _, filter := range filters {
+			subFilter, ok := filter.(bson.D)
+			if !ok {
+				return false, fmt.Errorf("mongodb: %s needs an array of documents", elem.Key)
+			}
+
+			matched, err := match(doc, subFilter)
+			if err != nil {
+				return false, err
+			}
+
+			switch {
+			case elem.Key == "$and" && !matched:
+				return false, nil
+			case elem.Key == "$or" && matched:
+				return true, nil
+			case elem.Key == "$nor" && matched:
+				return false, nil
+			}
+		}
+		return elem.Key != "$or", nil
+	}
+
+	if strings.HasPrefix(elem.Key, "$") {
+		return false, fmt.Errorf("mongodb: unknown operator %s", elem.Key)
+	}
+
+	values := lookup(doc, elem.Key)
+	if cond, ok := elem.Value.(bson.D); ok && isOperatorDoc(cond) {
+		for _, op := range cond {
+			matched, err := matchOperator(values, op)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	return matchEq(values, elem.Value), nil
+}
+
+// matchEq is {field: value}, null matches the missing field.
+func matchEq(values []interface{}, value interface{}) bool {
+	if len(values) == 0 {
+		return value == nil
+	}
+
+	for _, v := range expand(values) {
+		if equal(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchOperator(values []interface{}, op bson.E) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEq(values, op.Value), nil
+	case "$ne":
+		return !matchEq(values, op.Value), nil
+	case "$in", "$nin":
+		items, ok := op.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("mongodb: %s needs an array", op.Key)
+		}
+
+		in := false
+		for _, item := range items {
+			if matchEq(values, item) {
+				in = true
+				break
+			}
+		}
+		return in == (op.Key == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, value := range expand(values) {
+			c, ok := compare(value, op.Value)
+			if !ok {
+				continue
+			}
+
+			if (op.Key == "$gt" && c > 0) || (op.Key == "$gte" && c >= 0) ||
+				(op.Key == "$lt" && c < 0) || (op.Key == "$lte" && c <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$exists":
+		return (len(values) > 0) == truthy(op.Value), nil
+	}
+
+	return false, fmt.Errorf("mongodb: unknown operator %s", op.Key)
+}
+
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case nil:
+		return false
+	}
+
+	if f, ok := toFloat64(value); ok {
+		return f != 0
+	}
+
+	return true
+}
+
+// typeOrder is the order of the bson types in comparison, see the sort order of mongodb.
+func typeOrder(value interface{}) int {
+	switch value.(type) {
+	case primitive.MinKey:
+		return 0
+	case nil, primitive.Null, primitive.Undefined:
+		return 1
+	case int32, int64, float64, primitive.Decimal128:
+		return 2
+	case string, primitive.Symbol:
+		return 3
+	case bson.D:
+		return 4
+	case bson.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case primitive.Timestamp:
+		return 10
+	case primitive.MaxKey:
+		return 12
+	}
+
+	return 11
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	}
+
+	return 0, false
+}
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	case primitive.Decimal128:
+		f, err := strconv.ParseFloat(value.String(), 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func compareFloat64(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+// compare returns -1, 0 or 1 like the sort of mongodb,
+// false if a and b are of different types, then it is the order of the types.
+func compare(a, b interface{}) (int, bool) {
+	aOrder, bOrder := typeOrder(a), typeOrder(b)
+	if aOrder != bOrder {
+		return compareInt64(int64(aOrder), int64(bOrder)), false
+	}
+
+	switch a := a.(type) {
+	case nil, primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return 0, true
+	case int32, int64, float64, primitive.Decimal128:
+		aInt, aOk := toInt64(a)
+		bInt, bOk := toInt64(b)
+		if aOk && bOk {
+			return compareInt64(aInt, bInt), true
+		}
+
+		aFloat, _ := toFloat64(a)
+		bFloat, _ := toFloat64(b)
+		return compareFloat64(aFloat, bFloat), true
+	case string:
+		bString, ok := b.(string)
+		return strings.Compare(a, bString), ok
+	case bson.D:
+		bDoc := b.(bson.D)
+		for i := 0; i < len(a) && i < len(bDoc); i++ {
+			if c := strings.Compare(a[i].Key, bDoc[i].Key); c != 0 {
+				return c, true
+			}
+			if c, _ := compare(a[i].Value, bDoc[i].Value); c != 0 {
+				return c, true
+			}
+		}
+		return compareInt64(int64(len(a)), int64(len(bDoc))), true
+	case bson.A:
+		bArray := b.(bson.A)
+		for i := 0; i < len(a) && i < len(bArray); i++ {
+			if c, _ := compare(a[i], bArray[i]); c != 0 {
+				return c, true
+			}
+		}
+		return compareInt64(int64(len(a)), int64(len(bArray))), true
+	case primitive.Binary:
+		return bytes.Compare(a.Data, b.(primitive.Binary).Data), true
+	case primitive.ObjectID:
+		bID := b.(primitive.ObjectID)
+		return bytes.Compare(a[:], bID[:]), true
+	case bool:
+		bBool := b.(bool)
+		switch {
+		case a == bBool:
+			return 0, true
+		case bBool:
+			return -1, true
+		}
+		return 1, true
+	case primitive.DateTime:
+		return compareInt64(int64(a), int64(b.(primitive.DateTime))), true
+	case primitive.Timestamp:
+		bTimestamp := b.(primitive.Timestamp)
+		if c := compareInt64(int64(a.T), int64(bTimestamp.T)); c != 0 {
+			return c, true
+		}
+		return compareInt64(int64(a.I), int64(bTimestamp.I)), true
+	}
+
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	c, ok := compare(a, b)
+	return ok && c == 0
+}
+
+// lessDoc reports whether a is before b by spec like {age: -1, name: 1}, the missing fields are null.
+func lessDoc(a, b bson.D, spec bson.D) bool {
+	for _, elem := range spec {
+		c, _ := compare(sortValue(a, elem.Key), sortValue(b, elem.Key))
+		if c == 0 {
+			continue
+		}
+
+		if f, ok := toFloat64(elem.Value); ok && f < 0 {
+			return c > 0
+		}
+		return c < 0
+	}
+
+	return false
+}
+
+func sortValue(doc bson.D, path string) interface{} {
+	values := lookup(doc, path)
+	if len(values) == 0 {
+		return nil
+	}
+
+	return values[0]
+}
+
+// getValue returns the value of the dotted path in doc, the arrays are only walked by index.
+func getValue(value interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return value, true
+	}
+
+	switch value := value.(type) {
+	case bson.D:
+		for _, elem := range value {
+			if elem.Key == parts[0] {
+				return getValue(elem.Value, parts[1:])
+			}
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(value) {
+			return getValue(value[i], parts[1:])
+		}
+	}
+
+	return nil, false
+}
+
+// setValue sets the dotted path in container to value, the missing documents on the path are created.
+func setValue(container interface{}, parts []string, value interface{}) (interface{}, error) {
+	switch container := container.(type) {
+	case nil:
+		return setValue(bson.D{}, parts, value)
+	case bson.D:
+		for i, elem := range container {
+			if elem.Key != parts[0] {
+				continue
+			}
+
+			if len(parts) == 1 {
+				container[i].Value = value
+				return container, nil
+			}
+
+			child, err := setValue(elem.Value, parts[1:], value)
+			if err != nil {
+				return nil, err
+			}
+			container[i].Value = child
+			return container, nil
+		}
+
+		if len(parts) == 1 {
+			return append(container, bson.E{Key: parts[0], Value: value}), nil
+		}
+
+		child, err := setValue(bson.D{}, parts[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return append(container, bson.E{Key: parts[0], Value: child}), nil
+	case bson.A:
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("mongodb: cannot create field %s in an array", parts[0])
+		}
+
+		for len(container) <= i {
+			container = append(container, nil)
+		}
+
+		if len(parts) == 1 {
+			container[i] = value
+			return container, nil
+		}
+
+		child, err := setValue(container[i], parts[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		container[i] = child
+		return container, nil
+	}
+
+	return nil, fmt.Errorf("mongodb: cannot create field %s in %T", parts[0], container)
+}
+
+// unsetValue removes the dotted path of container, the item of an array becomes null.
+func unsetValue(container interface{}, parts []string) interface{} {
+	switch container := container.(type) {
+	case bson.D:
+		for i, elem := range container {
+			if elem.Key != parts[0] {
+				continue
+			}
+
+			if len(parts) == 1 {
+				return append(container[:i], container[i+1:]...)
+			}
+
+			container[i].Value = unsetValue(elem.Value, parts[1:])
+			return container
+		}
+	case bson.A:
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(container) {
+			if len(parts) == 1 {
+				container[i] = nil
+			} else {
+				container[i] = unsetValue(container[i], parts[1:])
+			}
+		}
+	}
+
+	return container
+}
+
+// add is a + b of $inc, int32 if both are int32 and the sum fits.
+func add(a, b interface{}) (interface{}, error) {
+	aInt, aOk := toInt64(a)
+	bInt, bOk := toInt64(b)
+	if aOk && bOk {
+		sum := aInt + bInt
+		_, aInt32 := a.(int32)
+		_, bInt32 := b.(int32)
+		if aInt32 && bInt32 && int64(int32(sum)) == sum {
+			return int32(sum), nil
+		}
+		return sum, nil
+	}
+
+	aFloat, aOk := toFloat64(a)
+	bFloat, bOk := toFloat64(b)
+	if !aOk || !bOk {
+		return nil, fmt.Errorf("mongodb: cannot $inc %T with %T", a, b)
+	}
+
+	return aFloat + bFloat, nil
+}
+
+// applyUpdate returns a copy of doc updated by the operators $set, $inc, $push and $unset.
+func applyUpdate(doc bson.D, update bson.D) (bson.D, error) {
+	if !isOperatorDoc(update) {
+		return nil, fmt.Errorf("mongodb: update document must contain key beginning with '$'")
+	}
+
+	updated, err := toDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var container interface{} = updated
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("mongodb: %s needs a document", op.Key)
+		}
+
+		for _, field := range fields {
+			if field.Key == "_id" || strings.HasPrefix(field.Key, "_id.") {
+				return nil, fmt.Errorf("mongodb: the field _id is immutable")
+			}
+
+			parts := strings.Split(field.Key, ".")
+			switch op.Key {
+			case "$set":
+				container, err = setValue(container, parts, field.Value)
+			case "$unset":
+				container = unsetValue(container, parts)
+			case "$inc":
+				value := field.Value
+				if old, ok := getValue(container, parts); ok {
+					value, err = add(old, field.Value)
+				} else if _, ok := toFloat64(value); !ok {
+					err = fmt.Errorf("mongodb: cannot $inc with %T", value)
+				}
+				if err == nil {
+					container, err = setValue(container, parts, value)
+				}
+			case "$push":
+				items := bson.A{field.Value}
+				if each, ok := field.Value.(bson.D); ok && len(each) == 1 && each[0].Key == "$each" {
+					if items, ok = each[0].Value.(bson.A); !ok {
+						return nil, fmt.Errorf("mongodb: $each needs an array")
+					}
+				}
+
+				array := bson.A{}
+				if old, ok := getValue(container, parts); ok {
+					if array, ok = old.(bson.A); !ok {
+						return nil, fmt.Errorf("mongodb: cannot $push to %T of %s", old, field.Key)
+					}
+				}
+				container, err = setValue(container, parts, append(array, items...))
+			default:
+				return nil, fmt.Errorf("mongodb: unknown update operator %s", op.Key)
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return container.(bson.D), nil
+}
+
+// upsertDoc is the document inserted by an upsert, the equality fields of filter updated by update,
+// a replacement if update has no operators.
+func upsertDoc(filter bson.D, update bson.D) (bson.D, error) {
+	if !isOperatorDoc(update) {
+		return toDoc(update)
+	}
+
+	var container interface{} = bson.D{}
+	var err error
+	for _, elem := range filter {
+		if strings.HasPrefix(elem.Key, "$") {
+			continue
+		}
+
+		value := elem.Value
+		if cond, ok := value.(bson.D); ok && isOperatorDoc(cond) {
+			if len(cond) != 1 || cond[0].Key != "$eq" {
+				continue
+			}
+			value = cond[0].Value
+		}
+
+		container, err = setValue(container, strings.Split(elem.Key, "."), value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return applyUpdate(container.(bson.D), update)
+}
@@ -7,9 +7,9 @@ import (
 var mongodbTotal = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "mongodb_total",
-		Help: "Number of total",
+		Help: "Number of commands",
 	},
-	[]string{"command"},
+	[]string{"client", "db", "coll", "command"},
 )
 
 var mongodbDuration = prometheus.NewHistogramVec(
@@ -18,15 +18,15 @@ var mongodbDuration = prometheus.NewHistogramVec(
 		Help:    "mongodb duration distribution",
 		Buckets: []float64{0.02, 0.08, 0.15, 0.5, 1, 3},
 	},
-	[]string{"command"},
+	[]string{"client", "db", "coll", "command"},
 )
 
 var mongodbErrTotal = prometheus.NewCounterVec(
 	prometheus.CounterOpts{
 		Name: "mongodb_err_total",
-		Help: "Number of err total",
+		Help: "Number of failed commands by the code name of the error",
 	},
-	[]string{"command"},
+	[]string{"client", "db", "coll", "command", "code"},
 )
 
 var mongodbPoolTypes = prometheus.NewCounterVec(
@@ -34,12 +34,119 @@ var mongodbPoolTypes = prometheus.NewCounterVec(
 		Name: "mongodb_pool_total",
 		Help: "Number of pool's types total",
 	},
-	[]string{"type"},
+	[]string{"client", "type"},
 )
 
+var mongodbPoolWaitDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mongodb_pool_wait_duration_seconds",
+		Help:    "connection check out duration distribution",
+		Buckets: []float64{0.001, 0.005, 0.02, 0.1, 0.5, 2},
+	},
+	[]string{"client"},
+)
+
+var mongodbCollTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_coll_total",
+		Help: "Number of calls of the collection",
+	},
+	[]string{"db", "coll", "method"},
+)
+
+var mongodbCollDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mongodb_coll_duration_seconds",
+		Help:    "call of the collection duration distribution",
+		Buckets: []float64{0.02, 0.08, 0.15, 0.5, 1, 3},
+	},
+	[]string{"db", "coll", "method"},
+)
+
+var mongodbCollErrTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_coll_err_total",
+		Help: "Number of failed calls of the collection",
+	},
+	[]string{"db", "coll", "method"},
+)
+
+var mongodbTxTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_tx_total",
+		Help: "Number of transactions by outcome",
+	},
+	[]string{"client", "outcome"},
+)
+
+var mongodbTxDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mongodb_tx_duration_seconds",
+		Help:    "mongodb transaction duration distribution",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+	},
+	[]string{"client", "outcome"},
+)
+
+var mongodbTxRetryTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_tx_retry_total",
+		Help: "Number of transactions retried on transient transaction errors",
+	},
+	[]string{"client"},
+)
+
+var mongodbChangeStreamEventTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_change_stream_event_total",
+		Help: "Number of handled change events",
+	},
+	[]string{"name", "operation", "result"},
+)
+
+var mongodbChangeStreamHandleDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mongodb_change_stream_handle_duration_seconds",
+		Help:    "change event handling duration distribution",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+	},
+	[]string{"name"},
+)
+
+var mongodbChangeStreamLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mongodb_change_stream_lag_seconds",
+		Help: "seconds from the cluster time of the last change event to its handling",
+	},
+	[]string{"name"},
+)
+
+var mongodbChangeStreamRestartTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mongodb_change_stream_restart_total",
+		Help: "Number of change streams reopened after errors",
+	},
+	[]string{"name"},
+)
+
+// "mongodb_pool_stats", read at scrape time
+var mongodbPoolCollector = newPoolCollector()
+
 func init() {
 	prometheus.MustRegister(mongodbTotal)
 	prometheus.MustRegister(mongodbDuration)
 	prometheus.MustRegister(mongodbErrTotal)
 	prometheus.MustRegister(mongodbPoolTypes)
+	prometheus.MustRegister(mongodbPoolWaitDuration)
+	prometheus.MustRegister(mongodbPoolCollector)
+	prometheus.MustRegister(mongodbCollTotal)
+	prometheus.MustRegister(mongodbCollDuration)
+	prometheus.MustRegister(mongodbCollErrTotal)
+	prometheus.MustRegister(mongodbTxTotal)
+	prometheus.MustRegister(mongodbTxDuration)
+	prometheus.MustRegister(mongodbTxRetryTotal)
+	prometheus.MustRegister(mongodbChangeStreamEventTotal)
+	prometheus.MustRegister(mongodbChangeStreamHandleDuration)
+	prometheus.MustRegister(mongodbChangeStreamLag)
+	prometheus.MustRegister(mongodbChangeStreamRestartTotal)
 }
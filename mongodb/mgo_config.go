@@ -0,0 +1,155 @@
+package mongodb
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MgoConfig is an entry of "mgos", a client named Db. Durations are strings with units like "500ms",
+// the pool settings are "mgo_max_pool_size" and the like if not set.
+//  mgos:
+//  - {db: 'test', uri: 'mongodb://0.0.0.0:27017/admin?connect=direct'}
+//  - {db: 'report', uri: 'mongodb://0.0.0.0:27017,0.0.0.0:27018/admin?replicaSet=rs0', database: 'analytics',
+//     readpreference: 'secondaryPreferred', maxstaleness: '90s', readconcern: 'majority',
+//     writeconcern: 'majority', journal: true, wtimeout: '1s', maxpoolsize: 50}
+type MgoConfig struct {
+	//the name of the client
+	Db  string `json:"db" yaml:"db"`
+	Uri string `json:"uri" yaml:"uri"`
+
+	//the database of GetColl if it is empty, default Db
+	Database string `json:"database" yaml:"database"`
+
+	//primary, primaryPreferred, secondary, secondaryPreferred or nearest, default primary
+	ReadPreference string        `json:"read_preference" yaml:"readpreference"`
+	MaxStaleness   time.Duration `json:"max_staleness" yaml:"maxstaleness"`
+
+	//local, majority, linearizable, available or snapshot
+	ReadConcern string `json:"read_concern" yaml:"readconcern"`
+
+	//majority or the number of nodes
+	WriteConcern string        `json:"write_concern" yaml:"writeconcern"`
+	Journal      bool          `json:"journal" yaml:"journal"`
+	WTimeout     time.Duration `json:"w_timeout" yaml:"wtimeout"`
+
+	MaxPoolSize     uint64        `json:"max_pool_size" yaml:"maxpoolsize"`
+	MinPoolSize     uint64        `json:"min_pool_size" yaml:"minpoolsize"`
+	MaxConnIdleTime time.Duration `json:"max_conn_idle_time" yaml:"maxconnidletime"`
+	ConnectTimeout  time.Duration `json:"connect_timeout" yaml:"connecttimeout"`
+}
+
+// LoadMgoConfigs reads "mgos" of conf.
+func LoadMgoConfigs(conf config.Config) ([]MgoConfig, error) {
+	mgoConfigs := []MgoConfig{}
+	err := conf.UnmarshalKey("mgos", &mgoConfigs, viper.DecodeHook(
+		mapstructure.StringToTimeDurationHookFunc(),
+	))
+
+	return mgoConfigs, err
+}
+
+// database returns the default database of the client.
+func (this MgoConfig) database() string {
+	if this.Database != "" {
+		return this.Database
+	}
+
+	return this.Db
+}
+
+// clientOptions returns the options of the client,
+// the settings not in MgoConfig are the ones of conf.
+func (this MgoConfig) clientOptions(conf config.Config) (*options.ClientOptions, error) {
+	clientOptions := options.Client()
+	clientOptions.ApplyURI(this.Uri)
+
+	connectTimeout := time.Duration(conf.GetInt64("mgo_connect_timeout")) * time.Millisecond
+	if this.ConnectTimeout != 0 {
+		connectTimeout = this.ConnectTimeout
+	}
+	if connectTimeout != 0 {
+		clientOptions.SetConnectTimeout(connectTimeout)
+		clientOptions.SetServerSelectionTimeout(connectTimeout)
+	}
+
+	maxConnIdleTime := time.Duration(conf.GetInt64("mgo_max_conn_idle_time")) * time.Minute
+	if this.MaxConnIdleTime != 0 {
+		maxConnIdleTime = this.MaxConnIdleTime
+	}
+	if maxConnIdleTime != 0 {
+		clientOptions.SetMaxConnIdleTime(maxConnIdleTime)
+	}
+
+	maxPoolSize := conf.GetUint64("mgo_max_pool_size")
+	if this.MaxPoolSize != 0 {
+		maxPoolSize = this.MaxPoolSize
+	}
+	if maxPoolSize != 0 {
+		clientOptions.SetMaxPoolSize(maxPoolSize)
+	}
+
+	minPoolSize := conf.GetUint64("mgo_min_pool_size")
+	if this.MinPoolSize != 0 {
+		minPoolSize = this.MinPoolSize
+	}
+	if minPoolSize != 0 {
+		clientOptions.SetMinPoolSize(minPoolSize)
+	}
+
+	if this.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(this.ReadPreference)
+		if err != nil {
+			return nil, err
+		}
+
+		var readPrefOptions []readpref.Option
+		if this.MaxStaleness != 0 {
+			readPrefOptions = append(readPrefOptions, readpref.WithMaxStaleness(this.MaxStaleness))
+		}
+
+		readPref, err := readpref.New(mode, readPrefOptions...)
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetReadPreference(readPref)
+	}
+
+	if this.ReadConcern != "" {
+		clientOptions.SetReadConcern(readconcern.New(readconcern.Level(this.ReadConcern)))
+	}
+
+	if this.WriteConcern != "" || this.Journal || this.WTimeout != 0 {
+		var writeConcernOptions []writeconcern.Option
+		switch this.WriteConcern {
+		case "":
+		case "majority":
+			writeConcernOptions = append(writeConcernOptions, writeconcern.WMajority())
+		default:
+			w, err := strconv.Atoi(this.WriteConcern)
+			if err != nil {
+				return nil, errors.New("mongodb: unknown write concern " + this.WriteConcern)
+			}
+			writeConcernOptions = append(writeConcernOptions, writeconcern.W(w))
+		}
+
+		if this.Journal {
+			writeConcernOptions = append(writeConcernOptions, writeconcern.J(true))
+		}
+
+		if this.WTimeout != 0 {
+			writeConcernOptions = append(writeConcernOptions, writeconcern.WTimeout(this.WTimeout))
+		}
+		clientOptions.SetWriteConcern(writeconcern.New(writeConcernOptions...))
+	}
+
+	return clientOptions, clientOptions.Validate()
+}
@@ -8,10 +8,10 @@ import (
 
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/proxy"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
@@ -30,40 +30,89 @@ type MgoClient struct {
 	mgoConfig []MgoConfig
 
 	eventOptions []EventOption
+
+	poolStats map[string]*poolStats
+
+	//client => the database of GetColl if db is empty
+	databases map[string]string
+
+	indexSpecs []IndexSpec
+
+	proxy []func() interface{}
+
+	//the instances of proxy, created by the first GetCtxColl
+	proxyInses []interface{}
+
+	collsLock sync.RWMutex
+
+	//client.db.coll => the first proxy
+	colls map[string]Mongo
 }
 
 type mongoBackEvent struct {
 	succEvent *event.CommandSucceededEvent
 
 	failedEvent *event.CommandFailedEvent
+
+	//nil if the started event is lost
+	command *startedCommand
+}
+
+func (this *mongoBackEvent) commandName() string {
+	if this.succEvent != nil {
+		return this.succEvent.CommandName
+	}
+
+	return this.failedEvent.CommandName
+}
+
+// String is like "find test.user {"phone": ?}".
+func (this *mongoBackEvent) String() string {
+	if this.command == nil {
+		return this.commandName()
+	}
+
+	return strings.TrimSpace(this.command.name + " " + this.command.database + "." +
+		this.command.collection + " " + this.command.filter)
 }
 
 type Option func(c *MgoClient)
 
 type MgoClientOptions struct{}
 
+// NewMongo returns the client of the process, options are only used the first time.
 func NewMongo(options ...Option) *MgoClient {
 	mgoOnce.Do(func() {
-		onceMgoClient = &MgoClient{
-			Mgos: make(map[string]*mongo.Client),
-		}
+		onceMgoClient = NewMgoClient(options...)
+	})
 
-		for _, option := range options {
-			option(onceMgoClient)
-		}
+	return onceMgoClient
+}
 
-		if onceMgoClient.conf == nil {
-			onceMgoClient.conf = config.NewNullConfig()
-		}
+// NewMgoClient returns a new client which connects to all of "mgos" and WithDbConfig.
+func NewMgoClient(options ...Option) *MgoClient {
+	mgoClient := &MgoClient{
+		Mgos:      make(map[string]*mongo.Client),
+		poolStats: make(map[string]*poolStats),
+		databases: make(map[string]string),
+		colls:     make(map[string]Mongo),
+	}
 
-		if onceMgoClient.logger == nil {
-			onceMgoClient.logger = log.NewLogger()
-		}
+	for _, option := range options {
+		option(mgoClient)
+	}
 
-		onceMgoClient.init()
-	})
+	if mgoClient.conf == nil {
+		mgoClient.conf = config.NewNullConfig()
+	}
 
-	return onceMgoClient
+	if mgoClient.logger == nil {
+		mgoClient.logger = log.NewLogger()
+	}
+
+	mgoClient.init()
+
+	return mgoClient
 }
 
 func (MgoClientOptions) WithConf(conf config.Config) Option {
@@ -90,15 +139,25 @@ func (MgoClientOptions) WithMonitorEvent(mongoEvent ...func() MonitorEvent) Opti
 	}
 }
 
-type MgoConfig struct {
-	Db  string `json:"db",yaml:"db"`
-	Uri string `json:"uri",yaml:"uri"`
+// WithIndexes declares indexes in Go besides "mgo_indexes", see SyncIndexes.
+func (MgoClientOptions) WithIndexes(specs ...IndexSpec) Option {
+	return func(m *MgoClient) {
+		m.indexSpecs = append(m.indexSpecs, specs...)
+	}
+}
+
+// WithProxy wraps the collections of GetCtxColl, the proxies implement Mongo and proxy.Proxy.
+// The proxies which implement CollBinder are created once and bound to each collection,
+// the factories of the others must return a new instance every time.
+func (MgoClientOptions) WithProxy(proxy ...func() interface{}) Option {
+	return func(m *MgoClient) {
+		m.proxy = append(m.proxy, proxy...)
+	}
 }
 
 func (this *MgoClient) init() {
 
-	mgoConfigs := []MgoConfig{}
-	err := this.conf.UnmarshalKey("mgos", &mgoConfigs)
+	mgoConfigs, err := LoadMgoConfigs(this.conf)
 	if err != nil {
 		this.logger.Panicf("Fatal error config file: %s \n", err.Error())
 	}
@@ -108,29 +167,30 @@ func (this *MgoClient) init() {
 	}
 
 	for _, mgo := range mgoConfigs {
+		clientName := strings.ToLower(mgo.Db)
 
-		clientOptions := options.Client()
-		clientOptions.ApplyURI(mgo.Uri)
+		clientOptions, err := mgo.clientOptions(this.conf)
+		if err != nil {
+			this.logger.Panicf("mongo client options error: %s , db: %s \n", err.Error(), mgo.Db)
+		}
 
 		if this.monitorEvents != nil {
 			firstEvent := this.initMonitorMulLevelEvent(mgo.Db)
 			//事件监控
 			eventComMon := &event.CommandMonitor{
 				Started: func(ctx context.Context, startEvent *event.CommandStartedEvent) {
-					exec_command, ok := ctx.Value("command").(*string)
-					if ok == true {
-						*exec_command = startEvent.Command.String()
+					if startEvent.CommandName != "ping" {
+						firstEvent.Start(contextWithClient(ctx, clientName), startEvent)
 					}
-					firstEvent.Start(ctx, startEvent)
 				},
 				Succeeded: func(ctx context.Context, succEvent *event.CommandSucceededEvent) {
 					if succEvent.CommandName != "ping" {
-						firstEvent.SucceededEvent(ctx, succEvent)
+						firstEvent.SucceededEvent(contextWithClient(ctx, clientName), succEvent)
 					}
 				},
 				Failed: func(ctx context.Context, failedEvent *event.CommandFailedEvent) {
 					if failedEvent.CommandName != "ping" {
-						firstEvent.FailedEvent(ctx, failedEvent)
+						firstEvent.FailedEvent(contextWithClient(ctx, clientName), failedEvent)
 					}
 				},
 			}
@@ -138,54 +198,55 @@ func (this *MgoClient) init() {
 		}
 
 		//池子监控
+		stats := mongodbPoolCollector.add(clientName)
+		this.poolStats[clientName] = stats
 		poolMon := &event.PoolMonitor{
 			Event: func(pev *event.PoolEvent) {
-				this.poolEvent(pev)
+				this.poolEvent(clientName, pev)
+				stats.event(pev)
 			},
 		}
 		clientOptions.SetPoolMonitor(poolMon)
 
-		mgo_connect_timeout := this.conf.GetInt64("mgo_connect_timeout")
-		if mgo_connect_timeout != 0 {
-			clientOptions.SetConnectTimeout(time.Duration(mgo_connect_timeout) * time.Millisecond)
-			clientOptions.SetServerSelectionTimeout(time.Duration(mgo_connect_timeout) * time.Millisecond)
-		}
-
-		mgo_max_conn_idle_time := this.conf.GetInt64("mgo_max_conn_idle_time")
-		if mgo_max_conn_idle_time != 0 {
-			clientOptions.SetMaxConnIdleTime(time.Duration(mgo_max_conn_idle_time) * time.Minute)
-		}
-
-		mgo_max_pool_size := this.conf.GetUint64("mgo_max_pool_size")
-		if mgo_max_pool_size != 0 {
-			clientOptions.SetMaxPoolSize(mgo_max_pool_size)
-		}
-
-		mgo_min_pool_size := this.conf.GetUint64("mgo_min_pool_size")
-		if mgo_min_pool_size != 0 {
-			clientOptions.SetMinPoolSize(mgo_min_pool_size)
-		}
-
 		client, err := mongo.NewClient(clientOptions)
 		if err != nil {
 			this.logger.Panicf("new mongo client error: %s , uri: %s \n", err.Error(), mgo.Uri)
 		}
 
-		ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 
 		err = client.Connect(ctx)
 		if err != nil {
+			cancel()
 			this.logger.Panicf("conn mongo error: %s , uri: %s \n", err.Error(), mgo.Uri)
 		}
 
 		err = client.Ping(ctx, readpref.Primary())
+		cancel()
 		if err != nil {
 			this.logger.Panicf("ping mongo error: %s , uri: %s \n", err.Error(), mgo.Uri)
 		}
 
 		this.setMgo(mgo.Db, client)
+		this.databases[strings.ToLower(mgo.Db)] = mgo.database()
 		this.logger.Infof("[mongodb] %s init success", mgo.Db)
 	}
+
+	indexSpecs, err := LoadIndexSpecs(this.conf)
+	if err != nil {
+		this.logger.Panicf("Fatal error config file: %s \n", err.Error())
+	}
+	this.indexSpecs = append(indexSpecs, this.indexSpecs...)
+
+	//"mgo_sync_indexes" creates the missing indexes, "mgo_drop_indexes" also drops the unexpected ones
+	if this.conf.GetBool("mgo_sync_indexes") {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		_, err = this.SyncIndexes(ctx, false, this.conf.GetBool("mgo_drop_indexes"))
+		cancel()
+		if err != nil {
+			this.logger.Panicf("sync mongo indexes error: %s \n", err.Error())
+		}
+	}
 }
 
 func (this *MgoClient) initMonitorMulLevelEvent(db_name string) MonitorEvent {
@@ -222,18 +283,77 @@ func (this *MgoClient) setMgo(mgo_name string, gdb *mongo.Client) bool {
 	return true
 }
 
-func (this *MgoClient) GetColl(dataBase, coll string) *mongo.Collection {
-	dataBase = strings.ToLower(dataBase)
-	if mgo, ok := this.Mgos[dataBase]; ok {
-		return mgo.Database(dataBase).Collection(coll)
-	} else {
-		this.logger.Errorf("[db] %s not found", dataBase)
+// GetClient returns the client named client, nil if it is not found.
+func (this *MgoClient) GetClient(client string) *mongo.Client {
+	if mgo, ok := this.Mgos[strings.ToLower(client)]; ok {
+		return mgo
+	}
+
+	this.logger.Errorf("[mongodb] client %s not found", client)
+	return nil
+}
+
+// GetColl returns coll of dataBase on client, dataBase is the database of the client if it is empty.
+func (this *MgoClient) GetColl(client, dataBase, coll string) *mongo.Collection {
+	mgo := this.GetClient(client)
+	if mgo == nil {
 		return nil
 	}
+
+	if dataBase == "" {
+		dataBase = this.databases[strings.ToLower(client)]
+	}
+
+	return mgo.Database(dataBase).Collection(coll)
+}
+
+// GetCtxColl returns coll of dataBase on client wrapped in the proxies of WithProxy,
+// the proxies of a collection are built once and shared by its callers.
+func (this *MgoClient) GetCtxColl(client, dataBase, coll string) Mongo {
+	realColl := this.GetColl(client, dataBase, coll)
+	if realColl == nil {
+		return nil
+	}
+
+	if len(this.proxy) == 0 {
+		return realColl
+	}
+
+	key := strings.ToLower(client) + "." + realColl.Database().Name() + "." + coll
+	this.collsLock.RLock()
+	firstProxy, ok := this.colls[key]
+	this.collsLock.RUnlock()
+	if ok {
+		return firstProxy
+	}
+
+	this.collsLock.Lock()
+	defer this.collsLock.Unlock()
+	if firstProxy, ok = this.colls[key]; ok {
+		return firstProxy
+	}
+
+	if this.proxyInses == nil {
+		this.proxyInses = proxy.NewProxyFactory().GetInstances("mgo", this.proxy...)
+	}
+
+	firstProxy = realColl
+	for k := len(this.proxy) - 1; k >= 0; k-- {
+		if binder, ok := this.proxyInses[k].(CollBinder); ok {
+			firstProxy = binder.Bind(firstProxy)
+		} else {
+			proxyIns := this.proxy[k]()
+			proxyIns.(proxy.Proxy).NextProxy(firstProxy)
+			firstProxy = proxyIns.(Mongo)
+		}
+	}
+	this.colls[key] = firstProxy
+
+	return firstProxy
 }
 
-func (this *MgoClient) poolEvent(pev *event.PoolEvent) {
-	lab := prometheus.Labels{"type": pev.Type}
+func (this *MgoClient) poolEvent(client string, pev *event.PoolEvent) {
+	lab := prometheus.Labels{"client": client, "type": pev.Type}
 	mongodbPoolTypes.With(lab).Inc()
 }
 
@@ -252,6 +372,7 @@ func (this *MgoClient) Ping() []error {
 	return errs
 }
 
+// Close disconnects the clients and removes their pools from "mongodb_pool_stats".
 func (this *MgoClient) Close() {
 	var err error
 	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
@@ -262,10 +383,36 @@ func (this *MgoClient) Close() {
 			this.logger.Errorf(err.Error())
 		}
 	}
+
+	for db_name, stats := range this.poolStats {
+		mongodbPoolCollector.remove(db_name, stats)
+	}
+}
+
+type clientKey struct{}
+
+// contextWithClient passes the name of the client to the MonitorEvents.
+func contextWithClient(ctx context.Context, client string) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// clientFromContext returns the name of the client of the command, or "".
+func clientFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	client, _ := ctx.Value(clientKey{}).(string)
+
+	return client
 }
 
-//mongodb 的上下文
+// GetCtx returns ctx.
+// Deprecated: the commands are correlated by RequestID, ctx needs nothing from the client.
 func (this *MgoClient) GetCtx(ctx context.Context) context.Context {
-	var command string
-	return context.WithValue(ctx, "command", &command)
+	return ctx
 }
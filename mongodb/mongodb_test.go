@@ -2,16 +2,27 @@ package mongodb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
+	opentracing2 "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/ory/dockertest/v3"
 	dc "github.com/ory/dockertest/v3/docker"
+	"github.com/prometheus/client_golang/prometheus"
+	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type User struct {
@@ -26,8 +37,13 @@ func TestMain(m *testing.M) {
 	logger = log.NewLogger()
 
 	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
 	if err != nil {
-		logger.Fatalf("Could not connect to docker: %s", err)
+		//the tests with mongodb are skipped, see requireMongo
+		logger.Warnf("Could not connect to docker: %s", err)
+		os.Exit(m.Run())
 	}
 
 	opt := &dockertest.RunOptions{
@@ -53,8 +69,8 @@ func TestMain(m *testing.M) {
 		client = NewMongo(
 			mgoClientOptions.WithDbConfig([]MgoConfig{
 				{
-					"test",
-					"mongodb://0.0.0.0:27017/admin?connect=direct",
+					Db:  "test",
+					Uri: "mongodb://0.0.0.0:27017/admin?connect=direct",
 				},
 			}))
 		if len(client.Ping()) > 0 {
@@ -78,7 +94,16 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// requireMongo skips t if TestMain has not started mongodb.
+func requireMongo(t *testing.T) {
+	if client == nil {
+		t.Skip("no docker, mongodb is not started")
+	}
+}
+
 func TestGetColl(t *testing.T) {
+	requireMongo(t)
+
 	mgoOnce = sync.Once{}
 
 	conf := config.NewMemConfig()
@@ -89,25 +114,25 @@ func TestGetColl(t *testing.T) {
 		mgoClientOptions.WithConf(conf),
 		mgoClientOptions.WithDbConfig([]MgoConfig{
 			{
-				"test",
-				"mongodb://127.0.0.1:27017",
+				Db:  "test",
+				Uri: "mongodb://127.0.0.1:27017",
 			},
 		}),
 	)
 
-	ctx := mongoClient.GetCtx(context.Background())
-	coll := mongoClient.GetColl("test", "coll")
-	mongoClient.GetCtx(ctx)
+	ctx := context.Background()
+	coll := mongoClient.GetColl("test", "", "coll")
 
 	filter := bson.M{"phone": "123456"}
-	coll.Find(ctx, filter)
-	_, ok := ctx.Value("command").(*string)
-	assert.True(t, ok)
+	_, err := coll.Find(ctx, filter)
+	assert.Nil(t, err)
 
 	mongoClient.Close()
 }
 
 func TestWithMonitorEvent(t *testing.T) {
+	requireMongo(t)
+
 	mgoOnce = sync.Once{}
 
 	conf := config.NewMemConfig()
@@ -128,14 +153,14 @@ func TestWithMonitorEvent(t *testing.T) {
 		),
 		mgoClientOptions.WithDbConfig([]MgoConfig{
 			{
-				"test",
-				"mongodb://127.0.0.1:27017",
+				Db:  "test",
+				Uri: "mongodb://127.0.0.1:27017",
 			},
 		}),
 	)
 
 	ctx := mongoClient.GetCtx(context.Background())
-	coll := mongoClient.GetColl("test", "coll")
+	coll := mongoClient.GetColl("test", "", "coll")
 	mongoClient.GetCtx(ctx)
 
 	u := User{}
@@ -145,6 +170,8 @@ func TestWithMonitorEvent(t *testing.T) {
 }
 
 func TestMulEvent(t *testing.T) {
+	requireMongo(t)
+
 	mgoOnce = sync.Once{}
 
 	conf := config.NewMemConfig()
@@ -168,14 +195,14 @@ func TestMulEvent(t *testing.T) {
 		),
 		mgoClientOptions.WithDbConfig([]MgoConfig{
 			{
-				"test",
-				"mongodb://127.0.0.1:27017",
+				Db:  "test",
+				Uri: "mongodb://127.0.0.1:27017",
 			},
 		}),
 	)
 
 	ctx := mongoClient.GetCtx(context.Background())
-	coll := mongoClient.GetColl("test", "coll")
+	coll := mongoClient.GetColl("test", "", "coll")
 	mongoClient.GetCtx(ctx)
 
 	u := User{}
@@ -183,3 +210,1026 @@ func TestMulEvent(t *testing.T) {
 	coll.FindOne(ctx, filter).Decode(u)
 	mongoClient.Close()
 }
+
+func TestPoolCollector(t *testing.T) {
+	collector := newPoolCollector()
+	stats := collector.add("test")
+
+	waitLab := prometheus.Labels{"client": "test"}
+	waitCount := histogramCount(mongodbPoolWaitDuration, waitLab)
+
+	for _, eventType := range []string{event.PoolCreated, event.ConnectionCreated, event.ConnectionCreated,
+		event.GetStarted, event.GetStarted, event.GetStarted, event.GetSucceeded, event.GetSucceeded,
+		event.ConnectionReturned, event.GetFailed, event.GetStarted} {
+		stats.event(&event.PoolEvent{Type: eventType, Address: "127.0.0.1:27017",
+			PoolOptions: &event.MonitorPoolOptions{MaxPoolSize: 100}})
+	}
+	//the succeeded and the failed check outs
+	assert.Equal(t, waitCount+3, histogramCount(mongodbPoolWaitDuration, waitLab))
+
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(collector))
+
+	values := func() map[string]float64 {
+		families, err := registry.Gather()
+		assert.Nil(t, err)
+
+		values := map[string]float64{}
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() == "stats" {
+						values[label.GetValue()] = metric.GetGauge().GetValue()
+					}
+				}
+			}
+		}
+		return values
+	}
+
+	assert.Equal(t, map[string]float64{"max_pool_size": 100, "open_conn": 2, "checked_out": 1, "idle": 1,
+		"waiting": 1, "created": 2, "closed": 0, "check_out_failed": 1, "cleared": 0}, values())
+
+	//replaced by a new client
+	newStats := collector.add("test")
+	collector.remove("test", stats)
+	assert.Len(t, values(), 9)
+
+	collector.remove("test", newStats)
+	assert.Empty(t, values())
+}
+
+func TestGetCtxColl(t *testing.T) {
+	//not connected, all calls are answered by stubs
+	mgo, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+	assert.Nil(t, err)
+
+	nullLogger := log.NewNullLogger()
+	conf := config.NewMemConfig()
+	conf.Set("mgo_metrics", true)
+
+	monitorProxyOptions := MonitorProxyOptions{}
+	monitor := NewMonitorProxy(
+		monitorProxyOptions.WithConf(conf),
+		monitorProxyOptions.WithLogger(nullLogger),
+	)
+	fault := NewFaultProxy(FaultProxyOptions{}.WithLogger(nullLogger))
+	spy := NewSpyProxy(nullLogger, "spy_proxy")
+	stubs := NewStubsProxy(StubsProxyOptions{}.WithLogger(nullLogger))
+	stubs.Stub("InsertOne", &mongo.InsertOneResult{InsertedID: 1}, nil).
+		Stub("FindOne", bson.M{"id": 1, "name": "test"}, nil).
+		Stub("Find", []interface{}{bson.M{"id": 1}, bson.M{"id": 2}}, nil)
+
+	mgoClient := &MgoClient{
+		Mgos:      map[string]*mongo.Client{"proxy_test": mgo},
+		databases: map[string]string{"proxy_test": "proxy_test"},
+		logger:    nullLogger,
+		colls:     make(map[string]Mongo),
+	}
+	MgoClientOptions{}.WithProxy(
+		func() interface{} { return monitor },
+		func() interface{} { return fault },
+		func() interface{} { return spy },
+		func() interface{} { return stubs },
+	)(mgoClient)
+
+	coll := mgoClient.GetCtxColl("proxy_test", "", "user")
+	assert.Equal(t, coll, mgoClient.GetCtxColl("proxy_test", "", "user"))
+	assert.Equal(t, "user", coll.Name())
+	assert.Nil(t, mgoClient.GetCtxColl("not_exists", "", "user"))
+
+	ctx := context.Background()
+	result, err := coll.InsertOne(ctx, User{Id: 1, Name: "test"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, result.InsertedID)
+	assert.True(t, spy.WasCalled("InsertOne"))
+
+	u := User{}
+	assert.Nil(t, coll.FindOne(ctx, bson.M{"id": 1}).Decode(&u))
+	assert.Equal(t, User{Id: 1, Name: "test"}, u)
+
+	cursor, err := coll.Find(ctx, bson.M{})
+	assert.Nil(t, err)
+	var users []User
+	assert.Nil(t, cursor.All(ctx, &users))
+	assert.Len(t, users, 2)
+
+	stubs.Stub("FindOne", nil, nil)
+	assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{"id": 2}).Err())
+
+	lab := prometheus.Labels{"db": "proxy_test", "coll": "user", "method": "FindOne"}
+	assert.Equal(t, float64(2), counterValue(mongodbCollTotal, lab))
+	assert.Equal(t, float64(0), counterValue(mongodbCollErrTotal, lab))
+
+	errFault := errors.New("fault")
+	fault.SetFault(Fault{Method: "FindOne", Err: errFault})
+	assert.Equal(t, errFault, coll.FindOne(ctx, bson.M{"id": 1}).Decode(&u))
+	assert.Equal(t, 2, spy.CallTimes("FindOne"))
+	assert.Equal(t, float64(1), counterValue(mongodbCollErrTotal, lab))
+
+	fault.RemoveFault("FindOne")
+	fault.SetFault(Fault{Method: "*", Delay: time.Minute})
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = coll.CountDocuments(cancelCtx, bson.M{})
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, spy.WasCalled("CountDocuments"))
+
+	fault.RemoveFault("*")
+
+	//the shared proxies are bound to each collection
+	order := mgoClient.GetCtxColl("proxy_test", "", "order")
+	assert.Equal(t, "order", order.Name())
+	assert.Equal(t, "user", coll.Name())
+	_, err = order.InsertOne(ctx, User{Id: 2, Name: "order"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, spy.CallTimes("InsertOne"))
+	assert.Equal(t, float64(1), counterValue(mongodbCollTotal,
+		prometheus.Labels{"db": "proxy_test", "coll": "order", "method": "InsertOne"}))
+	assert.Equal(t, float64(1), counterValue(mongodbCollTotal,
+		prometheus.Labels{"db": "proxy_test", "coll": "user", "method": "InsertOne"}))
+	assert.Nil(t, stubs.nextColl)
+
+	//the last of the chain
+	_, err = NewStubsProxy(StubsProxyOptions{}.WithLogger(nullLogger)).DeleteOne(ctx, bson.M{})
+	assert.Equal(t, ErrNotStubbed, err)
+}
+
+func TestMonitorProxy_Tracer(t *testing.T) {
+	conf := config.NewMemConfig()
+	conf.Set("mgo_tracer", true)
+
+	nullLogger := log.NewNullLogger()
+	tracer := mocktracer.New()
+	monitorProxyOptions := MonitorProxyOptions{}
+	monitor := NewMonitorProxy(
+		monitorProxyOptions.WithConf(conf),
+		monitorProxyOptions.WithLogger(nullLogger),
+		monitorProxyOptions.WithTracer(tracer),
+	)
+	stubs := NewStubsProxy(StubsProxyOptions{}.WithLogger(nullLogger))
+	stubs.Stub("InsertOne", &mongo.InsertOneResult{InsertedID: 1}, nil)
+	monitor.NextProxy(stubs)
+
+	//no span without parent
+	_, err := monitor.InsertOne(context.Background(), User{Id: 1})
+	assert.Nil(t, err)
+	assert.Empty(t, tracer.FinishedSpans())
+
+	span := tracer.StartSpan("parent")
+	ctx := opentracing2.ContextWithSpan(context.Background(), span)
+	_, err = monitor.InsertOne(ctx, User{Id: 1})
+	assert.Nil(t, err)
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	assert.Equal(t, "InsertOne", spans[0].OperationName)
+}
+
+func TestMonitorEvent_Correlation(t *testing.T) {
+	monitorEventOptions := MonitorEventOptions{}
+	monitor := NewMonitorEvent(
+		monitorEventOptions.WithLogger(log.NewNullLogger()),
+	)
+
+	var finished []string
+	monitor.afterEvents = append(monitor.afterEvents,
+		func(ctx context.Context, backEvent *mongoBackEvent, begin_time time.Time, end_time time.Time) {
+			finished = append(finished, backEvent.String())
+		})
+
+	started := func(requestID int64, command bson.D) *event.CommandStartedEvent {
+		raw, err := bson.Marshal(command)
+		assert.Nil(t, err)
+		return &event.CommandStartedEvent{Command: raw, DatabaseName: "test",
+			CommandName: command[0].Key, RequestID: requestID}
+	}
+	finishedEvent := func(requestID int64, name string) event.CommandFinishedEvent {
+		return event.CommandFinishedEvent{CommandName: name, RequestID: requestID, DurationNanos: 1000}
+	}
+
+	//the same ctx for concurrent commands
+	ctx := context.Background()
+	monitor.Start(ctx, started(1, doc("find", "user",
+		"filter", doc("phone", "123456", "age", doc("$in", bson.A{18, 19})))))
+	monitor.Start(ctx, started(2, doc("update", "order", "updates", bson.A{
+		doc("q", doc("$or", bson.A{doc("id", 1), doc("uid", 2)}), "u", doc("$set", doc("paid", true)))})))
+	monitor.Start(ctx, started(3, doc("getMore", int64(10), "collection", "user")))
+	assert.Equal(t, 3, monitor.commands.len())
+
+	monitor.SucceededEvent(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finishedEvent(2, "update")})
+	monitor.FailedEvent(ctx, &event.CommandFailedEvent{CommandFinishedEvent: finishedEvent(1, "find"),
+		Failure: "timeout"})
+	monitor.SucceededEvent(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finishedEvent(3, "getMore")})
+	//lost started event
+	monitor.SucceededEvent(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finishedEvent(4, "insert")})
+
+	assert.Equal(t, []string{
+		`update test.order {"$or": [{"id": ?}, {"uid": ?}]}`,
+		`find test.user {"phone": ?, "age": {"$in": ?}}`,
+		"getMore test.user",
+		"insert",
+	}, finished)
+	assert.Equal(t, 0, monitor.commands.len())
+}
+
+func TestMonitorEvent_Tracer(t *testing.T) {
+	conf := config.NewMemConfig()
+	conf.Set("mgo_tracer", true)
+
+	tracer := mocktracer.New()
+	monitorEventOptions := MonitorEventOptions{}
+	monitor := NewMonitorEvent(
+		monitorEventOptions.WithConf(conf),
+		monitorEventOptions.WithLogger(log.NewNullLogger()),
+		monitorEventOptions.WithTracer(tracer),
+	)
+
+	raw, err := bson.Marshal(doc("find", "user"))
+	assert.Nil(t, err)
+	started := &event.CommandStartedEvent{Command: raw, DatabaseName: "test",
+		CommandName: "find", RequestID: 1}
+	succeeded := &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{
+		CommandName: "find", RequestID: 1, DurationNanos: 1000}}
+
+	//no span without parent
+	monitor.Start(context.Background(), started)
+	monitor.SucceededEvent(context.Background(), succeeded)
+	assert.Empty(t, tracer.FinishedSpans())
+
+	span := tracer.StartSpan("parent")
+	ctx := opentracing2.ContextWithSpan(context.Background(), span)
+	monitor.Start(ctx, started)
+	monitor.SucceededEvent(ctx, succeeded)
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	assert.Equal(t, "test", spans[0].Tag("db.instance"))
+	assert.Equal(t, "user", spans[0].Tag("db.collection"))
+}
+
+func TestMonitorEvent_Metrics(t *testing.T) {
+	conf := config.NewMemConfig()
+	conf.Set("mgo_metrics", true)
+
+	monitorEventOptions := MonitorEventOptions{}
+	monitor := NewMonitorEvent(
+		monitorEventOptions.WithConf(conf),
+		monitorEventOptions.WithLogger(log.NewNullLogger()),
+	)
+
+	started := func(requestID int64, command bson.D) *event.CommandStartedEvent {
+		raw, err := bson.Marshal(command)
+		assert.Nil(t, err)
+		return &event.CommandStartedEvent{Command: raw, DatabaseName: "metrics",
+			CommandName: command[0].Key, RequestID: requestID}
+	}
+	finishedEvent := func(requestID int64, name string) event.CommandFinishedEvent {
+		return event.CommandFinishedEvent{CommandName: name, RequestID: requestID, DurationNanos: 1000}
+	}
+
+	ctx := contextWithClient(context.Background(), "test")
+	monitor.Start(ctx, started(1, doc("insert", "user")))
+	monitor.SucceededEvent(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: finishedEvent(1, "insert")})
+	monitor.Start(ctx, started(2, doc("insert", "user")))
+	monitor.FailedEvent(ctx, &event.CommandFailedEvent{CommandFinishedEvent: finishedEvent(2, "insert"),
+		Failure: "(NotWritablePrimary) not primary"})
+	monitor.Start(ctx, started(3, doc("find", "user")))
+	monitor.FailedEvent(ctx, &event.CommandFailedEvent{CommandFinishedEvent: finishedEvent(3, "find"),
+		Failure: "connection reset"})
+
+	lab := prometheus.Labels{"client": "test", "db": "metrics", "coll": "user", "command": "insert"}
+	assert.Equal(t, float64(2), counterValue(mongodbTotal, lab))
+	assert.Equal(t, uint64(2), histogramCount(mongodbDuration, lab))
+
+	lab["code"] = "NotWritablePrimary"
+	assert.Equal(t, float64(1), counterValue(mongodbErrTotal, lab))
+
+	lab = prometheus.Labels{"client": "test", "db": "metrics", "coll": "user", "command": "find", "code": "unknown"}
+	assert.Equal(t, float64(1), counterValue(mongodbErrTotal, lab))
+
+	assert.Equal(t, "", clientFromContext(context.Background()))
+}
+
+// doc builds bson.D of keys and values.
+func doc(pairs ...interface{}) bson.D {
+	d := bson.D{}
+	for k := 0; k+1 < len(pairs); k += 2 {
+		d = append(d, bson.E{Key: pairs[k].(string), Value: pairs[k+1]})
+	}
+	return d
+}
+
+func counterValue(counter *prometheus.CounterVec, labels prometheus.Labels) float64 {
+	metric := &io_prometheus_client.Metric{}
+	counter.With(labels).Write(metric)
+	return metric.Counter.GetValue()
+}
+
+func histogramCount(histogram *prometheus.HistogramVec, labels prometheus.Labels) uint64 {
+	metric := &io_prometheus_client.Metric{}
+	histogram.With(labels).(prometheus.Histogram).Write(metric)
+	return metric.Histogram.GetSampleCount()
+}
+
+func TestLoadMgoConfigs(t *testing.T) {
+	conf := config.NewViperConfig()
+	conf.Set("mgo_max_pool_size", 100)
+	conf.Set("mgos", []interface{}{
+		map[string]interface{}{"db": "test", "uri": "mongodb://127.0.0.1:27017"},
+		map[string]interface{}{"db": "report", "uri": "mongodb://127.0.0.1:27017,127.0.0.1:27018/?replicaSet=rs0",
+			"database": "analytics", "readpreference": "secondaryPreferred", "maxstaleness": "90s",
+			"readconcern": "majority", "writeconcern": "majority", "journal": true, "wtimeout": "1s",
+			"maxpoolsize": 50},
+	})
+
+	mgoConfigs, err := LoadMgoConfigs(conf)
+	assert.Nil(t, err)
+	assert.Len(t, mgoConfigs, 2)
+	assert.Equal(t, "test", mgoConfigs[0].database())
+	assert.Equal(t, "analytics", mgoConfigs[1].database())
+	assert.Equal(t, 90*time.Second, mgoConfigs[1].MaxStaleness)
+
+	clientOptions, err := mgoConfigs[0].clientOptions(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), *clientOptions.MaxPoolSize)
+	assert.Nil(t, clientOptions.ReadPreference)
+
+	clientOptions, err = mgoConfigs[1].clientOptions(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(50), *clientOptions.MaxPoolSize)
+	assert.Equal(t, "secondaryPreferred", clientOptions.ReadPreference.Mode().String())
+	maxStaleness, _ := clientOptions.ReadPreference.MaxStaleness()
+	assert.Equal(t, 90*time.Second, maxStaleness)
+	assert.Equal(t, "majority", clientOptions.ReadConcern.GetLevel())
+	assert.True(t, clientOptions.WriteConcern.GetJ())
+	assert.Equal(t, time.Second, clientOptions.WriteConcern.GetWTimeout())
+
+	_, err = MgoConfig{Db: "test", Uri: "mongodb://127.0.0.1:27017", WriteConcern: "all"}.clientOptions(conf)
+	assert.Error(t, err)
+
+	_, err = MgoConfig{Db: "test", Uri: "mongodb://127.0.0.1:27017", ReadPreference: "any"}.clientOptions(conf)
+	assert.Error(t, err)
+}
+
+func TestWithTransaction_NotFound(t *testing.T) {
+	mgoClient := &MgoClient{
+		Mgos:   make(map[string]*mongo.Client),
+		conf:   config.NewMemConfig(),
+		logger: log.NewNullLogger(),
+	}
+
+	called := false
+	err := mgoClient.WithTransaction(context.Background(), "not_exists",
+		func(sessCtx mongo.SessionContext) error {
+			called = true
+			return nil
+		})
+	assert.Error(t, err)
+	assert.False(t, called)
+	assert.Nil(t, mgoClient.GetColl("not_exists", "", "user"))
+}
+
+func TestWithTransaction_OtherClient(t *testing.T) {
+	//sessions need no server
+	newClient := func() *mongo.Client {
+		mgo, err := mongo.NewClient(options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
+		assert.Nil(t, err)
+		assert.Nil(t, mgo.Connect(context.Background()))
+		return mgo
+	}
+	test, report := newClient(), newClient()
+	defer test.Disconnect(context.Background())
+	defer report.Disconnect(context.Background())
+
+	mgoClient := &MgoClient{
+		Mgos:   map[string]*mongo.Client{"test": test, "report": report},
+		conf:   config.NewMemConfig(),
+		logger: log.NewNullLogger(),
+	}
+
+	sess, err := test.StartSession()
+	assert.Nil(t, err)
+	defer sess.EndSession(context.Background())
+	sessCtx := mongo.NewSessionContext(context.Background(), sess)
+
+	called := 0
+	fn := func(sessCtx mongo.SessionContext) error {
+		called++
+		return nil
+	}
+	assert.Error(t, mgoClient.WithTransaction(sessCtx, "report", fn))
+	assert.Equal(t, 0, called)
+
+	//join the session of the same client
+	assert.Nil(t, mgoClient.WithTransaction(sessCtx, "test", fn))
+	assert.Equal(t, 1, called)
+}
+
+func TestCommitWithRetry(t *testing.T) {
+	mgoClient := &MgoClient{logger: log.NewNullLogger()}
+	unknownErr := mongo.CommandError{Code: 50, Labels: []string{unknownTransactionCommitResult}}
+
+	commits := 0
+	err := mgoClient.commitWithRetry(context.Background(), "test", time.Now().Add(time.Minute),
+		func() error {
+			commits++
+			if commits < 3 {
+				return unknownErr
+			}
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, commits)
+
+	//not retried
+	commits = 0
+	err = mgoClient.commitWithRetry(context.Background(), "test", time.Now().Add(time.Minute),
+		func() error {
+			commits++
+			return errors.New("commit error")
+		})
+	assert.EqualError(t, err, "commit error")
+	assert.Equal(t, 1, commits)
+
+	//bounded by the deadline without a deadline of ctx
+	commits = 0
+	startTime := time.Now()
+	err = mgoClient.commitWithRetry(context.Background(), "test", time.Now().Add(200*time.Millisecond),
+		func() error {
+			commits++
+			return unknownErr
+		})
+	assert.Equal(t, unknownErr, err)
+	assert.True(t, commits > 1)
+	assert.True(t, time.Since(startTime) < time.Second)
+
+	//capped, also after many retries
+	assert.True(t, commitBackoff(0) < 40*time.Millisecond)
+	for _, retry := range []int{6, 39, 64, 1000} {
+		assert.Equal(t, time.Second, commitBackoff(retry))
+	}
+}
+
+func TestHasErrorLabel(t *testing.T) {
+	err := mongo.CommandError{Code: 112, Labels: []string{transientTransactionError}}
+	assert.True(t, hasErrorLabel(err, transientTransactionError))
+	assert.False(t, hasErrorLabel(err, unknownTransactionCommitResult))
+	assert.True(t, hasErrorLabel(fmt.Errorf("insert : %w", err), transientTransactionError))
+	assert.False(t, hasErrorLabel(errors.New("not labeled"), transientTransactionError))
+}
+
+type Account struct {
+	Id      primitive.ObjectID `bson:"_id,omitempty"`
+	Phone   string             `bson:"phone"`
+	Age     int                `bson:"age"`
+	Tags    []string           `bson:"tags,omitempty"`
+	Balance float64            `bson:"balance,omitempty"`
+	Profile struct {
+		City string `bson:"city"`
+	} `bson:"profile"`
+}
+
+func TestMemColl(t *testing.T) {
+	ctx := context.Background()
+	coll := NewMemColl("account", MemCollOptions{}.WithLogger(log.NewNullLogger()))
+
+	_, err := coll.CreateIndex(mongo.IndexModel{
+		Keys:    bson.D{{Key: "phone", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	assert.Nil(t, err)
+
+	one, err := coll.InsertOne(ctx, bson.M{"phone": "1", "age": 20, "tags": bson.A{"a"},
+		"profile": bson.M{"city": "gz"}})
+	assert.Nil(t, err)
+	assert.IsType(t, primitive.ObjectID{}, one.InsertedID)
+
+	many, err := coll.InsertMany(ctx, []interface{}{
+		bson.M{"phone": "2", "age": 30, "profile": bson.M{"city": "sz"}},
+		bson.M{"phone": "3", "age": 40, "tags": bson.A{"a", "b"}, "profile": bson.M{"city": "gz"}},
+		bson.M{"phone": "1", "age": 50},
+		bson.M{"phone": "4", "age": 50},
+	})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+	assert.Len(t, many.InsertedIDs, 2)
+
+	_, err = coll.InsertOne(ctx, bson.M{"phone": "2"})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	account := Account{}
+	assert.Nil(t, coll.FindOne(ctx, bson.M{"phone": "1"}).Decode(&account))
+	assert.Equal(t, one.InsertedID, account.Id)
+	assert.Equal(t, 20, account.Age)
+	assert.Equal(t, []string{"a"}, account.Tags)
+	assert.Equal(t, "gz", account.Profile.City)
+	assert.Equal(t, mongo.ErrNoDocuments, coll.FindOne(ctx, bson.M{"phone": "5"}).Err())
+
+	testCases := []struct {
+		filter interface{}
+		phones []string
+	}{
+		{bson.M{}, []string{"1", "2", "3"}},
+		{bson.M{"age": bson.M{"$gt": 20, "$lte": 40}}, []string{"2", "3"}},
+		{bson.M{"phone": bson.M{"$in": bson.A{"1", "3", "5"}}}, []string{"1", "3"}},
+		{bson.M{"phone": bson.M{"$nin": bson.A{"1", "3"}}}, []string{"2"}},
+		{bson.M{"$or": bson.A{bson.M{"age": 20}, bson.M{"profile.city": "sz"}}}, []string{"1", "2"}},
+		{bson.M{"$and": bson.A{bson.M{"tags": "a"}, bson.M{"profile.city": "gz"}}}, []string{"1", "3"}},
+		{bson.M{"tags": bson.M{"$exists": false}}, []string{"2"}},
+		{bson.M{"tags": "b", "age": bson.M{"$ne": 20}}, []string{"3"}},
+		{bson.M{"age": bson.M{"$gt": "20"}}, nil},
+	}
+
+	for _, test := range testCases {
+		cursor, err := coll.Find(ctx, test.filter)
+		assert.Nil(t, err)
+
+		var accounts []Account
+		assert.Nil(t, cursor.All(ctx, &accounts))
+
+		var phones []string
+		for _, account := range accounts {
+			phones = append(phones, account.Phone)
+		}
+		assert.Equal(t, test.phones, phones, "%v", test.filter)
+	}
+
+	_, err = coll.Find(ctx, bson.M{"age": bson.M{"$where": 1}})
+	assert.Error(t, err)
+
+	cursor, err := coll.Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "age", Value: -1}}).SetSkip(1).SetLimit(1))
+	assert.Nil(t, err)
+	var accounts []Account
+	assert.Nil(t, cursor.All(ctx, &accounts))
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, "2", accounts[0].Phone)
+
+	count, err := coll.CountDocuments(ctx, bson.M{"profile.city": "gz"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	cities, err := coll.Distinct(ctx, "profile.city", bson.M{})
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"gz", "sz"}, cities)
+
+	updateResult, err := coll.UpdateOne(ctx, bson.M{"phone": "1"}, bson.M{
+		"$set":   bson.M{"profile.city": "bj"},
+		"$inc":   bson.M{"age": 1, "balance": 1.5},
+		"$push":  bson.M{"tags": bson.M{"$each": bson.A{"c", "d"}}},
+		"$unset": bson.M{"missing": ""},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), updateResult.ModifiedCount)
+
+	account = Account{}
+	assert.Nil(t, coll.FindOne(ctx, bson.M{"phone": "1"}).Decode(&account))
+	assert.Equal(t, 21, account.Age)
+	assert.Equal(t, 1.5, account.Balance)
+	assert.Equal(t, []string{"a", "c", "d"}, account.Tags)
+	assert.Equal(t, "bj", account.Profile.City)
+
+	_, err = coll.UpdateOne(ctx, bson.M{"phone": "1"}, bson.M{"$set": bson.M{"phone": "2"}})
+	assert.True(t, mongo.IsDuplicateKeyError(err))
+
+	_, err = coll.UpdateOne(ctx, bson.M{"phone": "1"}, bson.M{"phone": "6"})
+	assert.Error(t, err)
+
+	updateResult, err = coll.UpdateMany(ctx, bson.M{"age": bson.M{"$gte": 30}},
+		bson.M{"$unset": bson.M{"tags": ""}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), updateResult.MatchedCount)
+	assert.Equal(t, int64(1), updateResult.ModifiedCount)
+
+	updateResult, err = coll.UpdateOne(ctx, bson.M{"phone": "7"},
+		bson.M{"$set": bson.M{"age": 70}}, options.Update().SetUpsert(true))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), updateResult.UpsertedCount)
+
+	account = Account{}
+	assert.Nil(t, coll.FindOneAndUpdate(ctx, bson.M{"phone": "7"}, bson.M{"$inc": bson.M{"age": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&account))
+	assert.Equal(t, updateResult.UpsertedID, account.Id)
+	assert.Equal(t, 71, account.Age)
+
+	account = Account{}
+	assert.Nil(t, coll.FindOneAndReplace(ctx, bson.M{"phone": "7"}, bson.M{"phone": "8"}).Decode(&account))
+	assert.Equal(t, "7", account.Phone)
+	account = Account{}
+	assert.Nil(t, coll.FindOne(ctx, bson.M{"_id": updateResult.UpsertedID}).Decode(&account))
+	assert.Equal(t, "8", account.Phone)
+	assert.Equal(t, 0, account.Age)
+
+	deleteResult, err := coll.DeleteMany(ctx, bson.M{"age": bson.M{"$lt": 40}})
+	assert.Nil(t, err)
+	//the missing age is null, not less than 40
+	assert.Equal(t, int64(2), deleteResult.DeletedCount)
+
+	assert.Nil(t, coll.FindOneAndDelete(ctx, bson.M{}).Decode(&account))
+	assert.Equal(t, "3", account.Phone)
+
+	count, err = coll.EstimatedDocumentCount(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+
+	_, err = coll.Aggregate(ctx, bson.A{})
+	assert.Equal(t, ErrMemNotSupported, err)
+}
+
+// fakeChangeStream returns events, an empty batch if postBatchToken, then err.
+type fakeChangeStream struct {
+	events []bson.D
+
+	pos int
+
+	postBatchToken bson.Raw
+
+	emptyBatch bool
+
+	//closed by the server after the events, like after an invalidate event
+	closed bool
+
+	done bool
+
+	err error
+}
+
+func (this *fakeChangeStream) TryNext(ctx context.Context) bool {
+	if this.pos < len(this.events) {
+		this.pos++
+		return true
+	}
+
+	if this.postBatchToken != nil && !this.emptyBatch {
+		this.emptyBatch = true
+		return false
+	}
+
+	this.done = true
+	return false
+}
+
+func (this *fakeChangeStream) ID() int64 {
+	if this.done && this.closed {
+		return 0
+	}
+
+	return 1
+}
+
+func (this *fakeChangeStream) Decode(val interface{}) error {
+	data, err := bson.Marshal(this.events[this.pos-1])
+	if err != nil {
+		return err
+	}
+
+	return bson.Unmarshal(data, val)
+}
+
+func (this *fakeChangeStream) ResumeToken() bson.Raw {
+	if this.emptyBatch {
+		return this.postBatchToken
+	}
+
+	event := ChangeEvent{}
+	this.Decode(&event)
+	return event.ID
+}
+
+func (this *fakeChangeStream) Err() error {
+	if this.done {
+		return this.err
+	}
+
+	return nil
+}
+
+func (this *fakeChangeStream) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestChangeStreamWorker(t *testing.T) {
+	ctx := context.Background()
+	nullLogger := log.NewNullLogger()
+	conf := config.NewMemConfig()
+	conf.Set("mgo_change_stream_max_backoff", 1)
+
+	var events []bson.D
+	for i := 1; i <= 4; i++ {
+		events = append(events, bson.D{
+			{Key: "_id", Value: bson.D{{Key: "n", Value: i}}},
+			{Key: "operationType", Value: "insert"},
+			{Key: "ns", Value: bson.D{{Key: "db", Value: "test"}, {Key: "coll", Value: "user"}}},
+			{Key: "fullDocument", Value: bson.D{{Key: "id", Value: i}}},
+			{Key: "clusterTime", Value: primitive.Timestamp{T: uint32(time.Now().Unix())}},
+		})
+	}
+
+	tokenColl := NewMemColl("resume_token", MemCollOptions{}.WithLogger(nullLogger))
+	store := NewMgoTokenStore(tokenColl)
+
+	//a stream of the events after the token, failing after 2 events
+	var lock sync.Mutex
+	var resumeAfter []interface{}
+	watch := func(ctx context.Context, pipeline interface{},
+		opts ...*options.ChangeStreamOptions) (changeStream, error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		start := 0
+		resumeAfter = append(resumeAfter, opts[0].ResumeAfter)
+		if token, ok := opts[0].ResumeAfter.(bson.Raw); ok {
+			start = int(token.Lookup("n").Int32())
+		}
+
+		end := start + 2
+		if end > len(events) {
+			end = len(events)
+		}
+		return &fakeChangeStream{events: events[start:end], err: errors.New("network")}, nil
+	}
+
+	var handled []int
+	failed := false
+	done := make(chan struct{})
+	handler := func(ctx context.Context, event ChangeEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		id := int(event.FullDocument.Lookup("id").Int32())
+		if id == 3 && !failed {
+			failed = true
+			return errors.New("handler")
+		}
+
+		handled = append(handled, id)
+		if id == len(events) {
+			close(done)
+		}
+		return nil
+	}
+
+	changeStreamWorkerOptions := ChangeStreamWorkerOptions{}
+	worker := NewChangeStreamWorker("user_sync",
+		changeStreamWorkerOptions.WithConf(conf),
+		changeStreamWorkerOptions.WithLogger(nullLogger),
+		changeStreamWorkerOptions.WithHandler(handler),
+		changeStreamWorkerOptions.WithTokenStore(store),
+	)
+	worker.watch = watch
+	worker.Start()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not handled")
+	}
+	worker.GracefulShutDown()
+
+	//3 is delivered again after the handler error
+	assert.Equal(t, []int{1, 2, 3, 4}, handled)
+	assert.Nil(t, resumeAfter[0])
+	assert.True(t, len(resumeAfter) >= 3)
+
+	token, err := store.Load(ctx, "user_sync")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), token.Lookup("n").Int32())
+
+	//a new worker resumes from the saved token
+	resumeAfter = nil
+	worker = NewChangeStreamWorker("user_sync",
+		changeStreamWorkerOptions.WithConf(conf),
+		changeStreamWorkerOptions.WithLogger(nullLogger),
+		changeStreamWorkerOptions.WithHandler(handler),
+		changeStreamWorkerOptions.WithTokenStore(store),
+	)
+	worker.watch = watch
+	token, err = worker.store.Load(ctx, worker.name)
+	assert.Nil(t, err)
+	_, err = worker.watchOnce(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, token, resumeAfter[0])
+
+	lab := prometheus.Labels{"name": "user_sync", "operation": "insert", "result": "fail"}
+	assert.Equal(t, float64(1), counterValue(mongodbChangeStreamEventTotal, lab))
+}
+
+func TestChangeStreamWorker_Resume(t *testing.T) {
+	ctx := context.Background()
+	nullLogger := log.NewNullLogger()
+	insert := bson.D{{Key: "_id", Value: bson.D{{Key: "n", Value: 1}}}, {Key: "operationType", Value: "insert"}}
+	invalidate := bson.D{{Key: "_id", Value: bson.D{{Key: "n", Value: 2}}}, {Key: "operationType", Value: "invalidate"}}
+	postBatchToken, err := bson.Marshal(bson.D{{Key: "n", Value: 3}})
+	assert.Nil(t, err)
+	invalidateToken, err := bson.Marshal(invalidate[0].Value)
+	assert.Nil(t, err)
+
+	var streams []changeStream
+	var watchErr error
+	var opts []*options.ChangeStreamOptions
+	changeStreamWorkerOptions := ChangeStreamWorkerOptions{}
+	worker := NewChangeStreamWorker("resume",
+		changeStreamWorkerOptions.WithLogger(nullLogger),
+		changeStreamWorkerOptions.WithHandler(func(ctx context.Context, event ChangeEvent) error {
+			return nil
+		}),
+	)
+	worker.watch = func(ctx context.Context, pipeline interface{},
+		streamOpts ...*options.ChangeStreamOptions) (changeStream, error) {
+		opts = append(opts, streamOpts[0])
+		if watchErr != nil {
+			return nil, watchErr
+		}
+
+		stream := streams[0]
+		streams = streams[1:]
+		return stream, nil
+	}
+
+	//the token of an empty batch is kept
+	streams = []changeStream{&fakeChangeStream{postBatchToken: postBatchToken, err: errors.New("network")}}
+	handled, err := worker.watchOnce(ctx)
+	assert.Equal(t, 0, handled)
+	assert.EqualError(t, err, "network")
+	assert.Equal(t, bson.Raw(postBatchToken), worker.lastToken)
+
+	//the stream is closed after an invalidate event, it starts after the event
+	streams = []changeStream{&fakeChangeStream{events: []bson.D{insert, invalidate}, closed: true}}
+	handled, err = worker.watchOnce(ctx)
+	assert.Equal(t, 2, handled)
+	assert.EqualError(t, err, "mongodb: change stream closed")
+	assert.Equal(t, bson.Raw(postBatchToken), opts[1].ResumeAfter)
+
+	streams = []changeStream{&fakeChangeStream{err: errors.New("network")}}
+	_, err = worker.watchOnce(ctx)
+	assert.Error(t, err)
+	assert.Nil(t, opts[2].ResumeAfter)
+	assert.Equal(t, bson.Raw(invalidateToken), opts[2].StartAfter)
+
+	//a stored token of an invalidate event, refused by ResumeAfter
+	worker.lastToken, worker.invalidated = nil, false
+	worker.store = &memTokenStore{token: invalidateToken}
+	watchErr = mongo.CommandError{Code: invalidResumeToken, Name: "InvalidResumeToken"}
+	_, err = worker.watchOnce(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, bson.Raw(invalidateToken), opts[3].ResumeAfter)
+	_, err = worker.watchOnce(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, bson.Raw(invalidateToken), opts[4].StartAfter)
+
+	//the token is gone from the oplog, the worker stops
+	watchErr = mongo.CommandError{Code: changeStreamHistoryLost, Name: "ChangeStreamHistoryLost"}
+	worker.Start()
+	select {
+	case <-worker.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker not stopped")
+	}
+	assert.True(t, isHistoryLost(worker.Err()))
+	worker.GracefulShutDown()
+}
+
+type memTokenStore struct {
+	token bson.Raw
+}
+
+func (this *memTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	return this.token, nil
+}
+
+func (this *memTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	this.token = token
+	return nil
+}
+
+// fakeIndexView lists indexes and records the created and dropped ones.
+type fakeIndexView struct {
+	indexes []interface{}
+
+	created []string
+
+	dropped []string
+}
+
+func (this *fakeIndexView) List(ctx context.Context, opts ...*options.ListIndexesOptions) (*mongo.Cursor, error) {
+	return mongo.NewCursorFromDocuments(this.indexes, nil, nil)
+}
+
+func (this *fakeIndexView) CreateOne(ctx context.Context, model mongo.IndexModel,
+	opts ...*options.CreateIndexesOptions) (string, error) {
+	this.created = append(this.created, *model.Options.Name)
+	return *model.Options.Name, nil
+}
+
+func (this *fakeIndexView) DropOne(ctx context.Context, name string,
+	opts ...*options.DropIndexesOptions) (bson.Raw, error) {
+	this.dropped = append(this.dropped, name)
+	return nil, nil
+}
+
+func TestSyncIndexes(t *testing.T) {
+	ctx := context.Background()
+	conf := config.NewViperConfig()
+	conf.Set("mgo_indexes", []interface{}{
+		map[string]interface{}{"client": "test", "coll": "user", "keys": []interface{}{"phone"}, "unique": true,
+			"partialfilter": map[string]interface{}{"phone": map[string]interface{}{"$exists": true}}},
+		map[string]interface{}{"client": "test", "coll": "user", "keys": []interface{}{"name", "-created_at"},
+			"collation": map[string]interface{}{"locale": "en", "strength": 2}},
+		map[string]interface{}{"client": "test", "coll": "user", "keys": []interface{}{"expire_at"},
+			"expireafter": "1h"},
+		map[string]interface{}{"client": "test", "coll": "user", "keys": []interface{}{"title:text"}},
+	})
+
+	specs, err := LoadIndexSpecs(conf)
+	assert.Nil(t, err)
+	assert.Len(t, specs, 4)
+	assert.Equal(t, "phone_1", specs[0].name())
+	assert.Equal(t, "name_1_created_at_-1", specs[1].name())
+	assert.Equal(t, time.Hour, *specs[2].ExpireAfter)
+	assert.Equal(t, "title_text", specs[3].name())
+	assert.Equal(t, ".user expire_at_1 {ttl 1h0m0s}", specs[2].String())
+
+	model := specs[1].model()
+	assert.Equal(t, bson.D{{Key: "name", Value: int32(1)}, {Key: "created_at", Value: int32(-1)}}, model.Keys)
+	assert.Equal(t, 2, model.Options.Collation.Strength)
+	assert.Equal(t, int32(3600), *specs[2].model().Options.ExpireAfterSeconds)
+
+	view := &fakeIndexView{indexes: []interface{}{
+		bson.M{"v": 2, "name": "_id_", "key": bson.M{"_id": 1}},
+		bson.M{"v": 2, "name": "phone_1", "key": bson.M{"phone": 1}, "unique": true,
+			"partialFilterExpression": bson.M{"phone": bson.M{"$exists": true}}},
+		bson.M{"v": 2, "name": "name_1_created_at_-1", "key": bson.D{{Key: "name", Value: 1}, {Key: "created_at", Value: -1}},
+			"collation": bson.M{"locale": "en", "strength": 3, "caseLevel": false}},
+		bson.M{"v": 2, "name": "title_text", "key": bson.M{"_fts": "text", "_ftsx": 1}},
+		bson.M{"v": 2, "name": "age_1", "key": bson.M{"age": 1.0}},
+	}}
+
+	diff, err := diffIndexes(ctx, view, specs)
+	assert.Nil(t, err)
+	assert.Len(t, diff.Missing, 1)
+	assert.Equal(t, "expire_at_1", diff.Missing[0].name())
+	assert.Len(t, diff.Changed, 1)
+	assert.Equal(t, "name_1_created_at_-1", diff.Changed[0].Name)
+	assert.Equal(t, []string{"age_1"}, diff.Unexpected)
+	assert.False(t, diff.Empty())
+
+	nullLogger := log.NewNullLogger()
+	assert.Nil(t, syncIndexes(ctx, view, diff, false, nullLogger))
+	assert.Equal(t, []string{"expire_at_1"}, view.created)
+	assert.Empty(t, view.dropped)
+
+	view.created = nil
+	assert.Nil(t, syncIndexes(ctx, view, diff, true, nullLogger))
+	assert.Equal(t, []string{"expire_at_1", "name_1_created_at_-1"}, view.created)
+	assert.Equal(t, []string{"age_1", "name_1_created_at_-1"}, view.dropped)
+
+	mgoClient := &MgoClient{
+		Mgos:       make(map[string]*mongo.Client),
+		databases:  make(map[string]string),
+		logger:     nullLogger,
+		indexSpecs: specs,
+	}
+	_, err = mgoClient.SyncIndexes(ctx, true, false)
+	assert.Error(t, err)
+}
+
+func TestSyncIndexes_Renamed(t *testing.T) {
+	ctx := context.Background()
+	specs := []IndexSpec{
+		{Coll: "user", Keys: []string{"phone"}, Unique: true},
+		{Coll: "user", Keys: []string{"name"}},
+		{Coll: "user", Keys: []string{"age"}},
+	}
+
+	//phone by hand, name with other keys under the declared name and the declared keys under another
+	view := &fakeIndexView{indexes: []interface{}{
+		bson.M{"v": 2, "name": "_id_", "key": bson.M{"_id": 1}},
+		bson.M{"v": 2, "name": "phone", "key": bson.M{"phone": 1}, "unique": true},
+		bson.M{"v": 2, "name": "name_1", "key": bson.M{"nick": 1}},
+		bson.M{"v": 2, "name": "by_name", "key": bson.M{"name": 1}},
+	}}
+
+	diff, err := diffIndexes(ctx, view, specs)
+	assert.Nil(t, err)
+	assert.Len(t, diff.Changed, 2)
+	assert.Equal(t, "phone", diff.Changed[0].Name)
+	assert.Equal(t, "phone_1", diff.Changed[0].Spec.name())
+	assert.Equal(t, ".user phone_1 {unique} (was phone)", diff.Changed[0].String())
+	assert.Equal(t, "by_name", diff.Changed[1].Name)
+	assert.Equal(t, "name_1", diff.Changed[1].Spec.name())
+	assert.Len(t, diff.Missing, 1)
+	assert.Equal(t, "age_1", diff.Missing[0].name())
+	assert.Equal(t, []string{"name_1"}, diff.Unexpected)
+
+	nullLogger := log.NewNullLogger()
+	assert.Nil(t, syncIndexes(ctx, view, diff, false, nullLogger))
+	assert.Equal(t, []string{"age_1"}, view.created)
+	assert.Empty(t, view.dropped)
+
+	view.created = nil
+	assert.Nil(t, syncIndexes(ctx, view, diff, true, nullLogger))
+	assert.Equal(t, []string{"name_1", "phone", "by_name"}, view.dropped)
+	assert.Equal(t, []string{"age_1", "phone_1", "name_1"}, view.created)
+}
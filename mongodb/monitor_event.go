@@ -2,12 +2,14 @@ package mongodb
 
 import (
 	"context"
+	"regexp"
 	"time"
 
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
 	"github.com/jukylin/esim/opentracing"
 	opentracing2 "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.mongodb.org/mongo-driver/event"
 )
@@ -22,6 +24,8 @@ type monitorEvent struct {
 	tracer opentracing2.Tracer
 
 	afterEvents []afterEvents
+
+	commands *commandStore
 }
 
 type afterEvents func(context.Context, *mongoBackEvent, time.Time, time.Time)
@@ -50,6 +54,12 @@ func NewMonitorEvent(options ...EventOption) *monitorEvent {
 		m.tracer = opentracing.NewTracer("mongodb", m.logger)
 	}
 
+	maxCommands := m.conf.GetInt("mgo_max_started_commands")
+	if maxCommands <= 0 {
+		maxCommands = 10000
+	}
+	m.commands = newCommandStore(maxCommands)
+
 	m.registerAfterEvent()
 
 	return m
@@ -82,6 +92,8 @@ func (m *monitorEvent) EventName() string {
 }
 
 func (m *monitorEvent) Start(ctx context.Context, starEv *event.CommandStartedEvent) {
+	m.commands.start(starEv)
+
 	if m.nextEvent != nil {
 		m.nextEvent.Start(ctx, starEv)
 	}
@@ -95,6 +107,7 @@ func (m *monitorEvent) SucceededEvent(ctx context.Context,
 	endTime := time.Now()
 
 	monBackEvent.succEvent = succEvent
+	monBackEvent.command = m.commands.finish(succEvent.RequestID)
 	beginTime = endTime.Add(-time.Duration(succEvent.DurationNanos))
 
 	if m.nextEvent != nil {
@@ -113,6 +126,7 @@ func (m *monitorEvent) FailedEvent(ctx context.Context, failedEvent *event.Comma
 	endTime := time.Now()
 
 	monBackEvent.failedEvent = failedEvent
+	monBackEvent.command = m.commands.finish(failedEvent.RequestID)
 	beginTime = endTime.Add(-time.Duration(failedEvent.DurationNanos))
 
 	if m.nextEvent != nil {
@@ -142,81 +156,80 @@ func (m *monitorEvent) registerAfterEvent() {
 	}
 }
 
-//执行慢的命令
-// dur_nan 纳秒
-//执行的命令
+// withSlowCommand logs the commands slower than "mgo_slow_time" ms.
 func (m *monitorEvent) withSlowCommand(ctx context.Context, backEvent *mongoBackEvent, begin_time time.Time, end_time time.Time) {
 	mgo_slow_time := m.conf.GetInt64("mgo_slow_time")
-	exec_command, ok := ctx.Value("command").(*string)
-
-	var dur_nan int64
-	if backEvent.succEvent != nil {
-		dur_nan = backEvent.succEvent.DurationNanos
-	} else if backEvent.failedEvent != nil {
-		dur_nan = backEvent.failedEvent.DurationNanos
+	if mgo_slow_time == 0 || end_time.Sub(begin_time) < time.Duration(mgo_slow_time)*time.Millisecond {
+		return
 	}
 
-	if ok == true && dur_nan != 0 && mgo_slow_time != 0 {
-		if int64(dur_nan/1000000) >= int64(mgo_slow_time) {
-			m.logger.Warnf("slow command %s", exec_command)
-		}
-	}
+	m.logger.Warnc(ctx, "slow command %s [%v]", backEvent.String(), end_time.Sub(begin_time).String())
 }
 
 func (m *monitorEvent) withTracer(ctx context.Context, backEvent *mongoBackEvent, begin_time time.Time, end_time time.Time) {
-	exec_command, ok := ctx.Value("command").(*string)
-
-	if ok {
-		var command_name string
-		var err_str string
-
-		if backEvent.succEvent != nil {
-			command_name = backEvent.succEvent.CommandName
-		} else if backEvent.failedEvent != nil {
-			command_name = backEvent.failedEvent.CommandName
-			err_str = backEvent.failedEvent.Failure
-		}
-
-		if command_name != "" {
-			span := opentracing.GetSpan(ctx, m.tracer,
-				command_name, begin_time)
-			if err_str != "" {
-				span.SetTag("error", true)
-				span.LogKV("error_detailed", err_str)
-			}
-			span.LogKV("exec_command", *exec_command)
-			span.FinishWithOptions(opentracing2.FinishOptions{FinishTime: end_time})
+	span := opentracing.GetSpan(ctx, m.tracer, backEvent.commandName(), begin_time)
+	if span == nil {
+		return
+	}
+
+	ext.DBType.Set(span, "mongodb")
+	if command := backEvent.command; command != nil {
+		ext.DBInstance.Set(span, command.database)
+		span.SetTag("db.collection", command.collection)
+		ext.DBStatement.Set(span, command.filter)
+		if command.txnNumber != 0 {
+			span.SetTag("db.txn_number", command.txnNumber)
 		}
 	}
 
+	if backEvent.failedEvent != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error_detailed", backEvent.failedEvent.Failure)
+	}
+	span.FinishWithOptions(opentracing2.FinishOptions{FinishTime: end_time})
 }
 
+// withMetrics counts the commands by client, database, collection and command,
+// the failed ones also by the code name of the error.
 func (m *monitorEvent) withMetrics(ctx context.Context, backEvent *mongoBackEvent, begin_time time.Time, end_time time.Time) {
+	lab := prometheus.Labels{
+		"client":  clientFromContext(ctx),
+		"db":      "",
+		"coll":    "",
+		"command": backEvent.commandName(),
+	}
+	if command := backEvent.command; command != nil {
+		lab["db"] = command.database
+		lab["coll"] = command.collection
+	}
 
-	var command_name string
+	mongodbTotal.With(lab).Inc()
+	mongodbDuration.With(lab).Observe(end_time.Sub(begin_time).Seconds())
 
-	if backEvent.succEvent != nil {
-		command_name = backEvent.succEvent.CommandName
-	} else if backEvent.failedEvent != nil {
-		command_name = backEvent.failedEvent.CommandName
+	if backEvent.failedEvent != nil {
+		lab["code"] = errorCode(backEvent.failedEvent.Failure)
+		mongodbErrTotal.With(lab).Inc()
 	}
+}
 
-	if command_name != "" {
-		lab := prometheus.Labels{"command": command_name}
-		mongodbErrTotal.With(lab).Inc()
-		mongodbDuration.With(lab).Observe(end_time.Sub(begin_time).Seconds())
+var errorCodeRegexp = regexp.MustCompile(`^\((\w+)\)`)
+
+// errorCode returns the code name of Failure, like "NotWritablePrimary" of
+// "(NotWritablePrimary) not primary", or "unknown".
+func errorCode(failure string) string {
+	if match := errorCodeRegexp.FindStringSubmatch(failure); match != nil {
+		return match[1]
 	}
+
+	return "unknown"
 }
 
 func (m *monitorEvent) withDebug(ctx context.Context, backEvent *mongoBackEvent, begin_time time.Time, end_time time.Time) {
-	command, ok := ctx.Value("command").(*string)
-	if ok {
-		if backEvent.succEvent != nil {
-			m.logger.Debugf("mongodb success [%v] %s",
-				end_time.Sub(begin_time).String(), *command)
-		} else if backEvent.failedEvent != nil {
-			m.logger.Debugf("mongodb fail [%v] %s",
-				end_time.Sub(begin_time).String(), *command)
-		}
+	if backEvent.succEvent != nil {
+		m.logger.Debugc(ctx, "mongodb success [%v] %s",
+			end_time.Sub(begin_time).String(), backEvent.String())
+	} else if backEvent.failedEvent != nil {
+		m.logger.Debugc(ctx, "mongodb fail [%v] %s : %s",
+			end_time.Sub(begin_time).String(), backEvent.String(), backEvent.failedEvent.Failure)
 	}
 }
@@ -0,0 +1,188 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/opentracing"
+	opentracing2 "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CollCallInfo is a call of the collection seen by monitorProxy.
+type CollCallInfo struct {
+	Db string
+
+	Coll string
+
+	Method string
+
+	Err error
+
+	StartTime time.Time
+
+	EndTime time.Time
+}
+
+type afterCallEvents func(context.Context, CollCallInfo)
+
+// monitorProxy watches the calls of the collection like monitorEvent watches the commands,
+// by "mgo_metrics", "mgo_tracer", "mgo_check_slow" and "debug".
+// A call may send more than one command, like Find with getMore.
+type monitorProxy struct {
+	*collInterceptor
+
+	name string
+
+	conf config.Config
+
+	logger log.Logger
+
+	tracer opentracing2.Tracer
+
+	afterEvents []afterCallEvents
+}
+
+type MonitorProxyOption func(c *monitorProxy)
+
+type MonitorProxyOptions struct{}
+
+func NewMonitorProxy(options ...MonitorProxyOption) *monitorProxy {
+	monitorProxy := &monitorProxy{}
+
+	for _, option := range options {
+		option(monitorProxy)
+	}
+
+	if monitorProxy.conf == nil {
+		monitorProxy.conf = config.NewNullConfig()
+	}
+
+	if monitorProxy.logger == nil {
+		monitorProxy.logger = log.NewLogger()
+	}
+
+	if monitorProxy.tracer == nil {
+		monitorProxy.tracer = opentracing.NewTracer("mongodb", monitorProxy.logger)
+	}
+
+	monitorProxy.registerAfterEvent()
+
+	monitorProxy.name = "monitor_proxy"
+	monitorProxy.collInterceptor = &collInterceptor{around: monitorProxy.around}
+
+	return monitorProxy
+}
+
+func (MonitorProxyOptions) WithConf(conf config.Config) MonitorProxyOption {
+	return func(m *monitorProxy) {
+		m.conf = conf
+	}
+}
+
+func (MonitorProxyOptions) WithLogger(logger log.Logger) MonitorProxyOption {
+	return func(m *monitorProxy) {
+		m.logger = logger
+	}
+}
+
+func (MonitorProxyOptions) WithTracer(tracer opentracing2.Tracer) MonitorProxyOption {
+	return func(m *monitorProxy) {
+		m.tracer = tracer
+	}
+}
+
+//implement Proxy interface
+func (this *monitorProxy) NextProxy(coll interface{}) {
+	this.nextColl = coll.(Mongo)
+}
+
+//implement Proxy interface
+func (this *monitorProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *monitorProxy) registerAfterEvent() {
+	if this.conf.GetBool("mgo_tracer") == true {
+		this.afterEvents = append(this.afterEvents, this.withTracer)
+	}
+
+	if this.conf.GetBool("mgo_check_slow") == true {
+		this.afterEvents = append(this.afterEvents, this.withSlowCall)
+	}
+
+	if this.conf.GetBool("mgo_metrics") == true {
+		this.afterEvents = append(this.afterEvents, this.withMetrics)
+	}
+
+	if this.conf.GetBool("debug") == true {
+		this.afterEvents = append(this.afterEvents, this.withDebug)
+	}
+}
+
+func (this *monitorProxy) around(ctx context.Context, coll Mongo, method string,
+	call func(ctx context.Context) error) error {
+	if len(this.afterEvents) == 0 {
+		return call(ctx)
+	}
+
+	info := CollCallInfo{Coll: coll.Name(), Method: method, StartTime: time.Now()}
+	if db := coll.Database(); db != nil {
+		info.Db = db.Name()
+	}
+
+	info.Err = call(ctx)
+	info.EndTime = time.Now()
+
+	for _, ev := range this.afterEvents {
+		ev(ctx, info)
+	}
+
+	return info.Err
+}
+
+func (this *monitorProxy) withSlowCall(ctx context.Context, info CollCallInfo) {
+	mgo_slow_time := this.conf.GetInt64("mgo_slow_time")
+	if mgo_slow_time != 0 && info.EndTime.Sub(info.StartTime) >= time.Duration(mgo_slow_time)*time.Millisecond {
+		this.logger.Warnc(ctx, "slow call %s.%s.%s [%v]", info.Db, info.Coll, info.Method,
+			info.EndTime.Sub(info.StartTime).String())
+	}
+}
+
+func (this *monitorProxy) withTracer(ctx context.Context, info CollCallInfo) {
+	span := opentracing.GetSpan(ctx, this.tracer, info.Method, info.StartTime)
+	if span == nil {
+		return
+	}
+
+	ext.DBType.Set(span, "mongodb")
+	ext.DBInstance.Set(span, info.Db)
+	span.SetTag("db.collection", info.Coll)
+	if info.Err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error_detailed", info.Err.Error())
+	}
+	span.FinishWithOptions(opentracing2.FinishOptions{FinishTime: info.EndTime})
+}
+
+func (this *monitorProxy) withMetrics(ctx context.Context, info CollCallInfo) {
+	lab := prometheus.Labels{"db": info.Db, "coll": info.Coll, "method": info.Method}
+	mongodbCollTotal.With(lab).Inc()
+	mongodbCollDuration.With(lab).Observe(info.EndTime.Sub(info.StartTime).Seconds())
+	if info.Err != nil {
+		mongodbCollErrTotal.With(lab).Inc()
+	}
+}
+
+func (this *monitorProxy) withDebug(ctx context.Context, info CollCallInfo) {
+	if info.Err != nil {
+		this.logger.Debugc(ctx, "mongodb fail [%v] %s.%s.%s : %s", info.EndTime.Sub(info.StartTime).String(),
+			info.Db, info.Coll, info.Method, info.Err.Error())
+	} else {
+		this.logger.Debugc(ctx, "mongodb success [%v] %s.%s.%s", info.EndTime.Sub(info.StartTime).String(),
+			info.Db, info.Coll, info.Method)
+	}
+}
@@ -0,0 +1,170 @@
+package mongodb
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// poolStats is counted from the events of the pool monitor,
+// the driver has no statistics of the pools.
+type poolStats struct {
+	client string
+
+	//of each server
+	maxPoolSize uint64
+
+	connections int64
+
+	checkedOut int64
+
+	//waiting for a connection
+	waiting int64
+
+	created uint64
+
+	closed uint64
+
+	checkOutFailed uint64
+
+	cleared uint64
+
+	lock sync.Mutex
+
+	//address => the times of the waiting check outs, the oldest first
+	waitStarts map[string][]time.Time
+}
+
+func (this *poolStats) event(pev *event.PoolEvent) {
+	switch pev.Type {
+	case event.PoolCreated:
+		if pev.PoolOptions != nil {
+			atomic.StoreUint64(&this.maxPoolSize, pev.PoolOptions.MaxPoolSize)
+		}
+	case event.ConnectionCreated:
+		atomic.AddInt64(&this.connections, 1)
+		atomic.AddUint64(&this.created, 1)
+	case event.ConnectionClosed:
+		atomic.AddInt64(&this.connections, -1)
+		atomic.AddUint64(&this.closed, 1)
+	case event.GetStarted:
+		atomic.AddInt64(&this.waiting, 1)
+		this.waitStarted(pev.Address)
+	case event.GetSucceeded:
+		atomic.AddInt64(&this.waiting, -1)
+		atomic.AddInt64(&this.checkedOut, 1)
+		this.waitFinished(pev.Address)
+	case event.ConnectionReturned:
+		atomic.AddInt64(&this.checkedOut, -1)
+	case event.GetFailed:
+		atomic.AddInt64(&this.waiting, -1)
+		atomic.AddUint64(&this.checkOutFailed, 1)
+		this.waitFinished(pev.Address)
+	case event.PoolCleared:
+		atomic.AddUint64(&this.cleared, 1)
+	}
+}
+
+func (this *poolStats) waitStarted(address string) {
+	this.lock.Lock()
+	if this.waitStarts == nil {
+		this.waitStarts = make(map[string][]time.Time)
+	}
+	this.waitStarts[address] = append(this.waitStarts[address], time.Now())
+	this.lock.Unlock()
+}
+
+// waitFinished observes the wait time of the oldest check out of address,
+// the events have no ids of the check outs, so the concurrent ones are approximate.
+func (this *poolStats) waitFinished(address string) {
+	this.lock.Lock()
+	starts := this.waitStarts[address]
+	if len(starts) == 0 {
+		this.lock.Unlock()
+		return
+	}
+
+	startTime := starts[0]
+	if len(starts) == 1 {
+		delete(this.waitStarts, address)
+	} else {
+		this.waitStarts[address] = starts[1:]
+	}
+	this.lock.Unlock()
+
+	mongodbPoolWaitDuration.With(prometheus.Labels{"client": this.client}).
+		Observe(time.Since(startTime).Seconds())
+}
+
+// poolCollector reads the poolStats of the clients at scrape time,
+// MgoClient adds them in init and removes them in Close.
+type poolCollector struct {
+	lock sync.RWMutex
+
+	pools map[string]*poolStats
+
+	desc *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	return &poolCollector{
+		pools: make(map[string]*poolStats),
+		desc: prometheus.NewDesc("mongodb_pool_stats", "pool's statistics",
+			[]string{"client", "stats"}, nil),
+	}
+}
+
+// add returns the poolStats of client, it replaces the old one.
+func (this *poolCollector) add(client string) *poolStats {
+	stats := &poolStats{client: client}
+
+	this.lock.Lock()
+	this.pools[client] = stats
+	this.lock.Unlock()
+
+	return stats
+}
+
+// remove removes stats if it is not replaced.
+func (this *poolCollector) remove(client string, stats *poolStats) {
+	this.lock.Lock()
+	if this.pools[client] == stats {
+		delete(this.pools, client)
+	}
+	this.lock.Unlock()
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- this.desc
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for client, stats := range this.pools {
+		checkedOut := atomic.LoadInt64(&stats.checkedOut)
+		connections := atomic.LoadInt64(&stats.connections)
+
+		values := map[string]float64{
+			"max_pool_size":    float64(atomic.LoadUint64(&stats.maxPoolSize)),
+			"open_conn":        float64(connections),
+			"checked_out":      float64(checkedOut),
+			"idle":             float64(connections - checkedOut),
+			"waiting":          float64(atomic.LoadInt64(&stats.waiting)),
+			"created":          float64(atomic.LoadUint64(&stats.created)),
+			"closed":           float64(atomic.LoadUint64(&stats.closed)),
+			"check_out_failed": float64(atomic.LoadUint64(&stats.checkOutFailed)),
+			"cleared":          float64(atomic.LoadUint64(&stats.cleared)),
+		}
+
+		for name, value := range values {
+			ch <- prometheus.MustNewConstMetric(this.desc, prometheus.GaugeValue, value, client, name)
+		}
+	}
+}
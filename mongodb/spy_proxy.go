@@ -0,0 +1,70 @@
+package mongodb
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jukylin/esim/log"
+)
+
+// spyProxy records the methods with ctx called on the collection.
+type spyProxy struct {
+	*collInterceptor
+
+	name string
+
+	logger log.Logger
+
+	lock sync.Mutex
+
+	//method => times
+	calls map[string]int
+}
+
+func NewSpyProxy(logger log.Logger, name string) *spyProxy {
+	spyProxy := &spyProxy{}
+
+	if logger == nil {
+		logger = log.NewLogger()
+	}
+	spyProxy.logger = logger
+
+	spyProxy.name = name
+	spyProxy.calls = make(map[string]int)
+	spyProxy.collInterceptor = &collInterceptor{around: spyProxy.around}
+
+	return spyProxy
+}
+
+//implement Proxy interface
+func (this *spyProxy) NextProxy(coll interface{}) {
+	this.nextColl = coll.(Mongo)
+}
+
+//implement Proxy interface
+func (this *spyProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *spyProxy) around(ctx context.Context, coll Mongo, method string,
+	call func(ctx context.Context) error) error {
+	this.lock.Lock()
+	this.calls[method]++
+	this.lock.Unlock()
+
+	this.logger.Infoc(ctx, "%s %sWasCalled", this.name, method)
+
+	return call(ctx)
+}
+
+// WasCalled reports whether method like "FindOne" is called.
+func (this *spyProxy) WasCalled(method string) bool {
+	return this.CallTimes(method) > 0
+}
+
+func (this *spyProxy) CallTimes(method string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.calls[method]
+}
@@ -0,0 +1,361 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/jukylin/esim/log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNotStubbed is returned by stubsProxy for the methods not stubbed if it is the last of the chain.
+var ErrNotStubbed = errors.New("mongodb: method not stubbed")
+
+type stubResult struct {
+	result interface{}
+
+	err error
+}
+
+// stubsProxy answers the stubbed methods with ctx, the others go to the next proxy.
+// result of Stub is the first return value of the method, the documents of Find and Aggregate
+// as []interface{} and the document of FindOne and FindOneAnd*, nil is not found.
+//  stubs := NewStubsProxy()
+//  stubs.Stub("InsertOne", &mongo.InsertOneResult{InsertedID: 1}, nil).
+//      Stub("Find", []interface{}{bson.M{"name": "test"}}, nil)
+type stubsProxy struct {
+	name string
+
+	logger log.Logger
+
+	nextColl Mongo
+
+	lock sync.RWMutex
+
+	//method => stub
+	stubs map[string]stubResult
+
+	//the stubsProxy whose stubs are answered, nil if not bound
+	parent *stubsProxy
+}
+
+type StubsProxyOption func(c *stubsProxy)
+
+type StubsProxyOptions struct{}
+
+func NewStubsProxy(options ...StubsProxyOption) *stubsProxy {
+	stubsProxy := &stubsProxy{}
+
+	for _, option := range options {
+		option(stubsProxy)
+	}
+
+	if stubsProxy.logger == nil {
+		stubsProxy.logger = log.NewLogger()
+	}
+
+	stubsProxy.stubs = make(map[string]stubResult)
+	stubsProxy.name = "stubs_proxy"
+
+	return stubsProxy
+}
+
+func (StubsProxyOptions) WithLogger(logger log.Logger) StubsProxyOption {
+	return func(s *stubsProxy) {
+		s.logger = logger
+	}
+}
+
+//implement Proxy interface
+func (this *stubsProxy) NextProxy(coll interface{}) {
+	this.nextColl = coll.(Mongo)
+}
+
+//implement Proxy interface
+func (this *stubsProxy) ProxyName() string {
+	return this.name
+}
+
+//implement CollBinder interface, the bound proxies answer the stubs of this
+func (this *stubsProxy) Bind(coll Mongo) Mongo {
+	parent := this
+	if this.parent != nil {
+		parent = this.parent
+	}
+
+	return &stubsProxy{
+		name:     this.name,
+		logger:   this.logger,
+		nextColl: coll,
+		parent:   parent,
+	}
+}
+
+// Stub makes method like "FindOne" return result and err.
+func (this *stubsProxy) Stub(method string, result interface{}, err error) *stubsProxy {
+	this.lock.Lock()
+	this.stubs[method] = stubResult{result: result, err: err}
+	this.lock.Unlock()
+
+	return this
+}
+
+// stub returns the stub of method, ErrNotStubbed if there is no next collection.
+func (this *stubsProxy) stub(ctx context.Context, method string) (stubResult, bool) {
+	stubs := this
+	if this.parent != nil {
+		stubs = this.parent
+	}
+
+	stubs.lock.RLock()
+	stub, ok := stubs.stubs[method]
+	stubs.lock.RUnlock()
+
+	if !ok && this.nextColl == nil {
+		this.logger.Errorc(ctx, "[mongodb] %s not stubbed", method)
+		return stubResult{err: ErrNotStubbed}, true
+	}
+
+	return stub, ok
+}
+
+// singleResult returns the document of stub.
+func (this stubResult) singleResult() *mongo.SingleResult {
+	if this.err != nil {
+		return errSingleResult(this.err)
+	}
+
+	if this.result == nil {
+		return errSingleResult(mongo.ErrNoDocuments)
+	}
+
+	return mongo.NewSingleResultFromDocument(this.result, nil, nil)
+}
+
+// cursor returns the documents of stub.
+func (this stubResult) cursor() (*mongo.Cursor, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+
+	documents, _ := this.result.([]interface{})
+	return mongo.NewCursorFromDocuments(documents, nil, nil)
+}
+
+func (this *stubsProxy) Clone(opts ...*options.CollectionOptions) (*mongo.Collection, error) {
+	if this.nextColl == nil {
+		return nil, ErrNotStubbed
+	}
+
+	return this.nextColl.Clone(opts...)
+}
+
+// Name is empty if there is no next collection.
+func (this *stubsProxy) Name() string {
+	if this.nextColl == nil {
+		return ""
+	}
+
+	return this.nextColl.Name()
+}
+
+// Database is nil if there is no next collection.
+func (this *stubsProxy) Database() *mongo.Database {
+	if this.nextColl == nil {
+		return nil
+	}
+
+	return this.nextColl.Database()
+}
+
+func (this *stubsProxy) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if stub, ok := this.stub(ctx, "BulkWrite"); ok {
+		result, _ := stub.result.(*mongo.BulkWriteResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.BulkWrite(ctx, models, opts...)
+}
+
+func (this *stubsProxy) InsertOne(ctx context.Context, document interface{},
+	opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if stub, ok := this.stub(ctx, "InsertOne"); ok {
+		result, _ := stub.result.(*mongo.InsertOneResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.InsertOne(ctx, document, opts...)
+}
+
+func (this *stubsProxy) InsertMany(ctx context.Context, documents []interface{},
+	opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if stub, ok := this.stub(ctx, "InsertMany"); ok {
+		result, _ := stub.result.(*mongo.InsertManyResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.InsertMany(ctx, documents, opts...)
+}
+
+func (this *stubsProxy) DeleteOne(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	if stub, ok := this.stub(ctx, "DeleteOne"); ok {
+		result, _ := stub.result.(*mongo.DeleteResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.DeleteOne(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) DeleteMany(ctx context.Context, filter interface{},
+	opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	if stub, ok := this.stub(ctx, "DeleteMany"); ok {
+		result, _ := stub.result.(*mongo.DeleteResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.DeleteMany(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) UpdateOne(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if stub, ok := this.stub(ctx, "UpdateOne"); ok {
+		result, _ := stub.result.(*mongo.UpdateResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.UpdateOne(ctx, filter, update, opts...)
+}
+
+func (this *stubsProxy) UpdateMany(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if stub, ok := this.stub(ctx, "UpdateMany"); ok {
+		result, _ := stub.result.(*mongo.UpdateResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.UpdateMany(ctx, filter, update, opts...)
+}
+
+func (this *stubsProxy) ReplaceOne(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if stub, ok := this.stub(ctx, "ReplaceOne"); ok {
+		result, _ := stub.result.(*mongo.UpdateResult)
+		return result, stub.err
+	}
+
+	return this.nextColl.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (this *stubsProxy) Aggregate(ctx context.Context, pipeline interface{},
+	opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	if stub, ok := this.stub(ctx, "Aggregate"); ok {
+		return stub.cursor()
+	}
+
+	return this.nextColl.Aggregate(ctx, pipeline, opts...)
+}
+
+func (this *stubsProxy) CountDocuments(ctx context.Context, filter interface{},
+	opts ...*options.CountOptions) (int64, error) {
+	if stub, ok := this.stub(ctx, "CountDocuments"); ok {
+		count, _ := stub.result.(int64)
+		return count, stub.err
+	}
+
+	return this.nextColl.CountDocuments(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) EstimatedDocumentCount(ctx context.Context,
+	opts ...*options.EstimatedDocumentCountOptions) (int64, error) {
+	if stub, ok := this.stub(ctx, "EstimatedDocumentCount"); ok {
+		count, _ := stub.result.(int64)
+		return count, stub.err
+	}
+
+	return this.nextColl.EstimatedDocumentCount(ctx, opts...)
+}
+
+func (this *stubsProxy) Distinct(ctx context.Context, fieldName string, filter interface{},
+	opts ...*options.DistinctOptions) ([]interface{}, error) {
+	if stub, ok := this.stub(ctx, "Distinct"); ok {
+		values, _ := stub.result.([]interface{})
+		return values, stub.err
+	}
+
+	return this.nextColl.Distinct(ctx, fieldName, filter, opts...)
+}
+
+func (this *stubsProxy) Find(ctx context.Context, filter interface{},
+	opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	if stub, ok := this.stub(ctx, "Find"); ok {
+		return stub.cursor()
+	}
+
+	return this.nextColl.Find(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) FindOne(ctx context.Context, filter interface{},
+	opts ...*options.FindOneOptions) *mongo.SingleResult {
+	if stub, ok := this.stub(ctx, "FindOne"); ok {
+		return stub.singleResult()
+	}
+
+	return this.nextColl.FindOne(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) FindOneAndDelete(ctx context.Context, filter interface{},
+	opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	if stub, ok := this.stub(ctx, "FindOneAndDelete"); ok {
+		return stub.singleResult()
+	}
+
+	return this.nextColl.FindOneAndDelete(ctx, filter, opts...)
+}
+
+func (this *stubsProxy) FindOneAndReplace(ctx context.Context, filter interface{},
+	replacement interface{}, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	if stub, ok := this.stub(ctx, "FindOneAndReplace"); ok {
+		return stub.singleResult()
+	}
+
+	return this.nextColl.FindOneAndReplace(ctx, filter, replacement, opts...)
+}
+
+func (this *stubsProxy) FindOneAndUpdate(ctx context.Context, filter interface{},
+	update interface{}, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	if stub, ok := this.stub(ctx, "FindOneAndUpdate"); ok {
+		return stub.singleResult()
+	}
+
+	return this.nextColl.FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+// Watch can only be stubbed with an error.
+func (this *stubsProxy) Watch(ctx context.Context, pipeline interface{},
+	opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	if stub, ok := this.stub(ctx, "Watch"); ok {
+		return nil, stub.err
+	}
+
+	return this.nextColl.Watch(ctx, pipeline, opts...)
+}
+
+func (this *stubsProxy) Indexes() mongo.IndexView {
+	if this.nextColl == nil {
+		return mongo.IndexView{}
+	}
+
+	return this.nextColl.Indexes()
+}
+
+func (this *stubsProxy) Drop(ctx context.Context) error {
+	if stub, ok := this.stub(ctx, "Drop"); ok {
+		return stub.err
+	}
+
+	return this.nextColl.Drop(ctx)
+}
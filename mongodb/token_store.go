@@ -0,0 +1,83 @@
+package mongodb
+
+import (
+	"context"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/jukylin/esim/redis"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const redisTokenPrefix = "mongodb_resume_token:"
+
+// ResumeTokenStore keeps the resume tokens of the change stream workers by their names.
+type ResumeTokenStore interface {
+	// Load returns nil if there is no token of name.
+	Load(ctx context.Context, name string) (bson.Raw, error)
+
+	Save(ctx context.Context, name string, token bson.Raw) error
+}
+
+type mgoTokenStore struct {
+	coll Mongo
+}
+
+// NewMgoTokenStore keeps the tokens in coll, a document per worker:
+//  {_id: name, token: {...}, updated_at: ISODate(...)}
+func NewMgoTokenStore(coll Mongo) ResumeTokenStore {
+	return &mgoTokenStore{coll: coll}
+}
+
+func (this *mgoTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	doc := struct {
+		Token bson.Raw `bson:"token"`
+	}{}
+
+	err := this.coll.FindOne(ctx, bson.M{"_id": name}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	return doc.Token, err
+}
+
+func (this *mgoTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	_, err := this.coll.UpdateOne(ctx, bson.M{"_id": name},
+		bson.M{"$set": bson.M{"token": token, "updated_at": time.Now()}},
+		options.Update().SetUpsert(true))
+
+	return err
+}
+
+type redisTokenStore struct {
+	client *redis.RedisClient
+}
+
+// NewRedisTokenStore keeps the tokens in "mongodb_resume_token:<name>" of client.
+func NewRedisTokenStore(client *redis.RedisClient) ResumeTokenStore {
+	return &redisTokenStore{client: client}
+}
+
+func (this *redisTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	token, err := redigo.Bytes(conn.Do(ctx, "GET", redisTokenPrefix+name))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+
+	return token, err
+}
+
+func (this *redisTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	_, err := conn.Do(ctx, "SET", redisTokenPrefix+name, []byte(token))
+
+	return err
+}
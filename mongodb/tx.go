@@ -0,0 +1,181 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the error labels of the transactions, see the transactions spec of mongodb
+const (
+	transientTransactionError      = "TransientTransactionError"
+	unknownTransactionCommitResult = "UnknownTransactionCommitResult"
+)
+
+// transactionTimeout bounds the retries of a transaction, as WithTransaction of the driver.
+const transactionTimeout = 120 * time.Second
+
+// WithTransaction runs fn in a transaction of client, it commits if fn returns nil
+// and aborts if fn returns an error or panics, the panic is thrown again after that.
+// The commands in fn must use sessCtx, they are seen by the monitor event with their txnNumber.
+// On TransientTransactionError the whole transaction is retried
+// "mgo_tx_max_retries" times (default 3) with exponential backoff, so fn must be retryable,
+// on UnknownTransactionCommitResult only the commit is retried.
+// The retries stop 120 seconds after the transaction starts.
+// Calling WithTransaction of the same client in fn joins the outer transaction,
+// of another client it returns an error.
+func (this *MgoClient) WithTransaction(ctx context.Context, client string,
+	fn func(sessCtx mongo.SessionContext) error, opts ...*options.TransactionOptions) error {
+	client = strings.ToLower(client)
+	mgo, ok := this.Mgos[client]
+	if !ok {
+		return fmt.Errorf("[mongodb] client %s not found", client)
+	}
+
+	//join the outer transaction
+	if sess := mongo.SessionFromContext(ctx); sess != nil {
+		if sess.Client() != mgo {
+			return fmt.Errorf("[mongodb] client %s can't join the session of another client", client)
+		}
+		return fn(mongo.NewSessionContext(ctx, sess))
+	}
+
+	sess, err := mgo.StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+
+	maxRetries := this.conf.GetInt("mgo_tx_max_retries")
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+
+	deadline := time.Now().Add(transactionTimeout)
+	backoff := 20 * time.Millisecond
+	for retry := 0; ; retry++ {
+		err = this.runTransaction(ctx, client, sess, fn, options.MergeTransactionOptions(opts...), deadline)
+		if err == nil || !hasErrorLabel(err, transientTransactionError) || retry >= maxRetries ||
+			time.Now().After(deadline) {
+			return err
+		}
+
+		mongodbTxRetryTotal.With(prometheus.Labels{"client": client}).Inc()
+		this.logger.Warnc(ctx, "[mongodb] %s retry transaction %d : %s", client, retry+1, err.Error())
+
+		wait := backoff<<uint(retry) + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (this *MgoClient) runTransaction(ctx context.Context, client string, sess mongo.Session,
+	fn func(sessCtx mongo.SessionContext) error, opts *options.TransactionOptions, deadline time.Time) (err error) {
+	startTime := time.Now()
+	outcome := "abort"
+	defer func() {
+		lab := prometheus.Labels{"client": client, "outcome": outcome}
+		mongodbTxTotal.With(lab).Inc()
+		mongodbTxDuration.With(lab).Observe(time.Since(startTime).Seconds())
+	}()
+
+	err = sess.StartTransaction(opts)
+	if err != nil {
+		outcome = "start_error"
+		return err
+	}
+
+	sessCtx := mongo.NewSessionContext(ctx, sess)
+
+	defer func() {
+		if p := recover(); p != nil {
+			outcome = "panic"
+			sess.AbortTransaction(context.Background())
+			panic(p)
+		}
+	}()
+
+	err = fn(sessCtx)
+	if err != nil {
+		if abortErr := sess.AbortTransaction(context.Background()); abortErr != nil {
+			this.logger.Errorc(ctx, "[mongodb] %s abort error : %s", client, abortErr.Error())
+		}
+		return err
+	}
+
+	err = this.commitWithRetry(ctx, client, deadline, func() error {
+		return sess.CommitTransaction(sessCtx)
+	})
+	if err != nil {
+		outcome = "commit_error"
+		return err
+	}
+	outcome = "commit"
+
+	return nil
+}
+
+// commitWithRetry retries commit on UnknownTransactionCommitResult with exponential backoff
+// until deadline or ctx is done.
+func (this *MgoClient) commitWithRetry(ctx context.Context, client string, deadline time.Time,
+	commit func() error) error {
+	for retry := 0; ; retry++ {
+		err := commit()
+		if err == nil || !hasErrorLabel(err, unknownTransactionCommitResult) {
+			return err
+		}
+
+		wait := commitBackoff(retry)
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		this.logger.Warnc(ctx, "[mongodb] %s retry commit %d : %s", client, retry+1, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// commitBackoff is the wait before the retry of commitWithRetry, at most 1s.
+func commitBackoff(retry int) time.Duration {
+	backoff := 20 * time.Millisecond
+	//20ms << 6 is over 1s, a larger shift overflows after a while
+	if retry > 6 {
+		retry = 6
+	}
+
+	wait := backoff<<uint(retry) + time.Duration(rand.Int63n(int64(backoff)))
+	if wait > time.Second {
+		wait = time.Second
+	}
+
+	return wait
+}
+
+// hasErrorLabel reports whether err or an error wrapped by it has label.
+func hasErrorLabel(err error, label string) bool {
+	var labeledErr interface {
+		error
+		HasErrorLabel(string) bool
+	}
+
+	if errors.As(err, &labeledErr) {
+		return labeledErr.HasErrorLabel(label)
+	}
+
+	return false
+}
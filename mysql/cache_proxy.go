@@ -0,0 +1,518 @@
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the first keywords of the statements changing tables
+var writeKeywords = map[string]bool{
+	"insert":   true,
+	"replace":  true,
+	"update":   true,
+	"delete":   true,
+	"truncate": true,
+	"alter":    true,
+	"drop":     true,
+	"rename":   true,
+}
+
+// keywords followed by the tables of a write, FROM and JOIN included
+// as the tables of multiple-table UPDATE and DELETE
+var writeTableKeywords = map[string]bool{
+	"update":   true,
+	"from":     true,
+	"join":     true,
+	"table":    true,
+	"truncate": true,
+}
+
+// modifiers between the keywords and the tables
+var tableModifiers = map[string]bool{
+	"low_priority":  true,
+	"high_priority": true,
+	"delayed":       true,
+	"ignore":        true,
+	"quick":         true,
+	"if":            true,
+	"not":           true,
+	"exists":        true,
+	"only":          true,
+}
+
+type cacheKey struct{}
+
+// NewCacheContext returns a ctx whose SELECTs are cached by cacheProxy for ttl,
+// ttl <= 0 is "mysql_cache_ttl".
+func NewCacheContext(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheKey{}, ttl)
+}
+
+// cachedResult is the encoded memResult in CacheStore.
+type cachedResult struct {
+	Columns []string
+
+	Rows [][]interface{}
+}
+
+func init() {
+	gob.Register(time.Time{})
+}
+
+var (
+	defaultCacheStore     CacheStore
+	defaultCacheStoreOnce sync.Once
+)
+
+// cacheProxy caches the result sets of the SELECTs whose fingerprints are in "mysql_cache_fingerprints",
+// or which run with NewCacheContext, so gorm callers of GetCtxDb read them without changes.
+// A result set is cached by the versions of the tables it reads,
+// the writes through cacheProxy increase the versions of the tables they change.
+// The statements in the transactions of WithTx are not cached, their writes invalidate
+// the tables again after commit, so do the writes of gorm Create, Update and Delete.
+// Writes of prepared statements are not seen.
+// The store is a local LRU of "mysql_cache_size" shared by all cacheProxy, or redis if "mysql_cache_store" is redis,
+// the local LRU only sees the writes of this process.
+//  mysql_cache_ttl: 60
+//  mysql_cache_fingerprints: ['select * from `config` where (`name` = ?)']
+type cacheProxy struct {
+	name string
+
+	nextProxy SqlCommon
+
+	conf config.Config
+
+	logger log.Logger
+
+	store CacheStore
+
+	ttl time.Duration
+
+	fingerprints map[string]bool
+
+	labels *fingerprintSet
+
+	//builds *sql.Rows and *sql.Row of cached result sets
+	memDb *sql.DB
+}
+
+type CacheProxyOption func(c *cacheProxy)
+
+type CacheProxyOptions struct{}
+
+func NewCacheProxy(options ...CacheProxyOption) *cacheProxy {
+	cacheProxy := &cacheProxy{}
+
+	for _, option := range options {
+		option(cacheProxy)
+	}
+
+	if cacheProxy.conf == nil {
+		cacheProxy.conf = config.NewNullConfig()
+	}
+
+	if cacheProxy.logger == nil {
+		cacheProxy.logger = log.NewLogger()
+	}
+
+	if cacheProxy.store == nil {
+		cacheProxy.store = cacheProxy.defaultStore()
+	}
+
+	ttl := cacheProxy.conf.GetInt64("mysql_cache_ttl")
+	if ttl <= 0 {
+		ttl = 60
+	}
+	cacheProxy.ttl = time.Duration(ttl) * time.Second
+
+	cacheProxy.fingerprints = make(map[string]bool)
+	for _, query := range cacheProxy.conf.GetStringSlice("mysql_cache_fingerprints") {
+		cacheProxy.fingerprints[fingerprint(query)] = true
+	}
+
+	maxFingerprints := cacheProxy.conf.GetInt("mysql_max_fingerprints")
+	if maxFingerprints <= 0 {
+		maxFingerprints = 500
+	}
+	//shared by the proxies of all dbs, they have the same conf
+	mysqlCacheFingerprints.setMax(maxFingerprints)
+	cacheProxy.labels = mysqlCacheFingerprints
+
+	cacheProxy.memDb = newMemDb(nil)
+
+	cacheProxy.name = "cache_proxy"
+
+	return cacheProxy
+}
+
+func (CacheProxyOptions) WithConf(conf config.Config) CacheProxyOption {
+	return func(c *cacheProxy) {
+		c.conf = conf
+	}
+}
+
+func (CacheProxyOptions) WithLogger(logger log.Logger) CacheProxyOption {
+	return func(c *cacheProxy) {
+		c.logger = logger
+	}
+}
+
+// WithStore replaces the store of "mysql_cache_store".
+func (CacheProxyOptions) WithStore(store CacheStore) CacheProxyOption {
+	return func(c *cacheProxy) {
+		c.store = store
+	}
+}
+
+func (this *cacheProxy) defaultStore() CacheStore {
+	if this.conf.GetString("mysql_cache_store") == "redis" {
+		redisClientOptions := redis.RedisClientOptions{}
+		return NewRedisCacheStore(redis.NewRedisClient(
+			redisClientOptions.WithConf(this.conf),
+			redisClientOptions.WithLogger(this.logger),
+		))
+	}
+
+	defaultCacheStoreOnce.Do(func() {
+		size := this.conf.GetInt("mysql_cache_size")
+		if size <= 0 {
+			size = 10000
+		}
+		defaultCacheStore = NewLRUCacheStore(size)
+	})
+
+	return defaultCacheStore
+}
+
+//implement Proxy interface
+func (this *cacheProxy) NextProxy(db interface{}) {
+	this.nextProxy = db.(SqlCommon)
+}
+
+//implement Proxy interface
+func (this *cacheProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *cacheProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+func (this *cacheProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+func (this *cacheProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+func (this *cacheProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *cacheProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	result, err := this.nextProxy.ExecContext(ctx, query, args...)
+	if err == nil {
+		this.invalidate(ctx, query)
+	}
+
+	return result, err
+}
+
+func (this *cacheProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return this.nextProxy.PrepareContext(ctx, query)
+}
+
+func (this *cacheProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	result := this.cached(ctx, query, args)
+	if result == nil {
+		rows, err := this.nextProxy.QueryContext(ctx, query, args...)
+		if err == nil {
+			//INSERT ... RETURNING and the like
+			this.invalidate(ctx, query)
+		}
+		return rows, err
+	}
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return this.memDb.QueryContext(withMemResult(ctx, result), query)
+}
+
+func (this *cacheProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	result := this.cached(ctx, query, args)
+	if result == nil {
+		row := this.nextProxy.QueryRowContext(ctx, query, args...)
+		this.invalidate(ctx, query)
+		return row
+	}
+
+	return this.memDb.QueryRowContext(withMemResult(ctx, result), query)
+}
+
+func (this *cacheProxy) Close() error {
+	this.memDb.Close()
+	return this.nextProxy.Close()
+}
+
+func (this *cacheProxy) Begin() (*sql.Tx, error) {
+	return this.nextProxy.Begin()
+}
+
+func (this *cacheProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.nextProxy.BeginTx(ctx, opts)
+}
+
+// cacheTTL returns the ttl of query, false if it is not cached.
+func (this *cacheProxy) cacheTTL(ctx context.Context, fp string) (time.Duration, bool) {
+	if !strings.HasPrefix(fp, "select ") {
+		return 0, false
+	}
+
+	if ttl, ok := ctx.Value(cacheKey{}).(time.Duration); ok {
+		if ttl <= 0 {
+			ttl = this.ttl
+		}
+		return ttl, true
+	}
+
+	return this.ttl, this.fingerprints[fp]
+}
+
+// cached returns the result set of query from the store, or queries and stores it.
+// It returns nil if query is not cached.
+func (this *cacheProxy) cached(ctx context.Context, query string, args []interface{}) *memResult {
+	fp := fingerprint(query)
+	ttl, ok := this.cacheTTL(ctx, fp)
+	if !ok {
+		return nil
+	}
+
+	dbName := dbNameFromContext(ctx)
+	if txFromContext(ctx, dbName) != nil {
+		return nil
+	}
+
+	key, err := this.key(ctx, dbName, readTables(fp), query, args)
+	if err != nil {
+		this.logger.Errorc(ctx, "[mysql] cache %s : %s", query, err.Error())
+		return nil
+	}
+
+	lab := prometheus.Labels{"db": dbName, "sql": this.labels.label(query)}
+
+	value, err := this.store.Get(ctx, key)
+	if err != nil {
+		this.logger.Errorc(ctx, "[mysql] cache get %s : %s", query, err.Error())
+	} else if value != nil {
+		var cached cachedResult
+		if err = gob.NewDecoder(bytes.NewReader(value)).Decode(&cached); err == nil {
+			lab["result"] = "hit"
+			mysqlCacheTotal.With(lab).Inc()
+			return cached.memResult()
+		}
+		this.logger.Errorc(ctx, "[mysql] cache decode %s : %s", query, err.Error())
+	}
+
+	lab["result"] = "miss"
+	mysqlCacheTotal.With(lab).Inc()
+
+	rows, err := this.nextProxy.QueryContext(ctx, query, args...)
+	if err != nil {
+		return &memResult{err: err}
+	}
+
+	result := materializeRows(rows)
+	if result.err != nil {
+		return result
+	}
+
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(newCachedResult(result)); err != nil {
+		this.logger.Errorc(ctx, "[mysql] cache encode %s : %s", query, err.Error())
+		return result
+	}
+
+	if err = this.store.Set(ctx, key, buf.Bytes(), ttl); err != nil {
+		this.logger.Errorc(ctx, "[mysql] cache set %s : %s", query, err.Error())
+	}
+
+	return result
+}
+
+// key is the hash of query, args and the versions of tables.
+func (this *cacheProxy) key(ctx context.Context, dbName string, tables []string,
+	query string, args []interface{}) (string, error) {
+	versions, err := this.store.Versions(ctx, versionKeys(dbName, tables))
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\n%s\n", dbName, query)
+	for _, arg := range args {
+		fmt.Fprintf(hash, "%T:%v\n", arg, arg)
+	}
+	for k, table := range tables {
+		fmt.Fprintf(hash, "%s:%d\n", table, versions[k])
+	}
+
+	return dbName + ":" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// invalidate increases the versions of the tables query writes,
+// again after commit if it is in the transaction of WithTx.
+func (this *cacheProxy) invalidate(ctx context.Context, query string) {
+	tables := writeTables(fingerprint(query))
+	if len(tables) == 0 {
+		return
+	}
+
+	dbName := dbNameFromContext(ctx)
+	incr := func(ctx context.Context) {
+		if err := this.store.Incr(ctx, versionKeys(dbName, tables)); err != nil {
+			this.logger.Errorc(ctx, "[mysql] cache invalidate %v : %s", tables, err.Error())
+			return
+		}
+
+		for _, table := range tables {
+			mysqlCacheInvalidationTotal.With(prometheus.Labels{"db": dbName, "table": table}).Inc()
+		}
+	}
+
+	incr(ctx)
+	onCommit(ctx, dbName, func() {
+		incr(context.Background())
+	})
+}
+
+func versionKeys(dbName string, tables []string) []string {
+	keys := make([]string, len(tables))
+	for k, table := range tables {
+		keys[k] = dbName + "." + table
+	}
+
+	return keys
+}
+
+func newCachedResult(result *memResult) cachedResult {
+	cached := cachedResult{Columns: result.columns, Rows: make([][]interface{}, len(result.rows))}
+	for k, row := range result.rows {
+		cached.Rows[k] = make([]interface{}, len(row))
+		for i, value := range row {
+			cached.Rows[k][i] = value
+		}
+	}
+
+	return cached
+}
+
+func (this cachedResult) memResult() *memResult {
+	result := &memResult{columns: this.Columns, rows: make([][]driver.Value, len(this.Rows))}
+	for k, row := range this.Rows {
+		result.rows[k] = make([]driver.Value, len(row))
+		for i, value := range row {
+			result.rows[k][i] = value
+		}
+	}
+
+	return result
+}
+
+// readTables returns the distinct tables after FROM and JOIN of a fingerprint, subqueries included.
+func readTables(fp string) []string {
+	tokens := sqlTokens(fp)
+
+	var tables []string
+	for k, token := range tokens {
+		if token.text != "from" && token.text != "join" {
+			continue
+		}
+
+		for _, table := range fromTables(tokens, k) {
+			if !containsString(tables, table) {
+				tables = append(tables, table)
+			}
+		}
+	}
+
+	return tables
+}
+
+// writeTables returns the distinct tables a fingerprint may change, nil if it is not a write.
+// All tables of multiple-table UPDATE and DELETE are returned.
+func writeTables(fp string) []string {
+	var tables []string
+	addTable := func(table string) {
+		if !containsString(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+
+	for _, statement := range strings.Split(fp, ";") {
+		var tokens []sqlToken
+		for _, token := range sqlTokens(statement) {
+			if token.depth == 0 && token.text == "set" {
+				//the tables of UPDATE are before SET
+				break
+			}
+
+			if !tableModifiers[token.text] {
+				tokens = append(tokens, token)
+			}
+		}
+
+		if len(tokens) == 0 || !writeKeywords[tokens[0].text] {
+			continue
+		}
+
+		first := tokens[0].text
+		for k, token := range tokens {
+			if token.depth != 0 {
+				continue
+			}
+
+			switch {
+			case first == "rename":
+				if k > 0 && token.text != "table" && token.text != "to" && token.text != "," {
+					addTable(tableName(token.text))
+				}
+			case first == "insert" || first == "replace":
+				//tables after INTO, not the ones of INSERT ... SELECT
+				if token.text == "into" && k+1 < len(tokens) {
+					addTable(tableName(tokens[k+1].text))
+				}
+			case writeTableKeywords[token.text]:
+				next := fromTables(tokens, k)
+				if (first == "alter" || first == "truncate") && len(next) > 1 {
+					//ALTER TABLE t ADD a, ADD b
+					next = next[:1]
+				}
+
+				for _, table := range next {
+					if table != "table" {
+						addTable(table)
+					}
+				}
+			}
+		}
+	}
+
+	return tables
+}
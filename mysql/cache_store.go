@@ -0,0 +1,200 @@
+package mysql
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/jukylin/esim/redis"
+)
+
+// CacheStore keeps the result sets of cacheProxy and the versions of the tables,
+// the versions are parts of the cache keys, so increasing them invalidates the result sets.
+type CacheStore interface {
+	// Get returns nil if key is not found or expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Versions returns the versions of tables in order, 0 if a table is never written.
+	Versions(ctx context.Context, tables []string) ([]int64, error)
+
+	Incr(ctx context.Context, tables []string) error
+}
+
+type lruEntry struct {
+	key string
+
+	value []byte
+
+	expireAt time.Time
+}
+
+// lruCacheStore keeps at most size result sets in memory,
+// it only sees the writes of this process.
+type lruCacheStore struct {
+	lock sync.Mutex
+
+	size int
+
+	ll *list.List
+
+	entries map[string]*list.Element
+
+	versions map[string]int64
+}
+
+func NewLRUCacheStore(size int) CacheStore {
+	return &lruCacheStore{
+		size:     size,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+		versions: make(map[string]int64),
+	}
+}
+
+func (this *lruCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	elem, ok := this.entries[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expireAt) {
+		this.ll.Remove(elem)
+		delete(this.entries, key)
+		return nil, nil
+	}
+	this.ll.MoveToFront(elem)
+
+	return entry.value, nil
+}
+
+func (this *lruCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	expireAt := time.Now().Add(ttl)
+	if elem, ok := this.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expireAt = expireAt
+		this.ll.MoveToFront(elem)
+		return nil
+	}
+
+	this.entries[key] = this.ll.PushFront(&lruEntry{key: key, value: value, expireAt: expireAt})
+	for this.ll.Len() > this.size {
+		oldest := this.ll.Back()
+		this.ll.Remove(oldest)
+		delete(this.entries, oldest.Value.(*lruEntry).key)
+	}
+
+	return nil
+}
+
+func (this *lruCacheStore) Versions(ctx context.Context, tables []string) ([]int64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	versions := make([]int64, len(tables))
+	for k, table := range tables {
+		versions[k] = this.versions[table]
+	}
+
+	return versions, nil
+}
+
+func (this *lruCacheStore) Incr(ctx context.Context, tables []string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, table := range tables {
+		this.versions[table]++
+	}
+
+	return nil
+}
+
+const redisCachePrefix = "mysql_cache:"
+
+// redisCacheStore shares the result sets and the versions between processes,
+// the result sets expire by the ttl of redis.
+type redisCacheStore struct {
+	client *redis.RedisClient
+}
+
+func NewRedisCacheStore(client *redis.RedisClient) CacheStore {
+	return &redisCacheStore{client: client}
+}
+
+func (this *redisCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	value, err := redigo.Bytes(conn.Do(ctx, "GET", redisCachePrefix+key))
+	if err == redigo.ErrNil {
+		return nil, nil
+	}
+
+	return value, err
+}
+
+func (this *redisCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	_, err := conn.Do(ctx, "SET", redisCachePrefix+key, value, "PX", int64(ttl/time.Millisecond))
+
+	return err
+}
+
+func (this *redisCacheStore) Versions(ctx context.Context, tables []string) ([]int64, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	args := make([]interface{}, len(tables))
+	for k, table := range tables {
+		args[k] = redisCachePrefix + "version:" + table
+	}
+
+	replies, err := redigo.Values(conn.Do(ctx, "MGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int64, len(tables))
+	for k, reply := range replies {
+		if reply == nil {
+			continue
+		}
+
+		if versions[k], err = redigo.Int64(reply, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+func (this *redisCacheStore) Incr(ctx context.Context, tables []string) error {
+	conn := this.client.GetCtxRedisConn()
+	defer conn.Close()
+
+	for _, table := range tables {
+		if _, err := conn.Do(ctx, "INCR", redisCachePrefix+"version:"+table); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
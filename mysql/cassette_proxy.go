@@ -0,0 +1,291 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
+)
+
+const cassetteKind = "mysql"
+
+// cassetteProxy records statements to a cassette or replays them from it,
+// the mode is chosen by "cassette_mode", put it last so the other proxies still run.
+// Prepared statements don't pass the proxy and are not recorded.
+type cassetteProxy struct {
+	name string
+
+	nextProxy SqlCommon
+
+	conf config.Config
+
+	logger log.Logger
+
+	cassette *cassette.Cassette
+
+	//builds *sql.Rows and *sql.Row from recorded results
+	memDb *sql.DB
+}
+
+// sqlCassette is the recorded response of a statement.
+type sqlCassette struct {
+	Columns []string `json:"columns,omitempty"`
+
+	Rows [][]cassette.Value `json:"rows,omitempty"`
+
+	LastInsertId int64 `json:"last_insert_id,omitempty"`
+
+	RowsAffected int64 `json:"rows_affected,omitempty"`
+}
+
+type CassetteProxyOption func(c *cassetteProxy)
+
+type CassetteProxyOptions struct{}
+
+func NewCassetteProxy(options ...CassetteProxyOption) *cassetteProxy {
+	cassetteProxy := &cassetteProxy{}
+
+	for _, option := range options {
+		option(cassetteProxy)
+	}
+
+	if cassetteProxy.conf == nil {
+		cassetteProxy.conf = config.NewNullConfig()
+	}
+
+	if cassetteProxy.logger == nil {
+		cassetteProxy.logger = log.NewLogger()
+	}
+
+	if cassetteProxy.cassette == nil {
+		cas, err := cassette.OpenWithConf(cassetteProxy.conf)
+		if err != nil {
+			cassetteProxy.logger.Panicf("[mysql] open cassette error : %s", err.Error())
+		}
+		cassetteProxy.cassette = cas
+	}
+
+	cassetteProxy.memDb = newMemDb(cassetteProxy.resolve)
+
+	cassetteProxy.name = "cassette_proxy"
+
+	return cassetteProxy
+}
+
+func (CassetteProxyOptions) WithConf(conf config.Config) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.conf = conf
+	}
+}
+
+func (CassetteProxyOptions) WithLogger(logger log.Logger) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.logger = logger
+	}
+}
+
+func (CassetteProxyOptions) WithCassette(cas *cassette.Cassette) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.cassette = cas
+	}
+}
+
+//implement Proxy interface
+func (this *cassetteProxy) NextProxy(db interface{}) {
+	this.nextProxy = db.(SqlCommon)
+}
+
+//implement Proxy interface
+func (this *cassetteProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *cassetteProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+func (this *cassetteProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+func (this *cassetteProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+func (this *cassetteProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *cassetteProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if this.cassette == nil {
+		return this.nextProxy.ExecContext(ctx, query, args...)
+	}
+
+	if this.isReplay() {
+		return this.memDb.ExecContext(ctx, query, args...)
+	}
+
+	result, err := this.nextProxy.ExecContext(ctx, query, args...)
+
+	recorded := sqlCassette{}
+	if err == nil {
+		recorded.LastInsertId, _ = result.LastInsertId()
+		recorded.RowsAffected, _ = result.RowsAffected()
+	}
+	this.record(query, args, recorded, err)
+
+	return result, err
+}
+
+func (this *cassetteProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if this.isReplay() {
+		return this.memDb.PrepareContext(ctx, query)
+	}
+
+	return this.nextProxy.PrepareContext(ctx, query)
+}
+
+func (this *cassetteProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if this.cassette == nil {
+		return this.nextProxy.QueryContext(ctx, query, args...)
+	}
+
+	if this.isReplay() {
+		return this.memDb.QueryContext(ctx, query, args...)
+	}
+
+	result := this.recordQuery(ctx, query, args)
+
+	return this.memDb.QueryContext(withMemResult(ctx, result), query, args...)
+}
+
+func (this *cassetteProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if this.cassette == nil {
+		return this.nextProxy.QueryRowContext(ctx, query, args...)
+	}
+
+	if this.isReplay() {
+		return this.memDb.QueryRowContext(ctx, query, args...)
+	}
+
+	//*sql.Row can't be read without scanning, so record it by Query
+	result := this.recordQuery(ctx, query, args)
+
+	return this.memDb.QueryRowContext(withMemResult(ctx, result), query, args...)
+}
+
+func (this *cassetteProxy) Close() error {
+	this.memDb.Close()
+	return this.nextProxy.Close()
+}
+
+func (this *cassetteProxy) Begin() (*sql.Tx, error) {
+	if this.isReplay() {
+		return this.memDb.Begin()
+	}
+
+	return this.nextProxy.Begin()
+}
+
+func (this *cassetteProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if this.isReplay() {
+		return this.memDb.BeginTx(ctx, opts)
+	}
+
+	return this.nextProxy.BeginTx(ctx, opts)
+}
+
+func (this *cassetteProxy) isReplay() bool {
+	return this.cassette != nil && this.cassette.Mode() == cassette.ModeReplay
+}
+
+func (this *cassetteProxy) recordQuery(ctx context.Context, query string, args []interface{}) *memResult {
+	rows, err := this.nextProxy.QueryContext(ctx, query, args...)
+	if err != nil {
+		this.record(query, args, sqlCassette{}, err)
+		return &memResult{err: err}
+	}
+
+	result := materializeRows(rows)
+
+	recorded := sqlCassette{Columns: result.columns}
+	for _, row := range result.rows {
+		values := make([]cassette.Value, len(row))
+		for k, value := range row {
+			v, err := cassette.EncodeValue(value)
+			if err != nil {
+				//the rows can't be replayed
+				err = fmt.Errorf("mysql: record %s : %s", query, err.Error())
+				this.logger.Errorf("[mysql] %s", err.Error())
+				return &memResult{err: err}
+			}
+			values[k] = v
+		}
+		recorded.Rows = append(recorded.Rows, values)
+	}
+	this.record(query, args, recorded, result.err)
+
+	return result
+}
+
+func (this *cassetteProxy) record(query string, args []interface{}, recorded sqlCassette, err error) {
+	request := cassetteRequest(query, driverValues(args))
+	recErr := this.cassette.Record(cassetteKind, request, recorded, err)
+	if recErr != nil {
+		this.logger.Errorf("[mysql] record %s error : %s", request, recErr.Error())
+	}
+}
+
+// resolve answers the statements of memDb in replay mode.
+func (this *cassetteProxy) resolve(query string, args []driver.Value) *memResult {
+	request := cassetteRequest(query, args)
+
+	recorded := sqlCassette{}
+	err := this.cassette.Replay(cassetteKind, request, &recorded)
+	if errors.Is(err, cassette.ErrUnmatched) {
+		this.logger.Errorf("[mysql] %s", err.Error())
+	}
+
+	result := &memResult{
+		columns:      recorded.Columns,
+		lastInsertId: recorded.LastInsertId,
+		rowsAffected: recorded.RowsAffected,
+		err:          err,
+	}
+
+	for _, values := range recorded.Rows {
+		row := make([]driver.Value, len(values))
+		for k, value := range values {
+			v, decErr := cassette.DecodeValue(value, nil)
+			if decErr != nil {
+				result.err = decErr
+				return result
+			}
+			row[k] = v
+		}
+		result.rows = append(result.rows, row)
+	}
+
+	return result
+}
+
+func cassetteRequest(query string, args []driver.Value) string {
+	request := query
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case []byte:
+			arg = string(v)
+		case time.Time:
+			arg = v.Format(time.RFC3339Nano)
+		}
+		request += fmt.Sprintf(" %q", fmt.Sprint(arg))
+	}
+
+	return request
+}
@@ -0,0 +1,258 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sync"
+)
+
+// gorm runs Create, Update and Delete in a *sql.Tx of its own and sends the statements
+// to it directly. The *sql.Tx of chainDb sends them back to the proxy chain with
+// the transaction in ctx, so they pass all proxies like the statements of WithTx.
+
+var chainDbOnce sync.Once
+
+var sharedChainDb *sql.DB
+
+type chainKey struct{}
+
+// chainDb returns the *sql.DB of the chain driver, shared by all dbs,
+// the proxy chain and ctx come with the ctx of BeginTx.
+func chainDb() *sql.DB {
+	chainDbOnce.Do(func() {
+		sharedChainDb = sql.OpenDB(&chainConnector{})
+	})
+
+	return sharedChainDb
+}
+
+// beginChainTx starts a transaction of the proxy chain with ctx, see ctxDb.Begin.
+func beginChainTx(ctx context.Context, chain SqlCommon, opts *sql.TxOptions) (*sql.Tx, error) {
+	return chainDb().BeginTx(context.WithValue(ctx, chainKey{}, chain), opts)
+}
+
+type chainConnector struct{}
+
+func (this *chainConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &chainConn{}, nil
+}
+
+func (this *chainConnector) Driver() driver.Driver {
+	return chainDriver{}
+}
+
+type chainDriver struct{}
+
+func (chainDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("mysql: chain driver must be opened by connector")
+}
+
+// chainConn is used by one transaction at a time, the fields are set by BeginTx.
+type chainConn struct {
+	chain SqlCommon
+
+	//carries the transaction
+	ctx context.Context
+
+	//nil if the transaction of WithTx is joined
+	ctxTx *ctxTx
+}
+
+func (this *chainConn) Prepare(query string) (driver.Stmt, error) {
+	return &chainStmt{conn: this, query: query}, nil
+}
+
+func (this *chainConn) Close() error {
+	return nil
+}
+
+func (this *chainConn) Begin() (driver.Tx, error) {
+	return this.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (this *chainConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	chain, ok := ctx.Value(chainKey{}).(SqlCommon)
+	if !ok {
+		return nil, errors.New("mysql: chain driver must be begun by ctxDb")
+	}
+	this.chain = chain
+
+	dbName := dbNameFromContext(ctx)
+	if ctxTxFromContext(ctx, dbName) != nil {
+		this.ctx = ctx
+		return &chainTx{conn: this}, nil
+	}
+
+	tx, err := chain.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.IsolationLevel(opts.Isolation),
+		ReadOnly:  opts.ReadOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	this.ctx, this.ctxTx = contextWithTx(ctx, dbName, tx)
+
+	return &chainTx{conn: this}, nil
+}
+
+//implement driver.NamedValueChecker interface, the args are converted by the driver of the chain
+func (this *chainConn) CheckNamedValue(arg *driver.NamedValue) error {
+	return nil
+}
+
+func (this *chainConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	return this.exec(query, namedArgs(args))
+}
+
+func (this *chainConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	return this.query(query, namedArgs(args))
+}
+
+// exec runs with the ctx of BeginTx, gorm calls the methods of *sql.Tx without context.
+func (this *chainConn) exec(query string, args []interface{}) (driver.Result, error) {
+	if this.ctx == nil {
+		return nil, driver.ErrBadConn
+	}
+
+	return this.chain.ExecContext(this.ctx, query, args...)
+}
+
+func (this *chainConn) query(query string, args []interface{}) (driver.Rows, error) {
+	if this.ctx == nil {
+		return nil, driver.ErrBadConn
+	}
+
+	rows, err := this.chain.QueryContext(this.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return nil, err
+	}
+
+	return &chainRows{rows: rows, columns: columns}, nil
+}
+
+func (this *chainConn) reset() {
+	this.chain = nil
+	this.ctx = nil
+	this.ctxTx = nil
+}
+
+// chainTx commits the transaction it has started,
+// the joined transaction of WithTx is committed or rolled back by WithTx.
+type chainTx struct {
+	conn *chainConn
+}
+
+func (this *chainTx) Commit() error {
+	ctxTx := this.conn.ctxTx
+	this.conn.reset()
+	if ctxTx == nil {
+		return nil
+	}
+
+	if err := ctxTx.tx.Commit(); err != nil {
+		return err
+	}
+	ctxTx.committed()
+
+	return nil
+}
+
+func (this *chainTx) Rollback() error {
+	ctxTx := this.conn.ctxTx
+	this.conn.reset()
+	if ctxTx == nil {
+		return nil
+	}
+
+	return ctxTx.tx.Rollback()
+}
+
+type chainStmt struct {
+	conn *chainConn
+
+	query string
+}
+
+func (this *chainStmt) Close() error {
+	return nil
+}
+
+func (this *chainStmt) NumInput() int {
+	return -1
+}
+
+func (this *chainStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return this.conn.exec(this.query, valueArgs(args))
+}
+
+func (this *chainStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return this.conn.query(this.query, valueArgs(args))
+}
+
+type chainRows struct {
+	rows *sql.Rows
+
+	columns []string
+}
+
+func (this *chainRows) Columns() []string {
+	return this.columns
+}
+
+func (this *chainRows) Close() error {
+	return this.rows.Close()
+}
+
+func (this *chainRows) Next(dest []driver.Value) error {
+	if !this.rows.Next() {
+		if err := this.rows.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+
+	values := make([]interface{}, len(dest))
+	scanDest := make([]interface{}, len(dest))
+	for k := range values {
+		scanDest[k] = &values[k]
+	}
+
+	if err := this.rows.Scan(scanDest...); err != nil {
+		return err
+	}
+
+	for k, value := range values {
+		dest[k] = value
+	}
+
+	return nil
+}
+
+func namedArgs(args []driver.NamedValue) []interface{} {
+	values := make([]interface{}, len(args))
+	for k, arg := range args {
+		values[k] = arg.Value
+	}
+
+	return values
+}
+
+func valueArgs(args []driver.Value) []interface{} {
+	values := make([]interface{}, len(args))
+	for k, arg := range args {
+		values[k] = arg
+	}
+
+	return values
+}
@@ -0,0 +1,69 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+)
+
+type dbNameKey struct{}
+
+func contextWithDbName(ctx context.Context, dbName string) context.Context {
+	return context.WithValue(ctx, dbNameKey{}, dbName)
+}
+
+func dbNameFromContext(ctx context.Context) string {
+	dbName, _ := ctx.Value(dbNameKey{}).(string)
+	return dbName
+}
+
+// ctxDb binds ctx to the proxy chain, gorm only calls the methods without context,
+// so they are turned into the context ones.
+type ctxDb struct {
+	ctx context.Context
+
+	db SqlCommon
+}
+
+func newCtxDb(ctx context.Context, dbName string, db SqlCommon) *ctxDb {
+	return &ctxDb{
+		ctx: contextWithDbName(ctx, dbName),
+		db:  db,
+	}
+}
+
+//implement gorm.SQLCommon interface
+func (this *ctxDb) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.db.ExecContext(this.ctx, query, args...)
+}
+
+//implement gorm.SQLCommon interface
+func (this *ctxDb) Prepare(query string) (*sql.Stmt, error) {
+	return this.db.PrepareContext(this.ctx, query)
+}
+
+//implement gorm.SQLCommon interface
+func (this *ctxDb) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.db.QueryContext(this.ctx, query, args...)
+}
+
+//implement gorm.SQLCommon interface
+func (this *ctxDb) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.db.QueryRowContext(this.ctx, query, args...)
+}
+
+// Begin starts a transaction whose statements pass the proxy chain with ctx,
+// gorm calls it for Create, Update and Delete. In a transaction of WithTx it joins that one,
+// Commit and Rollback do nothing then, WithTx decides by the error of fn.
+func (this *ctxDb) Begin() (*sql.Tx, error) {
+	return beginChainTx(this.ctx, this.db, nil)
+}
+
+// BeginTx is Begin with opts, it runs with the ctx of GetCtxDb, not ctx.
+func (this *ctxDb) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return beginChainTx(this.ctx, this.db, opts)
+}
+
+// Close does nothing, the db is shared by all contexts and closed by MysqlClient.
+func (this *ctxDb) Close() error {
+	return nil
+}
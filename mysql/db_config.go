@@ -0,0 +1,195 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/jukylin/esim/config"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+const defaultCharset = "utf8mb4"
+
+// NoProxy in DbConfig.Proxies or ReplicaConfig.Proxies turns off the proxies,
+// an empty list in the config file is the same as not set.
+const NoProxy = "none"
+
+// DbConfig is an entry of "dbs". The connection is Dsn, or the structured fields if Dsn is empty.
+// Durations are strings with units like "500ms" and "1h", bare numbers are seconds.
+//  dbs:
+//  - {db: 'test', host: '0.0.0.0', port: 3306, user: 'root', password: '123456', database: 'test',
+//     connecttimeout: '1s', maxlifetime: '1h', proxies: ['monitor_proxy', 'guard_proxy'],
+//     replicas: [{host: '0.0.0.0', port: 3307, proxies: ['monitor_proxy']}]}
+type DbConfig struct {
+	Db string `json:"db" yaml:"db"`
+	//mysql, postgres, pgx or sqlite3, default mysql, see DriverMysql
+	Driver string `json:"driver" yaml:"driver"`
+	Dsn    string `json:"dns" yaml:"dsn"`
+
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port" yaml:"port"`
+	User     string `json:"user" yaml:"user"`
+	Password string `json:"password" yaml:"password"`
+	//the file of sqlite3
+	Database string `json:"database" yaml:"database"`
+	//default utf8mb4
+	Charset        string        `json:"charset" yaml:"charset"`
+	ConnectTimeout time.Duration `json:"connect_timeout" yaml:"connecttimeout"`
+	ReadTimeout    time.Duration `json:"read_timeout" yaml:"readtimeout"`
+	WriteTimeout   time.Duration `json:"write_timeout" yaml:"writetimeout"`
+	//true, false, skip-verify, preferred or a profile of "mysql_tls_profiles"
+	TLS string `json:"tls" yaml:"tls"`
+
+	MaxIdle     int           `json:"max_idle" yaml:"maxidle"`
+	MaxOpen     int           `json:"max_open" yaml:"maxopen"`
+	MaxLifetime time.Duration `json:"max_lifetime" yaml:"maxlifetime"`
+
+	//reads go to the replicas, see rwRouter
+	Replicas []ReplicaConfig `json:"replicas" yaml:"replicas"`
+	//round_robin or least_conn, default round_robin
+	Balance string `json:"balance" yaml:"balance"`
+	//replicas lagging behind more are not read, 0 is no limit
+	MaxReplicaLag time.Duration `json:"max_replica_lag" yaml:"maxreplicalag"`
+
+	//names of the proxies, see MysqlClientOptions.WithNamedProxy,
+	//MysqlClientOptions.WithProxy is used if it is not set, see NoProxy
+	Proxies []string `json:"proxies" yaml:"proxies"`
+}
+
+// ReplicaConfig is a replica of DbConfig, it connects with Dsn, or with
+// Host and Port and the other fields of the master if Dsn is empty.
+// The pool and the proxies of a replica are the same as the master if not set.
+type ReplicaConfig struct {
+	Dsn  string `json:"dsn" yaml:"dsn"`
+	Host string `json:"host" yaml:"host"`
+	Port int    `json:"port" yaml:"port"`
+
+	MaxIdle     int           `json:"max_idle" yaml:"maxidle"`
+	MaxOpen     int           `json:"max_open" yaml:"maxopen"`
+	MaxLifetime time.Duration `json:"max_lifetime" yaml:"maxlifetime"`
+
+	Proxies []string `json:"proxies" yaml:"proxies"`
+}
+
+// TLSProfile is an entry of "mysql_tls_profiles", the files are PEM encoded.
+//  mysql_tls_profiles:
+//    internal: {ca: '/etc/mysql/ca.pem', cert: '/etc/mysql/client.pem', key: '/etc/mysql/client.key'}
+type TLSProfile struct {
+	CA         string `json:"ca" yaml:"ca"`
+	Cert       string `json:"cert" yaml:"cert"`
+	Key        string `json:"key" yaml:"key"`
+	ServerName string `json:"server_name" yaml:"servername"`
+	SkipVerify bool   `json:"skip_verify" yaml:"skipverify"`
+}
+
+// LoadDbConfigs reads "dbs" of conf.
+func LoadDbConfigs(conf config.Config) ([]DbConfig, error) {
+	dbConfigs := []DbConfig{}
+	err := conf.UnmarshalKey("dbs", &dbConfigs, viper.DecodeHook(
+		mapstructure.ComposeDecodeHookFunc(
+			durationHook,
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	))
+
+	return dbConfigs, err
+}
+
+// durationHook decodes durations from strings with units, bare numbers are seconds.
+func durationHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if to != reflect.TypeOf(time.Duration(0)) {
+		return data, nil
+	}
+
+	value := reflect.ValueOf(data)
+	switch value.Kind() {
+	case reflect.String:
+		if seconds, err := strconv.ParseFloat(value.String(), 64); err == nil {
+			return time.Duration(seconds * float64(time.Second)), nil
+		}
+		return time.ParseDuration(value.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return time.Duration(value.Int()) * time.Second, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return time.Duration(value.Uint()) * time.Second, nil
+	case reflect.Float32, reflect.Float64:
+		return time.Duration(value.Float() * float64(time.Second)), nil
+	}
+
+	return data, nil
+}
+
+// DSN returns Dsn, or the dsn of the structured fields.
+// The dsn of mysql parses time in local time like the generated dsn.
+func (this DbConfig) DSN() (string, error) {
+	if this.Dsn != "" {
+		return this.Dsn, nil
+	}
+
+	dialect, err := newDialect(this.Driver)
+	if err != nil {
+		return "", err
+	}
+
+	return dialect.dsn(this, nil)
+}
+
+// DSN returns Dsn, or the dsn of master with Host and Port.
+func (this ReplicaConfig) DSN(master DbConfig) (string, error) {
+	if this.Dsn != "" {
+		return this.Dsn, nil
+	}
+
+	if this.Host == "" {
+		return "", errors.New("mysql: replica of " + master.Db + " needs dsn or host")
+	}
+
+	dialect, err := newDialect(master.Driver)
+	if err != nil {
+		return "", err
+	}
+
+	return dialect.dsn(master, &this)
+}
+
+// RegisterTLSProfile makes name usable in DbConfig.TLS.
+func RegisterTLSProfile(name string, profile TLSProfile) error {
+	tlsProfilesLock.Lock()
+	tlsProfiles[name] = profile
+	tlsProfilesLock.Unlock()
+
+	tlsConfig := &tls.Config{
+		ServerName:         profile.ServerName,
+		InsecureSkipVerify: profile.SkipVerify,
+	}
+
+	if profile.CA != "" {
+		pem, err := ioutil.ReadFile(profile.CA)
+		if err != nil {
+			return err
+		}
+
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("mysql: no certificate in " + profile.CA)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if profile.Cert != "" || profile.Key != "" {
+		cert, err := tls.LoadX509KeyPair(profile.Cert, profile.Key)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return mysqlDriver.RegisterTLSConfig(name, tlsConfig)
+}
@@ -0,0 +1,431 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mysqlDriver "github.com/go-sql-driver/mysql"
+)
+
+// drivers of DbConfig.Driver, only the mysql driver is imported by this package,
+// import the others in main, like _ "github.com/lib/pq" or _ "github.com/mattn/go-sqlite3".
+const (
+	DriverMysql = "mysql"
+
+	//github.com/lib/pq
+	DriverPostgres = "postgres"
+
+	//github.com/jackc/pgx/stdlib
+	DriverPgx = "pgx"
+
+	//github.com/mattn/go-sqlite3
+	DriverSqlite = "sqlite3"
+)
+
+const (
+	erDeadlock = 1213
+
+	erLockWaitTimeout = 1205
+
+	//serialization_failure and deadlock_detected
+	pgSerializationFailure = "40001"
+
+	pgDeadlockDetected = "40P01"
+
+	//SQLITE_BUSY and SQLITE_LOCKED
+	sqliteBusy = "5"
+
+	sqliteLocked = "6"
+)
+
+var (
+	tlsProfilesLock sync.RWMutex
+
+	//profiles registered by RegisterTLSProfile, used by postgres
+	tlsProfiles = make(map[string]TLSProfile)
+)
+
+// dialect is what differs between databases,
+// the proxy chain, the router, transactions and stats are the same for all.
+type dialect interface {
+	//name of the database/sql driver
+	driverName() string
+
+	//name of the gorm dialect
+	gormDialect() string
+
+	//dsn builds the dsn of the structured fields of dbConfig,
+	//or of replica with the other fields of dbConfig.
+	dsn(dbConfig DbConfig, replica *ReplicaConfig) (string, error)
+
+	//addr returns host:port of dsn, or ""
+	addr(dsn string) string
+
+	//replicaLag returns how far db is behind master, 0 if db is not a replica.
+	replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error)
+
+	//isServerErr reports whether err is returned by the server for a statement,
+	//rather than by the connection.
+	isServerErr(err error) bool
+
+	//isRetryableErr reports whether a transaction failed by err can be run again,
+	//like deadlocks.
+	isRetryableErr(err error) bool
+}
+
+func newDialect(driver string) (dialect, error) {
+	switch driver {
+	case "", DriverMysql:
+		return mysqlDialect{}, nil
+	case DriverPostgres, DriverPgx:
+		return postgresDialect{driver: driver}, nil
+	case DriverSqlite:
+		return sqliteDialect{}, nil
+	default:
+		return nil, fmt.Errorf("mysql: unknown driver %s", driver)
+	}
+}
+
+// errCode returns the SQLSTATE or the Code field of the driver error in the chain of err,
+// so the drivers needn't be imported.
+func errCode(err error) (string, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if stater, ok := err.(interface{ SQLState() string }); ok {
+			return stater.SQLState(), true
+		}
+
+		value := reflect.Indirect(reflect.ValueOf(err))
+		if value.Kind() != reflect.Struct {
+			continue
+		}
+
+		code := value.FieldByName("Code")
+		switch code.Kind() {
+		case reflect.String:
+			return code.String(), true
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return strconv.FormatInt(code.Int(), 10), true
+		}
+	}
+
+	return "", false
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) driverName() string {
+	return DriverMysql
+}
+
+func (mysqlDialect) gormDialect() string {
+	return "mysql"
+}
+
+func (mysqlDialect) dsn(dbConfig DbConfig, replica *ReplicaConfig) (string, error) {
+	var driverConfig *mysqlDriver.Config
+	var err error
+	if dbConfig.Dsn != "" {
+		driverConfig, err = mysqlDriver.ParseDSN(dbConfig.Dsn)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if dbConfig.Host == "" {
+			return "", errors.New("mysql: " + dbConfig.Db + " needs dsn or host")
+		}
+
+		charset := dbConfig.Charset
+		if charset == "" {
+			charset = defaultCharset
+		}
+
+		driverConfig = mysqlDriver.NewConfig()
+		driverConfig.User = dbConfig.User
+		driverConfig.Passwd = dbConfig.Password
+		driverConfig.Net = "tcp"
+		driverConfig.Addr = net.JoinHostPort(dbConfig.Host, strconv.Itoa(defaultPort(dbConfig.Port, 3306)))
+		driverConfig.DBName = dbConfig.Database
+		driverConfig.Timeout = dbConfig.ConnectTimeout
+		driverConfig.ReadTimeout = dbConfig.ReadTimeout
+		driverConfig.WriteTimeout = dbConfig.WriteTimeout
+		driverConfig.TLSConfig = dbConfig.TLS
+		driverConfig.Params = map[string]string{"charset": charset}
+		driverConfig.ParseTime = true
+		driverConfig.Loc = time.Local
+	}
+
+	if replica != nil {
+		driverConfig.Addr = net.JoinHostPort(replica.Host, strconv.Itoa(defaultPort(replica.Port, 3306)))
+	}
+
+	return driverConfig.FormatDSN(), nil
+}
+
+func (mysqlDialect) addr(dsn string) string {
+	cfg, err := mysqlDriver.ParseDSN(dsn)
+	if err != nil {
+		return ""
+	}
+
+	return cfg.Addr
+}
+
+// replicaLag returns Seconds_Behind_Master of db.
+func (mysqlDialect) replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	rows, err := db.QueryContext(ctx, "SHOW SLAVE STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, rows.Err()
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for k := range values {
+		dest[k] = &values[k]
+	}
+
+	if err = rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for k, column := range columns {
+		if column != "Seconds_Behind_Master" {
+			continue
+		}
+
+		//NULL if the replication is stopped
+		if values[k] == nil {
+			return 0, errors.New("replication is not running")
+		}
+
+		seconds, err := strconv.ParseInt(string(values[k]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	return 0, nil
+}
+
+func (mysqlDialect) isServerErr(err error) bool {
+	var mysqlErr *mysqlDriver.MySQLError
+	return errors.As(err, &mysqlErr)
+}
+
+// isRetryableErr reports whether err is a deadlock or lock wait timeout.
+func (mysqlDialect) isRetryableErr(err error) bool {
+	var mysqlErr *mysqlDriver.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == erDeadlock || mysqlErr.Number == erLockWaitTimeout
+	}
+
+	return false
+}
+
+type postgresDialect struct {
+	driver string
+}
+
+func (this postgresDialect) driverName() string {
+	return this.driver
+}
+
+func (postgresDialect) gormDialect() string {
+	return "postgres"
+}
+
+// dsn builds the key/value form, ReadTimeout, WriteTimeout and Charset are not supported.
+// TLS is sslmode, true is verify-full, skip-verify is require, preferred is prefer,
+// a profile of RegisterTLSProfile sets the certificates, other values are sslmode as they are.
+func (postgresDialect) dsn(dbConfig DbConfig, replica *ReplicaConfig) (string, error) {
+	var params []string
+	addParam := func(key, value string) {
+		if value != "" {
+			params = append(params, key+"="+pgQuote(value))
+		}
+	}
+
+	if dbConfig.Dsn != "" {
+		if strings.Contains(dbConfig.Dsn, "://") {
+			return "", errors.New("mysql: replica of " + dbConfig.Db + " needs dsn with a url dsn of master")
+		}
+		params = append(params, dbConfig.Dsn)
+	} else {
+		if dbConfig.Host == "" {
+			return "", errors.New("mysql: " + dbConfig.Db + " needs dsn or host")
+		}
+
+		addParam("host", dbConfig.Host)
+		addParam("port", strconv.Itoa(defaultPort(dbConfig.Port, 5432)))
+		addParam("user", dbConfig.User)
+		addParam("password", dbConfig.Password)
+		addParam("dbname", dbConfig.Database)
+		if dbConfig.ConnectTimeout > 0 {
+			addParam("connect_timeout", strconv.Itoa(int(math.Ceil(dbConfig.ConnectTimeout.Seconds()))))
+		}
+
+		tlsProfilesLock.RLock()
+		profile, ok := tlsProfiles[dbConfig.TLS]
+		tlsProfilesLock.RUnlock()
+		switch {
+		case ok:
+			if profile.SkipVerify {
+				addParam("sslmode", "require")
+			} else {
+				addParam("sslmode", "verify-full")
+			}
+			addParam("sslrootcert", profile.CA)
+			addParam("sslcert", profile.Cert)
+			addParam("sslkey", profile.Key)
+		case dbConfig.TLS == "true":
+			addParam("sslmode", "verify-full")
+		case dbConfig.TLS == "skip-verify":
+			addParam("sslmode", "require")
+		case dbConfig.TLS == "preferred":
+			addParam("sslmode", "prefer")
+		case dbConfig.TLS == "false":
+			addParam("sslmode", "disable")
+		default:
+			addParam("sslmode", dbConfig.TLS)
+		}
+	}
+
+	//the later ones win
+	if replica != nil {
+		addParam("host", replica.Host)
+		addParam("port", strconv.Itoa(defaultPort(replica.Port, 5432)))
+	}
+
+	return strings.Join(params, " "), nil
+}
+
+func (postgresDialect) addr(dsn string) string {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return ""
+		}
+		return u.Host
+	}
+
+	var host, port string
+	for _, field := range strings.Fields(dsn) {
+		switch {
+		case strings.HasPrefix(field, "host="):
+			host = strings.Trim(field[len("host="):], "'")
+		case strings.HasPrefix(field, "port="):
+			port = strings.Trim(field[len("port="):], "'")
+		}
+	}
+
+	if host == "" {
+		return ""
+	}
+
+	if port == "" {
+		port = "5432"
+	}
+
+	return net.JoinHostPort(host, port)
+}
+
+// replicaLag returns the time since the last replayed transaction of a standby.
+func (postgresDialect) replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	var seconds float64
+	err := db.QueryRowContext(ctx, "SELECT CASE WHEN pg_is_in_recovery() THEN "+
+		"COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) ELSE 0 END").Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+func (postgresDialect) isServerErr(err error) bool {
+	_, ok := errCode(err)
+	return ok
+}
+
+func (postgresDialect) isRetryableErr(err error) bool {
+	code, _ := errCode(err)
+	return code == pgSerializationFailure || code == pgDeadlockDetected
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string {
+	return DriverSqlite
+}
+
+func (sqliteDialect) gormDialect() string {
+	return "sqlite3"
+}
+
+// dsn is Database, the file name, there are no replicas.
+func (sqliteDialect) dsn(dbConfig DbConfig, replica *ReplicaConfig) (string, error) {
+	if replica != nil {
+		return "", errors.New("mysql: sqlite3 " + dbConfig.Db + " has no replicas")
+	}
+
+	if dbConfig.Database == "" {
+		return "", errors.New("mysql: " + dbConfig.Db + " needs dsn or database")
+	}
+
+	return dbConfig.Database, nil
+}
+
+func (sqliteDialect) addr(dsn string) string {
+	return ""
+}
+
+func (sqliteDialect) replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	return 0, db.PingContext(ctx)
+}
+
+func (sqliteDialect) isServerErr(err error) bool {
+	_, ok := errCode(err)
+	return ok
+}
+
+func (sqliteDialect) isRetryableErr(err error) bool {
+	code, _ := errCode(err)
+	return code == sqliteBusy || code == sqliteLocked
+}
+
+func defaultPort(port, defaultPort int) int {
+	if port == 0 {
+		return defaultPort
+	}
+
+	return port
+}
+
+// pgQuote quotes value of the key/value dsn if needed.
+func pgQuote(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"github.com/jukylin/esim/log"
 )
@@ -54,10 +55,34 @@ func (this *dummyProxy) QueryRow(query string, args ...interface{}) *sql.Row {
 	return row
 }
 
+func (this *dummyProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return this.Exec(query, args...)
+}
+
+func (this *dummyProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return this.Prepare(query)
+}
+
+func (this *dummyProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return this.Query(query, args...)
+}
+
+func (this *dummyProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return this.QueryRow(query, args...)
+}
+
 func (this *dummyProxy) Close() error {
 	return this.nextProxy.Close()
 }
 
+func (this *dummyProxy) Begin() (*sql.Tx, error) {
+	return this.nextProxy.Begin()
+}
+
+func (this *dummyProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.nextProxy.BeginTx(ctx, opts)
+}
+
 // implement sql.Result interface
 type dummySqlResult struct {
 }
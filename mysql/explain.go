@@ -0,0 +1,237 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// explainPlan is the summary of the plan of a SELECT.
+type explainPlan struct {
+	//table:access_type in the order of the plan
+	accessTypes []string
+
+	//distinct keys used
+	keys []string
+
+	//sum of the estimated rows examined of each table
+	rowsExamined int64
+}
+
+func (this *explainPlan) addTable(table, accessType, key string, rows int64) {
+	if table == "" && accessType == "" {
+		return
+	}
+
+	this.accessTypes = append(this.accessTypes, table+":"+accessType)
+	this.rowsExamined += rows
+
+	if key != "" && !containsString(this.keys, key) {
+		this.keys = append(this.keys, key)
+	}
+}
+
+func (this *explainPlan) accessType() string {
+	return strings.Join(this.accessTypes, ",")
+}
+
+func (this *explainPlan) key() string {
+	return strings.Join(this.keys, ",")
+}
+
+func (this *explainPlan) String() string {
+	return "access_type=" + this.accessType() + " rows_examined=" +
+		strconv.FormatInt(this.rowsExamined, 10) + " keys=" + this.key()
+}
+
+// walkJSON adds the "table" objects of the plan of EXPLAIN FORMAT=JSON,
+// they are in query_block, nested_loop, subqueries and so on.
+func (this *explainPlan) walkJSON(node interface{}) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if table, ok := node["table"].(map[string]interface{}); ok {
+			tableName, _ := table["table_name"].(string)
+			accessType, _ := table["access_type"].(string)
+			key, _ := table["key"].(string)
+			rows, _ := table["rows_examined_per_scan"].(float64)
+			this.addTable(tableName, accessType, key, int64(rows))
+		}
+
+		names := make([]string, 0, len(node))
+		for name := range node {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			this.walkJSON(node[name])
+		}
+	case []interface{}:
+		for _, child := range node {
+			this.walkJSON(child)
+		}
+	}
+}
+
+type explainCache struct {
+	//nil if EXPLAIN failed
+	plan *explainPlan
+
+	expireAt time.Time
+}
+
+// explainer runs EXPLAIN of slow SELECTs, at most once in interval,
+// the plans are kept by fingerprint for ttl, so a SELECT is explained once in ttl.
+type explainer struct {
+	interval time.Duration
+
+	timeout time.Duration
+
+	ttl time.Duration
+
+	maxPlans int
+
+	lock sync.Mutex
+
+	lastTime time.Time
+
+	plans map[string]explainCache
+}
+
+func newExplainer(interval, timeout, ttl time.Duration, maxPlans int) *explainer {
+	return &explainer{
+		interval: interval,
+		timeout:  timeout,
+		ttl:      ttl,
+		maxPlans: maxPlans,
+		plans:    make(map[string]explainCache),
+	}
+}
+
+// explain returns the cached plan of query, nil if it is not a SELECT or not explained yet.
+// Without a cached plan it runs EXPLAIN on db in the background, at most once in interval,
+// and passes the plan to done, so the caller doesn't wait for it.
+func (this *explainer) explain(db SqlCommon, query string, args []interface{},
+	done func(plan *explainPlan)) *explainPlan {
+	fp := fingerprint(query)
+	if !strings.HasPrefix(fp, "select ") {
+		return nil
+	}
+
+	now := time.Now()
+	this.lock.Lock()
+	if cache, ok := this.plans[fp]; ok && now.Before(cache.expireAt) {
+		this.lock.Unlock()
+		return cache.plan
+	}
+
+	if now.Sub(this.lastTime) < this.interval {
+		this.lock.Unlock()
+		return nil
+	}
+	this.lastTime = now
+	this.lock.Unlock()
+
+	go func() {
+		plan := this.run(db, fp, query, args)
+		if plan != nil && done != nil {
+			done(plan)
+		}
+	}()
+
+	return nil
+}
+
+// run runs EXPLAIN of query and caches the plan by fp.
+func (this *explainer) run(db SqlCommon, fp, query string, args []interface{}) *explainPlan {
+	explainCtx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+
+	plan, err := this.query(explainCtx, db, "EXPLAIN FORMAT=JSON "+query, args)
+	if err != nil {
+		//servers without FORMAT=JSON
+		plan, _ = this.query(explainCtx, db, "EXPLAIN "+query, args)
+	}
+
+	now := time.Now()
+	this.lock.Lock()
+	if len(this.plans) >= this.maxPlans {
+		for fp, cache := range this.plans {
+			if now.After(cache.expireAt) || len(this.plans) >= this.maxPlans {
+				delete(this.plans, fp)
+			}
+		}
+	}
+	this.plans[fp] = explainCache{plan: plan, expireAt: now.Add(this.ttl)}
+	this.lock.Unlock()
+
+	return plan
+}
+
+// query reads the plan of the JSON format, or the table, type, key and rows columns of the traditional one.
+func (this *explainer) query(ctx context.Context, db SqlCommon, query string,
+	args []interface{}) (*explainPlan, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &explainPlan{}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for k := range values {
+		dest[k] = &values[k]
+	}
+
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		if len(columns) == 1 && strings.HasPrefix(strings.TrimSpace(string(values[0])), "{") {
+			var tree interface{}
+			if err = json.Unmarshal(values[0], &tree); err != nil {
+				return nil, err
+			}
+			plan.walkJSON(tree)
+			continue
+		}
+
+		var table, accessType, key string
+		var examined int64
+		for k, column := range columns {
+			switch strings.ToLower(column) {
+			case "table":
+				table = string(values[k])
+			case "type":
+				accessType = string(values[k])
+			case "key":
+				key = string(values[k])
+			case "rows":
+				examined, _ = strconv.ParseInt(string(values[k]), 10, 64)
+			}
+		}
+		plan.addTable(table, accessType, key, examined)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(plan.accessTypes) == 0 {
+		return nil, nil
+	}
+
+	return plan, nil
+}
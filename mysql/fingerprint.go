@@ -0,0 +1,196 @@
+package mysql
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// otherFingerprint takes the place of the fingerprints beyond the cap.
+const otherFingerprint = "other"
+
+var (
+	placeholderListReg = regexp.MustCompile(`\(\s*\?(\s*,\s*\?)*\s*\)`)
+
+	placeholderRowsReg = regexp.MustCompile(`\(\?\+\)(\s*,\s*\(\?\+\))+`)
+)
+
+// fingerprint normalizes query to a stable form, statements which differ only
+// in literals, IN-lists, comments, case and whitespace have the same fingerprint.
+//  SELECT * FROM user WHERE id IN (1, 2, 3) AND name = 'a'
+//  select * from user where id in (?+) and name = ?
+func fingerprint(query string) string {
+	var builder strings.Builder
+	builder.Grow(len(query))
+
+	space := false
+	writeSpace := func() {
+		if space && builder.Len() > 0 {
+			builder.WriteByte(' ')
+		}
+		space = false
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i)
+			writeSpace()
+			builder.WriteByte('?')
+		case c == '`':
+			//identifiers are kept as they are
+			end := strings.IndexByte(query[i+1:], '`')
+			if end < 0 {
+				end = len(query) - 1
+			} else {
+				end += i + 1
+			}
+			writeSpace()
+			builder.WriteString(query[i : end+1])
+			i = end
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			space = true
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && query[i+2] == ' '):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			space = true
+		case isDigit(c) && (i == 0 || !isIdentChar(query[i-1])):
+			i = skipNumber(query, i)
+			writeSpace()
+			builder.WriteByte('?')
+		default:
+			writeSpace()
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			builder.WriteByte(c)
+		}
+	}
+
+	fp := placeholderListReg.ReplaceAllString(builder.String(), "(?+)")
+	fp = placeholderRowsReg.ReplaceAllString(fp, "(?+)")
+
+	return fp
+}
+
+// skipQuoted returns the index of the quote closing the literal starting at i.
+func skipQuoted(query string, i int) int {
+	quote := query[i]
+	for i++; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			i++
+		case quote:
+			//'' is an escaped quote
+			if i+1 < len(query) && query[i+1] == quote {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+
+	return len(query) - 1
+}
+
+// skipNumber returns the index of the last char of the number starting at i,
+// like 12, 1.5, 1e10 and 0xff.
+func skipNumber(query string, i int) int {
+	if query[i] == '0' && i+1 < len(query) && (query[i+1] == 'x' || query[i+1] == 'X') {
+		i += 2
+		for i < len(query) && isHexDigit(query[i]) {
+			i++
+		}
+		return i - 1
+	}
+
+	for i < len(query) && (isDigit(query[i]) || query[i] == '.') {
+		i++
+	}
+
+	if i < len(query) && (query[i] == 'e' || query[i] == 'E') {
+		i++
+		if i < len(query) && (query[i] == '+' || query[i] == '-') {
+			i++
+		}
+		for i < len(query) && isDigit(query[i]) {
+			i++
+		}
+	}
+
+	return i - 1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentChar(c byte) bool {
+	return isDigit(c) || c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// fingerprintSet keeps at most max distinct fingerprints,
+// so they are safe to be metric labels.
+type fingerprintSet struct {
+	lock sync.RWMutex
+
+	max int
+
+	fingerprints map[string]struct{}
+}
+
+func newFingerprintSet(max int) *fingerprintSet {
+	return &fingerprintSet{
+		max:          max,
+		fingerprints: make(map[string]struct{}),
+	}
+}
+
+// setMax changes the cap, the fingerprints beyond it are kept.
+func (this *fingerprintSet) setMax(max int) {
+	this.lock.Lock()
+	this.max = max
+	this.lock.Unlock()
+}
+
+// label returns the fingerprint of query, or "other" if the set is full.
+func (this *fingerprintSet) label(query string) string {
+	fp := fingerprint(query)
+
+	this.lock.RLock()
+	_, ok := this.fingerprints[fp]
+	this.lock.RUnlock()
+	if ok {
+		return fp
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if _, ok = this.fingerprints[fp]; ok {
+		return fp
+	}
+
+	if len(this.fingerprints) >= this.max {
+		return otherFingerprint
+	}
+	this.fingerprints[fp] = struct{}{}
+
+	return fp
+}
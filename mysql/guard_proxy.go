@@ -0,0 +1,475 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rules of guardProxy
+const (
+	//UPDATE or DELETE without WHERE
+	GuardNoWhere = "no_where"
+
+	//SELECT without LIMIT on the tables of "mysql_guard_large_tables"
+	GuardNoLimit = "no_limit"
+
+	//CREATE, ALTER, DROP, TRUNCATE and RENAME, schemas are changed by esim migrate
+	GuardDDL = "ddl"
+
+	//more than one statement in a query
+	GuardMultiStatement = "multi_statement"
+)
+
+// actions of a rule
+const (
+	GuardReject = "reject"
+
+	GuardWarn = "warn"
+
+	GuardOff = "off"
+)
+
+var ddlKeywords = map[string]bool{
+	"create":   true,
+	"alter":    true,
+	"drop":     true,
+	"truncate": true,
+	"rename":   true,
+}
+
+// keywords ending the table list of FROM
+var fromEndKeywords = map[string]bool{
+	"where":         true,
+	"group":         true,
+	"order":         true,
+	"limit":         true,
+	"having":        true,
+	"union":         true,
+	"for":           true,
+	"join":          true,
+	"inner":         true,
+	"left":          true,
+	"right":         true,
+	"cross":         true,
+	"natural":       true,
+	"straight_join": true,
+	"on":            true,
+	"using":         true,
+	")":             true,
+}
+
+// GuardError is returned by guardProxy for rejected statements.
+type GuardError struct {
+	Rule string
+
+	Query string
+}
+
+func (this *GuardError) Error() string {
+	return "mysql: " + this.Rule + " rejected : " + this.Query
+}
+
+type guardExemptKey struct{}
+
+// NewGuardExemptContext returns a ctx whose statements are not checked by rules,
+// like creating tables in tests.
+func NewGuardExemptContext(ctx context.Context, rules ...string) context.Context {
+	exempt := make(map[string]bool, len(rules))
+	for _, rule := range guardExemptions(ctx) {
+		exempt[rule] = true
+	}
+	for _, rule := range rules {
+		exempt[rule] = true
+	}
+
+	merged := make([]string, 0, len(exempt))
+	for rule := range exempt {
+		merged = append(merged, rule)
+	}
+
+	return context.WithValue(ctx, guardExemptKey{}, merged)
+}
+
+func guardExemptions(ctx context.Context) []string {
+	rules, _ := ctx.Value(guardExemptKey{}).([]string)
+	return rules
+}
+
+// guardProxy checks statements against dangerous statement rules,
+// it rejects them with *GuardError or logs a warning, by the policy of runmode.
+// The default policy of "pro" is warning on GuardNoLimit and rejecting the others,
+// other runmodes reject all, override it by "mysql_guard_policy_" + runmode:
+//  mysql_guard_policy_pro:
+//    no_limit: off
+//    ddl: warn
+//  mysql_guard_large_tables: [user, order]
+type guardProxy struct {
+	name string
+
+	nextProxy SqlCommon
+
+	conf config.Config
+
+	logger log.Logger
+
+	//rule => action
+	policy map[string]string
+
+	largeTables map[string]bool
+
+	//builds *sql.Row of rejected statements
+	memDb *sql.DB
+}
+
+type GuardProxyOption func(c *guardProxy)
+
+type GuardProxyOptions struct{}
+
+func NewGuardProxy(options ...GuardProxyOption) *guardProxy {
+	guardProxy := &guardProxy{}
+
+	for _, option := range options {
+		option(guardProxy)
+	}
+
+	if guardProxy.conf == nil {
+		guardProxy.conf = config.NewNullConfig()
+	}
+
+	if guardProxy.logger == nil {
+		guardProxy.logger = log.NewLogger()
+	}
+
+	runmode := guardProxy.conf.GetString("runmode")
+	guardProxy.policy = map[string]string{
+		GuardNoWhere:        GuardReject,
+		GuardNoLimit:        GuardReject,
+		GuardDDL:            GuardReject,
+		GuardMultiStatement: GuardReject,
+	}
+	if runmode == "pro" {
+		guardProxy.policy[GuardNoLimit] = GuardWarn
+	}
+
+	for rule, action := range guardProxy.conf.GetStringMapString("mysql_guard_policy_" + runmode) {
+		if _, ok := guardProxy.policy[rule]; !ok {
+			guardProxy.logger.Panicf("[mysql] unknown guard rule %s", rule)
+		}
+
+		if action != GuardReject && action != GuardWarn && action != GuardOff {
+			guardProxy.logger.Panicf("[mysql] unknown guard action %s of %s", action, rule)
+		}
+		guardProxy.policy[rule] = action
+	}
+
+	guardProxy.largeTables = make(map[string]bool)
+	for _, table := range guardProxy.conf.GetStringSlice("mysql_guard_large_tables") {
+		guardProxy.largeTables[strings.ToLower(table)] = true
+	}
+
+	guardProxy.memDb = newMemDb(nil)
+
+	guardProxy.name = "guard_proxy"
+
+	return guardProxy
+}
+
+func (GuardProxyOptions) WithConf(conf config.Config) GuardProxyOption {
+	return func(g *guardProxy) {
+		g.conf = conf
+	}
+}
+
+func (GuardProxyOptions) WithLogger(logger log.Logger) GuardProxyOption {
+	return func(g *guardProxy) {
+		g.logger = logger
+	}
+}
+
+//implement Proxy interface
+func (this *guardProxy) NextProxy(db interface{}) {
+	this.nextProxy = db.(SqlCommon)
+}
+
+//implement Proxy interface
+func (this *guardProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *guardProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+func (this *guardProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+func (this *guardProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+func (this *guardProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *guardProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := this.check(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return this.nextProxy.ExecContext(ctx, query, args...)
+}
+
+func (this *guardProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if err := this.check(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return this.nextProxy.PrepareContext(ctx, query)
+}
+
+func (this *guardProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if err := this.check(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return this.nextProxy.QueryContext(ctx, query, args...)
+}
+
+func (this *guardProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if err := this.check(ctx, query); err != nil {
+		//*sql.Row can't be built by hand, memDb builds one whose Scan returns err
+		return this.memDb.QueryRowContext(withMemResult(ctx, &memResult{err: err}), query, args...)
+	}
+
+	return this.nextProxy.QueryRowContext(ctx, query, args...)
+}
+
+func (this *guardProxy) Close() error {
+	this.memDb.Close()
+	return this.nextProxy.Close()
+}
+
+func (this *guardProxy) Begin() (*sql.Tx, error) {
+	return this.nextProxy.Begin()
+}
+
+func (this *guardProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.nextProxy.BeginTx(ctx, opts)
+}
+
+// check returns *GuardError of the first rejected rule query violates.
+func (this *guardProxy) check(ctx context.Context, query string) error {
+	rules := inspectStatement(query, this.largeTables)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	exempt := guardExemptions(ctx)
+	var guardErr error
+	for _, rule := range rules {
+		action := this.policy[rule]
+		if action == GuardOff || containsString(exempt, rule) {
+			continue
+		}
+
+		mysqlGuardViolationTotal.With(prometheus.Labels{"db": dbNameFromContext(ctx),
+			"rule": rule, "action": action}).Inc()
+
+		if action == GuardReject {
+			this.logger.Errorc(ctx, "[mysql] %s rejected : %s", rule, query)
+			if guardErr == nil {
+				guardErr = &GuardError{Rule: rule, Query: query}
+			}
+		} else {
+			this.logger.Warnc(ctx, "[mysql] %s : %s", rule, query)
+		}
+	}
+
+	return guardErr
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inspectStatement returns the rules query violates,
+// largeTables are the lower case names of the tables checked by GuardNoLimit.
+func inspectStatement(query string, largeTables map[string]bool) []string {
+	var rules []string
+	addRule := func(rule string) {
+		if !containsString(rules, rule) {
+			rules = append(rules, rule)
+		}
+	}
+
+	//literals and comments are gone in the fingerprint, so ; separates statements
+	var statements []string
+	for _, statement := range strings.Split(fingerprint(query), ";") {
+		if strings.TrimSpace(statement) != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	if len(statements) > 1 {
+		addRule(GuardMultiStatement)
+	}
+
+	for _, statement := range statements {
+		tokens := sqlTokens(statement)
+
+		var first string
+		for _, token := range tokens {
+			if token.text != "(" {
+				first = token.text
+				break
+			}
+		}
+
+		switch {
+		case ddlKeywords[first]:
+			addRule(GuardDDL)
+		case first == "update" || first == "delete":
+			if !hasTopKeyword(tokens, "where") {
+				addRule(GuardNoWhere)
+			}
+		case first == "select":
+			if len(largeTables) > 0 && selectsWithoutLimit(tokens, largeTables) {
+				addRule(GuardNoLimit)
+			}
+		}
+	}
+
+	return rules
+}
+
+type sqlToken struct {
+	text string
+
+	//depth of parentheses
+	depth int
+}
+
+// sqlTokens splits a fingerprint to words and symbols.
+func sqlTokens(fp string) []sqlToken {
+	var tokens []sqlToken
+	depth := 0
+
+	for i := 0; i < len(fp); i++ {
+		c := fp[i]
+		switch {
+		case c == ' ':
+		case c == '(':
+			tokens = append(tokens, sqlToken{text: "(", depth: depth})
+			depth++
+		case c == ')':
+			if depth > 0 {
+				depth--
+			}
+			tokens = append(tokens, sqlToken{text: ")", depth: depth})
+		case isIdentChar(c) || c == '`' || c == '.':
+			start := i
+			for i < len(fp) && (isIdentChar(fp[i]) || fp[i] == '`' || fp[i] == '.') {
+				if fp[i] == '`' {
+					end := strings.IndexByte(fp[i+1:], '`')
+					if end < 0 {
+						i = len(fp)
+						break
+					}
+					i += end + 1
+				}
+				i++
+			}
+			tokens = append(tokens, sqlToken{text: fp[start:i], depth: depth})
+			i--
+		default:
+			tokens = append(tokens, sqlToken{text: string(c), depth: depth})
+		}
+	}
+
+	return tokens
+}
+
+func hasTopKeyword(tokens []sqlToken, keyword string) bool {
+	for _, token := range tokens {
+		if token.depth == 0 && token.text == keyword {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectsWithoutLimit reports whether a SELECT of tokens, or a subquery of it,
+// reads a large table without LIMIT.
+func selectsWithoutLimit(tokens []sqlToken, largeTables map[string]bool) bool {
+	for k, token := range tokens {
+		if token.text != "from" && token.text != "join" {
+			continue
+		}
+
+		for _, table := range fromTables(tokens, k) {
+			if largeTables[table] && !scopeHasLimit(tokens, k) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// fromTables returns the tables after FROM or JOIN at k, without database and backticks.
+func fromTables(tokens []sqlToken, k int) []string {
+	var tables []string
+	depth := tokens[k].depth
+	expectTable := true
+	for k++; k < len(tokens); k++ {
+		token := tokens[k]
+		if token.depth != depth || fromEndKeywords[token.text] {
+			break
+		}
+
+		if token.text == "," {
+			expectTable = true
+			continue
+		}
+
+		if expectTable && token.text != "(" {
+			tables = append(tables, tableName(token.text))
+		}
+		expectTable = false
+	}
+
+	return tables
+}
+
+// scopeHasLimit reports whether LIMIT follows k in the parentheses of k.
+func scopeHasLimit(tokens []sqlToken, k int) bool {
+	depth := tokens[k].depth
+	for k++; k < len(tokens) && tokens[k].depth >= depth; k++ {
+		if tokens[k].depth == depth && tokens[k].text == "limit" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func tableName(ident string) string {
+	if dot := strings.LastIndexByte(ident, '.'); dot >= 0 {
+		ident = ident[dot+1:]
+	}
+
+	return strings.ToLower(strings.Trim(ident, "`"))
+}
@@ -4,11 +4,32 @@ import (
 	"context"
 	"database/sql"
 	"github.com/jinzhu/gorm"
+	"time"
 )
 
+type MysqlExecInfo struct {
+	query string
+
+	startTime time.Time
+
+	endTime time.Time
+
+	//-1 if unknown, like a query
+	rowsAffected int64
+
+	err error
+
+	args []interface{}
+
+	//of slow SELECTs if mysql_explain is on
+	plan *explainPlan
+}
+
 type SqlCommon interface {
 	gorm.SQLCommon
 
+	sqlContext
+
 	sqlClose
 
 	Begin() (*sql.Tx, error)
@@ -16,6 +37,18 @@ type SqlCommon interface {
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
 }
 
+// sqlContext is the context version of gorm.SQLCommon, implemented by *sql.DB,
+// GetCtxDb passes the ctx down the proxy chain with it.
+type sqlContext interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type sqlClose interface {
 	Close() error
 }
@@ -23,3 +56,9 @@ type sqlClose interface {
 type sqlPing interface {
 	Ping() error
 }
+
+type sqlBegin interface {
+	Begin() (*sql.Tx, error)
+
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
@@ -0,0 +1,241 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+)
+
+// memResult is a result set or exec result already in memory,
+// memConn serves it as if it came from a database.
+type memResult struct {
+	columns []string
+
+	rows [][]driver.Value
+
+	lastInsertId int64
+
+	rowsAffected int64
+
+	err error
+}
+
+// implement driver.Result and sql.Result interface
+func (this *memResult) LastInsertId() (int64, error) {
+	return this.lastInsertId, nil
+}
+
+// implement driver.Result and sql.Result interface
+func (this *memResult) RowsAffected() (int64, error) {
+	return this.rowsAffected, nil
+}
+
+// memResolver answers the statements which come without a memResult in context,
+// like statements inside a transaction or a prepared statement.
+type memResolver func(query string, args []driver.Value) *memResult
+
+type memResultKey struct{}
+
+func withMemResult(ctx context.Context, result *memResult) context.Context {
+	return context.WithValue(ctx, memResultKey{}, result)
+}
+
+// newMemDb returns a *sql.DB whose statements are answered in memory,
+// it is used to build *sql.Rows and *sql.Row which can't be made by hand.
+func newMemDb(resolver memResolver) *sql.DB {
+	return sql.OpenDB(&memConnector{resolver: resolver})
+}
+
+type memConnector struct {
+	resolver memResolver
+}
+
+func (this *memConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return &memConn{resolver: this.resolver}, nil
+}
+
+func (this *memConnector) Driver() driver.Driver {
+	return memDriver{}
+}
+
+type memDriver struct{}
+
+func (memDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("mysql: mem driver must be opened by connector")
+}
+
+type memConn struct {
+	resolver memResolver
+}
+
+func (this *memConn) Prepare(query string) (driver.Stmt, error) {
+	return &memStmt{conn: this, query: query}, nil
+}
+
+func (this *memConn) Close() error {
+	return nil
+}
+
+func (this *memConn) Begin() (driver.Tx, error) {
+	return memTx{}, nil
+}
+
+func (this *memConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	result := this.resolve(ctx, query, namedValues(args))
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return &memRows{result: result}, nil
+}
+
+func (this *memConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	result := this.resolve(ctx, query, namedValues(args))
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return result, nil
+}
+
+func (this *memConn) resolve(ctx context.Context, query string, args []driver.Value) *memResult {
+	if result, ok := ctx.Value(memResultKey{}).(*memResult); ok {
+		return result
+	}
+
+	if this.resolver == nil {
+		return &memResult{err: errors.New("mysql: no result for " + query)}
+	}
+
+	return this.resolver(query, args)
+}
+
+type memStmt struct {
+	conn *memConn
+
+	query string
+}
+
+func (this *memStmt) Close() error {
+	return nil
+}
+
+func (this *memStmt) NumInput() int {
+	return -1
+}
+
+func (this *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result := this.conn.resolve(context.Background(), this.query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return result, nil
+}
+
+func (this *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result := this.conn.resolve(context.Background(), this.query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return &memRows{result: result}, nil
+}
+
+type memTx struct{}
+
+func (memTx) Commit() error {
+	return nil
+}
+
+func (memTx) Rollback() error {
+	return nil
+}
+
+type memRows struct {
+	result *memResult
+
+	cursor int
+}
+
+func (this *memRows) Columns() []string {
+	return this.result.columns
+}
+
+func (this *memRows) Close() error {
+	return nil
+}
+
+func (this *memRows) Next(dest []driver.Value) error {
+	if this.cursor >= len(this.result.rows) {
+		return io.EOF
+	}
+
+	copy(dest, this.result.rows[this.cursor])
+	this.cursor++
+
+	return nil
+}
+
+// materializeRows reads all rows into memory and closes them.
+func materializeRows(rows *sql.Rows) *memResult {
+	defer rows.Close()
+
+	result := &memResult{}
+	columns, err := rows.Columns()
+	if err != nil {
+		result.err = err
+		return result
+	}
+	result.columns = columns
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for k := range values {
+			dest[k] = &values[k]
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			result.err = err
+			return result
+		}
+
+		row := make([]driver.Value, len(columns))
+		for k, value := range values {
+			row[k] = value
+		}
+		result.rows = append(result.rows, row)
+	}
+
+	result.err = rows.Err()
+
+	return result
+}
+
+// driverValues converts args the same way database/sql does before calling a driver.
+func driverValues(args []interface{}) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for k, arg := range args {
+		value, err := driver.DefaultParameterConverter.ConvertValue(arg)
+		if err != nil {
+			value = arg
+		}
+		values[k] = value
+	}
+
+	return values
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for k, arg := range args {
+		values[k] = arg.Value
+	}
+
+	return values
+}
@@ -21,16 +21,128 @@ var mysqlDuration = prometheus.NewHistogramVec(
 	[]string{"sql"},
 )
 
-var mysqlStats = prometheus.NewGaugeVec(
+var mysqlSlowTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_slow_total",
+		Help: "Number of slow sql",
+	},
+	[]string{"sql"},
+)
+
+// the "sql" labels of mysql_total, mysql_duration_seconds and mysql_slow_total,
+// shared by the monitor proxies of all dbs, so the cap is of the metrics
+var mysqlFingerprints = newFingerprintSet(500)
+
+// "mysql_stats", read at scrape time
+var mysqlPoolCollector = newPoolCollector()
+
+var mysqlReplicaUp = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
-		Name: "mysql_stats",
-		Help: "database statistics",
+		Name: "mysql_replica_up",
+		Help: "1 if the replica receives reads",
+	},
+	[]string{"db", "replica"},
+)
+
+var mysqlReplicaLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "mysql_replica_lag_seconds",
+		Help: "seconds behind master of the replica",
+	},
+	[]string{"db", "replica"},
+)
+
+var mysqlTxTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_tx_total",
+		Help: "Number of transactions by outcome",
+	},
+	[]string{"db", "outcome"},
+)
+
+var mysqlTxDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mysql_tx_duration_seconds",
+		Help:    "mysql transaction duration distribution",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1, 5},
+	},
+	[]string{"db", "outcome"},
+)
+
+var mysqlTxRetryTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_tx_retry_total",
+		Help: "Number of transactions retried on deadlock or lock wait timeout",
+	},
+	[]string{"db"},
+)
+
+var mysqlGuardViolationTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_guard_violation_total",
+		Help: "Number of statements violating the guard rules",
+	},
+	[]string{"db", "rule", "action"},
+)
+
+var mysqlShardTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_shard_total",
+		Help: "Number of requests routed to the shard",
+	},
+	[]string{"logical", "shard", "db"},
+)
+
+var mysqlShardErrorTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_shard_error_total",
+		Help: "Number of failed scatter requests of the shard",
+	},
+	[]string{"logical", "shard", "db"},
+)
+
+var mysqlShardScatterDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "mysql_shard_scatter_duration_seconds",
+		Help:    "scatter request duration distribution of the shard",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.5, 1},
+	},
+	[]string{"logical", "shard", "db"},
+)
+
+var mysqlCacheTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_cache_total",
+		Help: "Number of cached statements by hit or miss",
+	},
+	[]string{"db", "sql", "result"},
+)
+
+// the "sql" labels of mysql_cache_total, shared by the cache proxies of all dbs
+var mysqlCacheFingerprints = newFingerprintSet(500)
+
+var mysqlCacheInvalidationTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "mysql_cache_invalidation_total",
+		Help: "Number of writes invalidating the cached result sets of the table",
 	},
-	[]string{"db", "stats"},
+	[]string{"db", "table"},
 )
 
 func init() {
 	prometheus.MustRegister(mysqlTotal)
 	prometheus.MustRegister(mysqlDuration)
-	prometheus.MustRegister(mysqlStats)
+	prometheus.MustRegister(mysqlSlowTotal)
+	prometheus.MustRegister(mysqlPoolCollector)
+	prometheus.MustRegister(mysqlReplicaUp)
+	prometheus.MustRegister(mysqlReplicaLag)
+	prometheus.MustRegister(mysqlTxTotal)
+	prometheus.MustRegister(mysqlTxDuration)
+	prometheus.MustRegister(mysqlTxRetryTotal)
+	prometheus.MustRegister(mysqlGuardViolationTotal)
+	prometheus.MustRegister(mysqlShardTotal)
+	prometheus.MustRegister(mysqlShardErrorTotal)
+	prometheus.MustRegister(mysqlShardScatterDuration)
+	prometheus.MustRegister(mysqlCacheTotal)
+	prometheus.MustRegister(mysqlCacheInvalidationTotal)
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/jukylin/esim/log"
 	"github.com/jukylin/esim/opentracing"
 	opentracing2 "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
 	"github.com/prometheus/client_golang/prometheus"
 	"time"
 )
@@ -24,9 +25,19 @@ type monitorProxy struct {
 	log log.Logger
 
 	afterEvents []afterEvents
+
+	//labels of metrics and names of spans
+	fingerprints *fingerprintSet
+
+	//nil if mysql_explain is off
+	explainer *explainer
+
+	//EXPLAIN runs on it, not through the proxies after the monitor proxy,
+	//nil if mysql_explain is off
+	rawDb *sql.DB
 }
 
-type afterEvents func(string, time.Time, time.Time)
+type afterEvents func(context.Context, MysqlExecInfo)
 
 type MonitorProxyOption func(c *monitorProxy)
 
@@ -51,6 +62,35 @@ func NewMonitorProxy(options ...MonitorProxyOption) *monitorProxy {
 		monitorProxy.tracer = opentracing.NewTracer("mysql", monitorProxy.log)
 	}
 
+	maxFingerprints := monitorProxy.conf.GetInt("mysql_max_fingerprints")
+	if maxFingerprints <= 0 {
+		maxFingerprints = 500
+	}
+	//shared by the proxies of all dbs, they have the same conf
+	mysqlFingerprints.setMax(maxFingerprints)
+	monitorProxy.fingerprints = mysqlFingerprints
+
+	if monitorProxy.conf.GetBool("mysql_explain") == true {
+		explainInterval := monitorProxy.conf.GetInt64("mysql_explain_interval")
+		if explainInterval <= 0 {
+			explainInterval = 1000
+		}
+
+		explainTimeout := monitorProxy.conf.GetInt64("mysql_explain_timeout")
+		if explainTimeout <= 0 {
+			explainTimeout = 1000
+		}
+
+		explainTTL := monitorProxy.conf.GetInt64("mysql_explain_ttl")
+		if explainTTL <= 0 {
+			explainTTL = 600
+		}
+
+		monitorProxy.explainer = newExplainer(time.Duration(explainInterval)*time.Millisecond,
+			time.Duration(explainTimeout)*time.Millisecond, time.Duration(explainTTL)*time.Second,
+			maxFingerprints)
+	}
+
 	monitorProxy.name = "monitor_proxy"
 
 	monitorProxy.registerAfterEvent()
@@ -86,33 +126,73 @@ func (this *monitorProxy) ProxyName() string {
 	return this.name
 }
 
+//implement rawDbUser interface
+func (this *monitorProxy) setRawDb(openDb func() *sql.DB) {
+	if this.explainer != nil {
+		this.rawDb = openDb()
+	}
+}
+
 func (this *monitorProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+func (this *monitorProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+func (this *monitorProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+func (this *monitorProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *monitorProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	startTime := time.Now()
-	result, err := this.nextProxy.Exec(query, args...)
-	this.after(query, startTime)
+	result, err := this.nextProxy.ExecContext(ctx, query, args...)
+
+	execInfo := MysqlExecInfo{}
+	execInfo.query = query
+	execInfo.startTime = startTime
+	execInfo.endTime = time.Now()
+	execInfo.rowsAffected = -1
+	execInfo.err = err
+	execInfo.args = args
+	if err == nil {
+		if rowsAffected, raErr := result.RowsAffected(); raErr == nil {
+			execInfo.rowsAffected = rowsAffected
+		}
+	}
+	this.after(ctx, execInfo)
+
 	return result, err
 }
 
-func (this *monitorProxy) Prepare(query string) (*sql.Stmt, error) {
+func (this *monitorProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
 	startTime := time.Now()
-	stmt, err := this.nextProxy.Prepare(query)
-	this.after(query, startTime)
+	stmt, err := this.nextProxy.PrepareContext(ctx, query)
+	this.after(ctx, MysqlExecInfo{query: query, startTime: startTime,
+		endTime: time.Now(), rowsAffected: -1, err: err})
 
 	return stmt, err
 }
 
-func (this *monitorProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+func (this *monitorProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
 	startTime := time.Now()
-	rows, err := this.nextProxy.Query(query, args...)
-	this.after(query, startTime)
+	rows, err := this.nextProxy.QueryContext(ctx, query, args...)
+	this.after(ctx, MysqlExecInfo{query: query, startTime: startTime,
+		endTime: time.Now(), rowsAffected: -1, err: err, args: args})
 
 	return rows, err
 }
 
-func (this *monitorProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+func (this *monitorProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
 	startTime := time.Now()
-	row := this.nextProxy.QueryRow(query, args...)
-	this.after(query, startTime)
+	row := this.nextProxy.QueryRowContext(ctx, query, args...)
+	this.after(ctx, MysqlExecInfo{query: query, startTime: startTime,
+		endTime: time.Now(), rowsAffected: -1, err: row.Err(), args: args})
 
 	return row
 }
@@ -143,33 +223,72 @@ func (this *monitorProxy) registerAfterEvent() {
 	}
 }
 
-func (this *monitorProxy) after(query string, beginTime time.Time) {
-	now := time.Now()
+func (this *monitorProxy) after(ctx context.Context, execInfo MysqlExecInfo) {
+	//before the events, the cached plan is in the slow sql log and the span,
+	//a new one is logged when EXPLAIN is done
+	if this.explainer != nil && this.rawDb != nil && execInfo.err == nil && this.isSlow(execInfo) {
+		execInfo.plan = this.explainer.explain(this.rawDb, execInfo.query, execInfo.args,
+			func(plan *explainPlan) {
+				this.log.Warnc(ctx, "slow sql %s plan: %s", this.fingerprints.label(execInfo.query),
+					plan.String())
+			})
+	}
+
 	for _, event := range this.afterEvents {
-		event(query, beginTime, now)
+		event(ctx, execInfo)
 	}
 }
 
-func (this *monitorProxy) withSlowSql(query string, beginTime, endTime time.Time) {
+func (this *monitorProxy) isSlow(execInfo MysqlExecInfo) bool {
 	mysql_slow_time := this.conf.GetInt64("mysql_slow_time")
 
-	if mysql_slow_time != 0 {
-		if endTime.Sub(beginTime) > time.Duration(mysql_slow_time)*time.Millisecond {
-			this.log.Warnf("slow sql %s", query)
+	return mysql_slow_time != 0 &&
+		execInfo.endTime.Sub(execInfo.startTime) > time.Duration(mysql_slow_time)*time.Millisecond
+}
+
+func (this *monitorProxy) withSlowSql(ctx context.Context, execInfo MysqlExecInfo) {
+	if this.isSlow(execInfo) {
+		duration := execInfo.endTime.Sub(execInfo.startTime)
+		fp := this.fingerprints.label(execInfo.query)
+		mysqlSlowTotal.With(prometheus.Labels{"sql": fp}).Inc()
+		if execInfo.plan != nil {
+			this.log.Warnc(ctx, "slow sql %s [%s] %s plan: %s", fp, duration.String(),
+				execInfo.query, execInfo.plan.String())
+		} else {
+			this.log.Warnc(ctx, "slow sql %s [%s] %s", fp, duration.String(), execInfo.query)
 		}
 	}
 }
 
-func (this *monitorProxy) withMysqlMetrics(query string, beginTime, endTime time.Time) {
-	lab := prometheus.Labels{"sql": query}
+func (this *monitorProxy) withMysqlMetrics(ctx context.Context, execInfo MysqlExecInfo) {
+	lab := prometheus.Labels{"sql": this.fingerprints.label(execInfo.query)}
 	mysqlTotal.With(lab).Inc()
-	mysqlDuration.With(lab).Observe(endTime.Sub(beginTime).Seconds())
+	mysqlDuration.With(lab).Observe(execInfo.endTime.Sub(execInfo.startTime).Seconds())
 }
 
-//要等2.0
-func (this *monitorProxy) withMysqlTracer(query string, beginTime, endTime time.Time) {
-	//span := opentracing.GetSpan(ctx, m.tracer,
-	//	query, beginTime)
-	//span.LogKV("sql", query)
-	//span.FinishWithOptions(opentracing2.FinishOptions{FinishTime: endTime})
+// withMysqlTracer starts a child span of the span in ctx, nothing if ctx has no span.
+func (this *monitorProxy) withMysqlTracer(ctx context.Context, execInfo MysqlExecInfo) {
+	span := opentracing.GetSpan(ctx, this.tracer, this.fingerprints.label(execInfo.query), execInfo.startTime)
+	if span == nil {
+		return
+	}
+
+	ext.DBType.Set(span, "sql")
+	ext.DBInstance.Set(span, dbNameFromContext(ctx))
+	ext.DBStatement.Set(span, execInfo.query)
+	if execInfo.rowsAffected >= 0 {
+		span.SetTag("db.rows_affected", execInfo.rowsAffected)
+	}
+
+	if execInfo.plan != nil {
+		span.SetTag("db.plan.access_type", execInfo.plan.accessType())
+		span.SetTag("db.plan.rows_examined", execInfo.plan.rowsExamined)
+		span.SetTag("db.plan.keys", execInfo.plan.key())
+	}
+
+	if execInfo.err != nil {
+		ext.Error.Set(span, true)
+		span.LogKV("error_detailed", execInfo.err.Error())
+	}
+	span.FinishWithOptions(opentracing2.FinishOptions{FinishTime: execInfo.endTime})
 }
@@ -7,8 +7,8 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
 	"github.com/jukylin/esim/proxy"
-	"github.com/prometheus/client_golang/prometheus"
 	"strings"
 	"sync"
 	"time"
@@ -18,13 +18,31 @@ var mysqlOnce sync.Once
 
 var onceClient *MysqlClient
 
-type MysqlClient struct {
+// SqlClient keeps the dbs of "dbs", each one has its own driver and proxies.
+type SqlClient struct {
 	gdbs map[string]*gorm.DB
 
 	sqlDbs map[string]*sql.DB
 
+	//the first of the proxy chain, GetCtxDb binds the ctx to it
+	sqlCommons map[string]SqlCommon
+
+	routers map[string]*rwRouter
+
+	dialects map[string]dialect
+
+	shardConfigs []ShardConfig
+
+	//logical of ShardConfig => router
+	shardRouters map[string]*shardRouter
+
+	shardKeys map[string]ShardKeyFunc
+
 	proxy []func() interface{}
 
+	//DbConfig.Proxies and ReplicaConfig.Proxies are resolved from it
+	namedProxies map[string]func() interface{}
+
 	conf config.Config
 
 	logger log.Logger
@@ -35,94 +53,137 @@ type MysqlClient struct {
 
 	closeChan chan bool
 
+	closeOnce sync.Once
+
+	//interval of the replica checks
 	stateTicker time.Duration
 
+	//the pools of rawDbOpener
+	rawDbs []*sql.DB
+
+	rawDbLock sync.Mutex
+
 	//for integration tests
 	db *sql.DB
 }
 
-type Option func(c *MysqlClient)
+type Option func(c *SqlClient)
 
-type MysqlClientOptions struct{}
+type SqlClientOptions struct{}
 
-type DbConfig struct {
-	Db          string `json:"db",yaml:"db"`
-	Dsn         string `json:"dns",yaml:"dsn"`
-	MaxIdle     int    `json:"max_idle",yaml:"maxidle"`
-	MaxOpen     int    `json:"max_open",yaml:"maxopen"`
-	MaxLifetime int    `json:"max_lifetime",yaml:"maxlifetime"`
-}
+// MysqlClientOptions is SqlClientOptions of the old name.
+type MysqlClientOptions = SqlClientOptions
 
+// MysqlClient is SqlClient of the old name, NewMysqlClient returns the one shared by the process.
+type MysqlClient = SqlClient
+
+// NewMysqlClient returns the shared client, the options take effect at the first call.
 func NewMysqlClient(options ...Option) *MysqlClient {
 	mysqlOnce.Do(func() {
+		onceClient = NewSqlClient(options...)
+	})
 
-		onceClient = &MysqlClient{
-			gdbs:        make(map[string]*gorm.DB),
-			sqlDbs:      make(map[string]*sql.DB),
-			proxy:       make([]func() interface{}, 0),
-			stateTicker: 10 * time.Second,
-			closeChan:   make(chan bool, 1),
-		}
+	return onceClient
+}
 
-		for _, option := range options {
-			option(onceClient)
-		}
+// NewSqlClient opens the dbs of "dbs" and SqlClientOptions.WithDbConfig,
+// it is expensive, create one and share it.
+func NewSqlClient(options ...Option) *SqlClient {
+	sqlClient := &SqlClient{
+		gdbs:         make(map[string]*gorm.DB),
+		sqlDbs:       make(map[string]*sql.DB),
+		sqlCommons:   make(map[string]SqlCommon),
+		routers:      make(map[string]*rwRouter),
+		dialects:     make(map[string]dialect),
+		shardRouters: make(map[string]*shardRouter),
+		shardKeys:    make(map[string]ShardKeyFunc),
+		proxy:        make([]func() interface{}, 0),
+		namedProxies: make(map[string]func() interface{}),
+		stateTicker:  10 * time.Second,
+		closeChan:    make(chan bool, 1),
+	}
 
-		if onceClient.conf == nil {
-			onceClient.conf = config.NewNullConfig()
-		}
+	for _, option := range options {
+		option(sqlClient)
+	}
 
-		if onceClient.logger == nil {
-			onceClient.logger = log.NewLogger()
-		}
+	if sqlClient.conf == nil {
+		sqlClient.conf = config.NewNullConfig()
+	}
 
-		onceClient.init()
-	})
+	if sqlClient.logger == nil {
+		sqlClient.logger = log.NewLogger()
+	}
 
-	return onceClient
+	sqlClient.init()
+
+	return sqlClient
 }
 
-func (MysqlClientOptions) WithConf(conf config.Config) Option {
-	return func(m *MysqlClient) {
+func (SqlClientOptions) WithConf(conf config.Config) Option {
+	return func(m *SqlClient) {
 		m.conf = conf
 	}
 }
 
-func (MysqlClientOptions) WithLogger(logger log.Logger) Option {
-	return func(m *MysqlClient) {
+func (SqlClientOptions) WithLogger(logger log.Logger) Option {
+	return func(m *SqlClient) {
 		m.logger = logger
 	}
 }
 
-func (MysqlClientOptions) WithDbConfig(dbConfigs []DbConfig) Option {
-	return func(m *MysqlClient) {
+func (SqlClientOptions) WithDbConfig(dbConfigs []DbConfig) Option {
+	return func(m *SqlClient) {
 		m.dbConfigs = dbConfigs
 	}
 }
 
-func (MysqlClientOptions) WithProxy(proxy ...func() interface{}) Option {
-	return func(m *MysqlClient) {
+func (SqlClientOptions) WithProxy(proxy ...func() interface{}) Option {
+	return func(m *SqlClient) {
 		m.proxy = append(m.proxy, proxy...)
 	}
 }
 
-func (MysqlClientOptions) WithStateTicker(stateTicker time.Duration) Option {
-	return func(m *MysqlClient) {
+// WithNamedProxy registers proxy by name for DbConfig.Proxies and ReplicaConfig.Proxies,
+// "monitor_proxy", "guard_proxy", "cache_proxy" and "cassette_proxy" are registered
+// with the conf and logger of the client if they are not registered.
+func (SqlClientOptions) WithNamedProxy(name string, proxy func() interface{}) Option {
+	return func(m *SqlClient) {
+		m.namedProxies[name] = proxy
+	}
+}
+
+// WithShardConfig adds logical dbs to "mysql_shards".
+func (SqlClientOptions) WithShardConfig(shardConfigs []ShardConfig) Option {
+	return func(m *SqlClient) {
+		m.shardConfigs = shardConfigs
+	}
+}
+
+// WithShardKey sets the extractor of the keys of logical, default DefaultShardKey.
+func (SqlClientOptions) WithShardKey(logical string, shardKey ShardKeyFunc) Option {
+	return func(m *SqlClient) {
+		m.shardKeys[strings.ToLower(logical)] = shardKey
+	}
+}
+
+// WithStateTicker sets the interval of the replica checks, default 10s.
+func (SqlClientOptions) WithStateTicker(stateTicker time.Duration) Option {
+	return func(m *SqlClient) {
 		m.stateTicker = stateTicker
 	}
 }
 
-func (MysqlClientOptions) WithDB(db *sql.DB) Option {
-	return func(m *MysqlClient) {
+func (SqlClientOptions) WithDB(db *sql.DB) Option {
+	return func(m *SqlClient) {
 		m.db = db
 	}
 }
 
-// initializes mysqlClient.
-func (this *MysqlClient) init() {
+// initializes sqlClient.
+func (this *SqlClient) init() {
 
-	dbConfigs := []DbConfig{}
-	err := this.conf.UnmarshalKey("dbs", &dbConfigs)
+	dbConfigs, err := LoadDbConfigs(this.conf)
 	if err != nil {
 		this.logger.Panicf("Fatal error config file: %s \n", err.Error())
 	}
@@ -131,14 +192,45 @@ func (this *MysqlClient) init() {
 		dbConfigs = append(dbConfigs, this.dbConfigs...)
 	}
 
+	profiles := make(map[string]TLSProfile)
+	err = this.conf.UnmarshalKey("mysql_tls_profiles", &profiles)
+	if err != nil {
+		this.logger.Panicf("Fatal error config file: %s \n", err.Error())
+	}
+
+	for name, tlsProfile := range profiles {
+		err = RegisterTLSProfile(name, tlsProfile)
+		if err != nil {
+			this.logger.Panicf("[db] tls profile %s error : %s", name, err.Error())
+		}
+	}
+
+	this.registerBuiltinProxies()
+
 	for _, dbConfig := range dbConfigs {
-		if len(this.proxy) == 0 {
+		proxies := this.resolveProxies(dbConfig.Db, dbConfig.Proxies)
+
+		dialect, err := newDialect(dbConfig.Driver)
+		if err != nil {
+			this.logger.Panicf("[db] %s init error : %s", dbConfig.Db, err.Error())
+		}
+		this.dialects[strings.ToLower(dbConfig.Db)] = dialect
+
+		var dsn string
+		if this.db == nil {
+			dsn, err = dbConfig.DSN()
+			if err != nil {
+				this.logger.Panicf("[db] %s init error : %s", dbConfig.Db, err.Error())
+			}
+		}
+
+		if len(proxies) == 0 {
 			var DB *gorm.DB
 
 			if this.db != nil {
-				DB, err = gorm.Open("mysql", this.db)
+				DB, err = gorm.Open(dialect.gormDialect(), this.db)
 			} else {
-				DB, err = gorm.Open("mysql", dbConfig.Dsn)
+				DB, err = gorm.Open(dialect.gormDialect(), dsn)
 			}
 
 			if err != nil {
@@ -147,9 +239,20 @@ func (this *MysqlClient) init() {
 
 			DB.DB().SetMaxIdleConns(dbConfig.MaxIdle)
 			DB.DB().SetMaxOpenConns(dbConfig.MaxOpen)
-			DB.DB().SetConnMaxLifetime(time.Duration(dbConfig.MaxLifetime))
+			DB.DB().SetConnMaxLifetime(dbConfig.MaxLifetime)
 
-			this.setDb(dbConfig.Db, DB, DB.DB())
+			dbSQL := DB.DB()
+			var sqlCommon SqlCommon = newTxAwareDb(dbConfig.Db, dbSQL)
+			if len(dbConfig.Replicas) > 0 {
+				sqlCommon = this.newRouter(dbConfig, dialect, dbSQL, proxies)
+				DB, err = gorm.Open(dialect.gormDialect(), sqlCommon)
+				if err != nil {
+					this.logger.Panicf("[db] %s init error : %s", dbConfig.Db, err.Error())
+				}
+			}
+			this.sqlCommons[strings.ToLower(dbConfig.Db)] = sqlCommon
+
+			this.setDb(dbConfig.Db, DB, dbSQL)
 
 			if this.conf.GetBool("debug") == true {
 				DB.LogMode(true)
@@ -159,7 +262,7 @@ func (this *MysqlClient) init() {
 			var dbSQL *sql.DB
 
 			if this.db == nil {
-				dbSQL, err = sql.Open("mysql", dbConfig.Dsn)
+				dbSQL, err = sql.Open(dialect.driverName(), dsn)
 				if err != nil {
 					this.logger.Panicf("[db] %s init error : %s", dbConfig.Db, err.Error())
 				}
@@ -167,21 +270,36 @@ func (this *MysqlClient) init() {
 				dbSQL = this.db
 			}
 
-			firstProxy := proxy.NewProxyFactory().GetFirstInstance("db_"+dbConfig.Db, dbSQL, this.proxy...)
+			openRawDb := this.rawDbOpener(dbConfig.Db, dialect, dsn, dbSQL)
+			firstProxy := proxy.NewProxyFactory().GetFirstInstance("db_"+dbConfig.Db,
+				newTxAwareDb(dbConfig.Db, dbSQL), withRawDb(openRawDb, proxies)...)
+			sqlCommon, ok := firstProxy.(SqlCommon)
+			if !ok {
+				this.logger.Panicf("[db] %s proxy %T must implement SqlCommon", dbConfig.Db, firstProxy)
+			}
 
-			DB, err = gorm.Open("mysql", firstProxy)
-			if err != nil {
-				this.logger.Panicf("[db] %s ping error : %s", dbConfig.Db, err.Error())
+			if len(dbConfig.Replicas) > 0 {
+				sqlCommon = this.newRouter(dbConfig, dialect, sqlCommon, proxies)
+				firstProxy = sqlCommon
 			}
+			this.sqlCommons[strings.ToLower(dbConfig.Db)] = sqlCommon
 
-			err = dbSQL.Ping()
+			DB, err = gorm.Open(dialect.gormDialect(), firstProxy)
 			if err != nil {
 				this.logger.Panicf("[db] %s ping error : %s", dbConfig.Db, err.Error())
 			}
 
+			//no database in replay mode
+			if cassette.IsReplay(this.conf) == false {
+				err = dbSQL.Ping()
+				if err != nil {
+					this.logger.Panicf("[db] %s ping error : %s", dbConfig.Db, err.Error())
+				}
+			}
+
 			dbSQL.SetMaxIdleConns(dbConfig.MaxIdle)
 			dbSQL.SetMaxOpenConns(dbConfig.MaxOpen)
-			dbSQL.SetConnMaxLifetime(time.Duration(dbConfig.MaxLifetime))
+			dbSQL.SetConnMaxLifetime(dbConfig.MaxLifetime)
 
 			this.setDb(dbConfig.Db, DB, dbSQL)
 
@@ -190,28 +308,246 @@ func (this *MysqlClient) init() {
 			}
 		}
 
-		go this.Stats()
 		//DB.SetLogger(log.L)
 		this.logger.Infof("[mysql] %s init success", dbConfig.Db)
 	}
+
+	this.initShards()
+
+	if len(this.routers) > 0 {
+		go this.checkReplicas()
+	}
 }
 
-func (this *MysqlClient) setDb(db_name string, gdb *gorm.DB, db *sql.DB) bool {
+// initShards builds the routers of "mysql_shards" and WithShardConfig.
+func (this *SqlClient) initShards() {
+	shardConfigs, err := LoadShardConfigs(this.conf)
+	if err != nil {
+		this.logger.Panicf("Fatal error config file: %s \n", err.Error())
+	}
+	shardConfigs = append(shardConfigs, this.shardConfigs...)
+
+	for _, shardConfig := range shardConfigs {
+		for _, db := range shardConfig.Dbs {
+			if _, ok := this.dialects[strings.ToLower(db)]; !ok {
+				this.logger.Panicf("[db] shard %s init error : %s not found in dbs", shardConfig.Logical, db)
+			}
+		}
+
+		logical := strings.ToLower(shardConfig.Logical)
+		router, err := newShardRouter(shardConfig, this.shardKeys[logical])
+		if err != nil {
+			this.logger.Panicf("[db] shard %s init error : %s", shardConfig.Logical, err.Error())
+		}
+		this.shardRouters[logical] = router
+
+		this.logger.Infof("[mysql] shard %s init success", shardConfig.Logical)
+	}
+}
+
+// newRouter opens the replicas of dbConfig, each one has its own proxy chain,
+// the proxies of master are used if the replica has none.
+func (this *SqlClient) newRouter(dbConfig DbConfig, dialect dialect, master SqlCommon,
+	masterProxies []func() interface{}) *rwRouter {
+	replicas := make([]*replica, 0, len(dbConfig.Replicas))
+	for k, replicaConfig := range dbConfig.Replicas {
+		var dbSQL *sql.DB
+
+		//not needed by integration tests
+		dsn, err := replicaConfig.DSN(dbConfig)
+		if err != nil && this.db == nil {
+			this.logger.Panicf("[db] %s replica %d init error : %s", dbConfig.Db, k, err.Error())
+		}
+		name := replicaName(dialect, dsn, k)
+
+		if this.db == nil {
+			dbSQL, err = sql.Open(dialect.driverName(), dsn)
+			if err != nil {
+				this.logger.Panicf("[db] %s replica %s init error : %s", dbConfig.Db, name, err.Error())
+			}
+		} else {
+			dbSQL = this.db
+		}
+
+		if replicaConfig.MaxIdle == 0 {
+			replicaConfig.MaxIdle = dbConfig.MaxIdle
+		}
+		if replicaConfig.MaxOpen == 0 {
+			replicaConfig.MaxOpen = dbConfig.MaxOpen
+		}
+		if replicaConfig.MaxLifetime == 0 {
+			replicaConfig.MaxLifetime = dbConfig.MaxLifetime
+		}
+		dbSQL.SetMaxIdleConns(replicaConfig.MaxIdle)
+		dbSQL.SetMaxOpenConns(replicaConfig.MaxOpen)
+		dbSQL.SetConnMaxLifetime(replicaConfig.MaxLifetime)
+
+		proxies := masterProxies
+		if replicaConfig.Proxies != nil {
+			proxies = this.resolveProxies(dbConfig.Db+"_"+name, replicaConfig.Proxies)
+		}
+
+		//never in a transaction, they go to master
+		var db SqlCommon = dbSQL
+		if len(proxies) > 0 {
+			openRawDb := this.rawDbOpener(dbConfig.Db+"_"+name, dialect, dsn, dbSQL)
+			firstProxy := proxy.NewProxyFactory().GetFirstInstance("db_"+dbConfig.Db+"_"+name,
+				dbSQL, withRawDb(openRawDb, proxies)...)
+			var ok bool
+			if db, ok = firstProxy.(SqlCommon); !ok {
+				this.logger.Panicf("[db] %s proxy %T must implement SqlCommon", dbConfig.Db, firstProxy)
+			}
+		}
+
+		replicas = append(replicas, &replica{name: name, db: db, sqlDb: dbSQL})
+		if dbSQL != nil {
+			mysqlPoolCollector.add(strings.ToLower(dbConfig.Db), name, dbSQL)
+		}
+	}
+
+	router := newRwRouter(dbConfig.Db, dialect, master, replicas, dbConfig.Balance,
+		dbConfig.MaxReplicaLag, this.logger)
+	this.routers[strings.ToLower(dbConfig.Db)] = router
+
+	return router
+}
+
+// registerBuiltinProxies registers the proxies of this package by their names.
+func (this *SqlClient) registerBuiltinProxies() {
+	builtins := map[string]func() interface{}{
+		"monitor_proxy": func() interface{} {
+			monitorProxyOptions := MonitorProxyOptions{}
+			return NewMonitorProxy(
+				monitorProxyOptions.WithConf(this.conf),
+				monitorProxyOptions.WithLogger(this.logger),
+			)
+		},
+		"guard_proxy": func() interface{} {
+			guardProxyOptions := GuardProxyOptions{}
+			return NewGuardProxy(
+				guardProxyOptions.WithConf(this.conf),
+				guardProxyOptions.WithLogger(this.logger),
+			)
+		},
+		"cache_proxy": func() interface{} {
+			cacheProxyOptions := CacheProxyOptions{}
+			return NewCacheProxy(
+				cacheProxyOptions.WithConf(this.conf),
+				cacheProxyOptions.WithLogger(this.logger),
+			)
+		},
+		"cassette_proxy": func() interface{} {
+			cassetteProxyOptions := CassetteProxyOptions{}
+			return NewCassetteProxy(
+				cassetteProxyOptions.WithConf(this.conf),
+				cassetteProxyOptions.WithLogger(this.logger),
+			)
+		},
+	}
+
+	for name, builtin := range builtins {
+		if _, ok := this.namedProxies[name]; !ok {
+			this.namedProxies[name] = builtin
+		}
+	}
+}
+
+// resolveProxies returns the proxies of names, or the proxies of WithProxy if names is nil.
+func (this *SqlClient) resolveProxies(db_name string, names []string) []func() interface{} {
+	if names == nil {
+		return this.proxy
+	}
+
+	proxies := make([]func() interface{}, 0, len(names))
+	for _, name := range names {
+		if name == NoProxy {
+			continue
+		}
+
+		namedProxy, ok := this.namedProxies[name]
+		if !ok {
+			this.logger.Panicf("[db] %s proxy %s is not registered", db_name, name)
+		}
+		proxies = append(proxies, namedProxy)
+	}
+
+	return proxies
+}
+
+// rawDbUser is a proxy which runs statements of its own, like EXPLAIN of the monitor proxy,
+// they go to the database directly, not through the proxies after it.
+// openDb returns a pool of one connection shared by the proxies of the db,
+// so they never take the connections of the app, it is opened at the first call.
+type rawDbUser interface {
+	setRawDb(openDb func() *sql.DB)
+}
+
+// withRawDb returns the proxies which pass openDb to the rawDbUsers.
+func withRawDb(openDb func() *sql.DB, proxies []func() interface{}) []func() interface{} {
+	rawDbProxies := make([]func() interface{}, len(proxies))
+	for k, proxyFunc := range proxies {
+		proxyFunc := proxyFunc
+		rawDbProxies[k] = func() interface{} {
+			proxyIns := proxyFunc()
+			if user, ok := proxyIns.(rawDbUser); ok {
+				user.setRawDb(openDb)
+			}
+			return proxyIns
+		}
+	}
+
+	return rawDbProxies
+}
+
+// rawDbOpener returns the openDb of rawDbUser for dsn, db is used by integration tests.
+func (this *SqlClient) rawDbOpener(dbName string, dialect dialect, dsn string, db *sql.DB) func() *sql.DB {
+	var once sync.Once
+	var rawDb *sql.DB
+
+	return func() *sql.DB {
+		once.Do(func() {
+			if this.db != nil {
+				rawDb = db
+				return
+			}
+
+			var err error
+			rawDb, err = sql.Open(dialect.driverName(), dsn)
+			if err != nil {
+				this.logger.Errorf("[db] %s open raw db error : %s", dbName, err.Error())
+				return
+			}
+			rawDb.SetMaxOpenConns(1)
+			rawDb.SetMaxIdleConns(1)
+
+			this.rawDbLock.Lock()
+			this.rawDbs = append(this.rawDbs, rawDb)
+			this.rawDbLock.Unlock()
+		})
+
+		return rawDb
+	}
+}
+
+func (this *SqlClient) setDb(db_name string, gdb *gorm.DB, db *sql.DB) bool {
 	db_name = strings.ToLower(db_name)
 
 	//m.mysqlLock.Lock()
 	this.gdbs[db_name] = gdb
 	this.sqlDbs[db_name] = db
+	if db != nil {
+		mysqlPoolCollector.add(db_name, "", db)
+	}
 
 	//m.mysqlLock.Unlock()
 	return true
 }
 
-func (this *MysqlClient) GetDb(db_name string) *gorm.DB {
+func (this *SqlClient) GetDb(db_name string) *gorm.DB {
 	return this.getDb(nil, db_name)
 }
 
-func (this *MysqlClient) getDb(ctx context.Context, db_name string) *gorm.DB {
+func (this *SqlClient) getDb(ctx context.Context, db_name string) *gorm.DB {
 	db_name = strings.ToLower(db_name)
 
 	//m.mysqlLock.RLock()
@@ -225,11 +561,38 @@ func (this *MysqlClient) getDb(ctx context.Context, db_name string) *gorm.DB {
 	}
 }
 
-func (this *MysqlClient) GetCtxDb(ctx context.Context, db_name string) *gorm.DB {
-	return this.getDb(ctx, db_name)
+// GetCtxDb returns the db of db_name whose statements carry ctx through the proxy chain,
+// so they are traced as children of the span in ctx and canceled with ctx.
+// If db_name has replicas, the reads after a write of the db or in a transaction go to master,
+// also through the later GetCtxDb calls if ctx comes from NewRWSessionContext.
+// The writes of gorm pass the proxy chain too, see ctxDb.Begin.
+// gorm keeps the SQLCommon in the *gorm.DB and sets it back after its transactions,
+// so each ctx gets its own *gorm.DB, settings made on the db of GetDb, like SingularTable, are not carried.
+func (this *SqlClient) GetCtxDb(ctx context.Context, db_name string) *gorm.DB {
+	db_name = strings.ToLower(db_name)
+	sqlCommon, ok := this.sqlCommons[db_name]
+	if !ok || ctx == nil {
+		return this.getDb(ctx, db_name)
+	}
+
+	if router, ok := this.routers[db_name]; ok {
+		ctx = router.withSession(ctx)
+	}
+
+	DB, err := gorm.Open(this.dialects[db_name].gormDialect(), newCtxDb(ctx, db_name, sqlCommon))
+	if err != nil {
+		this.logger.Errorc(ctx, "[db] %s open error : %s", db_name, err.Error())
+		return nil
+	}
+
+	if this.conf.GetBool("debug") == true {
+		DB.LogMode(true)
+	}
+
+	return DB
 }
 
-func (this *MysqlClient) Ping() []error {
+func (this *SqlClient) Ping() []error {
 	var errs []error
 	var err error
 	for _, db := range this.sqlDbs {
@@ -241,7 +604,11 @@ func (this *MysqlClient) Ping() []error {
 	return errs
 }
 
-func (this *MysqlClient) Close() {
+// Deprecated: the stats of the pools are read at scrape time, see "mysql_stats".
+func (this *SqlClient) Stats() {}
+
+// Close closes the dbs and removes their pools from "mysql_stats".
+func (this *SqlClient) Close() {
 	var err error
 	for _, db := range this.gdbs {
 		err = db.Close()
@@ -250,51 +617,50 @@ func (this *MysqlClient) Close() {
 		}
 	}
 
-	//this.closeChan <- true
-	return
-}
+	for db_name, db := range this.sqlDbs {
+		mysqlPoolCollector.remove(db_name, "", db)
+	}
 
-func (this *MysqlClient) Stats() {
+	this.rawDbLock.Lock()
+	for _, db := range this.rawDbs {
+		db.Close()
+	}
+	this.rawDbs = nil
+	this.rawDbLock.Unlock()
 
-	defer func() {
-		if err := recover(); err != nil {
-			this.logger.Infof(err.(error).Error())
+	for db_name, router := range this.routers {
+		for _, rep := range router.replicas {
+			if rep.sqlDb != nil {
+				mysqlPoolCollector.remove(db_name, rep.name, rep.sqlDb)
+			}
 		}
-	}()
+	}
 
+	this.closeOnce.Do(func() {
+		close(this.closeChan)
+	})
+
+	//the recorded statements
+	if err = cassette.SaveAll(); err != nil {
+		this.logger.Errorf("[db] save cassette error : %s", err.Error())
+	}
+}
+
+// checkReplicas checks the replicas of the routers every stateTicker until Close.
+func (this *SqlClient) checkReplicas() {
 	ticker := time.NewTicker(this.stateTicker)
-	var stats sql.DBStats
+	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			for db_name, db := range this.sqlDbs {
-
-				stats = db.Stats()
-
-				maxOpenConnLab := prometheus.Labels{"db": db_name, "stats": "max_open_conn"}
-				mysqlStats.With(maxOpenConnLab).Set(float64(stats.MaxOpenConnections))
-
-				openConnLab := prometheus.Labels{"db": db_name, "stats": "open_conn"}
-				mysqlStats.With(openConnLab).Set(float64(stats.OpenConnections))
-
-				inUseLab := prometheus.Labels{"db": db_name, "stats": "in_use"}
-				mysqlStats.With(inUseLab).Set(float64(stats.InUse))
-
-				idleLab := prometheus.Labels{"db": db_name, "stats": "idle"}
-				mysqlStats.With(idleLab).Set(float64(stats.Idle))
-
-				waitCountLab := prometheus.Labels{"db": db_name, "stats": "wait_count"}
-				mysqlStats.With(waitCountLab).Set(float64(stats.WaitCount))
+			for _, router := range this.routers {
+				ctx, cancel := context.WithTimeout(context.Background(), this.stateTicker)
+				router.check(ctx)
+				cancel()
 			}
 		case <-this.closeChan:
-			this.logger.Infof("stop stats")
-			goto Stop
+			return
 		}
 	}
-
-Stop:
-	ticker.Stop()
-
-	return
 }
@@ -3,15 +3,27 @@ package mysql
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	mysqlDriver "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
-	"github.com/ory/dockertest/v3"
-	dc "github.com/ory/dockertest/v3/docker"
+	"github.com/jukylin/esim/pkg/cassette"
+	opentracing2 "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/mattn/go-sqlite3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -19,13 +31,13 @@ import (
 var (
 	test1Config = DbConfig{
 		Db:      "test_1",
-		Dsn:     "root:123456@tcp(localhost:3306)/test_1?charset=utf8&parseTime=True&loc=Local",
+		Driver:  DriverSqlite,
 		MaxIdle: 10,
 		MaxOpen: 100}
 
 	test2Config = DbConfig{
 		Db:      "test_2",
-		Dsn:     "root:123456@tcp(localhost:3306)/test_1?charset=utf8&parseTime=True&loc=Local",
+		Driver:  DriverSqlite,
 		MaxIdle: 10,
 		MaxOpen: 100}
 )
@@ -45,73 +57,48 @@ var db *sql.DB
 func TestMain(m *testing.M) {
 	logger := log.NewLogger()
 
-	pool, err := dockertest.NewPool("")
+	dir, err := ioutil.TempDir("", "mysql")
 	if err != nil {
-		logger.Fatalf("Could not connect to docker: %s", err)
+		logger.Fatalf("Could not create the dir of sqlite: %s", err.Error())
 	}
 
-	opt := &dockertest.RunOptions{
-		Repository: "mysql",
-		Tag:        "latest",
-		Env:        []string{"MYSQL_ROOT_PASSWORD=123456"},
-	}
-
-	// pulls an image, creates a container based on it and runs it
-	resource, err := pool.RunWithOptions(opt, func(hostConfig *dc.HostConfig) {
-		hostConfig.PortBindings = map[dc.Port][]dc.PortBinding{
-			"3306/tcp": {{HostIP: "", HostPort: "3306"}},
+	test1Config.Database = filepath.Join(dir, "test_1.db")
+	test2Config.Database = filepath.Join(dir, "test_2.db")
+
+	sqls := map[string]string{
+		test1Config.Database: `CREATE TABLE IF NOT EXISTS test(
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  title VARCHAR(10) NOT NULL DEFAULT ''
+		);`,
+		test2Config.Database: `CREATE TABLE IF NOT EXISTS user(
+		  id INTEGER PRIMARY KEY AUTOINCREMENT,
+		  username VARCHAR(10) NOT NULL DEFAULT ''
+		);`}
+
+	for database, execSql := range sqls {
+		sqliteDb, err := sql.Open(DriverSqlite, database)
+		if err != nil {
+			logger.Fatalf("Could not open sqlite: %s", err.Error())
 		}
-	})
-	if err != nil {
-		logger.Fatalf("Could not start resource: %s", err)
-	}
 
-	resource.Expire(120)
-
-	if err := pool.Retry(func() error {
-		var err error
-		db, err = sql.Open("mysql", "root:123456@tcp(localhost:3306)/mysql?charset=utf8&parseTime=True&loc=Local")
+		_, err = sqliteDb.Exec(execSql)
 		if err != nil {
-			return err
+			logger.Fatalf("Could not create table: %s", err.Error())
 		}
-		db.SetMaxOpenConns(100)
-
-		return db.Ping()
-	}); err != nil {
-		logger.Fatalf("Could not connect to docker: %s", err)
+		sqliteDb.Close()
 	}
 
-	sqls := []string{
-		`create database test_1;`,
-		`CREATE TABLE IF NOT EXISTS test_1.test(
-		  id int not NULL auto_increment,
-		  title VARCHAR(10) not NULL DEFAULT '',
-		  PRIMARY KEY (id)
-		)engine=innodb;`,
-		`create database test_2;`,
-		`CREATE TABLE IF NOT EXISTS test_2.user(
-		  id int not NULL auto_increment,
-		  username VARCHAR(10) not NULL DEFAULT '',
-			PRIMARY KEY (id)
-		)engine=innodb;`}
-
-	for _, execSql := range sqls {
-		res, err := db.Exec(execSql)
-		if err != nil {
-			logger.Errorf(err.Error())
-		}
-		_, err = res.RowsAffected()
-		if err != nil {
-			logger.Errorf(err.Error())
-		}
+	db, err = sql.Open(DriverSqlite, test1Config.Database)
+	if err != nil {
+		logger.Fatalf("Could not open sqlite: %s", err.Error())
 	}
+	db.SetMaxOpenConns(100)
+
 	code := m.Run()
 
 	db.Close()
 	// You can't defer this because os.Exit doesn't care for defer
-	if err := pool.Purge(resource); err != nil {
-		logger.Fatalf("Could not purge resource: %s", err)
-	}
+	os.RemoveAll(dir)
 	os.Exit(code)
 }
 
@@ -125,7 +112,6 @@ func TestInitAndSingleInstance(t *testing.T) {
 	)
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	_, ok := mysqlClient.gdbs["test_1"]
@@ -156,7 +142,6 @@ func TestProxyPatternWithTwoInstance(t *testing.T) {
 
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	ts := &TestStruct{}
@@ -165,7 +150,6 @@ func TestProxyPatternWithTwoInstance(t *testing.T) {
 	assert.Len(t, db1.GetErrors(), 0)
 
 	db2 := mysqlClient.GetCtxDb(ctx, "test_2")
-	db2.Exec("use test_2;")
 	assert.NotNil(t, db2)
 
 	us := &UserStruct{}
@@ -206,9 +190,9 @@ func TestMulProxyPatternWithOneInstance(t *testing.T) {
 
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
+	db1.Exec("update test set title = title where id = 0")
 	ts := &TestStruct{}
 	db1.Table("test").First(ts)
 
@@ -255,7 +239,6 @@ func TestMulProxyPatternWithTwoInstance(t *testing.T) {
 
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	ts := &TestStruct{}
@@ -264,7 +247,6 @@ func TestMulProxyPatternWithTwoInstance(t *testing.T) {
 	assert.Len(t, db1.GetErrors(), 0)
 
 	db2 := mysqlClient.GetCtxDb(ctx, "test_2")
-	db2.Exec("use test_2;")
 	assert.NotNil(t, db2)
 
 	us := &UserStruct{}
@@ -334,7 +316,6 @@ func TestDummyProxy_Exec(t *testing.T) {
 	)
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	db1.Table("test").Create(&TestStruct{})
@@ -362,24 +343,77 @@ func TestMysqlClient_GetStats(t *testing.T) {
 	)
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
+	assert.Nil(t, db1.Table("test").Count(new(int)).Error)
 
-	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, float64(100), poolStatsValue(t, "test_1", "max_open_conn"))
+	assert.Equal(t, float64(1), poolStatsValue(t, "test_1", "idle"))
+	assert.Equal(t, float64(0), poolStatsValue(t, "test_1", "wait_duration_seconds"))
 
-	lab := prometheus.Labels{"db": "test_1", "stats": "max_open_conn"}
-	c, _ := mysqlStats.GetMetricWith(lab)
-	metric := &io_prometheus_client.Metric{}
-	c.Write(metric)
-	assert.Equal(t, float64(100), metric.Gauge.GetValue())
+	mysqlClient.Close()
+	assert.Equal(t, float64(-1), poolStatsValue(t, "test_1", "idle"))
+}
 
-	labIdle := prometheus.Labels{"db": "test_1", "stats": "idle"}
-	c, _ = mysqlStats.GetMetricWith(labIdle)
-	metric = &io_prometheus_client.Metric{}
-	c.Write(metric)
-	assert.Equal(t, float64(1), metric.Gauge.GetValue())
+// poolStatsValue returns -1 if the pool is not collected.
+func poolStatsValue(t *testing.T, db, stats string) float64 {
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(mysqlPoolCollector))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+
+			if labels["db"] == db && labels["replica"] == "" && labels["stats"] == stats {
+				if metric.Counter != nil {
+					return metric.GetCounter().GetValue()
+				}
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
 
-	mysqlClient.Close()
+	return -1
+}
+
+func TestPoolCollector(t *testing.T) {
+	collector := newPoolCollector()
+	pool := newMemDb(nil)
+	pool.SetMaxOpenConns(10)
+	collector.add("pool_test", "", pool)
+
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(collector))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+
+	types := map[string]io_prometheus_client.MetricType{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "stats" {
+					types[family.GetName()+"."+label.GetValue()] = family.GetType()
+				}
+			}
+		}
+	}
+
+	assert.Equal(t, io_prometheus_client.MetricType_GAUGE, types["mysql_stats.max_open_conn"])
+	assert.Equal(t, io_prometheus_client.MetricType_GAUGE, types["mysql_stats.idle"])
+	assert.Equal(t, io_prometheus_client.MetricType_COUNTER, types["mysql_stats_total.wait_count"])
+	assert.Equal(t, io_prometheus_client.MetricType_COUNTER, types["mysql_stats_total.max_idle_closed"])
+	assert.Equal(t, io_prometheus_client.MetricType_COUNTER, types["mysql_stats_total.max_idle_time_closed"])
+	assert.Len(t, types, 9)
+
+	collector.remove("pool_test", "", pool)
+	families, err = registry.Gather()
+	assert.Nil(t, err)
+	assert.Empty(t, families)
 }
 
 func TestMysqlClient_TxCommit(t *testing.T) {
@@ -399,7 +433,6 @@ func TestMysqlClient_TxCommit(t *testing.T) {
 	)
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	tx := db1.Begin()
@@ -435,7 +468,6 @@ func TestMysqlClient_TxRollBack(t *testing.T) {
 	)
 	ctx := context.Background()
 	db1 := mysqlClient.GetCtxDb(ctx, "test_1")
-	db1.Exec("use test_1;")
 	assert.NotNil(t, db1)
 
 	tx := db1.Begin()
@@ -453,3 +485,1139 @@ func TestMysqlClient_TxRollBack(t *testing.T) {
 
 	mysqlClient.Close()
 }
+
+func TestCassetteProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	memConfig := config.NewMemConfig()
+	memConfig.Set("cassette_mode", cassette.ModeRecord)
+	memConfig.Set("cassette_file", filepath.Join(dir, "mysql.json"))
+
+	cassetteProxyOptions := CassetteProxyOptions{}
+	recordProxy := NewCassetteProxy(
+		cassetteProxyOptions.WithConf(memConfig),
+		cassetteProxyOptions.WithLogger(log.NewLogger()))
+	recordProxy.NextProxy(newMemDb(func(query string, args []driver.Value) *memResult {
+		if query == "select count(*) from test" {
+			//not supported by the cassette
+			return &memResult{columns: []string{"count(*)"}, rows: [][]driver.Value{{uint64(1)}}}
+		}
+
+		return &memResult{
+			columns:      []string{"id", "title"},
+			rows:         [][]driver.Value{{int64(1), []byte("test")}},
+			rowsAffected: 1,
+		}
+	}))
+
+	ts := &TestStruct{}
+	err = recordProxy.QueryRow("select id, title from test where id = ?", 1).Scan(&ts.Id, &ts.Title)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", ts.Title)
+
+	result, err := recordProxy.Exec("update test set title = ? where id = ?", "test", 1)
+	assert.Nil(t, err)
+	affected, _ := result.RowsAffected()
+	assert.Equal(t, int64(1), affected)
+
+	var count uint64
+	err = recordProxy.QueryRow("select count(*) from test").Scan(&count)
+	assert.EqualError(t, err, "mysql: record select count(*) from test : cassette: unsupported value type uint64")
+
+	recordProxy.cassette.Eject()
+	memConfig.Set("cassette_mode", cassette.ModeReplay)
+	replayProxy := NewCassetteProxy(
+		cassetteProxyOptions.WithConf(memConfig),
+		cassetteProxyOptions.WithLogger(log.NewLogger()))
+
+	ts = &TestStruct{}
+	rows, err := replayProxy.Query("select id, title from test where id = ?", 1)
+	assert.Nil(t, err)
+	assert.True(t, rows.Next())
+	assert.Nil(t, rows.Scan(&ts.Id, &ts.Title))
+	rows.Close()
+	assert.Equal(t, 1, ts.Id)
+	assert.Equal(t, "test", ts.Title)
+
+	result, err = replayProxy.Exec("update test set title = ? where id = ?", "test", 1)
+	assert.Nil(t, err)
+	affected, _ = result.RowsAffected()
+	assert.Equal(t, int64(1), affected)
+
+	_, err = replayProxy.Exec("delete from test")
+	assert.True(t, errors.Is(err, cassette.ErrUnmatched))
+
+	//not recorded
+	err = replayProxy.QueryRow("select count(*) from test").Scan(&count)
+	assert.True(t, errors.Is(err, cassette.ErrUnmatched))
+}
+
+func newTitleDb(title string, lag string) *sql.DB {
+	return newMemDb(func(query string, args []driver.Value) *memResult {
+		if query == "SHOW SLAVE STATUS" {
+			return &memResult{
+				columns: []string{"Slave_IO_State", "Seconds_Behind_Master"},
+				rows:    [][]driver.Value{{[]byte("Waiting"), []byte(lag)}},
+			}
+		}
+
+		return &memResult{
+			columns: []string{"title"},
+			rows:    [][]driver.Value{{[]byte(title)}},
+		}
+	})
+}
+
+func queryTitle(t *testing.T, db gorm.SQLCommon, query string) string {
+	var title string
+	err := db.QueryRow(query).Scan(&title)
+	assert.Nil(t, err)
+	return title
+}
+
+func TestRwRouter(t *testing.T) {
+	replicaA := &replica{name: "a", sqlDb: newTitleDb("a", "0")}
+	replicaA.db = replicaA.sqlDb
+	replicaB := &replica{name: "b", sqlDb: newTitleDb("b", "5")}
+	replicaB.db = replicaB.sqlDb
+
+	router := newRwRouter("test", mysqlDialect{}, newTitleDb("master", "0"),
+		[]*replica{replicaA, replicaB}, RoundRobin, time.Second, log.NewLogger())
+
+	titles := map[string]int{}
+	for i := 0; i < 4; i++ {
+		titles[queryTitle(t, router, "select title from test")]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, titles)
+
+	assert.Equal(t, "master", queryTitle(t, router, "select title from test for update"))
+	assert.Equal(t, "master", queryTitle(t, newCtxDb(PinMaster(context.Background()), "test", router),
+		"select title from test"))
+
+	//read your writes
+	ctx := NewRWSessionContext(context.Background())
+	bound := newCtxDb(ctx, "test", router)
+	assert.NotEqual(t, "master", queryTitle(t, bound, "select title from test"))
+	_, err := bound.Exec("update test set title = ?", "master")
+	assert.Nil(t, err)
+	assert.Equal(t, "master", queryTitle(t, bound, "select title from test"))
+	assert.Equal(t, "master", queryTitle(t, newCtxDb(ctx, "test", router), "select title from test"))
+
+	//read your writes through separate GetCtxDb calls
+	mysqlClient := &SqlClient{
+		sqlCommons: map[string]SqlCommon{"test": router},
+		routers:    map[string]*rwRouter{"test": router},
+		dialects:   map[string]dialect{"test": mysqlDialect{}},
+		conf:       config.NewNullConfig(),
+		logger:     log.NewLogger(),
+	}
+	reqCtx := NewRWSessionContext(context.Background())
+	assert.Nil(t, mysqlClient.GetCtxDb(reqCtx, "test").Exec("update test set title = ?", "master").Error)
+	ts := TestStruct{}
+	assert.Nil(t, mysqlClient.GetCtxDb(reqCtx, "test").Raw("select title from test").Row().Scan(&ts.Title))
+	assert.Equal(t, "master", ts.Title)
+	//the values of reqCtx share its session
+	valueCtx := context.WithValue(reqCtx, memResultKey{}, nil)
+	assert.Nil(t, mysqlClient.GetCtxDb(valueCtx, "test").Raw("select title from test").Row().Scan(&ts.Title))
+	assert.Equal(t, "master", ts.Title)
+
+	//without a session each call has its own, also with a long-lived ctx
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, mysqlClient.GetCtxDb(baseCtx, "test").Exec("update test set title = ?", "master").Error)
+	assert.Nil(t, mysqlClient.GetCtxDb(baseCtx, "test").Raw("select title from test").Row().Scan(&ts.Title))
+	assert.NotEqual(t, "master", ts.Title)
+
+	//transactions stay on master
+	gdb, err := gorm.Open("mysql", newCtxDb(router.withSession(context.Background()), "test", router))
+	assert.Nil(t, err)
+	tx := gdb.Begin()
+	assert.Nil(t, tx.Error)
+	assert.Nil(t, tx.Raw("select title from test").Row().Scan(&ts.Title))
+	assert.Equal(t, "master", ts.Title)
+	tx.Rollback()
+
+	//b lags behind
+	router.check(context.Background())
+	assert.Equal(t, int32(1), replicaA.up)
+	assert.Equal(t, int32(0), replicaB.up)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, "a", queryTitle(t, router, "select title from test"))
+	}
+
+	//a is down too, fall back to master
+	replicaA.sqlDb.Close()
+	rows, err := router.Query("select title from test")
+	assert.Nil(t, err)
+	rows.Close()
+	assert.Equal(t, int32(0), replicaA.up)
+	assert.Equal(t, "master", queryTitle(t, router, "select title from test"))
+}
+
+func TestIsReadQuery(t *testing.T) {
+	assert.True(t, isReadQuery("select * from test"))
+	assert.True(t, isReadQuery(" /* hint */ SELECT 1"))
+	assert.True(t, isReadQuery("show tables"))
+	assert.False(t, isReadQuery("select * from test for update"))
+	assert.False(t, isReadQuery("select * from test lock in share mode"))
+	assert.False(t, isReadQuery("insert into test values (1)"))
+	assert.False(t, isReadQuery("/* unclosed"))
+}
+
+func TestMonitorProxy_Tracer(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("mysql_tracer", true)
+
+	tracer := mocktracer.New()
+	monitorProxyOptions := MonitorProxyOptions{}
+	monitorProxy := NewMonitorProxy(
+		monitorProxyOptions.WithConf(memConfig),
+		monitorProxyOptions.WithLogger(log.NewLogger()),
+		monitorProxyOptions.WithTracer(tracer))
+	monitorProxy.NextProxy(newMemDb(func(query string, args []driver.Value) *memResult {
+		return &memResult{rowsAffected: 2}
+	}))
+
+	span := tracer.StartSpan("parent")
+	ctx := opentracing2.ContextWithSpan(context.Background(), span)
+
+	gdb, err := gorm.Open("mysql", newCtxDb(ctx, "test_1", monitorProxy))
+	assert.Nil(t, err)
+	assert.Nil(t, gdb.Exec("update test set title = ?", "test").Error)
+
+	//no span without parent
+	_, err = monitorProxy.Exec("update test set title = ?", "test")
+	assert.Nil(t, err)
+
+	//the writes of gorm
+	assert.Nil(t, gdb.Table("test").Where("id = ?", 1).Update("title", "gorm").Error)
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).SpanID, spans[0].ParentID)
+	assert.Equal(t, "test_1", spans[0].Tag("db.instance"))
+	assert.Equal(t, "update test set title = ?", spans[0].Tag("db.statement"))
+	assert.Equal(t, int64(2), spans[0].Tag("db.rows_affected"))
+	assert.Equal(t, span.Context().(mocktracer.MockSpanContext).SpanID, spans[1].ParentID)
+	assert.Equal(t, "UPDATE `test` SET `title` = ?  WHERE (id = ?)", spans[1].Tag("db.statement"))
+}
+
+func counterValue(counter *prometheus.CounterVec, labels prometheus.Labels) float64 {
+	metric := &io_prometheus_client.Metric{}
+	counter.With(labels).Write(metric)
+	return metric.Counter.GetValue()
+}
+
+func TestMysqlClient_WithTx(t *testing.T) {
+	var execNum int
+	memDb := newMemDb(func(query string, args []driver.Value) *memResult {
+		execNum++
+		//deadlock at the first time
+		if execNum == 1 {
+			return &memResult{err: &mysqlDriver.MySQLError{Number: erDeadlock, Message: "Deadlock found"}}
+		}
+		return &memResult{rowsAffected: 1}
+	})
+
+	spyProxy := newSpyProxy(log.NewLogger(), "spyProxy")
+	spyProxy.NextProxy(newTxAwareDb("tx_test", memDb))
+
+	mysqlClient := &SqlClient{
+		gdbs:       make(map[string]*gorm.DB),
+		sqlCommons: map[string]SqlCommon{"tx_test": spyProxy},
+		routers:    make(map[string]*rwRouter),
+		dialects:   map[string]dialect{"tx_test": mysqlDialect{}},
+		conf:       config.NewNullConfig(),
+		logger:     log.NewLogger(),
+	}
+
+	ctx := context.Background()
+	err := mysqlClient.WithTx(ctx, "tx_test", nil, func(ctx context.Context, tx *gorm.DB) error {
+		assert.NotNil(t, txFromContext(ctx, "tx_test"))
+		return tx.Exec("update test set title = ?", "test").Error
+	})
+	assert.Nil(t, err)
+	assert.True(t, spyProxy.ExecWasCalled)
+	assert.Equal(t, 2, execNum)
+	assert.Equal(t, float64(1), counterValue(mysqlTxRetryTotal, prometheus.Labels{"db": "tx_test"}))
+	assert.Equal(t, float64(1), counterValue(mysqlTxTotal,
+		prometheus.Labels{"db": "tx_test", "outcome": "commit"}))
+
+	errBiz := errors.New("biz error")
+	err = mysqlClient.WithTx(ctx, "tx_test", nil, func(ctx context.Context, tx *gorm.DB) error {
+		//join the outer transaction
+		return mysqlClient.WithTx(ctx, "tx_test", nil, func(ctx context.Context, tx *gorm.DB) error {
+			return errBiz
+		})
+	})
+	assert.Equal(t, errBiz, err)
+
+	assert.Panics(t, func() {
+		mysqlClient.WithTx(ctx, "tx_test", nil, func(ctx context.Context, tx *gorm.DB) error {
+			panic("tx panic")
+		})
+	})
+	assert.Equal(t, float64(2), counterValue(mysqlTxTotal,
+		prometheus.Labels{"db": "tx_test", "outcome": "rollback"}))
+	assert.Equal(t, float64(1), counterValue(mysqlTxTotal,
+		prometheus.Labels{"db": "tx_test", "outcome": "panic"}))
+
+	assert.Error(t, mysqlClient.WithTx(ctx, "not_exists", nil, nil))
+}
+
+func TestMysqlClient_WithTx_CrossDb(t *testing.T) {
+	newDb := func(dbName string) SqlCommon {
+		return newTxAwareDb(dbName, newMemDb(func(query string, args []driver.Value) *memResult {
+			return &memResult{rowsAffected: 1}
+		}))
+	}
+
+	mysqlClient := &SqlClient{
+		gdbs:       make(map[string]*gorm.DB),
+		sqlCommons: map[string]SqlCommon{"tx_outer": newDb("tx_outer"), "tx_inner": newDb("tx_inner")},
+		routers:    make(map[string]*rwRouter),
+		dialects:   map[string]dialect{"tx_outer": mysqlDialect{}, "tx_inner": mysqlDialect{}},
+		conf:       config.NewNullConfig(),
+		logger:     log.NewLogger(),
+	}
+
+	var committed []string
+	ctx := context.Background()
+	err := mysqlClient.WithTx(ctx, "tx_outer", nil, func(ctx context.Context, tx *gorm.DB) error {
+		outerTx := txFromContext(ctx, "tx_outer")
+
+		err := mysqlClient.WithTx(ctx, "tx_inner", nil, func(ctx context.Context, tx *gorm.DB) error {
+			//the outer transaction stays in ctx
+			assert.Equal(t, outerTx, txFromContext(ctx, "tx_outer"))
+			assert.NotNil(t, txFromContext(ctx, "tx_inner"))
+			assert.True(t, onCommit(ctx, "tx_outer", func() { committed = append(committed, "tx_outer") }))
+			assert.True(t, onCommit(ctx, "tx_inner", func() { committed = append(committed, "tx_inner") }))
+
+			return mysqlClient.GetCtxDb(ctx, "tx_outer").Exec("update test set title = ?", "test").Error
+		})
+		assert.Nil(t, err)
+		assert.Nil(t, txFromContext(ctx, "tx_inner"))
+		assert.Equal(t, []string{"tx_inner"}, committed)
+
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"tx_inner", "tx_outer"}, committed)
+	assert.Nil(t, txFromContext(ctx, "tx_outer"))
+}
+
+func TestMysqlClient_WithTx_Gorm(t *testing.T) {
+	spyProxy := newSpyProxy(log.NewNullLogger(), "spyProxy")
+	sqlClientOptions := SqlClientOptions{}
+	sqlClient := NewSqlClient(
+		sqlClientOptions.WithLogger(log.NewNullLogger()),
+		sqlClientOptions.WithDbConfig([]DbConfig{test1Config}),
+		sqlClientOptions.WithProxy(func() interface{} {
+			return spyProxy
+		}),
+	)
+	defer sqlClient.Close()
+
+	countTitle := func(title string) int {
+		var count int
+		assert.Nil(t, sqlClient.GetCtxDb(context.Background(), "test_1").
+			Table("test").Where("title = ?", title).Count(&count).Error)
+		return count
+	}
+
+	ctx := context.Background()
+	errBiz := errors.New("biz error")
+	err := sqlClient.WithTx(ctx, "test_1", nil, func(ctx context.Context, tx *gorm.DB) error {
+		err := tx.Table("test").Create(&TestStruct{Title: "gorm_rb"}).Error
+		assert.Nil(t, err)
+		assert.True(t, spyProxy.ExecWasCalled)
+
+		err = tx.Table("test").Where("title = ?", "gorm_rb").Update("title", "gorm_rb2").Error
+		assert.Nil(t, err)
+
+		return errBiz
+	})
+	assert.Equal(t, errBiz, err)
+	assert.Equal(t, 0, countTitle("gorm_rb"))
+	assert.Equal(t, 0, countTitle("gorm_rb2"))
+
+	err = sqlClient.WithTx(ctx, "test_1", nil, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Table("test").Create(&TestStruct{Title: "gorm_tx"}).Error; err != nil {
+			return err
+		}
+		return tx.Table("test").Where("title = ?", "gorm_tx").Update("title", "gorm_tx2").Error
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, countTitle("gorm_tx2"))
+
+	//outside WithTx gorm starts a transaction of the chain
+	err = sqlClient.GetCtxDb(ctx, "test_1").Table("test").Where("title = ?", "gorm_tx2").
+		Delete(&TestStruct{}).Error
+	assert.Nil(t, err)
+	assert.Equal(t, 0, countTitle("gorm_tx2"))
+}
+
+func TestFingerprint(t *testing.T) {
+	testCases := []struct {
+		query string
+		fp    string
+	}{
+		{"SELECT * FROM user WHERE id IN (1, 2, 3) AND name = 'a'",
+			"select * from user where id in (?+) and name = ?"},
+		{"select *  from user\n where id in (4) and name = 'it''s'",
+			"select * from user where id in (?+) and name = ?"},
+		{"INSERT INTO `Test1` (id, title) VALUES (1, \"a\\\"b\"), (2, 'c')",
+			"insert into `Test1` (id, title) values (?+)"},
+		{"update t2 set score = -1.5e3, flag = 0xff /* hint */ where id = ? -- comment",
+			"update t2 set score = -?, flag = ? where id = ?"},
+		{"select id from user # comment\nlimit 10", "select id from user limit ?"},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.fp, fingerprint(test.query), test.query)
+	}
+
+	fingerprints := newFingerprintSet(1)
+	assert.Equal(t, "select ?", fingerprints.label("select 1"))
+	assert.Equal(t, "select ?", fingerprints.label("SELECT 2"))
+	assert.Equal(t, otherFingerprint, fingerprints.label("select 1 from dual"))
+
+	//one set of the metrics for all proxies
+	monitorProxyOptions := MonitorProxyOptions{}
+	monitorA := NewMonitorProxy(monitorProxyOptions.WithConf(config.NewMemConfig()))
+	monitorB := NewMonitorProxy(monitorProxyOptions.WithConf(config.NewMemConfig()))
+	assert.True(t, monitorA.fingerprints == monitorB.fingerprints)
+	assert.True(t, mysqlFingerprints == monitorA.fingerprints)
+	cacheProxyOptions := CacheProxyOptions{}
+	cacheA := NewCacheProxy(cacheProxyOptions.WithConf(config.NewMemConfig()))
+	cacheB := NewCacheProxy(cacheProxyOptions.WithConf(config.NewMemConfig()))
+	assert.True(t, cacheA.labels == cacheB.labels)
+	assert.True(t, mysqlCacheFingerprints == cacheA.labels)
+}
+
+func TestStubsProxy(t *testing.T) {
+	stubsProxyOptions := StubsProxyOptions{}
+	stubs := NewStubsProxy(stubsProxyOptions.WithLogger(log.NewLogger()))
+
+	stubs.ExpectSql("SELECT * FROM `test`  WHERE (id = 1)").
+		WillReturnRows([]string{"id", "title"}, []interface{}{1, "test"})
+	stubs.ExpectRegexp("^UPDATE `test`").WithArgs("test2", AnyArg).
+		WillReturnResult(0, 1)
+	stubs.ExpectSql("delete from test where id = ?").WithArgs(2).
+		WillReturnError(errors.New("delete error"))
+	stubs.ExpectSql("select 1").Times(2)
+
+	mysqlOnce = sync.Once{}
+	mysqlClientOptions := MysqlClientOptions{}
+	mysqlClient := NewMysqlClient(
+		mysqlClientOptions.WithDbConfig([]DbConfig{{Db: "stubs"}}),
+		mysqlClientOptions.WithDB(stubs.DB()),
+	)
+
+	ctx := context.Background()
+	ts := &TestStruct{}
+	err := mysqlClient.GetCtxDb(ctx, "stubs").Table("test").Where("id = ?", 5).Find(ts).Error
+	assert.Nil(t, err)
+	assert.Equal(t, "test", ts.Title)
+
+	db := mysqlClient.GetCtxDb(ctx, "stubs").Table("test").Where("id = ?", 1).
+		Update("title", "test2")
+	assert.Nil(t, db.Error)
+	assert.Equal(t, int64(1), db.RowsAffected)
+
+	err = mysqlClient.GetCtxDb(ctx, "stubs").Exec("delete from test where id = ?", 2).Error
+	assert.EqualError(t, err, "delete error")
+
+	err = mysqlClient.GetCtxDb(ctx, "stubs").Exec("insert into test values (3, 'c')").Error
+	assert.True(t, errors.Is(err, ErrUnexpectedSql))
+
+	err = stubs.ExpectationsWereMet()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected select ? 2 times, called 0 times")
+	assert.Contains(t, err.Error(), "unexpected insert into test values (3, 'c')")
+}
+
+func TestInspectStatement(t *testing.T) {
+	largeTables := map[string]bool{"user": true}
+
+	testCases := []struct {
+		query string
+		rules []string
+	}{
+		{"UPDATE `test` SET `title` = 'a'", []string{GuardNoWhere}},
+		{"update test set title = 'where' where id = 1", nil},
+		{"update test set title = (select title from t2 where id = 1)", []string{GuardNoWhere}},
+		{"DELETE FROM test", []string{GuardNoWhere}},
+		{"delete from test where id in (1, 2)", nil},
+		{"select * from user", []string{GuardNoLimit}},
+		{"select * from `db`.`USER` u where id = 1", []string{GuardNoLimit}},
+		{"select * from test t, user u where t.id = u.id", []string{GuardNoLimit}},
+		{"select * from test left join user on test.id = user.id limit 10", nil},
+		{"select * from user limit 1", nil},
+		{"select * from (select * from user limit 10) t", nil},
+		{"select * from test", nil},
+		{"CREATE TABLE test (id int)", []string{GuardDDL}},
+		{"/* drop */ truncate test", []string{GuardDDL}},
+		{"select 1; select 2;", []string{GuardMultiStatement}},
+		{"select ';'; ", nil},
+		{"select 1; delete from test", []string{GuardMultiStatement, GuardNoWhere}},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.rules, inspectStatement(test.query, largeTables), test.query)
+	}
+}
+
+func TestGuardProxy(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("runmode", "pro")
+	memConfig.Set("mysql_guard_policy_pro", map[string]interface{}{GuardDDL: GuardOff})
+	memConfig.Set("mysql_guard_large_tables", []string{"test"})
+
+	guardProxyOptions := GuardProxyOptions{}
+	guardProxy := NewGuardProxy(
+		guardProxyOptions.WithConf(memConfig),
+		guardProxyOptions.WithLogger(log.NewNullLogger()),
+	)
+
+	stubs := NewStubsProxy(StubsProxyOptions{}.WithLogger(log.NewNullLogger()))
+	stubs.ExpectSql("select * from test").WillReturnRows([]string{"id"}, []interface{}{1})
+	stubs.ExpectSql("create table t (id int)")
+	stubs.ExpectSql("delete from test").WithArgs()
+	guardProxy.NextProxy(stubs)
+
+	ctx := contextWithDbName(context.Background(), "guard")
+
+	_, err := guardProxy.ExecContext(ctx, "update test set title = ?", "a")
+	guardErr := &GuardError{}
+	assert.True(t, errors.As(err, &guardErr))
+	assert.Equal(t, GuardNoWhere, guardErr.Rule)
+	assert.Equal(t, float64(1), counterValue(mysqlGuardViolationTotal,
+		prometheus.Labels{"db": "guard", "rule": GuardNoWhere, "action": GuardReject}))
+
+	var id int
+	err = guardProxy.QueryRowContext(ctx, "select 1; select 2").Scan(&id)
+	assert.True(t, errors.As(err, &guardErr))
+	assert.Equal(t, GuardMultiStatement, guardErr.Rule)
+
+	//warned in pro
+	rows, err := guardProxy.QueryContext(ctx, "select * from test")
+	assert.Nil(t, err)
+	rows.Close()
+	assert.Equal(t, float64(1), counterValue(mysqlGuardViolationTotal,
+		prometheus.Labels{"db": "guard", "rule": GuardNoLimit, "action": GuardWarn}))
+
+	//off by config
+	_, err = guardProxy.ExecContext(ctx, "create table t (id int)")
+	assert.Nil(t, err)
+
+	_, err = guardProxy.ExecContext(NewGuardExemptContext(ctx, GuardNoWhere), "delete from test")
+	assert.Nil(t, err)
+
+	assert.Nil(t, stubs.ExpectationsWereMet())
+}
+
+func TestGuardProxy_Gorm(t *testing.T) {
+	dbConfig := test1Config
+	dbConfig.Proxies = []string{"guard_proxy"}
+	sqlClientOptions := SqlClientOptions{}
+	sqlClient := NewSqlClient(
+		sqlClientOptions.WithLogger(log.NewNullLogger()),
+		sqlClientOptions.WithDbConfig([]DbConfig{dbConfig}),
+	)
+	defer sqlClient.Close()
+
+	db := sqlClient.GetCtxDb(context.Background(), "test_1")
+	assert.Nil(t, db.Table("test").Create(&TestStruct{Title: "guard"}).Error)
+
+	err := db.Table("test").Update("title", "guard2").Error
+	guardErr := &GuardError{}
+	assert.True(t, errors.As(err, &guardErr))
+	assert.Equal(t, GuardNoWhere, guardErr.Rule)
+
+	var count int
+	assert.Nil(t, db.Table("test").Where("title = ?", "guard2").Count(&count).Error)
+	assert.Equal(t, 0, count)
+
+	assert.Nil(t, db.Table("test").Where("title = ?", "guard").Delete(&TestStruct{}).Error)
+}
+
+func TestLoadDbConfigs(t *testing.T) {
+	file, err := ioutil.TempFile("", "dbs*.yaml")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(`
+dbs:
+- {db: 'test', dsn: 'root:123456@tcp(0.0.0.0:3306)/test', maxlifetime: 10, maxreplicalag: '1.5s'}
+- {db: 'analytics', host: 'db.local', user: 'root', password: '123456', database: 'analytics',
+   connecttimeout: '500ms', readtimeout: 30, tls: 'skip-verify', maxlifetime: '1h',
+   proxies: ['monitor_proxy'],
+   replicas: [{host: 'replica.local', port: 3307, proxies: ['none']}]}
+`)
+	assert.Nil(t, err)
+	file.Close()
+
+	conf := config.NewViperConfig(config.ViperConfOptions{}.WithConfFile([]string{file.Name()}))
+	dbConfigs, err := LoadDbConfigs(conf)
+	assert.Nil(t, err)
+	assert.Len(t, dbConfigs, 2)
+
+	assert.Equal(t, 10*time.Second, dbConfigs[0].MaxLifetime)
+	assert.Equal(t, 1500*time.Millisecond, dbConfigs[0].MaxReplicaLag)
+	assert.Nil(t, dbConfigs[0].Proxies)
+	dsn, err := dbConfigs[0].DSN()
+	assert.Nil(t, err)
+	assert.Equal(t, "root:123456@tcp(0.0.0.0:3306)/test", dsn)
+
+	analytics := dbConfigs[1]
+	assert.Equal(t, time.Hour, analytics.MaxLifetime)
+	assert.Equal(t, []string{"monitor_proxy"}, analytics.Proxies)
+	dsn, err = analytics.DSN()
+	assert.Nil(t, err)
+	driverConfig, err := mysqlDriver.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, "db.local:3306", driverConfig.Addr)
+	assert.Equal(t, "analytics", driverConfig.DBName)
+	assert.Equal(t, 500*time.Millisecond, driverConfig.Timeout)
+	assert.Equal(t, 30*time.Second, driverConfig.ReadTimeout)
+	assert.Equal(t, "skip-verify", driverConfig.TLSConfig)
+	assert.Equal(t, defaultCharset, driverConfig.Params["charset"])
+	assert.True(t, driverConfig.ParseTime)
+
+	assert.Equal(t, []string{NoProxy}, analytics.Replicas[0].Proxies)
+	dsn, err = analytics.Replicas[0].DSN(analytics)
+	assert.Nil(t, err)
+	driverConfig, err = mysqlDriver.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, "replica.local:3307", driverConfig.Addr)
+	assert.Equal(t, "root", driverConfig.User)
+
+	_, err = DbConfig{Db: "empty"}.DSN()
+	assert.Error(t, err)
+}
+
+func TestMysqlClient_NamedProxies(t *testing.T) {
+	var spies []*spyProxy
+	memDb := newMemDb(func(query string, args []driver.Value) *memResult {
+		return &memResult{rowsAffected: 1}
+	})
+
+	mysqlOnce = sync.Once{}
+	mysqlClientOptions := MysqlClientOptions{}
+	mysqlClient := NewMysqlClient(
+		mysqlClientOptions.WithLogger(log.NewNullLogger()),
+		mysqlClientOptions.WithDbConfig([]DbConfig{
+			{Db: "primary", Proxies: []string{"spy", "guard_proxy"}},
+			{Db: "analytics", Proxies: []string{"spy"}},
+			{Db: "raw", Proxies: []string{NoProxy}},
+		}),
+		mysqlClientOptions.WithDB(memDb),
+		mysqlClientOptions.WithNamedProxy("spy", func() interface{} {
+			spy := newSpyProxy(log.NewNullLogger(), "spy")
+			spies = append(spies, spy)
+			return spy
+		}),
+	)
+
+	ctx := context.Background()
+	err := mysqlClient.GetCtxDb(ctx, "primary").Exec("delete from test").Error
+	guardErr := &GuardError{}
+	assert.True(t, errors.As(err, &guardErr))
+
+	err = mysqlClient.GetCtxDb(ctx, "analytics").Exec("delete from test").Error
+	assert.Nil(t, err)
+
+	_, ok := mysqlClient.sqlCommons["raw"].(*txAwareDb)
+	assert.True(t, ok)
+	assert.NotNil(t, mysqlClient.GetDb("raw").DB())
+
+	spyNum := 0
+	for _, spy := range spies {
+		if spy.ExecWasCalled {
+			spyNum++
+		}
+	}
+	assert.Equal(t, 2, spyNum)
+}
+
+type pgError struct {
+	code string
+}
+
+func (this pgError) Error() string {
+	return "pq: " + this.code
+}
+
+func (this pgError) SQLState() string {
+	return this.code
+}
+
+func TestDialect(t *testing.T) {
+	_, err := newDialect("oracle")
+	assert.NotNil(t, err)
+
+	mysql, err := newDialect("")
+	assert.Nil(t, err)
+	assert.Equal(t, DriverMysql, mysql.driverName())
+
+	pg, err := newDialect(DriverPgx)
+	assert.Nil(t, err)
+	assert.Equal(t, DriverPgx, pg.driverName())
+	assert.Equal(t, "postgres", pg.gormDialect())
+
+	assert.Nil(t, RegisterTLSProfile("pg_internal", TLSProfile{ServerName: "db.local"}))
+	analytics := DbConfig{Db: "analytics", Driver: DriverPostgres, Host: "db.local", User: "root",
+		Password: "it's", Database: "analytics", ConnectTimeout: 500 * time.Millisecond, TLS: "pg_internal"}
+	dsn, err := analytics.DSN()
+	assert.Nil(t, err)
+	assert.Equal(t, "host=db.local port=5432 user=root password='it\\'s' dbname=analytics "+
+		"connect_timeout=1 sslmode=verify-full", dsn)
+	assert.Equal(t, "db.local:5432", pg.addr(dsn))
+
+	dsn, err = ReplicaConfig{Host: "replica.local", Port: 5433}.DSN(analytics)
+	assert.Nil(t, err)
+	assert.Equal(t, "replica.local:5433", pg.addr(dsn))
+	assert.Equal(t, "db.local:5432", pg.addr("postgres://root@db.local:5432/analytics"))
+
+	assert.True(t, pg.isRetryableErr(fmt.Errorf("tx : %w", pgError{code: pgSerializationFailure})))
+	assert.False(t, pg.isRetryableErr(pgError{code: "23505"}))
+	assert.True(t, pg.isServerErr(pgError{code: "23505"}))
+	assert.False(t, pg.isServerErr(errors.New("dial tcp: connection refused")))
+
+	sqlite, err := newDialect(DriverSqlite)
+	assert.Nil(t, err)
+	dsn, err = DbConfig{Db: "local", Driver: DriverSqlite, Database: "local.db"}.DSN()
+	assert.Nil(t, err)
+	assert.Equal(t, "local.db", dsn)
+	_, err = ReplicaConfig{Host: "replica.local"}.DSN(DbConfig{Db: "local", Driver: DriverSqlite})
+	assert.NotNil(t, err)
+
+	assert.True(t, sqlite.isRetryableErr(sqlite3.Error{Code: sqlite3.ErrBusy}))
+	assert.False(t, sqlite.isRetryableErr(sqlite3.Error{Code: sqlite3.ErrConstraint}))
+	assert.True(t, isRetryableTxErr(mysql, &mysqlDriver.MySQLError{Number: erLockWaitTimeout}))
+}
+
+func TestShardRouter(t *testing.T) {
+	modulo, err := newShardRouter(ShardConfig{Logical: "order", Dbs: []string{"order_0", "order_1"}, Tables: 2}, nil)
+	assert.Nil(t, err)
+	shard, err := modulo.route(7)
+	assert.Nil(t, err)
+	assert.Equal(t, Shard{Logical: "order", Index: 3, Db: "order_1", TableSuffix: "_3"}, shard)
+	assert.Equal(t, "order_3", shard.Table("order"))
+
+	shard, err = modulo.route("6")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, shard.Index)
+
+	_, err = modulo.route(-1)
+	assert.NotNil(t, err)
+	_, err = modulo.route(1.5)
+	assert.NotNil(t, err)
+
+	ranges, err := newShardRouter(ShardConfig{Logical: "user", Dbs: []string{"user_0", "user_1"},
+		Strategy: Range, Ranges: []uint64{1000, 2000}}, nil)
+	assert.Nil(t, err)
+	shard, err = ranges.route(999)
+	assert.Nil(t, err)
+	assert.Equal(t, "user_0", shard.Db)
+	assert.Equal(t, "", shard.TableSuffix)
+	shard, err = ranges.route(1000)
+	assert.Nil(t, err)
+	assert.Equal(t, "user_1", shard.Db)
+	_, err = ranges.route(2000)
+	assert.True(t, errors.Is(err, ErrShardNotFound))
+
+	_, err = newShardRouter(ShardConfig{Logical: "user", Dbs: []string{"user_0", "user_1"},
+		Strategy: Range, Ranges: []uint64{2000, 1000}}, nil)
+	assert.NotNil(t, err)
+	_, err = newShardRouter(ShardConfig{Logical: "user", Dbs: []string{"user_0"}, Strategy: "random"}, nil)
+	assert.NotNil(t, err)
+
+	//only the keys of the new shard move
+	hash, err := newShardRouter(ShardConfig{Logical: "log", Dbs: []string{"log_0", "log_1", "log_2"},
+		Strategy: ConsistentHash}, nil)
+	assert.Nil(t, err)
+	moreHash, err := newShardRouter(ShardConfig{Logical: "log", Dbs: []string{"log_0", "log_1", "log_2", "log_3"},
+		Strategy: ConsistentHash}, nil)
+	assert.Nil(t, err)
+
+	var moved int
+	counts := map[string]int{}
+	for key := 0; key < 1000; key++ {
+		before, err := hash.route(key)
+		assert.Nil(t, err)
+		after, err := moreHash.route(key)
+		assert.Nil(t, err)
+		counts[before.Db]++
+		if before.Db != after.Db {
+			moved++
+			assert.Equal(t, "log_3", after.Db)
+		}
+	}
+	assert.Len(t, counts, 3)
+	assert.True(t, moved > 0 && moved < 500, "moved %d", moved)
+
+	custom, err := newShardRouter(ShardConfig{Logical: "order", Dbs: []string{"order_0", "order_1"}},
+		func(key interface{}) (uint64, error) {
+			return uint64(len(key.(string))), nil
+		})
+	assert.Nil(t, err)
+	shard, err = custom.route("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "order_1", shard.Db)
+}
+
+func TestSqlClient_Shard(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shard")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var dbConfigs []DbConfig
+	for k := 0; k < 2; k++ {
+		dbConfig := DbConfig{
+			Db:       "order_" + strconv.Itoa(k),
+			Driver:   DriverSqlite,
+			Database: filepath.Join(dir, "order_"+strconv.Itoa(k)+".db"),
+			MaxIdle:  1,
+			MaxOpen:  1}
+		dbConfigs = append(dbConfigs, dbConfig)
+
+		sqliteDb, err := sql.Open(DriverSqlite, dbConfig.Database)
+		assert.Nil(t, err)
+		for i := 0; i < 2; i++ {
+			_, err = sqliteDb.Exec("CREATE TABLE user_" + strconv.Itoa(k*2+i) +
+				" (id INTEGER PRIMARY KEY, username VARCHAR(10) NOT NULL DEFAULT '')")
+			assert.Nil(t, err)
+		}
+		sqliteDb.Close()
+	}
+
+	sqlClientOptions := SqlClientOptions{}
+	sqlClient := NewSqlClient(
+		sqlClientOptions.WithDbConfig(dbConfigs),
+		sqlClientOptions.WithShardConfig([]ShardConfig{
+			{Logical: "user", Dbs: []string{"order_0", "order_1"}, Tables: 2}}),
+	)
+	defer sqlClient.Close()
+
+	ctx := context.Background()
+	for id := 1; id <= 10; id++ {
+		db, err := sqlClient.GetShardDb(ctx, "user", id)
+		assert.Nil(t, err)
+		table, err := sqlClient.ShardTable("user", "user", id)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Table(table).Create(&UserStruct{Id: id, Username: "u" + strconv.Itoa(id)}).Error)
+	}
+
+	var count int64
+	assert.Nil(t, sqlClient.GetCtxDb(ctx, "order_1").Table("user_3").Count(&count).Error)
+	assert.Equal(t, int64(2), count)
+
+	count, err = sqlClient.ScatterCount(ctx, "user", "user", "id > ?", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), count)
+
+	var users []UserStruct
+	assert.Nil(t, sqlClient.ScatterFind(ctx, "user", "user", &users, "id <= ?", 4))
+	assert.Equal(t, []UserStruct{{4, "u4"}, {1, "u1"}, {2, "u2"}, {3, "u3"}}, users)
+
+	_, err = sqlClient.ScatterGather(ctx, "user", func(ctx context.Context, shard Shard, db *gorm.DB) (interface{}, error) {
+		return nil, db.Table(shard.Table("order")).Count(&count).Error
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, float64(1), counterValue(mysqlShardErrorTotal,
+		prometheus.Labels{"logical": "user", "shard": "0", "db": "order_0"}))
+	assert.Equal(t, float64(6), counterValue(mysqlShardTotal,
+		prometheus.Labels{"logical": "user", "shard": "1", "db": "order_0"}))
+
+	_, err = sqlClient.GetShardDb(ctx, "order", 1)
+	assert.NotNil(t, err)
+	assert.Len(t, sqlClient.Shards("user"), 4)
+}
+
+func TestMonitorProxy_Explain(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("mysql_tracer", true)
+	memConfig.Set("mysql_check_slow", true)
+	memConfig.Set("mysql_slow_time", 1)
+	memConfig.Set("mysql_explain", true)
+	memConfig.Set("mysql_explain_interval", 3600*1000)
+
+	var explainNum int32
+	tracer := mocktracer.New()
+	monitorProxyOptions := MonitorProxyOptions{}
+	monitorProxy := NewMonitorProxy(
+		monitorProxyOptions.WithConf(memConfig),
+		monitorProxyOptions.WithLogger(log.NewLogger()),
+		monitorProxyOptions.WithTracer(tracer))
+	monitorProxy.NextProxy(newMemDb(func(query string, args []driver.Value) *memResult {
+		assert.False(t, strings.HasPrefix(query, "EXPLAIN"), "EXPLAIN through the next proxy")
+
+		time.Sleep(2 * time.Millisecond)
+		return &memResult{columns: []string{"title"}, rows: [][]driver.Value{{[]byte("a")}}}
+	}))
+	rawDb := newMemDb(func(query string, args []driver.Value) *memResult {
+		assert.True(t, strings.HasPrefix(query, "EXPLAIN FORMAT=JSON"))
+		assert.Equal(t, []driver.Value{int64(1)}, args)
+		atomic.AddInt32(&explainNum, 1)
+		return &memResult{
+			columns: []string{"EXPLAIN"},
+			rows: [][]driver.Value{{[]byte(`{"query_block": {"nested_loop": [
+{"table": {"table_name": "test", "access_type": "ALL", "rows_examined_per_scan": 1000}},
+{"table": {"table_name": "user", "access_type": "ref", "key": "idx_title", "rows_examined_per_scan": 2}}]}}`)}},
+		}
+	})
+	monitorProxy.setRawDb(func() *sql.DB { return rawDb })
+
+	span := tracer.StartSpan("parent")
+	ctx := opentracing2.ContextWithSpan(context.Background(), span)
+
+	query := "select title from test join user on test.title = user.title where test.id > ?"
+	var title string
+	//explained in the background
+	assert.Nil(t, monitorProxy.QueryRowContext(ctx, query, 1).Scan(&title))
+	assert.Eventually(t, func() bool {
+		return monitorProxy.explainer.explain(nil, query, nil, nil) != nil
+	}, time.Second, time.Millisecond)
+
+	assert.Nil(t, monitorProxy.QueryRowContext(ctx, query, 1).Scan(&title))
+	//limited by mysql_explain_interval
+	assert.Nil(t, monitorProxy.QueryRowContext(ctx, "select title from test where id = ?", 1).Scan(&title))
+	assert.Nil(t, monitorProxy.QueryRowContext(ctx, "update test set title = ?", 1).Scan(&title))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&explainNum))
+
+	spans := tracer.FinishedSpans()
+	assert.Len(t, spans, 4)
+	assert.Nil(t, spans[0].Tag("db.plan.access_type"))
+	assert.Equal(t, "test:ALL,user:ref", spans[1].Tag("db.plan.access_type"))
+	assert.Equal(t, int64(1002), spans[1].Tag("db.plan.rows_examined"))
+	assert.Equal(t, "idx_title", spans[1].Tag("db.plan.keys"))
+	assert.Nil(t, spans[2].Tag("db.plan.access_type"))
+	assert.Nil(t, spans[3].Tag("db.plan.access_type"))
+
+	//passed by the client
+	db := newMemDb(nil)
+	withRawDb(func() *sql.DB { return db }, []func() interface{}{func() interface{} { return monitorProxy }})[0]()
+	assert.Equal(t, db, monitorProxy.rawDb)
+}
+
+func TestSqlClient_RawDbOpener(t *testing.T) {
+	sqlClient := &SqlClient{logger: log.NewLogger()}
+	dialect, err := newDialect("mysql")
+	assert.Nil(t, err)
+
+	appDb := newMemDb(nil)
+	openDb := sqlClient.rawDbOpener("test", dialect, "root:123456@tcp(127.0.0.1:3306)/test", appDb)
+	rawDb := openDb()
+	assert.NotEqual(t, appDb, rawDb)
+	assert.Equal(t, 1, rawDb.Stats().MaxOpenConnections)
+	//shared by the proxies of the db
+	assert.Equal(t, rawDb, openDb())
+	assert.Len(t, sqlClient.rawDbs, 1)
+
+	//not opened without explain
+	monitorProxy := NewMonitorProxy(MonitorProxyOptions{}.WithConf(config.NewMemConfig()))
+	monitorProxy.setRawDb(func() *sql.DB {
+		t.Fatal("opened without mysql_explain")
+		return nil
+	})
+	assert.Nil(t, monitorProxy.rawDb)
+}
+
+func TestExplainer_Traditional(t *testing.T) {
+	db := newMemDb(func(query string, args []driver.Value) *memResult {
+		if strings.HasPrefix(query, "EXPLAIN FORMAT=JSON") {
+			return &memResult{err: errors.New("You have an error in your SQL syntax")}
+		}
+
+		return &memResult{
+			columns: []string{"id", "select_type", "table", "type", "key", "rows"},
+			rows: [][]driver.Value{
+				{[]byte("1"), []byte("SIMPLE"), []byte("test"), []byte("range"), []byte("PRIMARY"), []byte("10")},
+				{[]byte("1"), []byte("SIMPLE"), []byte("user"), []byte("ALL"), nil, []byte("300")},
+			},
+		}
+	})
+
+	explainer := newExplainer(0, time.Second, time.Minute, 10)
+	plans := make(chan *explainPlan, 1)
+	query := "select * from test, user where test.id > 1"
+	assert.Nil(t, explainer.explain(db, query, nil, func(plan *explainPlan) { plans <- plan }))
+	plan := <-plans
+	assert.Equal(t, "access_type=test:range,user:ALL rows_examined=310 keys=PRIMARY", plan.String())
+	//cached
+	assert.Equal(t, plan, explainer.explain(db, query, nil, nil))
+
+	assert.Nil(t, explainer.explain(db, "delete from test where id > 1", nil, nil))
+}
+
+func TestCacheProxy(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("mysql_cache_fingerprints", []string{"SELECT id, name, created, data FROM config WHERE name = 'a'"})
+
+	var queryNum int
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	memDb := newMemDb(func(query string, args []driver.Value) *memResult {
+		if strings.HasPrefix(query, "select") {
+			queryNum++
+			return &memResult{columns: []string{"id", "name", "created", "data"},
+				rows: [][]driver.Value{{int64(1), "a", createdAt, nil}, {int64(2), "b", createdAt, []byte("x")}}}
+		}
+		return &memResult{rowsAffected: 1}
+	})
+
+	cacheProxyOptions := CacheProxyOptions{}
+	cacheProxy := NewCacheProxy(
+		cacheProxyOptions.WithConf(memConfig),
+		cacheProxyOptions.WithLogger(log.NewNullLogger()),
+		cacheProxyOptions.WithStore(NewLRUCacheStore(10)),
+	)
+	cacheProxy.NextProxy(newTxAwareDb("cache_test", memDb))
+
+	ctx := contextWithDbName(context.Background(), "cache_test")
+	query := "select id, name, created, data from config where name = ?"
+	readAll := func(ctx context.Context) [][]interface{} {
+		rows, err := cacheProxy.QueryContext(ctx, query, "a")
+		assert.Nil(t, err)
+		defer rows.Close()
+
+		var result [][]interface{}
+		for rows.Next() {
+			var id int64
+			var name string
+			var created time.Time
+			var data []byte
+			assert.Nil(t, rows.Scan(&id, &name, &created, &data))
+			result = append(result, []interface{}{id, name, created, data})
+		}
+		return result
+	}
+
+	expected := readAll(ctx)
+	assert.Equal(t, expected, readAll(ctx))
+	assert.Equal(t, 1, queryNum)
+	assert.Equal(t, []interface{}{int64(2), "b", createdAt, []byte("x")}, expected[1])
+
+	lab := prometheus.Labels{"db": "cache_test", "sql": "select id, name, created, data from config where name = ?"}
+	lab["result"] = "hit"
+	assert.Equal(t, float64(1), counterValue(mysqlCacheTotal, lab))
+	lab["result"] = "miss"
+	assert.Equal(t, float64(1), counterValue(mysqlCacheTotal, lab))
+
+	var id int64
+	assert.Nil(t, cacheProxy.QueryRowContext(ctx, query, "a").Scan(&id, new(string), new(time.Time), new([]byte)))
+	assert.Equal(t, int64(1), id)
+	assert.Equal(t, 1, queryNum)
+
+	//other args
+	cacheProxy.QueryRowContext(ctx, query, "b").Scan(&id, new(string), new(time.Time), new([]byte))
+	assert.Equal(t, 2, queryNum)
+
+	//writes of the table invalidate it
+	_, err := cacheProxy.ExecContext(ctx, "update `test`.`config` set value = ? where name = ?", "v", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), counterValue(mysqlCacheInvalidationTotal,
+		prometheus.Labels{"db": "cache_test", "table": "config"}))
+	readAll(ctx)
+	assert.Equal(t, 3, queryNum)
+	readAll(ctx)
+	assert.Equal(t, 3, queryNum)
+
+	//not configured
+	otherQuery := "select id, name, created, data from config"
+	rows, err := cacheProxy.QueryContext(ctx, otherQuery)
+	assert.Nil(t, err)
+	rows.Close()
+	rows, err = cacheProxy.QueryContext(ctx, otherQuery)
+	assert.Nil(t, err)
+	rows.Close()
+	assert.Equal(t, 5, queryNum)
+
+	//hinted by ctx
+	hintCtx := NewCacheContext(ctx, time.Minute)
+	rows, err = cacheProxy.QueryContext(hintCtx, otherQuery)
+	assert.Nil(t, err)
+	rows.Close()
+	rows, err = cacheProxy.QueryContext(hintCtx, otherQuery)
+	assert.Nil(t, err)
+	rows.Close()
+	assert.Equal(t, 6, queryNum)
+
+	//not cached in transactions, writes invalidate again after commit
+	mysqlClient := &SqlClient{
+		gdbs:       make(map[string]*gorm.DB),
+		sqlCommons: map[string]SqlCommon{"cache_test": cacheProxy},
+		routers:    make(map[string]*rwRouter),
+		dialects:   map[string]dialect{"cache_test": mysqlDialect{}},
+		conf:       config.NewNullConfig(),
+		logger:     log.NewNullLogger(),
+	}
+
+	err = mysqlClient.WithTx(ctx, "cache_test", nil, func(ctx context.Context, tx *gorm.DB) error {
+		readAll(ctx)
+		readAll(ctx)
+		assert.Equal(t, 8, queryNum)
+
+		return tx.Exec("insert into config (name) values (?)", "c").Error
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, float64(3), counterValue(mysqlCacheInvalidationTotal,
+		prometheus.Labels{"db": "cache_test", "table": "config"}))
+	readAll(ctx)
+	readAll(ctx)
+	assert.Equal(t, 9, queryNum)
+
+	//writes of gorm invalidate too
+	err = mysqlClient.GetCtxDb(ctx, "cache_test").Table("config").
+		Where("name = ?", "a").Update("data", "y").Error
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), counterValue(mysqlCacheInvalidationTotal,
+		prometheus.Labels{"db": "cache_test", "table": "config"}))
+	readAll(ctx)
+	assert.Equal(t, 10, queryNum)
+}
+
+func TestWriteTables(t *testing.T) {
+	testCases := []struct {
+		query  string
+		tables []string
+	}{
+		{"select * from user where id = 1", nil},
+		{"INSERT IGNORE INTO `db`.`User` (id, name) VALUES (1, 'a'), (2, 'b')", []string{"user"}},
+		{"insert into user (id) select id from account on duplicate key update id = values(id)", []string{"user"}},
+		{"replace into user set id = 1, name = 'a'", []string{"user"}},
+		{"update low_priority user u join account a on u.id = a.uid set u.name = a.name, a.x = 1",
+			[]string{"user", "account"}},
+		{"update user set name = (select name from account limit 1) where id = 1", []string{"user"}},
+		{"delete from user where id in (select uid from account)", []string{"user"}},
+		{"delete u from user u join account a on u.id = a.uid where a.id = 1", []string{"user", "account"}},
+		{"truncate table user", []string{"user"}},
+		{"drop table if exists user, account", []string{"user", "account"}},
+		{"alter table user add column age int, add index idx_age (age)", []string{"user"}},
+		{"rename table user to user_old, user_new to user", []string{"user", "user_old", "user_new"}},
+		{"update user set name = 'a' where id = 1; delete from account", []string{"user", "account"}},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.tables, writeTables(fingerprint(testCase.query)), testCase.query)
+	}
+
+	assert.Equal(t, []string{"user", "account", "order"}, readTables(fingerprint(
+		"select * from user u join account a on u.id = a.uid where a.id in (select uid from `db`.`order`)")))
+}
+
+func TestMysqlClient_Compatible(t *testing.T) {
+	var option Option = func(c *MysqlClient) {
+		c.stateTicker = time.Second
+	}
+	client := &MysqlClient{}
+	option(client)
+	assert.Equal(t, time.Second, client.stateTicker)
+
+	//returns at once, the pools are read by mysqlPoolCollector
+	client.Stats()
+}
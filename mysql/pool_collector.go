@@ -0,0 +1,100 @@
+package mysql
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type poolKey struct {
+	db string
+
+	//empty for master
+	replica string
+}
+
+// poolCollector reads sql.DBStats of the pools at scrape time, the clients add their pools
+// in init and remove them in Close, a pool of the same db and replica replaces the old one.
+type poolCollector struct {
+	lock sync.RWMutex
+
+	pools map[poolKey]*sql.DB
+
+	//the current state of the pools
+	desc *prometheus.Desc
+
+	//the cumulative statistics
+	totalDesc *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	return &poolCollector{
+		pools: make(map[poolKey]*sql.DB),
+		desc: prometheus.NewDesc("mysql_stats", "database statistics",
+			[]string{"db", "replica", "stats"}, nil),
+		totalDesc: prometheus.NewDesc("mysql_stats_total", "database cumulative statistics",
+			[]string{"db", "replica", "stats"}, nil),
+	}
+}
+
+func (this *poolCollector) add(db, replica string, pool *sql.DB) {
+	this.lock.Lock()
+	this.pools[poolKey{db: db, replica: replica}] = pool
+	this.lock.Unlock()
+}
+
+// remove removes the pool if it is not replaced.
+func (this *poolCollector) remove(db, replica string, pool *sql.DB) {
+	key := poolKey{db: db, replica: replica}
+
+	this.lock.Lock()
+	if this.pools[key] == pool {
+		delete(this.pools, key)
+	}
+	this.lock.Unlock()
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- this.desc
+	ch <- this.totalDesc
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for key, pool := range this.pools {
+		stats := pool.Stats()
+
+		values := map[string]float64{
+			"max_open_conn": float64(stats.MaxOpenConnections),
+			"open_conn":     float64(stats.OpenConnections),
+			"in_use":        float64(stats.InUse),
+			"idle":          float64(stats.Idle),
+		}
+
+		for name, value := range values {
+			ch <- prometheus.MustNewConstMetric(this.desc, prometheus.GaugeValue, value,
+				key.db, key.replica, name)
+		}
+
+		totals := map[string]float64{
+			"wait_count":            float64(stats.WaitCount),
+			"wait_duration_seconds": stats.WaitDuration.Seconds(),
+			"max_idle_closed":       float64(stats.MaxIdleClosed),
+			"max_lifetime_closed":   float64(stats.MaxLifetimeClosed),
+		}
+		//since go 1.15
+		if maxIdleTimeClosed, ok := maxIdleTimeClosed(stats); ok {
+			totals["max_idle_time_closed"] = maxIdleTimeClosed
+		}
+
+		for name, value := range totals {
+			ch <- prometheus.MustNewConstMetric(this.totalDesc, prometheus.CounterValue, value,
+				key.db, key.replica, name)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !go1.15
+// +build !go1.15
+
+package mysql
+
+import "database/sql"
+
+// maxIdleTimeClosed is not in sql.DBStats before go 1.15.
+func maxIdleTimeClosed(stats sql.DBStats) (float64, bool) {
+	return 0, false
+}
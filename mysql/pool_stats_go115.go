@@ -0,0 +1,10 @@
+//go:build go1.15
+// +build go1.15
+
+package mysql
+
+import "database/sql"
+
+func maxIdleTimeClosed(stats sql.DBStats) (float64, bool) {
+	return float64(stats.MaxIdleTimeClosed), true
+}
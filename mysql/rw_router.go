@@ -0,0 +1,314 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jukylin/esim/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// RoundRobin sends reads to the healthy replicas in turn.
+	RoundRobin = "round_robin"
+
+	// LeastConn sends reads to the healthy replica with the fewest connections in use.
+	LeastConn = "least_conn"
+)
+
+var lockingReadReg = regexp.MustCompile(`(?i)\bFOR\s+UPDATE\b|\bFOR\s+SHARE\b|\bLOCK\s+IN\s+SHARE\s+MODE\b`)
+
+type rwSessionKey struct{}
+
+// rwSession remembers the writes of a context, reads after them go to master.
+type rwSession struct {
+	master int32
+}
+
+// NewRWSessionContext returns a copy of ctx whose reads go to master after its first write,
+// so a request reads its own writes across all GetCtxDb calls and all dbs.
+// Without it, each GetCtxDb call has a session of its own.
+func NewRWSessionContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rwSessionKey{}, &rwSession{})
+}
+
+// PinMaster returns a copy of ctx whose reads always go to master.
+func PinMaster(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rwSessionKey{}, &rwSession{master: 1})
+}
+
+type replica struct {
+	//host:port, the label of metrics
+	name string
+
+	db SqlCommon
+
+	sqlDb *sql.DB
+
+	up int32
+}
+
+// rwRouter sends writes, transactions, prepared and locking statements to master
+// and the other reads to a healthy replica, or to master if there is no healthy one.
+// A replica which returns a connection error is marked down until the next health check.
+type rwRouter struct {
+	dbName string
+
+	dialect dialect
+
+	master SqlCommon
+
+	replicas []*replica
+
+	balance string
+
+	//replicas lagging behind more than maxLag are marked down, 0 is no limit
+	maxLag time.Duration
+
+	next uint32
+
+	logger log.Logger
+}
+
+func newRwRouter(dbName string, dialect dialect, master SqlCommon, replicas []*replica,
+	balance string, maxLag time.Duration, logger log.Logger) *rwRouter {
+	for _, rep := range replicas {
+		rep.up = 1
+	}
+
+	return &rwRouter{
+		dbName:   dbName,
+		dialect:  dialect,
+		master:   master,
+		replicas: replicas,
+		balance:  balance,
+		maxLag:   maxLag,
+		logger:   logger,
+	}
+}
+
+// withSession returns ctx with a new rwSession if it has none.
+func (this *rwRouter) withSession(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(rwSessionKey{}).(*rwSession); ok {
+		return ctx
+	}
+
+	return NewRWSessionContext(ctx)
+}
+
+// pick returns a healthy replica, or nil.
+func (this *rwRouter) pick() *replica {
+	var healthy []*replica
+	for _, rep := range this.replicas {
+		if atomic.LoadInt32(&rep.up) == 1 {
+			healthy = append(healthy, rep)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	if this.balance == LeastConn {
+		least := healthy[0]
+		leastInUse := least.sqlDb.Stats().InUse
+		for _, rep := range healthy[1:] {
+			if inUse := rep.sqlDb.Stats().InUse; inUse < leastInUse {
+				least, leastInUse = rep, inUse
+			}
+		}
+		return least
+	}
+
+	return healthy[atomic.AddUint32(&this.next, 1)%uint32(len(healthy))]
+}
+
+func (this *rwRouter) markDown(rep *replica, err error) {
+	if atomic.CompareAndSwapInt32(&rep.up, 1, 0) {
+		this.logger.Errorf("[db] %s replica %s is down : %s", this.dbName, rep.name, err.Error())
+		mysqlReplicaUp.With(prometheus.Labels{"db": this.dbName, "replica": rep.name}).Set(0)
+	}
+}
+
+// check pings the replicas and reads their lag, it marks them up or down
+// and exports "mysql_replica_up" and "mysql_replica_lag_seconds".
+func (this *rwRouter) check(ctx context.Context) {
+	for _, rep := range this.replicas {
+		labels := prometheus.Labels{"db": this.dbName, "replica": rep.name}
+
+		lag, err := this.dialect.replicaLag(ctx, rep.sqlDb)
+		if err == nil && this.maxLag > 0 && lag > this.maxLag {
+			err = fmt.Errorf("lag %s is more than %s", lag, this.maxLag)
+		}
+
+		if err != nil {
+			this.markDown(rep, err)
+			continue
+		}
+
+		mysqlReplicaLag.With(labels).Set(lag.Seconds())
+		mysqlReplicaUp.With(labels).Set(1)
+		if atomic.CompareAndSwapInt32(&rep.up, 0, 1) {
+			this.logger.Infof("[db] %s replica %s is up", this.dbName, rep.name)
+		}
+	}
+}
+
+func (this *rwRouter) isRead(ctx context.Context, query string) bool {
+	if !isReadQuery(query) {
+		//reads after it go to master
+		if session, ok := ctx.Value(rwSessionKey{}).(*rwSession); ok {
+			atomic.StoreInt32(&session.master, 1)
+		}
+		return false
+	}
+
+	if len(this.replicas) == 0 || txFromContext(ctx, strings.ToLower(this.dbName)) != nil {
+		return false
+	}
+
+	session, ok := ctx.Value(rwSessionKey{}).(*rwSession)
+	return !ok || atomic.LoadInt32(&session.master) == 0
+}
+
+func (this *rwRouter) pinMaster(ctx context.Context) {
+	if session, ok := ctx.Value(rwSessionKey{}).(*rwSession); ok {
+		atomic.StoreInt32(&session.master, 1)
+	}
+}
+
+//implement gorm.SQLCommon interface
+func (this *rwRouter) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+//implement gorm.SQLCommon interface
+func (this *rwRouter) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+//implement gorm.SQLCommon interface
+func (this *rwRouter) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+//implement gorm.SQLCommon interface
+func (this *rwRouter) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *rwRouter) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	this.pinMaster(ctx)
+	return this.master.ExecContext(ctx, query, args...)
+}
+
+func (this *rwRouter) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return this.master.PrepareContext(ctx, query)
+}
+
+func (this *rwRouter) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if !this.isRead(ctx, query) {
+		return this.master.QueryContext(ctx, query, args...)
+	}
+
+	rep := this.pick()
+	if rep == nil {
+		return this.master.QueryContext(ctx, query, args...)
+	}
+
+	rows, err := rep.db.QueryContext(ctx, query, args...)
+	if err != nil && this.isConnErr(err) {
+		this.markDown(rep, err)
+		return this.master.QueryContext(ctx, query, args...)
+	}
+
+	return rows, err
+}
+
+func (this *rwRouter) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if !this.isRead(ctx, query) {
+		return this.master.QueryRowContext(ctx, query, args...)
+	}
+
+	rep := this.pick()
+	if rep == nil {
+		return this.master.QueryRowContext(ctx, query, args...)
+	}
+
+	return rep.db.QueryRowContext(ctx, query, args...)
+}
+
+func (this *rwRouter) Begin() (*sql.Tx, error) {
+	return this.master.Begin()
+}
+
+func (this *rwRouter) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	this.pinMaster(ctx)
+	return this.master.BeginTx(ctx, opts)
+}
+
+func (this *rwRouter) Close() error {
+	var err error
+	for _, rep := range this.replicas {
+		if closeErr := rep.db.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+
+	if closeErr := this.master.Close(); closeErr != nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// isReadQuery reports whether query can be served by a replica.
+func isReadQuery(query string) bool {
+	query = strings.TrimSpace(query)
+	for strings.HasPrefix(query, "/*") {
+		end := strings.Index(query, "*/")
+		if end < 0 {
+			return false
+		}
+		query = strings.TrimSpace(query[end+2:])
+	}
+
+	word := query
+	if i := strings.IndexAny(query, " \t\r\n("); i >= 0 {
+		word = query[:i]
+	}
+
+	switch strings.ToUpper(word) {
+	case "SELECT":
+		return !lockingReadReg.MatchString(query)
+	case "SHOW", "DESC", "DESCRIBE", "EXPLAIN":
+		return true
+	default:
+		return false
+	}
+}
+
+// isConnErr reports whether err comes from the connection rather than the statement.
+func (this *rwRouter) isConnErr(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	return !this.dialect.isServerErr(err)
+}
+
+// replicaName returns host:port of dsn.
+func replicaName(dialect dialect, dsn string, index int) string {
+	if addr := dialect.addr(dsn); addr != "" {
+		return addr
+	}
+
+	return "replica_" + strconv.Itoa(index)
+}
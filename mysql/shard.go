@@ -0,0 +1,462 @@
+package mysql
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/jukylin/esim/config"
+	"github.com/mitchellh/mapstructure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Modulo routes the key to the shard of key % shards.
+	Modulo = "modulo"
+
+	// Range routes the key to the first shard whose bound of ShardConfig.Ranges is greater than the key.
+	Range = "range"
+
+	// ConsistentHash routes the key by a hash ring, only a few keys move when shards are added.
+	ConsistentHash = "consistent_hash"
+)
+
+const defaultVirtualNodes = 160
+
+var ErrShardNotFound = errors.New("mysql: no shard for the key")
+
+// ShardConfig is an entry of "mysql_shards", a logical db split across the physical dbs of "dbs".
+// With Tables, each db has Tables tables, the shard index is also the table index,
+// like order_0 and order_1 in the first db, order_2 and order_3 in the second.
+//  mysql_shards:
+//  - {logical: 'order', dbs: ['order_0', 'order_1'], strategy: 'modulo', tables: 2}
+type ShardConfig struct {
+	Logical string `json:"logical" yaml:"logical"`
+
+	//names in "dbs"
+	Dbs []string `json:"dbs" yaml:"dbs"`
+
+	//modulo, range or consistent_hash, default modulo
+	Strategy string `json:"strategy" yaml:"strategy"`
+
+	//tables of each db, 0 is one table without suffix
+	Tables int `json:"tables" yaml:"tables"`
+
+	//format of the table index, default "_%d"
+	TableSuffix string `json:"table_suffix" yaml:"tablesuffix"`
+
+	//range, the exclusive upper bounds of the shards in order
+	Ranges []uint64 `json:"ranges" yaml:"ranges"`
+
+	//consistent_hash, points of each shard on the ring, default 160
+	VirtualNodes int `json:"virtual_nodes" yaml:"virtualnodes"`
+}
+
+// Shard is a physical table of a logical db.
+type Shard struct {
+	Logical string
+
+	Index int
+
+	//name in "dbs"
+	Db string
+
+	//empty without ShardConfig.Tables
+	TableSuffix string
+}
+
+// Table returns table with the suffix of the shard.
+func (this Shard) Table(table string) string {
+	return table + this.TableSuffix
+}
+
+// ShardKeyFunc extracts the number routed by the strategy from the key of GetShardDb.
+type ShardKeyFunc func(key interface{}) (uint64, error)
+
+// DefaultShardKey uses integers and numeric strings as they are,
+// other strings and []byte are hashed.
+func DefaultShardKey(key interface{}) (uint64, error) {
+	value := reflect.ValueOf(key)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Int() < 0 {
+			return 0, fmt.Errorf("mysql: negative shard key %d", value.Int())
+		}
+		return uint64(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return value.Uint(), nil
+	case reflect.String:
+		if number, err := strconv.ParseUint(value.String(), 10, 64); err == nil {
+			return number, nil
+		}
+		return hashKey([]byte(value.String())), nil
+	case reflect.Slice:
+		if bytes, ok := key.([]byte); ok {
+			return hashKey(bytes), nil
+		}
+	}
+
+	return 0, fmt.Errorf("mysql: unsupported shard key %T", key)
+}
+
+func hashKey(key []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(key)
+	return hash.Sum64()
+}
+
+// LoadShardConfigs reads "mysql_shards" of conf.
+func LoadShardConfigs(conf config.Config) ([]ShardConfig, error) {
+	shardConfigs := []ShardConfig{}
+	err := conf.UnmarshalKey("mysql_shards", &shardConfigs, viper.DecodeHook(
+		mapstructure.StringToSliceHookFunc(","),
+	))
+
+	return shardConfigs, err
+}
+
+type shardStrategy interface {
+	shard(key uint64) (int, error)
+}
+
+func newShardStrategy(shardConfig ShardConfig, shards []Shard) (shardStrategy, error) {
+	switch shardConfig.Strategy {
+	case "", Modulo:
+		return moduloStrategy{shards: uint64(len(shards))}, nil
+	case Range:
+		if len(shardConfig.Ranges) != len(shards) {
+			return nil, fmt.Errorf("mysql: %d ranges for %d shards", len(shardConfig.Ranges), len(shards))
+		}
+		for k := 1; k < len(shardConfig.Ranges); k++ {
+			if shardConfig.Ranges[k] <= shardConfig.Ranges[k-1] {
+				return nil, errors.New("mysql: ranges must be ascending")
+			}
+		}
+		return rangeStrategy{bounds: shardConfig.Ranges}, nil
+	case ConsistentHash:
+		virtualNodes := shardConfig.VirtualNodes
+		if virtualNodes <= 0 {
+			virtualNodes = defaultVirtualNodes
+		}
+		return newConsistentHashStrategy(shards, virtualNodes), nil
+	default:
+		return nil, fmt.Errorf("mysql: unknown shard strategy %s", shardConfig.Strategy)
+	}
+}
+
+type moduloStrategy struct {
+	shards uint64
+}
+
+func (this moduloStrategy) shard(key uint64) (int, error) {
+	return int(key % this.shards), nil
+}
+
+type rangeStrategy struct {
+	bounds []uint64
+}
+
+func (this rangeStrategy) shard(key uint64) (int, error) {
+	index := sort.Search(len(this.bounds), func(i int) bool {
+		return key < this.bounds[i]
+	})
+	if index == len(this.bounds) {
+		return 0, ErrShardNotFound
+	}
+
+	return index, nil
+}
+
+type consistentHashStrategy struct {
+	//sorted points of the ring
+	points []uint32
+
+	//shard index of the points
+	shards map[uint32]int
+}
+
+// newConsistentHashStrategy puts the shards on the ring by db and table index,
+// so a shard keeps its points when others are added.
+func newConsistentHashStrategy(shards []Shard, virtualNodes int) *consistentHashStrategy {
+	strategy := &consistentHashStrategy{
+		shards: make(map[uint32]int, len(shards)*virtualNodes),
+	}
+
+	for _, shard := range shards {
+		for i := 0; i < virtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(shard.Db + shard.TableSuffix + "#" + strconv.Itoa(i)))
+			if _, ok := strategy.shards[point]; ok {
+				continue
+			}
+			strategy.shards[point] = shard.Index
+			strategy.points = append(strategy.points, point)
+		}
+	}
+
+	sort.Slice(strategy.points, func(i, j int) bool {
+		return strategy.points[i] < strategy.points[j]
+	})
+
+	return strategy
+}
+
+func (this *consistentHashStrategy) shard(key uint64) (int, error) {
+	var bytes [8]byte
+	binary.BigEndian.PutUint64(bytes[:], key)
+	hash := crc32.ChecksumIEEE(bytes[:])
+
+	index := sort.Search(len(this.points), func(i int) bool {
+		return this.points[i] >= hash
+	})
+	if index == len(this.points) {
+		index = 0
+	}
+
+	return this.shards[this.points[index]], nil
+}
+
+// shardRouter resolves the keys of a logical db.
+type shardRouter struct {
+	logical string
+
+	shards []Shard
+
+	strategy shardStrategy
+
+	shardKey ShardKeyFunc
+}
+
+func newShardRouter(shardConfig ShardConfig, shardKey ShardKeyFunc) (*shardRouter, error) {
+	if len(shardConfig.Dbs) == 0 {
+		return nil, errors.New("mysql: shard " + shardConfig.Logical + " has no dbs")
+	}
+
+	tableSuffix := shardConfig.TableSuffix
+	if tableSuffix == "" {
+		tableSuffix = "_%d"
+	}
+
+	tables := shardConfig.Tables
+	if tables <= 0 {
+		tables = 1
+	}
+
+	var shards []Shard
+	for _, db := range shardConfig.Dbs {
+		for i := 0; i < tables; i++ {
+			shard := Shard{
+				Logical: shardConfig.Logical,
+				Index:   len(shards),
+				Db:      db,
+			}
+			if shardConfig.Tables > 0 {
+				shard.TableSuffix = fmt.Sprintf(tableSuffix, shard.Index)
+			}
+			shards = append(shards, shard)
+		}
+	}
+
+	strategy, err := newShardStrategy(shardConfig, shards)
+	if err != nil {
+		return nil, err
+	}
+
+	if shardKey == nil {
+		shardKey = DefaultShardKey
+	}
+
+	return &shardRouter{
+		logical:  shardConfig.Logical,
+		shards:   shards,
+		strategy: strategy,
+		shardKey: shardKey,
+	}, nil
+}
+
+func (this *shardRouter) route(key interface{}) (Shard, error) {
+	number, err := this.shardKey(key)
+	if err != nil {
+		return Shard{}, err
+	}
+
+	index, err := this.strategy.shard(number)
+	if err != nil {
+		return Shard{}, fmt.Errorf("%w : %s %v", err, this.logical, key)
+	}
+
+	return this.shards[index], nil
+}
+
+func (this *SqlClient) getShardRouter(logical string) (*shardRouter, error) {
+	router, ok := this.shardRouters[strings.ToLower(logical)]
+	if !ok {
+		return nil, errors.New("mysql: shard " + logical + " not found")
+	}
+
+	return router, nil
+}
+
+// GetShard returns the shard of key in logical.
+func (this *SqlClient) GetShard(logical string, key interface{}) (Shard, error) {
+	router, err := this.getShardRouter(logical)
+	if err != nil {
+		return Shard{}, err
+	}
+
+	return router.route(key)
+}
+
+// GetShardDb returns GetCtxDb of the db holding key in logical,
+// use ShardTable or Shard.Table for the table name.
+func (this *SqlClient) GetShardDb(ctx context.Context, logical string, key interface{}) (*gorm.DB, error) {
+	shard, err := this.GetShard(logical, key)
+	if err != nil {
+		return nil, err
+	}
+
+	mysqlShardTotal.With(shardLabels(shard)).Inc()
+
+	return this.GetCtxDb(ctx, shard.Db), nil
+}
+
+// ShardTable returns table with the suffix of the shard of key in logical.
+func (this *SqlClient) ShardTable(logical, table string, key interface{}) (string, error) {
+	shard, err := this.GetShard(logical, key)
+	if err != nil {
+		return "", err
+	}
+
+	return shard.Table(table), nil
+}
+
+// Shards returns all shards of logical in order.
+func (this *SqlClient) Shards(logical string) []Shard {
+	router, err := this.getShardRouter(logical)
+	if err != nil {
+		return nil
+	}
+
+	return append([]Shard(nil), router.shards...)
+}
+
+// ScatterGather calls fn on all shards of logical concurrently, the results are in the order of Shards.
+// The first error cancels the ctx of the others and is returned.
+func (this *SqlClient) ScatterGather(ctx context.Context, logical string,
+	fn func(ctx context.Context, shard Shard, db *gorm.DB) (interface{}, error)) ([]interface{}, error) {
+	router, err := this.getShardRouter(logical)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]interface{}, len(router.shards))
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for k, shard := range router.shards {
+		wg.Add(1)
+		go func(k int, shard Shard) {
+			defer wg.Done()
+
+			labels := shardLabels(shard)
+			mysqlShardTotal.With(labels).Inc()
+			startTime := time.Now()
+
+			result, err := fn(ctx, shard, this.GetCtxDb(ctx, shard.Db))
+			mysqlShardScatterDuration.With(labels).Observe(time.Since(startTime).Seconds())
+			if err != nil {
+				mysqlShardErrorTotal.With(labels).Inc()
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("mysql: shard %d of %s : %w", shard.Index, shard.Logical, err)
+					cancel()
+				})
+				return
+			}
+			results[k] = result
+		}(k, shard)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return results, nil
+}
+
+// ScatterFind finds the rows of table matching where in all shards of logical,
+// and appends them to dest, a pointer to a slice, in the order of Shards.
+func (this *SqlClient) ScatterFind(ctx context.Context, logical, table string,
+	dest interface{}, where ...interface{}) error {
+	destValue := reflect.ValueOf(dest)
+	if destValue.Kind() != reflect.Ptr || destValue.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("mysql: dest of ScatterFind must be a pointer to a slice, not %T", dest)
+	}
+	sliceType := destValue.Elem().Type()
+
+	results, err := this.ScatterGather(ctx, logical,
+		func(ctx context.Context, shard Shard, db *gorm.DB) (interface{}, error) {
+			part := reflect.New(sliceType)
+			db = db.Table(shard.Table(table))
+			if len(where) > 0 {
+				db = db.Where(where[0], where[1:]...)
+			}
+
+			err := db.Find(part.Interface()).Error
+
+			return part.Interface(), err
+		})
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		destValue.Elem().Set(reflect.AppendSlice(destValue.Elem(), reflect.ValueOf(result).Elem()))
+	}
+
+	return nil
+}
+
+// ScatterCount sums the rows of table matching where in all shards of logical.
+func (this *SqlClient) ScatterCount(ctx context.Context, logical, table string,
+	where ...interface{}) (int64, error) {
+	results, err := this.ScatterGather(ctx, logical,
+		func(ctx context.Context, shard Shard, db *gorm.DB) (interface{}, error) {
+			var count int64
+			db = db.Table(shard.Table(table))
+			if len(where) > 0 {
+				db = db.Where(where[0], where[1:]...)
+			}
+
+			err := db.Count(&count).Error
+
+			return count, err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, result := range results {
+		total += result.(int64)
+	}
+
+	return total, nil
+}
+
+func shardLabels(shard Shard) prometheus.Labels {
+	return prometheus.Labels{"logical": shard.Logical, "shard": strconv.Itoa(shard.Index), "db": shard.Db}
+}
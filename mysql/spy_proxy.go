@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"github.com/jukylin/esim/log"
 )
@@ -41,34 +42,58 @@ func (this *spyProxy) ProxyName() string {
 }
 
 func (this *spyProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.ExecContext(context.Background(), query, args...)
+}
+
+func (this *spyProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.PrepareContext(context.Background(), query)
+}
+
+func (this *spyProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.QueryContext(context.Background(), query, args...)
+}
+
+func (this *spyProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.QueryRowContext(context.Background(), query, args...)
+}
+
+func (this *spyProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
 	this.ExecWasCalled = true
 	this.logger.Infof("%s ExecWasCalled %s", this.name, query)
-	result, err := this.nextProxy.Exec(query, args...)
+	result, err := this.nextProxy.ExecContext(ctx, query, args...)
 	return result, err
 }
 
-func (this *spyProxy) Prepare(query string) (*sql.Stmt, error) {
+func (this *spyProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
 	this.PrepareWasCalled = true
 	this.logger.Infof("%s PrepareWasCalled %s", this.name, query)
-	stmt, err := this.nextProxy.Prepare(query)
+	stmt, err := this.nextProxy.PrepareContext(ctx, query)
 
 	return stmt, err
 }
 
-func (this *spyProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+func (this *spyProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
 	this.QueryWasCalled = true
 	this.logger.Infof("%s QueryWasCalled %s", this.name, query)
-	rows, err := this.nextProxy.Query(query, args...)
+	rows, err := this.nextProxy.QueryContext(ctx, query, args...)
 	return rows, err
 }
 
-func (this *spyProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+func (this *spyProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
 	this.QueryRowWasCalled = true
 	this.logger.Infof("%s QueryRowWasCalled %s", this.name, query)
-	row := this.nextProxy.QueryRow(query, args...)
+	row := this.nextProxy.QueryRowContext(ctx, query, args...)
 	return row
 }
 
 func (this *spyProxy) Close() error {
 	return this.nextProxy.Close()
 }
+
+func (this *spyProxy) Begin() (*sql.Tx, error) {
+	return this.nextProxy.Begin()
+}
+
+func (this *spyProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.nextProxy.BeginTx(ctx, opts)
+}
@@ -0,0 +1,316 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jukylin/esim/log"
+)
+
+var ErrUnexpectedSql = errors.New("mysql: unexpected sql")
+
+// AnyArg matches any argument in Expectation.WithArgs.
+var AnyArg = anyArg{}
+
+type anyArg struct{}
+
+// stubsProxy answers statements with the expectations declared by tests,
+// no statement reaches the database. Plug it in by MysqlClientOptions.WithDB(stubs.DB()),
+// or put it last in MysqlClientOptions.WithProxy together with WithDB(stubs.DB()).
+//  stubs := NewStubsProxy()
+//  stubs.ExpectSql("select id, name from user where id = ?").WithArgs(1).
+//      WillReturnRows([]string{"id", "name"}, []interface{}{1, "test"})
+//  ...
+//  assert.Nil(t, stubs.ExpectationsWereMet())
+type stubsProxy struct {
+	name string
+
+	logger log.Logger
+
+	nextProxy SqlCommon
+
+	lock sync.Mutex
+
+	expectations []*Expectation
+
+	unexpected []string
+
+	memDb *sql.DB
+}
+
+// Expectation is a statement expected by stubsProxy and its response.
+type Expectation struct {
+	//statement is the fingerprint of the expected sql or a regexp
+	fingerprint string
+
+	regexp *regexp.Regexp
+
+	//nil matches any arguments
+	args []driver.Value
+
+	result *memResult
+
+	//expected times, -1 is any times
+	times int
+
+	called int
+}
+
+type StubsProxyOption func(c *stubsProxy)
+
+type StubsProxyOptions struct{}
+
+func NewStubsProxy(options ...StubsProxyOption) *stubsProxy {
+	stubsProxy := &stubsProxy{}
+
+	for _, option := range options {
+		option(stubsProxy)
+	}
+
+	if stubsProxy.logger == nil {
+		stubsProxy.logger = log.NewLogger()
+	}
+
+	if stubsProxy.name == "" {
+		stubsProxy.name = "stubs_proxy"
+	}
+
+	stubsProxy.memDb = newMemDb(stubsProxy.resolve)
+
+	return stubsProxy
+}
+
+func (StubsProxyOptions) WithName(name string) StubsProxyOption {
+	return func(s *stubsProxy) {
+		s.name = name
+	}
+}
+
+func (StubsProxyOptions) WithLogger(logger log.Logger) StubsProxyOption {
+	return func(s *stubsProxy) {
+		s.logger = logger
+	}
+}
+
+// ExpectSql expects a statement with the same fingerprint as query,
+// literals, IN-lists, case and whitespace don't matter.
+func (this *stubsProxy) ExpectSql(query string) *Expectation {
+	return this.expect(&Expectation{fingerprint: fingerprint(query)})
+}
+
+// ExpectRegexp expects a statement matching expr.
+func (this *stubsProxy) ExpectRegexp(expr string) *Expectation {
+	return this.expect(&Expectation{regexp: regexp.MustCompile(expr)})
+}
+
+func (this *stubsProxy) expect(expectation *Expectation) *Expectation {
+	expectation.times = 1
+	expectation.result = &memResult{}
+
+	this.lock.Lock()
+	this.expectations = append(this.expectations, expectation)
+	this.lock.Unlock()
+
+	return expectation
+}
+
+// DB returns a *sql.DB answered by the expectations.
+func (this *stubsProxy) DB() *sql.DB {
+	return this.memDb
+}
+
+// ExpectationsWereMet returns an error listing the expectations which were not
+// called enough times and the statements which were not expected.
+func (this *stubsProxy) ExpectationsWereMet() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var msgs []string
+	for _, expectation := range this.expectations {
+		if expectation.times >= 0 && expectation.called < expectation.times {
+			msgs = append(msgs, fmt.Sprintf("expected %s %d times, called %d times",
+				expectation.String(), expectation.times, expectation.called))
+		}
+	}
+
+	for _, query := range this.unexpected {
+		msgs = append(msgs, "unexpected "+query)
+	}
+
+	if len(msgs) > 0 {
+		return errors.New("mysql: " + strings.Join(msgs, "; "))
+	}
+
+	return nil
+}
+
+// WithArgs expects the arguments, AnyArg matches any one.
+func (this *Expectation) WithArgs(args ...interface{}) *Expectation {
+	this.args = driverValues(args)
+	return this
+}
+
+// WillReturnRows answers a query with columns and rows.
+func (this *Expectation) WillReturnRows(columns []string, rows ...[]interface{}) *Expectation {
+	this.result.columns = columns
+	for _, row := range rows {
+		this.result.rows = append(this.result.rows, driverValues(row))
+	}
+
+	return this
+}
+
+// WillReturnResult answers an exec.
+func (this *Expectation) WillReturnResult(lastInsertId, rowsAffected int64) *Expectation {
+	this.result.lastInsertId = lastInsertId
+	this.result.rowsAffected = rowsAffected
+	return this
+}
+
+func (this *Expectation) WillReturnError(err error) *Expectation {
+	this.result.err = err
+	return this
+}
+
+// Times expects the statement n times, -1 is any times.
+func (this *Expectation) Times(n int) *Expectation {
+	this.times = n
+	return this
+}
+
+func (this *Expectation) String() string {
+	if this.regexp != nil {
+		return this.regexp.String()
+	}
+
+	return this.fingerprint
+}
+
+func (this *Expectation) match(query, fp string, args []driver.Value) bool {
+	if this.regexp != nil {
+		if !this.regexp.MatchString(query) {
+			return false
+		}
+	} else if this.fingerprint != fp {
+		return false
+	}
+
+	if this.args == nil {
+		return true
+	}
+
+	if len(this.args) != len(args) {
+		return false
+	}
+
+	for k, arg := range this.args {
+		if _, ok := arg.(anyArg); ok {
+			continue
+		}
+
+		if !reflect.DeepEqual(normalizeArg(arg), normalizeArg(args[k])) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// normalizeArg makes []byte and string equal.
+func normalizeArg(arg driver.Value) driver.Value {
+	if b, ok := arg.([]byte); ok {
+		return string(b)
+	}
+
+	return arg
+}
+
+// resolve answers the statements of memDb.
+func (this *stubsProxy) resolve(query string, args []driver.Value) *memResult {
+	fp := fingerprint(query)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, expectation := range this.expectations {
+		if expectation.times >= 0 && expectation.called >= expectation.times {
+			continue
+		}
+
+		if expectation.match(query, fp, args) {
+			expectation.called++
+			return expectation.result
+		}
+	}
+
+	unexpected := fmt.Sprintf("%s %v", query, args)
+	this.unexpected = append(this.unexpected, unexpected)
+	this.logger.Errorf("[mysql] %s : %s", ErrUnexpectedSql.Error(), unexpected)
+
+	return &memResult{err: fmt.Errorf("%w : %s", ErrUnexpectedSql, unexpected)}
+}
+
+//implement Proxy interface
+func (this *stubsProxy) NextProxy(db interface{}) {
+	this.nextProxy = db.(SqlCommon)
+}
+
+//implement Proxy interface
+func (this *stubsProxy) ProxyName() string {
+	return this.name
+}
+
+func (this *stubsProxy) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.memDb.Exec(query, args...)
+}
+
+func (this *stubsProxy) Prepare(query string) (*sql.Stmt, error) {
+	return this.memDb.Prepare(query)
+}
+
+func (this *stubsProxy) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.memDb.Query(query, args...)
+}
+
+func (this *stubsProxy) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.memDb.QueryRow(query, args...)
+}
+
+func (this *stubsProxy) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return this.memDb.ExecContext(ctx, query, args...)
+}
+
+func (this *stubsProxy) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return this.memDb.PrepareContext(ctx, query)
+}
+
+func (this *stubsProxy) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return this.memDb.QueryContext(ctx, query, args...)
+}
+
+func (this *stubsProxy) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return this.memDb.QueryRowContext(ctx, query, args...)
+}
+
+func (this *stubsProxy) Close() error {
+	if this.nextProxy != nil {
+		return this.nextProxy.Close()
+	}
+
+	return nil
+}
+
+func (this *stubsProxy) Begin() (*sql.Tx, error) {
+	return this.memDb.Begin()
+}
+
+func (this *stubsProxy) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	return this.memDb.BeginTx(ctx, opts)
+}
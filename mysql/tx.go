@@ -0,0 +1,240 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type txKey struct{}
+
+// ctxTx is the transaction of WithTx, it is carried by ctx down to txAwareDb.
+type ctxTx struct {
+	dbName string
+
+	tx *sql.Tx
+
+	lock sync.Mutex
+
+	//run after commit, see onCommit
+	afterCommit []func()
+}
+
+// ctxTxs are the transactions of ctx by db, a nested WithTx of another db
+// adds its transaction to a copy, the outer ones stay visible in fn.
+type ctxTxs map[string]*ctxTx
+
+// contextWithTx returns a copy of ctx with tx of dbName added to the transactions of ctx.
+func contextWithTx(ctx context.Context, dbName string, tx *sql.Tx) (context.Context, *ctxTx) {
+	outer, _ := ctx.Value(txKey{}).(ctxTxs)
+	txs := make(ctxTxs, len(outer)+1)
+	for name, outerTx := range outer {
+		txs[name] = outerTx
+	}
+
+	newTx := &ctxTx{dbName: dbName, tx: tx}
+	txs[dbName] = newTx
+
+	return context.WithValue(ctx, txKey{}, txs), newTx
+}
+
+func ctxTxFromContext(ctx context.Context, dbName string) *ctxTx {
+	txs, _ := ctx.Value(txKey{}).(ctxTxs)
+	return txs[dbName]
+}
+
+// onCommit adds fn to run after the transaction of dbName in ctx commits,
+// it returns false if there is no such transaction.
+func onCommit(ctx context.Context, dbName string, fn func()) bool {
+	ctxTx := ctxTxFromContext(ctx, dbName)
+	if ctxTx == nil {
+		return false
+	}
+
+	ctxTx.lock.Lock()
+	ctxTx.afterCommit = append(ctxTx.afterCommit, fn)
+	ctxTx.lock.Unlock()
+
+	return true
+}
+
+func (this *ctxTx) committed() {
+	this.lock.Lock()
+	afterCommit := this.afterCommit
+	this.afterCommit = nil
+	this.lock.Unlock()
+
+	for _, fn := range afterCommit {
+		fn()
+	}
+}
+
+// txFromContext returns the transaction of dbName in ctx, or nil.
+func txFromContext(ctx context.Context, dbName string) *sql.Tx {
+	if ctxTx := ctxTxFromContext(ctx, dbName); ctxTx != nil {
+		return ctxTx.tx
+	}
+
+	return nil
+}
+
+// txAwareDb is the last of the proxy chain, it runs the statements
+// in the transaction of ctx if there is one, so they pass all proxies.
+type txAwareDb struct {
+	*sql.DB
+
+	dbName string
+}
+
+func newTxAwareDb(dbName string, db *sql.DB) *txAwareDb {
+	return &txAwareDb{DB: db, dbName: strings.ToLower(dbName)}
+}
+
+func (this *txAwareDb) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if tx := txFromContext(ctx, this.dbName); tx != nil {
+		return tx.ExecContext(ctx, query, args...)
+	}
+
+	return this.DB.ExecContext(ctx, query, args...)
+}
+
+func (this *txAwareDb) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	if tx := txFromContext(ctx, this.dbName); tx != nil {
+		return tx.PrepareContext(ctx, query)
+	}
+
+	return this.DB.PrepareContext(ctx, query)
+}
+
+func (this *txAwareDb) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if tx := txFromContext(ctx, this.dbName); tx != nil {
+		return tx.QueryContext(ctx, query, args...)
+	}
+
+	return this.DB.QueryContext(ctx, query, args...)
+}
+
+func (this *txAwareDb) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	if tx := txFromContext(ctx, this.dbName); tx != nil {
+		return tx.QueryRowContext(ctx, query, args...)
+	}
+
+	return this.DB.QueryRowContext(ctx, query, args...)
+}
+
+// WithTx runs fn in a transaction of db_name, it commits if fn returns nil
+// and rolls back if fn returns an error or panics, the panic is thrown again after that.
+// The statements of tx and of GetCtxDb(ctx, db_name) in fn pass the proxy chain, also those
+// of gorm Create, Update and Delete, the gorm transactions in fn join this one and don't commit.
+// On deadlock, lock wait timeout or the like of other databases the whole transaction is retried
+// "mysql_tx_max_retries" times (default 3) with exponential backoff, so fn must be retryable.
+// Calling WithTx of db_name in fn joins the outer transaction, of another db it starts a new one
+// and the outer transaction stays in ctx.
+func (this *SqlClient) WithTx(ctx context.Context, db_name string, opts *sql.TxOptions,
+	fn func(ctx context.Context, tx *gorm.DB) error) error {
+	db_name = strings.ToLower(db_name)
+	sqlCommon, ok := this.sqlCommons[db_name]
+	if !ok {
+		return fmt.Errorf("[db] %s not found", db_name)
+	}
+
+	//join the outer transaction
+	if txFromContext(ctx, db_name) != nil {
+		return fn(ctx, this.GetCtxDb(ctx, db_name))
+	}
+
+	maxRetries := this.conf.GetInt("mysql_tx_max_retries")
+	if maxRetries <= 0 {
+		maxRetries = 3
+	}
+
+	backoff := 20 * time.Millisecond
+	for retry := 0; ; retry++ {
+		err := this.runTx(ctx, db_name, sqlCommon, opts, fn)
+		if err == nil || !isRetryableTxErr(this.dialects[db_name], err) || retry >= maxRetries {
+			return err
+		}
+
+		mysqlTxRetryTotal.With(prometheus.Labels{"db": db_name}).Inc()
+		this.logger.Warnc(ctx, "[db] %s retry transaction %d : %s", db_name, retry+1, err.Error())
+
+		wait := backoff<<uint(retry) + time.Duration(rand.Int63n(int64(backoff)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (this *SqlClient) runTx(ctx context.Context, db_name string, sqlCommon SqlCommon, opts *sql.TxOptions,
+	fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	startTime := time.Now()
+	outcome := "rollback"
+	defer func() {
+		lab := prometheus.Labels{"db": db_name, "outcome": outcome}
+		mysqlTxTotal.With(lab).Inc()
+		mysqlTxDuration.With(lab).Observe(time.Since(startTime).Seconds())
+	}()
+
+	if router, ok := this.routers[db_name]; ok {
+		ctx = router.withSession(ctx)
+	}
+
+	tx, err := sqlCommon.BeginTx(ctx, opts)
+	if err != nil {
+		outcome = "begin_error"
+		return err
+	}
+
+	txCtx, ctxTx := contextWithTx(ctx, db_name, tx)
+
+	defer func() {
+		if p := recover(); p != nil {
+			outcome = "panic"
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	err = fn(txCtx, this.GetCtxDb(txCtx, db_name))
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && rbErr != sql.ErrTxDone {
+			this.logger.Errorc(ctx, "[db] %s rollback error : %s", db_name, rbErr.Error())
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		outcome = "commit_error"
+		return err
+	}
+	outcome = "commit"
+	ctxTx.committed()
+
+	return nil
+}
+
+// isRetryableTxErr reports whether err is a deadlock or the like of dialect.
+func isRetryableTxErr(dialect dialect, err error) bool {
+	var gormErrs gorm.Errors
+	if errors.As(err, &gormErrs) {
+		for _, gormErr := range gormErrs {
+			if isRetryableTxErr(dialect, gormErr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return dialect.isRetryableErr(err)
+}
@@ -0,0 +1,289 @@
+package cassette
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jukylin/esim/config"
+)
+
+// Version is the format version of cassette files,
+// bump it when Interaction or Value change incompatibly.
+const Version = 1
+
+const (
+	// ModeLive talks to the real service, nothing is recorded.
+	ModeLive = "live"
+
+	// ModeRecord talks to the real service and writes every interaction to the cassette.
+	ModeRecord = "record"
+
+	// ModeReplay never talks to the real service, responses come from the cassette.
+	ModeReplay = "replay"
+)
+
+var ErrUnmatched = errors.New("cassette: unmatched request")
+
+// Interaction is one request and its response, Kind is the dependency, like redis, mysql or http.
+type Interaction struct {
+	Kind string `json:"kind"`
+
+	Request string `json:"request"`
+
+	Response json.RawMessage `json:"response,omitempty"`
+
+	Err string `json:"err,omitempty"`
+}
+
+type Cassette struct {
+	Version int `json:"version"`
+
+	Interactions []*Interaction `json:"interactions"`
+
+	path string
+
+	mode string
+
+	lock sync.Mutex
+
+	//kind + request => interactions in recorded order
+	index map[string][]*Interaction
+
+	//kind + request => times replayed
+	replayed map[string]int
+}
+
+var cassettesLock sync.Mutex
+
+var cassettes = make(map[string]*Cassette)
+
+// Open returns the cassette stored in path, all proxies which use the same path
+// share one cassette. In replay mode the file must exist and have the current Version,
+// in record mode the file is truncated on first open.
+func Open(path, mode string) (*Cassette, error) {
+	if path == "" {
+		return nil, errors.New("cassette: path is empty")
+	}
+
+	if mode != ModeRecord && mode != ModeReplay {
+		return nil, fmt.Errorf("cassette: unknown mode %s", mode)
+	}
+
+	cassettesLock.Lock()
+	defer cassettesLock.Unlock()
+
+	if c, ok := cassettes[path]; ok {
+		if c.mode != mode {
+			return nil, fmt.Errorf("cassette: %s already opened in %s mode", path, c.mode)
+		}
+		return c, nil
+	}
+
+	c := &Cassette{
+		Version:      Version,
+		Interactions: make([]*Interaction, 0),
+		path:         path,
+		mode:         mode,
+		index:        make(map[string][]*Interaction),
+		replayed:     make(map[string]int),
+	}
+
+	if mode == ModeReplay {
+		err := c.load()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := c.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cassettes[path] = c
+
+	return c, nil
+}
+
+// OpenWithConf opens the cassette by "cassette_mode" and "cassette_file",
+// it returns nil in live mode, so callers can pass through to the real service.
+func OpenWithConf(conf config.Config) (*Cassette, error) {
+	mode := conf.GetString("cassette_mode")
+	if mode == "" || mode == ModeLive {
+		return nil, nil
+	}
+
+	return Open(conf.GetString("cassette_file"), mode)
+}
+
+// IsReplay reports whether the config selects replay mode,
+// clients use it to skip connecting to the real service.
+func IsReplay(conf config.Config) bool {
+	return conf.GetString("cassette_mode") == ModeReplay
+}
+
+// Eject writes the recorded interactions to disk and forgets the cassette,
+// the next Open of its path reads the file again.
+func (this *Cassette) Eject() error {
+	cassettesLock.Lock()
+	if cassettes[this.path] == this {
+		delete(cassettes, this.path)
+	}
+	cassettesLock.Unlock()
+
+	return this.Save()
+}
+
+// Save writes the recorded interactions to disk in record mode.
+func (this *Cassette) Save() error {
+	if this.mode != ModeRecord {
+		return nil
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.save()
+}
+
+// SaveAll saves the open cassettes, the mysql and redis clients call it in Close,
+// others, like the http client without Close, call it before exit.
+func SaveAll() error {
+	cassettesLock.Lock()
+	opened := make([]*Cassette, 0, len(cassettes))
+	for _, c := range cassettes {
+		opened = append(opened, c)
+	}
+	cassettesLock.Unlock()
+
+	var firstErr error
+	for _, c := range opened {
+		if err := c.Save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (this *Cassette) Mode() string {
+	return this.mode
+}
+
+func (this *Cassette) Path() string {
+	return this.path
+}
+
+// Record appends an interaction in memory, the cassette is written to disk once by Save, SaveAll or Eject.
+func (this *Cassette) Record(kind, request string, response interface{}, err error) error {
+	interaction := &Interaction{
+		Kind:    kind,
+		Request: request,
+	}
+
+	if response != nil {
+		raw, jsonErr := json.Marshal(response)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		interaction.Response = raw
+	}
+
+	if err != nil {
+		interaction.Err = err.Error()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.Interactions = append(this.Interactions, interaction)
+	this.addIndex(interaction)
+
+	return nil
+}
+
+// Replay decodes the recorded response of request into response and returns the recorded error.
+// The same request recorded several times is replayed in order, the last one is repeated after that.
+// If request was never recorded, the returned error wraps ErrUnmatched.
+func (this *Cassette) Replay(kind, request string, response interface{}) error {
+	key := kind + " " + request
+
+	this.lock.Lock()
+	interactions := this.index[key]
+	if len(interactions) == 0 {
+		this.lock.Unlock()
+		return fmt.Errorf("%w: %s in %s", ErrUnmatched, key, this.path)
+	}
+
+	i := this.replayed[key]
+	if i >= len(interactions) {
+		i = len(interactions) - 1
+	}
+	this.replayed[key]++
+	interaction := interactions[i]
+	this.lock.Unlock()
+
+	if response != nil && len(interaction.Response) > 0 {
+		err := json.Unmarshal(interaction.Response, response)
+		if err != nil {
+			return err
+		}
+	}
+
+	if interaction.Err != "" {
+		return errors.New(interaction.Err)
+	}
+
+	return nil
+}
+
+func (this *Cassette) addIndex(interaction *Interaction) {
+	key := interaction.Kind + " " + interaction.Request
+	this.index[key] = append(this.index[key], interaction)
+}
+
+func (this *Cassette) load() error {
+	data, err := ioutil.ReadFile(this.path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, this)
+	if err != nil {
+		return fmt.Errorf("cassette: %s : %s", this.path, err.Error())
+	}
+
+	if this.Version != Version {
+		return fmt.Errorf("cassette: %s version is %d, want %d", this.path, this.Version, Version)
+	}
+
+	for _, interaction := range this.Interactions {
+		this.addIndex(interaction)
+	}
+
+	return nil
+}
+
+func (this *Cassette) save() error {
+	data, err := json.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(this.path)
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := this.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, this.path)
+}
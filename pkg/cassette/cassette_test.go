@@ -0,0 +1,129 @@
+package cassette
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func resetCassettes() {
+	cassettesLock.Lock()
+	cassettes = make(map[string]*Cassette)
+	cassettesLock.Unlock()
+}
+
+func TestCassette_RecordAndReplay(t *testing.T) {
+	resetCassettes()
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.json")
+
+	recorder, err := Open(path, ModeRecord)
+	assert.Nil(t, err)
+	assert.Nil(t, recorder.Record("redis", `GET "name"`, "test", nil))
+	assert.Nil(t, recorder.Record("redis", `GET "name"`, "test2", nil))
+	assert.Nil(t, recorder.Record("redis", `GET "version"`, nil, errors.New("timeout")))
+
+	//written once by Eject
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), "timeout")
+
+	assert.Nil(t, recorder.Eject())
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "timeout")
+	player, err := Open(path, ModeReplay)
+	assert.Nil(t, err)
+
+	var reply string
+	assert.Nil(t, player.Replay("redis", `GET "name"`, &reply))
+	assert.Equal(t, "test", reply)
+	assert.Nil(t, player.Replay("redis", `GET "name"`, &reply))
+	assert.Equal(t, "test2", reply)
+	//repeat the last one
+	assert.Nil(t, player.Replay("redis", `GET "name"`, &reply))
+	assert.Equal(t, "test2", reply)
+
+	err = player.Replay("redis", `GET "version"`, &reply)
+	assert.EqualError(t, err, "timeout")
+
+	err = player.Replay("mysql", `GET "name"`, &reply)
+	assert.True(t, errors.Is(err, ErrUnmatched))
+}
+
+func TestSaveAll(t *testing.T) {
+	resetCassettes()
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "all.json")
+	recorder, err := Open(path, ModeRecord)
+	assert.Nil(t, err)
+	assert.Nil(t, recorder.Record("mysql", "select 1", 1, nil))
+
+	assert.Nil(t, SaveAll())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "select 1")
+}
+
+func TestCassette_Version(t *testing.T) {
+	resetCassettes()
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "old.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(`{"version":0,"interactions":[]}`), 0644))
+
+	_, err = Open(path, ModeReplay)
+	assert.Error(t, err)
+}
+
+func TestOpenWithConf(t *testing.T) {
+	resetCassettes()
+	memConfig := config.NewMemConfig()
+
+	cas, err := OpenWithConf(memConfig)
+	assert.Nil(t, err)
+	assert.Nil(t, cas)
+
+	memConfig.Set("cassette_mode", ModeReplay)
+	memConfig.Set("cassette_file", "not_exists.json")
+	_, err = OpenWithConf(memConfig)
+	assert.Error(t, err)
+	assert.True(t, IsReplay(memConfig))
+}
+
+func TestValue(t *testing.T) {
+	now := time.Now().Round(0)
+	values := []interface{}{nil, int64(1), 1.5, true, "OK", []byte("bulk"),
+		[]byte{0xff, 0xfe}, now, []interface{}{int64(2), []byte("a")}}
+
+	for _, value := range values {
+		encoded, err := EncodeValue(value)
+		assert.Nil(t, err)
+
+		decoded, err := DecodeValue(encoded, nil)
+		assert.Nil(t, err)
+
+		if tm, ok := value.(time.Time); ok {
+			assert.True(t, tm.Equal(decoded.(time.Time)))
+		} else {
+			assert.Equal(t, value, decoded)
+		}
+	}
+
+	_, err := EncodeValue(struct{}{})
+	assert.Error(t, err)
+}
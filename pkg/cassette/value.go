@@ -0,0 +1,107 @@
+package cassette
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Value keeps the Go type of a recorded value, plain json would turn []byte into string
+// and int64 into float64.
+type Value struct {
+	Kind string `json:"kind"`
+
+	Str string `json:"str,omitempty"`
+
+	Bytes []byte `json:"bytes,omitempty"`
+
+	Int int64 `json:"int,omitempty"`
+
+	Float float64 `json:"float,omitempty"`
+
+	Bool bool `json:"bool,omitempty"`
+
+	Array []Value `json:"array,omitempty"`
+}
+
+// EncodeValue supports the values returned by redis replies and database/sql drivers.
+func EncodeValue(v interface{}) (Value, error) {
+	switch val := v.(type) {
+	case nil:
+		return Value{Kind: "nil"}, nil
+	case int64:
+		return Value{Kind: "int", Int: val}, nil
+	case int:
+		return Value{Kind: "int", Int: int64(val)}, nil
+	case float64:
+		return Value{Kind: "float", Float: val}, nil
+	case bool:
+		return Value{Kind: "bool", Bool: val}, nil
+	case string:
+		return Value{Kind: "string", Str: val}, nil
+	case []byte:
+		//keep readable text in the cassette
+		if utf8.Valid(val) {
+			return Value{Kind: "bytes", Str: string(val)}, nil
+		}
+		return Value{Kind: "bytes", Bytes: val}, nil
+	case time.Time:
+		return Value{Kind: "time", Str: val.Format(time.RFC3339Nano)}, nil
+	case []interface{}:
+		arr := make([]Value, len(val))
+		for k, elem := range val {
+			ev, err := EncodeValue(elem)
+			if err != nil {
+				return Value{}, err
+			}
+			arr[k] = ev
+		}
+		return Value{Kind: "array", Array: arr}, nil
+	case error:
+		return Value{Kind: "error", Str: val.Error()}, nil
+	default:
+		return Value{}, fmt.Errorf("cassette: unsupported value type %T", v)
+	}
+}
+
+// DecodeValue is the reverse of EncodeValue,
+// newErr builds values of kind "error", errors.New is used if it is nil.
+func DecodeValue(v Value, newErr func(string) interface{}) (interface{}, error) {
+	switch v.Kind {
+	case "nil":
+		return nil, nil
+	case "int":
+		return v.Int, nil
+	case "float":
+		return v.Float, nil
+	case "bool":
+		return v.Bool, nil
+	case "string":
+		return v.Str, nil
+	case "bytes":
+		if v.Bytes != nil {
+			return v.Bytes, nil
+		}
+		return []byte(v.Str), nil
+	case "time":
+		return time.Parse(time.RFC3339Nano, v.Str)
+	case "array":
+		arr := make([]interface{}, len(v.Array))
+		for k, elem := range v.Array {
+			dv, err := DecodeValue(elem, newErr)
+			if err != nil {
+				return nil, err
+			}
+			arr[k] = dv
+		}
+		return arr, nil
+	case "error":
+		if newErr == nil {
+			return errors.New(v.Str), nil
+		}
+		return newErr(v.Str), nil
+	default:
+		return nil, fmt.Errorf("cassette: unknown value kind %s", v.Kind)
+	}
+}
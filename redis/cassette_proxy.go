@@ -0,0 +1,256 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
+)
+
+const cassetteKind = "redis"
+
+var errReplayConn = errors.New("redis: no connection in replay mode")
+
+// cassetteProxy records replies to a cassette or replays them from it,
+// the mode is chosen by "cassette_mode", put it last so the other proxies still run.
+type cassetteProxy struct {
+	name string
+
+	nextConn ContextConn
+
+	conf config.Config
+
+	logger log.Logger
+
+	cassette *cassette.Cassette
+
+	lock sync.Mutex
+
+	//requests which were sent but not received on this connection
+	pending []string
+}
+
+type CassetteProxyOption func(c *cassetteProxy)
+
+type CassetteProxyOptions struct{}
+
+func NewCassetteProxy(options ...CassetteProxyOption) *cassetteProxy {
+	cassetteProxy := &cassetteProxy{}
+
+	for _, option := range options {
+		option(cassetteProxy)
+	}
+
+	if cassetteProxy.conf == nil {
+		cassetteProxy.conf = config.NewNullConfig()
+	}
+
+	if cassetteProxy.logger == nil {
+		cassetteProxy.logger = log.NewLogger()
+	}
+
+	if cassetteProxy.cassette == nil {
+		cas, err := cassette.OpenWithConf(cassetteProxy.conf)
+		if err != nil {
+			cassetteProxy.logger.Panicf("[redis] open cassette error : %s", err.Error())
+		}
+		cassetteProxy.cassette = cas
+	}
+
+	cassetteProxy.name = "cassette_proxy"
+
+	return cassetteProxy
+}
+
+func (CassetteProxyOptions) WithConf(conf config.Config) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.conf = conf
+	}
+}
+
+func (CassetteProxyOptions) WithLogger(logger log.Logger) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.logger = logger
+	}
+}
+
+func (CassetteProxyOptions) WithCassette(cas *cassette.Cassette) CassetteProxyOption {
+	return func(c *cassetteProxy) {
+		c.cassette = cas
+	}
+}
+
+//implement Proxy interface
+func (this *cassetteProxy) NextProxy(conn interface{}) {
+	this.nextConn = conn.(ContextConn)
+}
+
+//implement Proxy interface
+func (this *cassetteProxy) ProxyName() string {
+	return this.name
+}
+
+//implement ConnBinder interface
+func (this *cassetteProxy) Bind(conn ContextConn) ContextConn {
+	return &cassetteProxy{
+		name:     this.name,
+		nextConn: conn,
+		conf:     this.conf,
+		logger:   this.logger,
+		cassette: this.cassette,
+	}
+}
+
+func (this *cassetteProxy) Close() error {
+	return this.nextConn.Close()
+}
+
+func (this *cassetteProxy) Err() error {
+	if this.isReplay() {
+		return nil
+	}
+
+	return this.nextConn.Err()
+}
+
+func (this *cassetteProxy) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	if this.cassette == nil {
+		return this.nextConn.Do(ctx, commandName, args...)
+	}
+
+	request := cassetteRequest(commandName, args)
+	if this.isReplay() {
+		return this.replay(request)
+	}
+
+	reply, err = this.nextConn.Do(ctx, commandName, args...)
+	this.record(request, reply, err)
+
+	return
+}
+
+func (this *cassetteProxy) Send(ctx context.Context, commandName string, args ...interface{}) (err error) {
+	if this.cassette == nil {
+		return this.nextConn.Send(ctx, commandName, args...)
+	}
+
+	if !this.isReplay() {
+		err = this.nextConn.Send(ctx, commandName, args...)
+		if err != nil {
+			return
+		}
+	}
+
+	this.lock.Lock()
+	this.pending = append(this.pending, cassetteRequest(commandName, args))
+	this.lock.Unlock()
+
+	return
+}
+
+func (this *cassetteProxy) Flush(ctx context.Context) error {
+	if this.isReplay() {
+		return nil
+	}
+
+	return this.nextConn.Flush(ctx)
+}
+
+func (this *cassetteProxy) Receive(ctx context.Context) (reply interface{}, err error) {
+	if this.cassette == nil {
+		return this.nextConn.Receive(ctx)
+	}
+
+	request := "RECEIVE"
+	this.lock.Lock()
+	if len(this.pending) > 0 {
+		request = this.pending[0]
+		this.pending = this.pending[1:]
+	}
+	this.lock.Unlock()
+
+	if this.isReplay() {
+		return this.replay(request)
+	}
+
+	reply, err = this.nextConn.Receive(ctx)
+	this.record(request, reply, err)
+
+	return
+}
+
+func (this *cassetteProxy) isReplay() bool {
+	return this.cassette != nil && this.cassette.Mode() == cassette.ModeReplay
+}
+
+func (this *cassetteProxy) record(request string, reply interface{}, err error) {
+	value, encErr := cassette.EncodeValue(reply)
+	if encErr != nil {
+		this.logger.Errorf("[redis] record %s error : %s", request, encErr.Error())
+		return
+	}
+
+	encErr = this.cassette.Record(cassetteKind, request, value, err)
+	if encErr != nil {
+		this.logger.Errorf("[redis] record %s error : %s", request, encErr.Error())
+	}
+}
+
+func (this *cassetteProxy) replay(request string) (interface{}, error) {
+	value := cassette.Value{}
+	err := this.cassette.Replay(cassetteKind, request, &value)
+	if errors.Is(err, cassette.ErrUnmatched) {
+		this.logger.Errorf("[redis] %s", err.Error())
+		return nil, err
+	}
+
+	reply, decErr := cassette.DecodeValue(value, func(msg string) interface{} {
+		return redis.Error(msg)
+	})
+	if decErr != nil {
+		return nil, decErr
+	}
+
+	//redigo returns the error reply as err too
+	if redisErr, ok := reply.(redis.Error); ok && err != nil {
+		err = redisErr
+	}
+
+	return reply, err
+}
+
+func cassetteRequest(commandName string, args []interface{}) string {
+	request := strings.ToUpper(commandName)
+	for _, arg := range args {
+		if b, ok := arg.([]byte); ok {
+			arg = string(b)
+		}
+		request += fmt.Sprintf(" %q", fmt.Sprint(arg))
+	}
+
+	return request
+}
+
+// replayConn stands in for the pool's connection in replay mode,
+// every command must be answered by cassetteProxy.
+type replayConn struct{}
+
+func (replayConn) Close() error { return nil }
+
+func (replayConn) Err() error { return nil }
+
+func (replayConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, errReplayConn
+}
+
+func (replayConn) Send(commandName string, args ...interface{}) error { return errReplayConn }
+
+func (replayConn) Flush() error { return errReplayConn }
+
+func (replayConn) Receive() (interface{}, error) { return nil, errReplayConn }
@@ -0,0 +1,144 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keySpec tells which arguments of a command are keys, like "COMMAND INFO" of redis.
+// Keys are args[first], args[first+step] ... args[last],
+// a negative last counts from the end, -1 is the last argument.
+// If numKeysAt is not 0, args[numKeysAt - 1] is the number of the keys following it, like EVAL.
+type keySpec struct {
+	first int
+
+	last int
+
+	step int
+
+	numKeysAt int
+}
+
+var (
+	noKey      = keySpec{first: -1}
+	firstKey   = keySpec{first: 0, last: 0, step: 1}
+	allKeys    = keySpec{first: 0, last: -1, step: 1}
+	keyValues  = keySpec{first: 0, last: -1, step: 2}
+	keysButEnd = keySpec{first: 0, last: -2, step: 1}
+	numKeys    = keySpec{first: -1, numKeysAt: 2}
+)
+
+var commandKeySpecs = map[string]keySpec{
+	"AUTH": noKey, "SELECT": noKey, "PING": noKey, "ECHO": noKey, "INFO": noKey,
+	"MULTI": noKey, "EXEC": noKey, "DISCARD": noKey, "UNWATCH": noKey,
+	"SCRIPT": noKey, "DBSIZE": noKey, "FLUSHDB": noKey, "FLUSHALL": noKey,
+	"TIME": noKey, "RANDOMKEY": noKey, "PUBLISH": noKey, "SUBSCRIBE": noKey,
+	"PSUBSCRIBE": noKey, "UNSUBSCRIBE": noKey, "PUNSUBSCRIBE": noKey,
+	"SCAN": noKey, "KEYS": noKey,
+
+	"GET": firstKey, "SET": firstKey, "SETEX": firstKey, "PSETEX": firstKey,
+	"SETNX": firstKey, "GETSET": firstKey, "APPEND": firstKey, "STRLEN": firstKey,
+	"INCR": firstKey, "INCRBY": firstKey, "INCRBYFLOAT": firstKey, "DECR": firstKey,
+	"DECRBY": firstKey, "GETRANGE": firstKey, "SETRANGE": firstKey, "GETBIT": firstKey,
+	"SETBIT": firstKey, "BITCOUNT": firstKey, "BITPOS": firstKey, "EXPIRE": firstKey,
+	"PEXPIRE": firstKey, "EXPIREAT": firstKey, "PEXPIREAT": firstKey, "TTL": firstKey,
+	"PTTL": firstKey, "PERSIST": firstKey, "TYPE": firstKey, "DUMP": firstKey,
+	"RESTORE": firstKey, "SORT": firstKey,
+	"HGET": firstKey, "HSET": firstKey, "HSETNX": firstKey, "HMGET": firstKey,
+	"HMSET": firstKey, "HDEL": firstKey, "HLEN": firstKey, "HEXISTS": firstKey,
+	"HGETALL": firstKey, "HKEYS": firstKey, "HVALS": firstKey, "HINCRBY": firstKey,
+	"HINCRBYFLOAT": firstKey, "HSTRLEN": firstKey, "HSCAN": firstKey,
+	"LPUSH": firstKey, "RPUSH": firstKey, "LPUSHX": firstKey, "RPUSHX": firstKey,
+	"LPOP": firstKey, "RPOP": firstKey, "LLEN": firstKey, "LRANGE": firstKey,
+	"LINDEX": firstKey, "LSET": firstKey, "LREM": firstKey, "LTRIM": firstKey,
+	"LINSERT": firstKey,
+	"SADD": firstKey, "SREM": firstKey, "SCARD": firstKey, "SISMEMBER": firstKey,
+	"SMEMBERS": firstKey, "SPOP": firstKey, "SRANDMEMBER": firstKey, "SSCAN": firstKey,
+	"ZADD": firstKey, "ZREM": firstKey, "ZCARD": firstKey, "ZCOUNT": firstKey,
+	"ZSCORE": firstKey, "ZINCRBY": firstKey, "ZRANGE": firstKey, "ZREVRANGE": firstKey,
+	"ZRANGEBYSCORE": firstKey, "ZREVRANGEBYSCORE": firstKey, "ZRANK": firstKey,
+	"ZREVRANK": firstKey, "ZREMRANGEBYRANK": firstKey, "ZREMRANGEBYSCORE": firstKey,
+	"ZSCAN": firstKey, "ZLEXCOUNT": firstKey, "ZRANGEBYLEX": firstKey,
+	"ZREVRANGEBYLEX": firstKey, "ZREMRANGEBYLEX": firstKey, "ZPOPMIN": firstKey,
+	"ZPOPMAX": firstKey,
+	"PFADD": firstKey, "GEOADD": firstKey, "GEOPOS": firstKey, "GEODIST": firstKey,
+	"GEOHASH": firstKey, "GEORADIUS": firstKey, "GEORADIUSBYMEMBER": firstKey,
+	"XADD": firstKey, "XLEN": firstKey, "XRANGE": firstKey, "XREVRANGE": firstKey,
+	"XDEL": firstKey, "XTRIM": firstKey, "XACK": firstKey,
+
+	"DEL": allKeys, "UNLINK": allKeys, "EXISTS": allKeys, "TOUCH": allKeys,
+	"MGET": allKeys, "WATCH": allKeys, "RENAME": allKeys, "RENAMENX": allKeys,
+	"RPOPLPUSH": allKeys, "SINTER": allKeys, "SUNION": allKeys, "SDIFF": allKeys,
+	"SINTERSTORE": allKeys, "SUNIONSTORE": allKeys, "SDIFFSTORE": allKeys,
+	"PFCOUNT": allKeys, "PFMERGE": allKeys,
+	"SMOVE": {first: 0, last: 1, step: 1},
+
+	"MSET": keyValues, "MSETNX": keyValues,
+
+	"BLPOP": keysButEnd, "BRPOP": keysButEnd, "BRPOPLPUSH": keysButEnd,
+	"BZPOPMIN": keysButEnd, "BZPOPMAX": keysButEnd,
+
+	"BITOP":  {first: 1, last: -1, step: 1},
+	"OBJECT": {first: 1, last: 1, step: 1},
+
+	"EVAL": numKeys, "EVALSHA": numKeys,
+	"ZUNIONSTORE": {first: 0, last: 0, step: 1, numKeysAt: 2},
+	"ZINTERSTORE": {first: 0, last: 0, step: 1, numKeysAt: 2},
+}
+
+// keyIndexes returns the indexes of the key arguments,
+// known is false if the command is not in commandKeySpecs.
+func keyIndexes(commandName string, args []interface{}) (indexes []int, known bool) {
+	spec, known := commandKeySpecs[strings.ToUpper(commandName)]
+	if !known {
+		return nil, false
+	}
+
+	argNum := len(args)
+	if spec.first >= 0 && spec.first < argNum {
+		last := spec.last
+		if last < 0 {
+			last = argNum + last
+		}
+		if last >= argNum {
+			last = argNum - 1
+		}
+
+		for i := spec.first; i <= last; i += spec.step {
+			indexes = append(indexes, i)
+		}
+	}
+
+	if spec.numKeysAt > 0 && spec.numKeysAt <= argNum {
+		n, err := strconv.Atoi(argString(args[spec.numKeysAt-1]))
+		if err == nil {
+			for i := spec.numKeysAt; i < spec.numKeysAt+n && i < argNum; i++ {
+				indexes = append(indexes, i)
+			}
+		}
+	}
+
+	return indexes, true
+}
+
+// commandKey returns the first key of the command.
+func commandKey(commandName string, args []interface{}) (string, bool) {
+	indexes, _ := keyIndexes(commandName, args)
+	if len(indexes) == 0 {
+		return "", false
+	}
+
+	return argString(args[indexes[0]]), true
+}
+
+func argString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
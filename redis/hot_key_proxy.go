@@ -0,0 +1,390 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hotKeyProxy samples commands to find the most frequent keys and the keys with the biggest replies,
+// and warns about every reply or argument bigger than "redis_big_value_size".
+// The top "redis_hotkey_top_k" keys of each "redis_hotkey_report_interval" seconds are logged and exported,
+// then the counts start over, so the report reflects the current traffic. The keys may hold
+// user data, the metrics have their hashes only, the log maps the hashes to the keys.
+// keyTrackerFactor times top k keys are tracked for the estimates of the top keys.
+type hotKeyProxy struct {
+	name string
+
+	nextConn ContextConn
+
+	conf config.Config
+
+	logger log.Logger
+
+	sampleRate float64
+
+	bigValueSize int
+
+	reportInterval time.Duration
+
+	topK int
+
+	//shared by all bound proxies
+	stats *hotKeyStats
+}
+
+type hotKeyStats struct {
+	lock sync.Mutex
+
+	hotKeys *keyTracker
+
+	bigKeys *keyTracker
+
+	lastReport time.Time
+}
+
+type HotKeyProxyOption func(c *hotKeyProxy)
+
+type HotKeyProxyOptions struct{}
+
+func NewHotKeyProxy(options ...HotKeyProxyOption) *hotKeyProxy {
+	hotKeyProxy := &hotKeyProxy{}
+
+	for _, option := range options {
+		option(hotKeyProxy)
+	}
+
+	if hotKeyProxy.conf == nil {
+		hotKeyProxy.conf = config.NewNullConfig()
+	}
+
+	if hotKeyProxy.logger == nil {
+		hotKeyProxy.logger = log.NewLogger()
+	}
+
+	hotKeyProxy.sampleRate = hotKeyProxy.conf.GetFloat64("redis_hotkey_sample_rate")
+	if hotKeyProxy.sampleRate <= 0 {
+		hotKeyProxy.sampleRate = 0.1
+	}
+
+	topK := hotKeyProxy.conf.GetInt("redis_hotkey_top_k")
+	if topK <= 0 {
+		topK = 10
+	}
+
+	hotKeyProxy.reportInterval = time.Duration(hotKeyProxy.conf.GetInt64("redis_hotkey_report_interval")) * time.Second
+	if hotKeyProxy.reportInterval <= 0 {
+		hotKeyProxy.reportInterval = 60 * time.Second
+	}
+
+	hotKeyProxy.bigValueSize = hotKeyProxy.conf.GetInt("redis_big_value_size")
+	if hotKeyProxy.bigValueSize <= 0 {
+		hotKeyProxy.bigValueSize = 1 << 20
+	}
+
+	hotKeyProxy.topK = topK
+	hotKeyProxy.stats = &hotKeyStats{
+		hotKeys:    newKeyTracker(topK * keyTrackerFactor),
+		bigKeys:    newKeyTracker(topK * keyTrackerFactor),
+		lastReport: time.Now(),
+	}
+
+	hotKeyProxy.name = "hot_key_proxy"
+
+	return hotKeyProxy
+}
+
+func (HotKeyProxyOptions) WithConf(conf config.Config) HotKeyProxyOption {
+	return func(h *hotKeyProxy) {
+		h.conf = conf
+	}
+}
+
+func (HotKeyProxyOptions) WithLogger(logger log.Logger) HotKeyProxyOption {
+	return func(h *hotKeyProxy) {
+		h.logger = logger
+	}
+}
+
+//implement Proxy interface
+func (this *hotKeyProxy) NextProxy(conn interface{}) {
+	this.nextConn = conn.(ContextConn)
+}
+
+//implement Proxy interface
+func (this *hotKeyProxy) ProxyName() string {
+	return this.name
+}
+
+//implement ConnBinder interface
+func (this *hotKeyProxy) Bind(conn ContextConn) ContextConn {
+	return &hotKeyProxy{
+		name:           this.name,
+		nextConn:       conn,
+		conf:           this.conf,
+		logger:         this.logger,
+		sampleRate:     this.sampleRate,
+		bigValueSize:   this.bigValueSize,
+		reportInterval: this.reportInterval,
+		topK:           this.topK,
+		stats:          this.stats,
+	}
+}
+
+func (this *hotKeyProxy) Close() error {
+	return this.nextConn.Close()
+}
+
+func (this *hotKeyProxy) Err() error {
+	return this.nextConn.Err()
+}
+
+func (this *hotKeyProxy) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	key, hasKey := commandKey(commandName, args)
+	this.checkArgs(ctx, commandName, key, args)
+
+	reply, err = this.nextConn.Do(ctx, commandName, args...)
+
+	replySize := valueSize(reply)
+	if replySize > this.bigValueSize {
+		redisBigValueTotal.With(prometheus.Labels{"cmd": strings.ToUpper(commandName)}).Inc()
+		this.logger.Warnc(ctx, "big redis reply %s %s : %d bytes", commandName, key, replySize)
+	}
+
+	if hasKey && this.sampled() {
+		this.stats.lock.Lock()
+		this.stats.hotKeys.incr(key, 1)
+		this.stats.bigKeys.max(key, int64(replySize))
+		this.stats.lock.Unlock()
+
+		this.report()
+	}
+
+	return
+}
+
+func (this *hotKeyProxy) Send(ctx context.Context, commandName string, args ...interface{}) error {
+	key, hasKey := commandKey(commandName, args)
+	this.checkArgs(ctx, commandName, key, args)
+
+	//the reply size is unknown in pipeline, only count the key
+	if hasKey && this.sampled() {
+		this.stats.lock.Lock()
+		this.stats.hotKeys.incr(key, 1)
+		this.stats.lock.Unlock()
+
+		this.report()
+	}
+
+	return this.nextConn.Send(ctx, commandName, args...)
+}
+
+func (this *hotKeyProxy) Flush(ctx context.Context) error {
+	return this.nextConn.Flush(ctx)
+}
+
+func (this *hotKeyProxy) Receive(ctx context.Context) (reply interface{}, err error) {
+	reply, err = this.nextConn.Receive(ctx)
+
+	replySize := valueSize(reply)
+	if replySize > this.bigValueSize {
+		redisBigValueTotal.With(prometheus.Labels{"cmd": "RECEIVE"}).Inc()
+		this.logger.Warnc(ctx, "big redis reply in pipeline : %d bytes", replySize)
+	}
+
+	return
+}
+
+func (this *hotKeyProxy) sampled() bool {
+	return this.sampleRate >= 1 || rand.Float64() < this.sampleRate
+}
+
+func (this *hotKeyProxy) checkArgs(ctx context.Context, commandName, key string, args []interface{}) {
+	for _, arg := range args {
+		size := valueSize(arg)
+		if size > this.bigValueSize {
+			redisBigValueTotal.With(prometheus.Labels{"cmd": strings.ToUpper(commandName)}).Inc()
+			this.logger.Warnc(ctx, "big redis argument %s %s : %d bytes", commandName, key, size)
+		}
+	}
+}
+
+// report logs and exports the top keys once every reportInterval and resets the counts.
+func (this *hotKeyProxy) report() {
+	stats := this.stats
+
+	stats.lock.Lock()
+	if time.Since(stats.lastReport) < this.reportInterval {
+		stats.lock.Unlock()
+		return
+	}
+	stats.lastReport = time.Now()
+	hotKeys := stats.hotKeys.top(this.topK)
+	bigKeys := stats.bigKeys.top(this.topK)
+	stats.hotKeys.reset()
+	stats.bigKeys.reset()
+	stats.lock.Unlock()
+
+	//drop the keys which left the top
+	redisHotKey.Reset()
+	for _, kc := range hotKeys {
+		redisHotKey.With(prometheus.Labels{"key_hash": keyHash(kc.key)}).Set(float64(kc.count))
+	}
+
+	redisBigKey.Reset()
+	for _, kc := range bigKeys {
+		redisBigKey.With(prometheus.Labels{"key_hash": keyHash(kc.key)}).Set(float64(kc.count))
+	}
+
+	if len(hotKeys) > 0 {
+		this.logger.Infof("redis hot keys (sampled count) %s", formatKeyCounts(hotKeys))
+	}
+
+	if len(bigKeys) > 0 {
+		this.logger.Infof("redis big keys (bytes) %s", formatKeyCounts(bigKeys))
+	}
+}
+
+// valueSize is the approximate size in bytes of an argument or a reply.
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return len(v)
+	case []byte:
+		return len(v)
+	case redis.Error:
+		return len(v)
+	case []interface{}:
+		size := 0
+		for _, elem := range v {
+			size += valueSize(elem)
+		}
+		return size
+	default:
+		//integers are too small to matter
+		return 0
+	}
+}
+
+func formatKeyCounts(keyCounts []keyCount) string {
+	strs := make([]string, len(keyCounts))
+	for k, kc := range keyCounts {
+		strs[k] = fmt.Sprintf("%s(%s):%d", kc.key, keyHash(kc.key), kc.count)
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// keyHash is the label of key in the metrics, the first 8 bytes of its sha1 in hex.
+func keyHash(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyTrackerFactor is the number of the tracked keys per top key, with capacity keys
+// the count of a key is overestimated by at most the count of all keys / capacity.
+const keyTrackerFactor = 20
+
+type keyCount struct {
+	key string
+
+	count int64
+}
+
+// keyTracker keeps at most capacity keys, it is not safe for concurrent use.
+// incr is the Space-Saving algorithm, a new key takes the place of the smallest one
+// and inherits its count, so frequent keys are kept with a bounded overestimate.
+type keyTracker struct {
+	capacity int
+
+	counts map[string]int64
+}
+
+func newKeyTracker(capacity int) *keyTracker {
+	return &keyTracker{
+		capacity: capacity,
+		counts:   make(map[string]int64, capacity),
+	}
+}
+
+func (this *keyTracker) incr(key string, n int64) {
+	if _, ok := this.counts[key]; ok || len(this.counts) < this.capacity {
+		this.counts[key] += n
+		return
+	}
+
+	minKey, minCount := this.min()
+	delete(this.counts, minKey)
+	this.counts[key] = minCount + n
+}
+
+// max keeps the biggest n of key.
+func (this *keyTracker) max(key string, n int64) {
+	if count, ok := this.counts[key]; ok {
+		if n > count {
+			this.counts[key] = n
+		}
+		return
+	}
+
+	if len(this.counts) < this.capacity {
+		this.counts[key] = n
+		return
+	}
+
+	minKey, minCount := this.min()
+	if n > minCount {
+		delete(this.counts, minKey)
+		this.counts[key] = n
+	}
+}
+
+func (this *keyTracker) min() (string, int64) {
+	var minKey string
+	var minCount int64 = -1
+	for key, count := range this.counts {
+		if minCount == -1 || count < minCount {
+			minKey, minCount = key, count
+		}
+	}
+
+	return minKey, minCount
+}
+
+func (this *keyTracker) reset() {
+	this.counts = make(map[string]int64, this.capacity)
+}
+
+// top returns at most k keys sorted by count desc.
+func (this *keyTracker) top(k int) []keyCount {
+	keyCounts := make([]keyCount, 0, len(this.counts))
+	for key, count := range this.counts {
+		keyCounts = append(keyCounts, keyCount{key, count})
+	}
+
+	sort.Slice(keyCounts, func(i, j int) bool {
+		if keyCounts[i].count == keyCounts[j].count {
+			return keyCounts[i].key < keyCounts[j].key
+		}
+		return keyCounts[i].count > keyCounts[j].count
+	})
+
+	if len(keyCounts) > k {
+		keyCounts = keyCounts[:k]
+	}
+
+	return keyCounts
+}
@@ -37,3 +37,10 @@ type ContextConn interface {
 	// Receive receives a single reply from the Redis server
 	Receive(ctx context.Context) (reply interface{}, err error)
 }
+
+// ConnBinder is implemented by proxies which are created once and shared by all connections.
+// Bind returns a proxy for one borrowed connection whose next is conn,
+// it must not change the receiver.
+type ConnBinder interface {
+	Bind(conn ContextConn) ContextConn
+}
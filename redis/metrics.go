@@ -22,16 +22,39 @@ var redisDuration = prometheus.NewHistogramVec(
 	[]string{"cmd"},
 )
 
-var redisStats = prometheus.NewGaugeVec(
+// "redis_stats", read at scrape time
+var redisPoolCollector = newPoolCollector()
+
+// only the current top keys are kept, see hotKeyProxy
+var redisHotKey = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "redis_hot_key",
+		Help: "sampled count of the most frequent keys, by the hash of the key in the log",
+	},
+	[]string{"key_hash"},
+)
+
+var redisBigKey = prometheus.NewGaugeVec(
 	prometheus.GaugeOpts{
-		Name: "redis_stats",
-		Help: "pool's statistics",
+		Name: "redis_big_key_bytes",
+		Help: "biggest sampled reply of the keys with the biggest replies, by the hash of the key in the log",
 	},
-	[]string{"stats"},
+	[]string{"key_hash"},
+)
+
+var redisBigValueTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "redis_big_value_total",
+		Help: "Number of replies or arguments bigger than redis_big_value_size",
+	},
+	[]string{"cmd"},
 )
 
 func init() {
 	prometheus.MustRegister(redisTotal)
 	prometheus.MustRegister(redisDuration)
-	prometheus.MustRegister(redisStats)
+	prometheus.MustRegister(redisPoolCollector)
+	prometheus.MustRegister(redisHotKey)
+	prometheus.MustRegister(redisBigKey)
+	prometheus.MustRegister(redisBigValueTotal)
 }
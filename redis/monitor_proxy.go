@@ -82,6 +82,18 @@ func (pc *monitorProxy) ProxyName() string {
 	return pc.name
 }
 
+//implement ConnBinder interface
+func (pc *monitorProxy) Bind(conn ContextConn) ContextConn {
+	return &monitorProxy{
+		name:        pc.name,
+		nextConn:    conn,
+		tracer:      pc.tracer,
+		conf:        pc.conf,
+		log:         pc.log,
+		afterEvents: pc.afterEvents,
+	}
+}
+
 func (pc *monitorProxy) Close() error {
 	err := pc.nextConn.Close()
 
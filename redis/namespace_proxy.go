@@ -0,0 +1,327 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+)
+
+type tenantKey struct{}
+
+// NewTenantContext returns a copy of ctx carrying tenant,
+// namespaceProxy puts the tenant in the prefix of every key.
+func NewTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// namespaceProxy isolates the services and tenants which share one redis.
+// It prefixes every key argument with "redis_key_prefix", followed by "tenant:"
+// if the context carries a tenant, and strips the prefix from the keys in replies
+// of KEYS, SCAN, RANDOMKEY and the blocking pops.
+// The key positions come from commandKeySpecs, commands not in it are passed through
+// or refused if "redis_key_prefix_strict" is true.
+// FLUSHDB, FLUSHALL, DBSIZE and RANDOMKEY work on the keys of all namespaces, they are not isolated
+// and refused in strict mode.
+// Replies of EXEC are not stripped, and keys in lua scripts must be passed by KEYS.
+type namespaceProxy struct {
+	name string
+
+	nextConn ContextConn
+
+	conf config.Config
+
+	logger log.Logger
+
+	prefix string
+
+	//prefix was set by WithPrefix
+	fixedPrefix bool
+
+	strict bool
+
+	lock sync.Mutex
+
+	//commands and prefixes which were sent but not received on this connection
+	pending []namespaceCommand
+}
+
+// unisolatedCommands work on the whole database whatever the prefix.
+var unisolatedCommands = map[string]bool{
+	"FLUSHDB": true, "FLUSHALL": true, "DBSIZE": true, "RANDOMKEY": true,
+}
+
+type namespaceCommand struct {
+	commandName string
+
+	prefix string
+}
+
+type NamespaceProxyOption func(c *namespaceProxy)
+
+type NamespaceProxyOptions struct{}
+
+func NewNamespaceProxy(options ...NamespaceProxyOption) *namespaceProxy {
+	namespaceProxy := &namespaceProxy{}
+
+	for _, option := range options {
+		option(namespaceProxy)
+	}
+
+	if namespaceProxy.conf == nil {
+		namespaceProxy.conf = config.NewNullConfig()
+	}
+
+	if namespaceProxy.logger == nil {
+		namespaceProxy.logger = log.NewLogger()
+	}
+
+	if !namespaceProxy.fixedPrefix {
+		namespaceProxy.prefix = namespaceProxy.conf.GetString("redis_key_prefix")
+	}
+
+	namespaceProxy.strict = namespaceProxy.conf.GetBool("redis_key_prefix_strict")
+
+	namespaceProxy.name = "namespace_proxy"
+
+	return namespaceProxy
+}
+
+func (NamespaceProxyOptions) WithConf(conf config.Config) NamespaceProxyOption {
+	return func(n *namespaceProxy) {
+		n.conf = conf
+	}
+}
+
+func (NamespaceProxyOptions) WithLogger(logger log.Logger) NamespaceProxyOption {
+	return func(n *namespaceProxy) {
+		n.logger = logger
+	}
+}
+
+func (NamespaceProxyOptions) WithPrefix(prefix string) NamespaceProxyOption {
+	return func(n *namespaceProxy) {
+		n.prefix = prefix
+		n.fixedPrefix = true
+	}
+}
+
+//implement Proxy interface
+func (this *namespaceProxy) NextProxy(conn interface{}) {
+	this.nextConn = conn.(ContextConn)
+}
+
+//implement Proxy interface
+func (this *namespaceProxy) ProxyName() string {
+	return this.name
+}
+
+//implement ConnBinder interface
+func (this *namespaceProxy) Bind(conn ContextConn) ContextConn {
+	return &namespaceProxy{
+		name:     this.name,
+		nextConn: conn,
+		conf:     this.conf,
+		logger:   this.logger,
+		prefix:   this.prefix,
+		strict:   this.strict,
+	}
+}
+
+func (this *namespaceProxy) Close() error {
+	return this.nextConn.Close()
+}
+
+func (this *namespaceProxy) Err() error {
+	return this.nextConn.Err()
+}
+
+func (this *namespaceProxy) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
+	prefix := this.keyPrefix(ctx)
+	if prefix == "" {
+		return this.nextConn.Do(ctx, commandName, args...)
+	}
+
+	args, err = this.prefixArgs(commandName, prefix, args)
+	if err != nil {
+		this.logger.Errorc(ctx, "%s", err.Error())
+		return nil, err
+	}
+
+	reply, err = this.nextConn.Do(ctx, commandName, args...)
+
+	return stripReply(commandName, prefix, reply), err
+}
+
+func (this *namespaceProxy) Send(ctx context.Context, commandName string, args ...interface{}) (err error) {
+	prefix := this.keyPrefix(ctx)
+	if prefix != "" {
+		args, err = this.prefixArgs(commandName, prefix, args)
+		if err != nil {
+			this.logger.Errorc(ctx, "%s", err.Error())
+			return err
+		}
+	}
+
+	err = this.nextConn.Send(ctx, commandName, args...)
+	if err != nil {
+		return
+	}
+
+	this.lock.Lock()
+	this.pending = append(this.pending, namespaceCommand{commandName, prefix})
+	this.lock.Unlock()
+
+	return
+}
+
+func (this *namespaceProxy) Flush(ctx context.Context) error {
+	return this.nextConn.Flush(ctx)
+}
+
+func (this *namespaceProxy) Receive(ctx context.Context) (reply interface{}, err error) {
+	reply, err = this.nextConn.Receive(ctx)
+
+	this.lock.Lock()
+	if len(this.pending) == 0 {
+		this.lock.Unlock()
+		return
+	}
+	command := this.pending[0]
+	this.pending = this.pending[1:]
+	this.lock.Unlock()
+
+	if command.prefix == "" {
+		return
+	}
+
+	return stripReply(command.commandName, command.prefix, reply), err
+}
+
+func (this *namespaceProxy) keyPrefix(ctx context.Context) string {
+	if tenant, ok := TenantFromContext(ctx); ok {
+		return this.prefix + tenant + ":"
+	}
+
+	return this.prefix
+}
+
+// prefixArgs returns a copy of args with the prefix, args of the caller are not modified.
+func (this *namespaceProxy) prefixArgs(commandName, prefix string,
+	args []interface{}) ([]interface{}, error) {
+	if this.strict && unisolatedCommands[strings.ToUpper(commandName)] {
+		return nil, fmt.Errorf("redis: %s is not isolated in strict namespace",
+			strings.ToUpper(commandName))
+	}
+
+	newArgs := make([]interface{}, len(args))
+	copy(newArgs, args)
+
+	switch strings.ToUpper(commandName) {
+	case "KEYS":
+		if len(newArgs) > 0 {
+			newArgs[0] = escapePattern(prefix) + argString(newArgs[0])
+		}
+		return newArgs, nil
+	case "SCAN":
+		for i := 1; i < len(newArgs)-1; i++ {
+			if strings.ToUpper(argString(newArgs[i])) == "MATCH" {
+				newArgs[i+1] = escapePattern(prefix) + argString(newArgs[i+1])
+				return newArgs, nil
+			}
+		}
+		//never scan the keys of others
+		return append(newArgs, "MATCH", escapePattern(prefix)+"*"), nil
+	}
+
+	indexes, known := keyIndexes(commandName, newArgs)
+	if !known {
+		if this.strict {
+			return nil, fmt.Errorf("redis: unknown key positions of %s in strict namespace",
+				strings.ToUpper(commandName))
+		}
+		return args, nil
+	}
+
+	for _, index := range indexes {
+		switch key := newArgs[index].(type) {
+		case []byte:
+			newArgs[index] = append([]byte(prefix), key...)
+		default:
+			newArgs[index] = prefix + argString(key)
+		}
+	}
+
+	return newArgs, nil
+}
+
+// stripReply removes prefix from the keys in the reply of commands returning keys.
+func stripReply(commandName, prefix string, reply interface{}) interface{} {
+	switch strings.ToUpper(commandName) {
+	case "KEYS":
+		return stripKeys(prefix, reply)
+	case "SCAN":
+		if values, ok := reply.([]interface{}); ok && len(values) == 2 {
+			return []interface{}{values[0], stripKeys(prefix, values[1])}
+		}
+	case "RANDOMKEY":
+		return stripKey(prefix, reply)
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		if values, ok := reply.([]interface{}); ok && len(values) > 0 {
+			newValues := make([]interface{}, len(values))
+			copy(newValues, values)
+			newValues[0] = stripKey(prefix, values[0])
+			return newValues
+		}
+	}
+
+	return reply
+}
+
+func stripKeys(prefix string, reply interface{}) interface{} {
+	keys, ok := reply.([]interface{})
+	if !ok {
+		return reply
+	}
+
+	newKeys := make([]interface{}, len(keys))
+	for k, key := range keys {
+		newKeys[k] = stripKey(prefix, key)
+	}
+
+	return newKeys
+}
+
+func stripKey(prefix string, key interface{}) interface{} {
+	switch k := key.(type) {
+	case []byte:
+		return bytes.TrimPrefix(k, []byte(prefix))
+	case string:
+		return strings.TrimPrefix(k, prefix)
+	default:
+		return key
+	}
+}
+
+// escapePattern escapes the glob characters of redis in s.
+func escapePattern(s string) string {
+	var builder strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			builder.WriteByte('\\')
+		}
+		builder.WriteRune(r)
+	}
+
+	return builder.String()
+}
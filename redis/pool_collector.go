@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reads redis.PoolStats of the pool of RedisClient at scrape time,
+// the client sets its pool in init and removes it in Close.
+type poolCollector struct {
+	lock sync.RWMutex
+
+	pool *redis.Pool
+
+	desc *prometheus.Desc
+}
+
+func newPoolCollector() *poolCollector {
+	return &poolCollector{
+		desc: prometheus.NewDesc("redis_stats", "pool's statistics", []string{"stats"}, nil),
+	}
+}
+
+func (this *poolCollector) set(pool *redis.Pool) {
+	this.lock.Lock()
+	this.pool = pool
+	this.lock.Unlock()
+}
+
+// remove removes the pool if it is not replaced.
+func (this *poolCollector) remove(pool *redis.Pool) {
+	this.lock.Lock()
+	if this.pool == pool {
+		this.pool = nil
+	}
+	this.lock.Unlock()
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- this.desc
+}
+
+//implement prometheus.Collector interface
+func (this *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	this.lock.RLock()
+	pool := this.pool
+	this.lock.RUnlock()
+
+	if pool == nil {
+		return
+	}
+
+	stats := pool.Stats()
+	values := map[string]float64{
+		"active_count": float64(stats.ActiveCount),
+		"idle_count":   float64(stats.IdleCount),
+		"max_active":   float64(pool.MaxActive),
+		"max_idle":     float64(pool.MaxIdle),
+	}
+
+	for name, value := range values {
+		ch <- prometheus.MustNewConstMetric(this.desc, prometheus.GaugeValue, value, name)
+	}
+}
@@ -1,6 +1,10 @@
 package redis
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
 	"log"
 	"os"
 	"sync"
@@ -9,8 +13,8 @@ import (
 	"github.com/gomodule/redigo/redis"
 	"github.com/jukylin/esim/config"
 	elog "github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
 	"github.com/jukylin/esim/proxy"
-	"github.com/prometheus/client_golang/prometheus"
 )
 
 var poolRedisOnce sync.Once
@@ -27,11 +31,10 @@ type RedisClient struct {
 
 	proxyNum int
 
+	//created once, bound to every borrowed connection
 	proxyInses []interface{}
 
-	stateTicker time.Duration
-
-	closeChan chan bool
+	tlsConfig *tls.Config
 }
 
 type Option func(c *RedisClient)
@@ -46,9 +49,7 @@ func newPoolRedis(options ...Option) *RedisClient {
 	poolRedisOnce.Do(func() {
 
 		onceRedisClient = &RedisClient{
-			proxyConn:   make([]func() interface{}, 0),
-			stateTicker: 10 * time.Second,
-			closeChan:   make(chan bool, 1),
+			proxyConn: make([]func() interface{}, 0),
 		}
 
 		for _, option := range options {
@@ -75,7 +76,7 @@ func newPoolRedis(options ...Option) *RedisClient {
 		}
 
 		redisMaxIdle := onceRedisClient.conf.GetInt("redis_max_idle")
-		if redisMaxActive == 0 {
+		if redisMaxIdle == 0 {
 			redisMaxIdle = 100
 		}
 
@@ -93,8 +94,12 @@ func newPoolRedis(options ...Option) *RedisClient {
 			redis_etc1_port = "6379"
 		}
 
+		redis_etc1_username := onceRedisClient.conf.GetString("redis_username")
+
 		redis_etc1_password := onceRedisClient.conf.GetString("redis_password")
 
+		redis_database := onceRedisClient.conf.GetInt("redis_database")
+
 		redis_read_time_out := onceRedisClient.conf.GetInt64("redis_read_time_out")
 		if redis_read_time_out == 0 {
 			redis_read_time_out = 300
@@ -110,29 +115,65 @@ func newPoolRedis(options ...Option) *RedisClient {
 			redis_conn_time_out = 300
 		}
 
+		//seconds, 0 never PING idle connections
+		redis_test_idle_time := onceRedisClient.conf.GetInt64("redis_test_idle_time")
+
+		//seconds, 0 never close connections because of age
+		redis_max_conn_lifetime := onceRedisClient.conf.GetInt64("redis_max_conn_lifetime")
+
+		dialOptions := []redis.DialOption{
+			redis.DialReadTimeout(time.Duration(redis_read_time_out) * time.Millisecond),
+			redis.DialWriteTimeout(time.Duration(redis_write_time_out) * time.Millisecond),
+			redis.DialConnectTimeout(time.Duration(redis_conn_time_out) * time.Millisecond),
+			redis.DialDatabase(redis_database),
+		}
+
+		//the AUTH with username is sent by hand
+		if redis_etc1_username == "" && redis_etc1_password != "" {
+			dialOptions = append(dialOptions, redis.DialPassword(redis_etc1_password))
+		}
+
+		if onceRedisClient.tlsConfig == nil && onceRedisClient.conf.GetBool("redis_tls") == true {
+			tlsConfig, err := newTLSConfig(onceRedisClient.conf)
+			if err != nil {
+				onceRedisClient.logger.Panicf("[redis] tls config error : %s", err.Error())
+			}
+			onceRedisClient.tlsConfig = tlsConfig
+		}
+
+		if onceRedisClient.tlsConfig != nil {
+			dialOptions = append(dialOptions, redis.DialUseTLS(true),
+				redis.DialTLSConfig(onceRedisClient.tlsConfig),
+				redis.DialTLSSkipVerify(onceRedisClient.tlsConfig.InsecureSkipVerify))
+		}
+
 		onceRedisClient.client = &redis.Pool{
-			MaxIdle:     redisMaxIdle,
-			MaxActive:   redisMaxActive,
-			IdleTimeout: time.Duration(redisIdleTimeout) * time.Second,
+			MaxIdle:         redisMaxIdle,
+			MaxActive:       redisMaxActive,
+			IdleTimeout:     time.Duration(redisIdleTimeout) * time.Second,
+			MaxConnLifetime: time.Duration(redis_max_conn_lifetime) * time.Second,
+			//block Get until a connection is returned, instead of returning ErrPoolExhausted
+			Wait:         onceRedisClient.conf.GetBool("redis_wait"),
+			TestOnBorrow: testOnBorrow(time.Duration(redis_test_idle_time) * time.Second),
+			//errors are returned by ContextConn.Err()
 			Dial: func() (redis.Conn, error) {
-				c, err := redis.Dial("tcp", redis_etc1_host+":"+redis_etc1_port,
-					redis.DialReadTimeout(time.Duration(redis_read_time_out)*time.Millisecond),
-					redis.DialWriteTimeout(time.Duration(redis_write_time_out)*time.Millisecond),
-					redis.DialConnectTimeout(time.Duration(redis_conn_time_out)*time.Millisecond))
+				if cassette.IsReplay(onceRedisClient.conf) {
+					return replayConn{}, nil
+				}
 
+				c, err := redis.Dial("tcp", redis_etc1_host+":"+redis_etc1_port, dialOptions...)
 				if err != nil {
-					onceRedisClient.logger.Panicf("redis.Dial err: %s", err.Error())
+					onceRedisClient.logger.Errorf("redis.Dial err: %s", err.Error())
 					return nil, err
 				}
-				if redis_etc1_password != "" {
-					if _, err := c.Do("AUTH", redis_etc1_password); err != nil {
+
+				if redis_etc1_username != "" {
+					if _, err := c.Do("AUTH", redis_etc1_username, redis_etc1_password); err != nil {
 						c.Close()
-						onceRedisClient.logger.Panicf("redis.AUTH err: %s", err.Error())
+						onceRedisClient.logger.Errorf("redis.AUTH err: %s", err.Error())
 						return nil, err
 					}
 				}
-				// 选择db
-				c.Do("SELECT", 0)
 
 				if onceRedisClient.conf.GetBool("debug") == true {
 					c = redis.NewLoggingConn(
@@ -152,7 +193,7 @@ func newPoolRedis(options ...Option) *RedisClient {
 			rc.Close()
 		}
 
-		go onceRedisClient.Stats()
+		redisPoolCollector.set(onceRedisClient.client)
 
 		onceRedisClient.logger.Infof("[redis] init success %s : %s", redis_etc1_host, redis_etc1_port)
 	})
@@ -172,18 +213,27 @@ func (RedisClientOptions) WithLogger(logger elog.Logger) Option {
 	}
 }
 
+// WithProxy adds the factories of the proxies, the proxies which implement ConnBinder are created once
+// and bound to each borrowed connection, the factories of the others must return a new instance
+// every time, a shared one is changed by NextProxy of every borrow.
 func (RedisClientOptions) WithProxy(proxyConn ...func() interface{}) Option {
 	return func(r *RedisClient) {
 		r.proxyConn = append(r.proxyConn, proxyConn...)
 	}
 }
 
-func (RedisClientOptions) WithStateTicker(stateTicker time.Duration) Option {
+// WithTLSConfig enables TLS, it takes precedence over the "redis_tls_*" config.
+func (RedisClientOptions) WithTLSConfig(tlsConfig *tls.Config) Option {
 	return func(r *RedisClient) {
-		r.stateTicker = stateTicker
+		r.tlsConfig = tlsConfig
 	}
 }
 
+// Deprecated: the stats of the pool are read at scrape time.
+func (RedisClientOptions) WithStateTicker(stateTicker time.Duration) Option {
+	return func(r *RedisClient) {}
+}
+
 //使用原生redisgo
 func (this *RedisClient) GetRedisConn() redis.Conn {
 
@@ -194,54 +244,98 @@ func (this *RedisClient) GetRedisConn() redis.Conn {
 
 //Recommended
 func (this *RedisClient) GetCtxRedisConn() ContextConn {
-
 	rc := this.client.Get()
 
+	return this.newCtxConn(rc)
+}
+
+// newCtxConn builds a proxy chain for one borrowed connection,
+// proxies implement ConnBinder are bound, others are created by their factory again.
+func (this *RedisClient) newCtxConn(rc redis.Conn) ContextConn {
 	facadeProxy := NewFacadeProxy()
 	facadeProxy.NextProxy(rc)
 
-	var firstProxy ContextConn
-	if this.proxyNum > 0 && rc.Err() == nil {
-		firstProxy = this.proxyInses[len(this.proxyInses)-1].(ContextConn)
-		firstProxy.(proxy.Proxy).NextProxy(facadeProxy)
-	} else {
-		firstProxy = facadeProxy
+	if this.proxyNum == 0 || rc.Err() != nil {
+		return facadeProxy
 	}
 
-	return firstProxy
-}
+	var conn ContextConn = facadeProxy
+	for k := this.proxyNum - 1; k >= 0; k-- {
+		if binder, ok := this.proxyInses[k].(ConnBinder); ok {
+			conn = binder.Bind(conn)
+		} else {
+			proxyIns := this.proxyConn[k]()
+			proxyIns.(proxy.Proxy).NextProxy(conn)
+			conn = proxyIns.(ContextConn)
+		}
+	}
 
-func (this *RedisClient) Close() {
-	this.client.Close()
-	this.closeChan <- true
+	return conn
 }
 
-func (this *RedisClient) Ping() error {
-	conn := this.client.Get()
-	return conn.Err()
-}
+// testOnBorrow PINGs the connections which were idle longer than idleTime.
+func testOnBorrow(idleTime time.Duration) func(c redis.Conn, t time.Time) error {
+	if idleTime <= 0 {
+		return nil
+	}
 
-func (this *RedisClient) Stats() {
-	ticker := time.NewTicker(this.stateTicker)
-	var stats redis.PoolStats
+	return func(c redis.Conn, t time.Time) error {
+		if time.Since(t) < idleTime {
+			return nil
+		}
 
-	for {
-		select {
-		case <-ticker.C:
+		_, err := c.Do("PING")
+		return err
+	}
+}
 
-			stats = this.client.Stats()
+// newTLSConfig reads "redis_tls_ca_file" to verify the server,
+// and "redis_tls_cert_file", "redis_tls_key_file" for the client certificate.
+func newTLSConfig(conf config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.GetString("redis_tls_server_name"),
+		InsecureSkipVerify: conf.GetBool("redis_tls_skip_verify"),
+	}
 
-			activeCountLab := prometheus.Labels{"stats": "active_count"}
-			redisStats.With(activeCountLab).Set(float64(stats.ActiveCount))
+	caFile := conf.GetString("redis_tls_ca_file")
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
 
-			idleCountLab := prometheus.Labels{"stats": "idle_count"}
-			redisStats.With(idleCountLab).Set(float64(stats.IdleCount))
+		certPool := x509.NewCertPool()
+		if certPool.AppendCertsFromPEM(ca) == false {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		tlsConfig.RootCAs = certPool
+	}
 
-		case <-this.closeChan:
-			this.logger.Infof("stop stats")
-			goto Stop
+	certFile := conf.GetString("redis_tls_cert_file")
+	keyFile := conf.GetString("redis_tls_key_file")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
 		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
-Stop:
-	ticker.Stop()
+
+	return tlsConfig, nil
+}
+
+// Close closes the pool and removes it from "redis_stats".
+func (this *RedisClient) Close() {
+	redisPoolCollector.remove(this.client)
+	this.client.Close()
+
+	//the recorded commands
+	if err := cassette.SaveAll(); err != nil {
+		this.logger.Errorf("[redis] save cassette error : %s", err.Error())
+	}
+}
+
+func (this *RedisClient) Ping() error {
+	conn := this.client.Get()
+	return conn.Err()
 }
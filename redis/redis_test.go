@@ -2,8 +2,13 @@ package redis
 
 import (
 	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
 	"github.com/jukylin/esim/config"
 	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/pkg/cassette"
+	"github.com/jukylin/esim/proxy"
 	"github.com/ory/dockertest/v3"
 	dc "github.com/ory/dockertest/v3/docker"
 	"github.com/prometheus/client_golang/prometheus"
@@ -249,34 +254,451 @@ func Benchmark_MulGo_Do(b *testing.B) {
 }
 
 func TestRedisClient_Stats(t *testing.T) {
+	poolRedisOnce = sync.Once{}
 
 	redisClientOptions := RedisClientOptions{}
 	memConfig := config.NewMemConfig()
 	memConfig.Set("debug", true)
+	memConfig.Set("redis_max_active", 20)
 
 	redisClent := NewRedisClient(
 		redisClientOptions.WithConf(memConfig),
-		redisClientOptions.WithStateTicker(10*time.Microsecond),
 	)
 
-	time.Sleep(100 * time.Millisecond)
-
 	ctx := context.Background()
 	conn := redisClent.GetCtxRedisConn()
 	conn.Do(ctx, "get", "name")
 	conn.Close()
 
-	conn.Do(ctx, "get", "name")
-	conn.Close()
+	assert.True(t, poolStatsValue(t, "active_count") >= 0)
+	assert.Equal(t, float64(20), poolStatsValue(t, "max_active"))
 
-	conn.Do(ctx, "get", "name")
+	redisClent.Close()
+	assert.Equal(t, float64(-1), poolStatsValue(t, "max_active"))
+}
+
+// poolStatsValue returns -1 if the pool is not collected.
+func poolStatsValue(t *testing.T, stats string) float64 {
+	registry := prometheus.NewPedanticRegistry()
+	assert.Nil(t, registry.Register(redisPoolCollector))
+
+	families, err := registry.Gather()
+	assert.Nil(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == stats {
+				return metric.GetGauge().GetValue()
+			}
+		}
+	}
+
+	return -1
+}
+
+func TestCassetteProxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	memConfig := config.NewMemConfig()
+	memConfig.Set("cassette_mode", cassette.ModeRecord)
+	memConfig.Set("cassette_file", filepath.Join(dir, "redis.json"))
+
+	ctx := context.Background()
+	cassetteProxyOptions := CassetteProxyOptions{}
+
+	recordProxy := NewCassetteProxy(
+		cassetteProxyOptions.WithConf(memConfig),
+		cassetteProxyOptions.WithLogger(log.NewLogger()))
+	recordProxy.NextProxy(NewStubsProxy(log.NewLogger(), "stubsProxy"))
+
+	name, err := String(recordProxy.Do(ctx, "get", "name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", name)
+
+	recordProxy.cassette.Eject()
+	memConfig.Set("cassette_mode", cassette.ModeReplay)
+
+	spyProxy := NewSpyProxy(log.NewLogger(), "spyProxy")
+	replayProxy := NewCassetteProxy(
+		cassetteProxyOptions.WithConf(memConfig),
+		cassetteProxyOptions.WithLogger(log.NewLogger()))
+	replayProxy.NextProxy(spyProxy)
+
+	name, err = String(replayProxy.Do(ctx, "get", "name"))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", name)
+	assert.False(t, spyProxy.DoWasCalled)
+
+	_, err = replayProxy.Do(ctx, "get", "version")
+	assert.True(t, errors.Is(err, cassette.ErrUnmatched))
+}
+
+// idConn replies its id to every command.
+type idConn struct {
+	id int
+}
+
+func (this *idConn) Close() error { return nil }
+
+func (this *idConn) Err() error { return nil }
+
+func (this *idConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return int64(this.id), nil
+}
+
+func (this *idConn) Send(commandName string, args ...interface{}) error { return nil }
+
+func (this *idConn) Flush() error { return nil }
+
+func (this *idConn) Receive() (interface{}, error) { return int64(this.id), nil }
+
+func newProxyRedisClient() *RedisClient {
+	redisClient := &RedisClient{
+		proxyConn: []func() interface{}{
+			func() interface{} {
+				monitorProxyOptions := MonitorProxyOptions{}
+				return NewMonitorProxy(
+					monitorProxyOptions.WithLogger(log.NewLogger()),
+				)
+			},
+			func() interface{} {
+				return NewCassetteProxy()
+			},
+		},
+	}
+	redisClient.proxyNum = len(redisClient.proxyConn)
+	redisClient.proxyInses = proxy.NewProxyFactory().
+		GetInstances("redis", redisClient.proxyConn...)
+
+	return redisClient
+}
+
+//run with -race
+func TestGetCtxRedisConn_Isolation(t *testing.T) {
+	redisClient := newProxyRedisClient()
+	ctx := context.Background()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			conn := redisClient.newCtxConn(&idConn{id: id})
+			assert.IsType(t, &monitorProxy{}, conn)
+			for j := 0; j < 100; j++ {
+				reply, err := Int(conn.Do(ctx, "get", "name"))
+				assert.Nil(t, err)
+				if reply != id {
+					t.Errorf("conn %d got reply of conn %d", id, reply)
+					return
+				}
+			}
+			conn.Close()
+		}(i)
+	}
+	wg.Wait()
+}
+
+//run with -race
+func TestGetCtxRedisConn_SharedSpy(t *testing.T) {
+	spyProxy := NewSpyProxy(log.NewLogger(), "spyProxy")
+	redisClient := &RedisClient{
+		proxyConn: []func() interface{}{
+			func() interface{} {
+				return spyProxy
+			},
+		},
+	}
+	redisClient.proxyNum = len(redisClient.proxyConn)
+	redisClient.proxyInses = proxy.NewProxyFactory().
+		GetInstances("redis", redisClient.proxyConn...)
+	ctx := context.Background()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			conn := redisClient.newCtxConn(&idConn{id: id})
+			reply, err := Int(conn.Do(ctx, "get", "name"))
+			assert.Nil(t, err)
+			assert.Equal(t, id, reply)
+			conn.Close()
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, spyProxy.DoWasCalled)
+
+	//stubs are bound too
+	stubsProxy := NewStubsProxy(log.NewLogger(), "stubsProxy")
+	facadeProxy := NewFacadeProxy()
+	facadeProxy.NextProxy(&idConn{id: 1})
+	conn := stubsProxy.Bind(facadeProxy)
+	reply, err := Int(conn.Receive(ctx))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, reply)
+	assert.Nil(t, stubsProxy.nextConn)
+}
+
+func BenchmarkGetCtxRedisConn(b *testing.B) {
+	redisClient := newProxyRedisClient()
+	rc := &idConn{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			redisClient.newCtxConn(rc)
+		}
+	})
+}
+
+// errConn fails every command.
+type errConn struct {
+	idConn
+}
+
+func (this *errConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("broken pipe")
+}
+
+func TestTestOnBorrow(t *testing.T) {
+	assert.Nil(t, testOnBorrow(0))
+
+	test := testOnBorrow(time.Minute)
+	assert.Nil(t, test(&errConn{}, time.Now()))
+	assert.Nil(t, test(&idConn{}, time.Now().Add(-2*time.Minute)))
+	assert.Error(t, test(&errConn{}, time.Now().Add(-2*time.Minute)))
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("redis_tls_skip_verify", true)
+	memConfig.Set("redis_tls_server_name", "redis.local")
+
+	tlsConfig, err := newTLSConfig(memConfig)
+	assert.Nil(t, err)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+	assert.Equal(t, "redis.local", tlsConfig.ServerName)
+
+	memConfig.Set("redis_tls_ca_file", "not_exists.pem")
+	_, err = newTLSConfig(memConfig)
+	assert.Error(t, err)
+}
+
+func TestDialErr(t *testing.T) {
+	poolRedisOnce = sync.Once{}
+
+	memConfig := config.NewMemConfig()
+	memConfig.Set("redis_host", "127.0.0.1")
+	memConfig.Set("redis_post", "1")
+
+	redisClientOptions := RedisClientOptions{}
+	redisClient := NewRedisClient(
+		redisClientOptions.WithConf(memConfig),
+	)
+
+	conn := redisClient.GetCtxRedisConn()
+	assert.Error(t, conn.Err())
+
+	_, err := conn.Do(context.Background(), "get", "name")
+	assert.Error(t, err)
 	conn.Close()
+	redisClient.Close()
+}
+
+func TestKeyTracker(t *testing.T) {
+	tracker := newKeyTracker(2)
+	tracker.incr("a", 1)
+	tracker.incr("a", 1)
+	tracker.incr("a", 1)
+	tracker.incr("b", 1)
+	//c takes the place of b
+	tracker.incr("c", 1)
+
+	top := tracker.top(2)
+	assert.Len(t, top, 2)
+	assert.Equal(t, keyCount{"a", 3}, top[0])
+	assert.Equal(t, keyCount{"c", 2}, top[1])
+	assert.Equal(t, []keyCount{{"a", 3}}, tracker.top(1))
+
+	tracker.reset()
+	assert.Empty(t, tracker.top(2))
+
+	sizes := newKeyTracker(2)
+	sizes.max("a", 10)
+	sizes.max("b", 100)
+	sizes.max("a", 5)
+	sizes.max("c", 1)
+	sizes.max("d", 50)
+	assert.Equal(t, []keyCount{{"b", 100}, {"d", 50}}, sizes.top(2))
+}
+
+func TestHotKeyProxy(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("redis_hotkey_sample_rate", 1)
+	memConfig.Set("redis_hotkey_top_k", 2)
+	memConfig.Set("redis_big_value_size", 4)
+
+	hotKeyProxyOptions := HotKeyProxyOptions{}
+	hotKeyProxy := NewHotKeyProxy(
+		hotKeyProxyOptions.WithConf(memConfig),
+		hotKeyProxyOptions.WithLogger(log.NewLogger()))
+	assert.Equal(t, 2*keyTrackerFactor, hotKeyProxy.stats.hotKeys.capacity)
+
+	facadeProxy := NewFacadeProxy()
+	facadeProxy.NextProxy(&idConn{id: 1})
+	conn := hotKeyProxy.Bind(facadeProxy)
 
-	lab := prometheus.Labels{"stats": "active_count"}
-	c, _ := redisStats.GetMetricWith(lab)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		conn.Do(ctx, "get", "hot")
+	}
+	conn.Do(ctx, "get", "cold")
+	conn.Do(ctx, "ping")
+	conn.Do(ctx, "set", "big", "123456789")
+
+	top := hotKeyProxy.stats.hotKeys.top(2)
+	assert.Equal(t, []keyCount{{"hot", 3}, {"big", 1}}, top)
+
+	//the counts start over after the report
+	hotKeyProxy.stats.lastReport = time.Time{}
+	hotKeyProxy.report()
+	assert.Empty(t, hotKeyProxy.stats.hotKeys.top(2))
+
+	//the keys are not exported
+	assert.Equal(t, "4bd8eddacb60b412", keyHash("hot"))
+	assert.Equal(t, "hot(4bd8eddacb60b412):3", formatKeyCounts([]keyCount{{"hot", 3}}))
+	c, _ := redisHotKey.GetMetricWith(prometheus.Labels{"key_hash": keyHash("hot")})
 	metric := &io_prometheus_client.Metric{}
 	c.Write(metric)
-	assert.True(t, metric.Gauge.GetValue() >= 0)
+	assert.Equal(t, float64(3), metric.Gauge.GetValue())
+
+	conn.Do(ctx, "get", "cold")
+	hotKeyProxy.stats.lastReport = time.Time{}
+	hotKeyProxy.report()
+	//hot left the top
+	metric = &io_prometheus_client.Metric{}
+	c, _ = redisHotKey.GetMetricWith(prometheus.Labels{"key_hash": keyHash("hot")})
+	c.Write(metric)
+	assert.Equal(t, float64(0), metric.Gauge.GetValue())
 
-	redisClent.Close()
+	c2, _ := redisBigValueTotal.GetMetricWith(prometheus.Labels{"cmd": "SET"})
+	metric = &io_prometheus_client.Metric{}
+	c2.Write(metric)
+	assert.Equal(t, float64(1), metric.Counter.GetValue())
+}
+
+// argsConn keeps the arguments of the last command and replies with reply.
+type argsConn struct {
+	args []interface{}
+
+	reply interface{}
+}
+
+func (this *argsConn) Close() error { return nil }
+
+func (this *argsConn) Err() error { return nil }
+
+func (this *argsConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	this.args = args
+	return this.reply, nil
+}
+
+func (this *argsConn) Send(commandName string, args ...interface{}) error {
+	this.args = args
+	return nil
+}
+
+func (this *argsConn) Flush() error { return nil }
+
+func (this *argsConn) Receive() (interface{}, error) { return this.reply, nil }
+
+func TestKeyIndexes(t *testing.T) {
+	testCases := []struct {
+		commandName string
+		args        []interface{}
+		indexes     []int
+	}{
+		{"get", []interface{}{"a"}, []int{0}},
+		{"MGET", []interface{}{"a", "b", "c"}, []int{0, 1, 2}},
+		{"MSET", []interface{}{"a", 1, "b", 2}, []int{0, 2}},
+		{"BLPOP", []interface{}{"a", "b", 0}, []int{0, 1}},
+		{"ZUNIONSTORE", []interface{}{"dest", 2, "a", "b", "WEIGHTS", 1, 2}, []int{0, 2, 3}},
+		{"EVAL", []interface{}{"return 1", "2", "a", "b", "arg"}, []int{2, 3}},
+		{"BITOP", []interface{}{"AND", "dest", "a"}, []int{1, 2}},
+		{"PING", nil, nil},
+	}
+
+	for _, test := range testCases {
+		indexes, known := keyIndexes(test.commandName, test.args)
+		assert.True(t, known)
+		assert.Equal(t, test.indexes, indexes, test.commandName)
+	}
+
+	_, known := keyIndexes("CLIENT", []interface{}{"LIST"})
+	assert.False(t, known)
+}
+
+func TestNamespaceProxy(t *testing.T) {
+	memConfig := config.NewMemConfig()
+	memConfig.Set("redis_key_prefix", "svc:")
+	memConfig.Set("redis_key_prefix_strict", true)
+
+	namespaceProxyOptions := NamespaceProxyOptions{}
+	namespaceProxy := NewNamespaceProxy(
+		namespaceProxyOptions.WithConf(memConfig),
+		namespaceProxyOptions.WithLogger(log.NewLogger()))
+
+	argsConn := &argsConn{}
+	facadeProxy := NewFacadeProxy()
+	facadeProxy.NextProxy(argsConn)
+	conn := namespaceProxy.Bind(facadeProxy)
+
+	ctx := context.Background()
+	args := []interface{}{"a", []byte("b")}
+	conn.Do(ctx, "MGET", args...)
+	assert.Equal(t, []interface{}{"svc:a", []byte("svc:b")}, argsConn.args)
+	//the caller's args are not modified
+	assert.Equal(t, "a", args[0])
+
+	conn.Do(ctx, "EVAL", "return 1", 1, "a", "arg")
+	assert.Equal(t, []interface{}{"return 1", 1, "svc:a", "arg"}, argsConn.args)
+
+	tenantCtx := NewTenantContext(ctx, "t1")
+	conn.Do(tenantCtx, "DEL", "a")
+	assert.Equal(t, []interface{}{"svc:t1:a"}, argsConn.args)
+
+	argsConn.reply = []interface{}{[]byte("0"), []interface{}{[]byte("svc:t1:a")}}
+	reply, err := conn.Do(tenantCtx, "SCAN", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{0, "MATCH", "svc:t1:*"}, argsConn.args)
+	assert.Equal(t, []interface{}{[]byte("0"), []interface{}{[]byte("a")}}, reply)
+
+	argsConn.reply = []interface{}{[]byte("svc:a"), []byte("svc:b")}
+	conn.Send(ctx, "KEYS", "*")
+	assert.Equal(t, []interface{}{"svc:*"}, argsConn.args)
+	reply, err = conn.Receive(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{[]byte("a"), []byte("b")}, reply)
+
+	_, err = conn.Do(ctx, "CLIENT", "LIST")
+	assert.Error(t, err)
+
+	//the keys of all namespaces
+	for _, commandName := range []string{"FLUSHDB", "flushall", "DBSIZE", "RANDOMKEY"} {
+		argsConn.args = nil
+		_, err = conn.Do(tenantCtx, commandName)
+		assert.Error(t, err)
+		assert.Nil(t, argsConn.args)
+	}
+
+	//passed through if not strict
+	memConfig.Set("redis_key_prefix_strict", false)
+	conn = NewNamespaceProxy(
+		namespaceProxyOptions.WithConf(memConfig),
+		namespaceProxyOptions.WithLogger(log.NewLogger())).Bind(facadeProxy)
+	_, err = conn.Do(ctx, "DBSIZE")
+	assert.Nil(t, err)
 }
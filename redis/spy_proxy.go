@@ -2,6 +2,8 @@ package redis
 
 import (
 	"context"
+	"sync"
+
 	"github.com/jukylin/esim/log"
 )
 
@@ -19,6 +21,11 @@ type spyProxy struct {
 	name string
 
 	log log.Logger
+
+	//the spy of the client whose flags are set, nil if not bound
+	parent *spyProxy
+
+	lock sync.Mutex
 }
 
 type spyProxyOption func(c *spyProxy)
@@ -47,6 +54,32 @@ func (this *spyProxy) ProxyName() string {
 	return this.name
 }
 
+//implement ConnBinder interface, the bound proxies set the flags of this
+func (this *spyProxy) Bind(conn ContextConn) ContextConn {
+	return &spyProxy{
+		nextConn: conn,
+		name:     this.name,
+		log:      this.log,
+		parent:   this.spy(),
+	}
+}
+
+// spy returns the spyProxy whose flags are set.
+func (this *spyProxy) spy() *spyProxy {
+	if this.parent != nil {
+		return this.parent
+	}
+
+	return this
+}
+
+func (this *spyProxy) called(flag func(spy *spyProxy)) {
+	spy := this.spy()
+	spy.lock.Lock()
+	flag(spy)
+	spy.lock.Unlock()
+}
+
 func (this *spyProxy) Close() error {
 	err := this.nextConn.Close()
 
@@ -59,28 +92,28 @@ func (this *spyProxy) Err() (err error) {
 }
 
 func (this *spyProxy) Do(ctx context.Context, commandName string, args ...interface{}) (reply interface{}, err error) {
-	this.DoWasCalled = true
+	this.called(func(spy *spyProxy) { spy.DoWasCalled = true })
 	reply, err = this.nextConn.Do(ctx, commandName, args...)
 
 	return
 }
 
 func (this *spyProxy) Send(ctx context.Context, commandName string, args ...interface{}) (err error) {
-	this.SendWasCalled = true
+	this.called(func(spy *spyProxy) { spy.SendWasCalled = true })
 	err = this.nextConn.Send(ctx, commandName, args...)
 
 	return
 }
 
 func (this *spyProxy) Flush(ctx context.Context) (err error) {
-	this.FlushWasCalled = true
+	this.called(func(spy *spyProxy) { spy.FlushWasCalled = true })
 	err = this.nextConn.Flush(ctx)
 
 	return
 }
 
 func (this *spyProxy) Receive(ctx context.Context) (reply interface{}, err error) {
-	this.ReceiveWasCalled = true
+	this.called(func(spy *spyProxy) { spy.ReceiveWasCalled = true })
 	reply, err = this.nextConn.Receive(ctx)
 
 	return
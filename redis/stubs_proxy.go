@@ -39,6 +39,15 @@ func (this *stubsProxy) ProxyName() string {
 	return this.name
 }
 
+//implement ConnBinder interface
+func (this *stubsProxy) Bind(conn ContextConn) ContextConn {
+	return &stubsProxy{
+		nextConn: conn,
+		name:     this.name,
+		log:      this.log,
+	}
+}
+
 func (this *stubsProxy) Close() error {
 	err := this.nextConn.Close()
 
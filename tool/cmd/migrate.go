@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/mysql"
+	"github.com/jukylin/esim/tool/migrate"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/spf13/cobra"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "数据库版本迁移",
+	Long: `1：需要在项目根目录下执行
+迁移文件在 migrations/ 下，如 20200102150405_create_user.up.sql 和 20200102150405_create_user.down.sql，
+数据库使用 conf/conf.yaml 里 dbs 的配置，已执行的版本记录在 schema_migrations 表
+2：支持 mysql，postgres 和 sqlite3，默认使用 db 配置的 driver
+`,
+}
+
+var migrateCreateCmd = &cobra.Command{
+	Use:   "create name",
+	Short: "创建迁移文件",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.NewLogger()
+		migrator := migrate.NewMigrator(
+			migrate.MigratorOptions{}.WithDir(v.GetString("dir")),
+			migrate.MigratorOptions{}.WithLogger(logger),
+		)
+
+		upFile, downFile, err := migrator.Create(args[0])
+		if err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		logger.Infof("%s created", upFile)
+		logger.Infof("%s created", downFile)
+	},
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up [n]",
+	Short: "执行未执行的迁移，默认全部",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigrator(func(ctx context.Context, migrator *migrate.Migrator) error {
+			return migrator.Up(ctx, stepsArg(args))
+		})
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [n]",
+	Short: "回滚最近执行的迁移，默认 1 个",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigrator(func(ctx context.Context, migrator *migrate.Migrator) error {
+			return migrator.Down(ctx, stepsArg(args))
+		})
+	},
+}
+
+var migrateGotoCmd = &cobra.Command{
+	Use:   "goto version",
+	Short: "迁移到指定版本，0 回滚全部",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		version, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			log.NewLogger().Fatalf("version %s : %s", args[0], err.Error())
+		}
+
+		runMigrator(func(ctx context.Context, migrator *migrate.Migrator) error {
+			return migrator.Goto(ctx, version)
+		})
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "查看迁移状态",
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigrator(func(ctx context.Context, migrator *migrate.Migrator) error {
+			migrations, err := migrator.Status(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, migration := range migrations {
+				status := "pending"
+				if migration.AppliedAt != nil {
+					status = "applied at " + migration.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				fmt.Printf("%d_%s\t%s\n", migration.Version, migration.Name, status)
+			}
+
+			return nil
+		})
+	},
+}
+
+// runMigrator opens the db of the --db flag in --conf and runs fn.
+func runMigrator(fn func(ctx context.Context, migrator *migrate.Migrator) error) {
+	logger := log.NewLogger()
+
+	conf := config.NewViperConfig(
+		config.ViperConfOptions{}.WithConfigType("yaml"),
+		config.ViperConfOptions{}.WithConfFile([]string{v.GetString("conf")}),
+	)
+
+	dbConfigs, err := mysql.LoadDbConfigs(conf)
+	if err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+
+	dbName := v.GetString("db")
+	var dbConfig *mysql.DbConfig
+	for k := range dbConfigs {
+		if dbName == "" || strings.EqualFold(dbConfigs[k].Db, dbName) {
+			dbConfig = &dbConfigs[k]
+			break
+		}
+	}
+
+	if dbConfig == nil {
+		logger.Fatalf("db %s not found in %s", dbName, v.GetString("conf"))
+	}
+
+	dsn, err := dbConfig.DSN()
+	if err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+
+	driver := v.GetString("driver")
+	if driver == "" {
+		driver = dbConfig.Driver
+	}
+	if driver == "" {
+		driver = mysql.DriverMysql
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		logger.Fatalf("%s", err.Error())
+	}
+	defer db.Close()
+
+	migrator := migrate.NewMigrator(
+		migrate.MigratorOptions{}.WithDB(db),
+		migrate.MigratorOptions{}.WithDir(v.GetString("dir")),
+		migrate.MigratorOptions{}.WithLogger(logger),
+		migrate.MigratorOptions{}.WithDriver(driver),
+	)
+
+	err = fn(context.Background(), migrator)
+	if err != nil {
+		db.Close()
+		logger.Fatalf("[migrate] %s : %s", dbConfig.Db, err.Error())
+	}
+}
+
+func stepsArg(args []string) int {
+	if len(args) == 0 {
+		return 0
+	}
+
+	steps, err := strconv.Atoi(args[0])
+	if err != nil {
+		log.NewLogger().Fatalf("steps %s : %s", args[0], err.Error())
+	}
+
+	return steps
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.AddCommand(migrateCreateCmd, migrateUpCmd, migrateDownCmd, migrateGotoCmd, migrateStatusCmd)
+
+	migrateCmd.PersistentFlags().StringP("conf", "c", "conf/conf.yaml", "config file with dbs")
+
+	migrateCmd.PersistentFlags().StringP("db", "d", "", "db name in dbs, default the first one")
+
+	migrateCmd.PersistentFlags().StringP("dir", "", "migrations", "migrations dir")
+
+	migrateCmd.PersistentFlags().StringP("driver", "", "", "database driver, default the driver of the db")
+
+	v.BindPFlags(migrateCmd.PersistentFlags())
+}
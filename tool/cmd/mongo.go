@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jukylin/esim/config"
+	"github.com/jukylin/esim/log"
+	"github.com/jukylin/esim/mongodb"
+	"github.com/spf13/cobra"
+)
+
+var mongoCmd = &cobra.Command{
+	Use:   "mongo",
+	Short: "mongodb 工具",
+}
+
+var mongoIndexesCmd = &cobra.Command{
+	Use:   "indexes",
+	Short: "mongodb 索引管理",
+	Long: `1：需要在项目根目录下执行
+索引声明在 conf/conf.yaml 的 mgo_indexes，如
+mgo_indexes:
+- {client: 'test', coll: 'user', keys: ['phone', '-created_at'], unique: true}
+2：只处理声明了索引的集合，_id_ 除外
+`,
+}
+
+var mongoIndexesSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "对比声明的索引和已有的索引，创建缺少的索引",
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := log.NewLogger()
+
+		confFile, _ := cmd.Flags().GetString("conf")
+		client, _ := cmd.Flags().GetString("client")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		drop, _ := cmd.Flags().GetBool("drop")
+
+		conf := config.NewViperConfig(
+			config.ViperConfOptions{}.WithConfigType("yaml"),
+			config.ViperConfOptions{}.WithConfFile([]string{confFile}),
+		)
+		//synced below, not by the client
+		conf.Set("mgo_sync_indexes", false)
+
+		mgoConfigs, err := mongodb.LoadMgoConfigs(conf)
+		if err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		conf.Set("mgos", []interface{}{})
+
+		indexSpecs, err := mongodb.LoadIndexSpecs(conf)
+		if err != nil {
+			logger.Fatalf("%s", err.Error())
+		}
+		conf.Set("mgo_indexes", []interface{}{})
+
+		//only connect to the clients with declared indexes
+		var clientConfigs []mongodb.MgoConfig
+		var clientSpecs []mongodb.IndexSpec
+		for _, mgoConfig := range mgoConfigs {
+			if client != "" && !strings.EqualFold(mgoConfig.Db, client) {
+				continue
+			}
+
+			declared := false
+			for _, spec := range indexSpecs {
+				if strings.EqualFold(spec.Client, mgoConfig.Db) {
+					clientSpecs = append(clientSpecs, spec)
+					declared = true
+				}
+			}
+
+			if declared {
+				clientConfigs = append(clientConfigs, mgoConfig)
+			}
+		}
+
+		if len(clientConfigs) == 0 {
+			logger.Fatalf("no mgo_indexes of %s in %s", client, confFile)
+		}
+
+		mgoClientOptions := mongodb.MgoClientOptions{}
+		mgoClient := mongodb.NewMgoClient(
+			mgoClientOptions.WithConf(conf),
+			mgoClientOptions.WithLogger(logger),
+			mgoClientOptions.WithDbConfig(clientConfigs),
+			mgoClientOptions.WithIndexes(clientSpecs...),
+		)
+		defer mgoClient.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+		defer cancel()
+
+		diffs, err := mgoClient.SyncIndexes(ctx, dryRun, drop)
+		for _, diff := range diffs {
+			for _, spec := range diff.Missing {
+				fmt.Printf("+ %s\n", spec.String())
+			}
+
+			for _, change := range diff.Changed {
+				fmt.Printf("~ %s\n", change.String())
+			}
+
+			for _, name := range diff.Unexpected {
+				fmt.Printf("- %s.%s %s\n", diff.Database, diff.Coll, name)
+			}
+		}
+
+		if err != nil {
+			mgoClient.Close()
+			logger.Fatalf("[mongo] sync indexes : %s", err.Error())
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mongoCmd)
+
+	mongoCmd.AddCommand(mongoIndexesCmd)
+
+	mongoIndexesCmd.AddCommand(mongoIndexesSyncCmd)
+
+	mongoIndexesCmd.PersistentFlags().StringP("conf", "c", "conf/conf.yaml", "config file with mgos and mgo_indexes")
+
+	mongoIndexesCmd.PersistentFlags().StringP("client", "", "", "client name in mgos, default all")
+
+	mongoIndexesSyncCmd.Flags().BoolP("dry-run", "", false, "only print the difference")
+
+	mongoIndexesSyncCmd.Flags().BoolP("drop", "", false, "also recreate the changed and drop the unexpected indexes")
+}
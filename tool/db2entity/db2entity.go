@@ -349,9 +349,9 @@ func (this *` + structName + `Dao) GetDb(ctx context.Context) *gorm.DB  {
 	return this.mysql.GetCtxDb(ctx, "` + pkgName + `").Table("` + tableName + `")
 }
 
-//从库
+//从库，读请求由 MysqlClient 路由到 replicas
 func (this *` + structName + `Dao) GetSlaveDb(ctx context.Context) *gorm.DB  {
-	return this.mysql.GetCtxDb(ctx, "` + pkgName + `_slave").Table("` + tableName + `")
+	return this.mysql.GetCtxDb(ctx, "` + pkgName + `").Table("` + tableName + `")
 }
 
 
@@ -0,0 +1,582 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jukylin/esim/log"
+)
+
+const (
+	versionTable = "schema_migrations"
+
+	lockTable = "schema_migrations_lock"
+
+	versionFormat = "20060102150405"
+)
+
+var ErrLocked = errors.New("migrate: locked by another instance")
+
+var fileNameReg = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// the delimiter of a dollar-quoted string of postgres, like $$ or $body$
+var dollarTagReg = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// Migration is a pair of files in the migrations dir,
+// 20200102150405_create_user.up.sql and 20200102150405_create_user.down.sql.
+type Migration struct {
+	Version int64
+
+	Name string
+
+	Up string
+
+	Down string
+
+	//nil if not applied
+	AppliedAt *time.Time
+}
+
+// Migrator applies and reverts migrations, the applied versions are kept in "schema_migrations".
+// Only one Migrator runs at a time, it holds the single row of "schema_migrations_lock",
+// if a migrator crashed, delete the row by hand.
+type Migrator struct {
+	db *sql.DB
+
+	dir string
+
+	logger log.Logger
+
+	//waiting for the lock
+	lockTimeout time.Duration
+
+	//placeholders of postgres are $1, $2 ...
+	driver string
+}
+
+type Option func(c *Migrator)
+
+type MigratorOptions struct{}
+
+func NewMigrator(options ...Option) *Migrator {
+	migrator := &Migrator{}
+
+	for _, option := range options {
+		option(migrator)
+	}
+
+	if migrator.dir == "" {
+		migrator.dir = "migrations"
+	}
+
+	if migrator.logger == nil {
+		migrator.logger = log.NewLogger()
+	}
+
+	if migrator.lockTimeout == 0 {
+		migrator.lockTimeout = 30 * time.Second
+	}
+
+	return migrator
+}
+
+func (MigratorOptions) WithDB(db *sql.DB) Option {
+	return func(m *Migrator) {
+		m.db = db
+	}
+}
+
+func (MigratorOptions) WithDir(dir string) Option {
+	return func(m *Migrator) {
+		m.dir = dir
+	}
+}
+
+func (MigratorOptions) WithLogger(logger log.Logger) Option {
+	return func(m *Migrator) {
+		m.logger = logger
+	}
+}
+
+func (MigratorOptions) WithLockTimeout(lockTimeout time.Duration) Option {
+	return func(m *Migrator) {
+		m.lockTimeout = lockTimeout
+	}
+}
+
+// WithDriver is the driver of the db, default mysql.
+func (MigratorOptions) WithDriver(driver string) Option {
+	return func(m *Migrator) {
+		m.driver = driver
+	}
+}
+
+func isMysql(driver string) bool {
+	return driver == "" || driver == "mysql"
+}
+
+func isPostgres(driver string) bool {
+	return driver == "postgres" || driver == "pgx"
+}
+
+// bind replaces ? with $n for postgres, the queries of Migrator have no ? in strings.
+func (this *Migrator) bind(query string) string {
+	if !isPostgres(this.driver) {
+		return query
+	}
+
+	var builder strings.Builder
+	var n int
+	for _, char := range query {
+		if char == '?' {
+			n++
+			builder.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		builder.WriteRune(char)
+	}
+
+	return builder.String()
+}
+
+// Create writes an empty up and down file of name, the version is the current time.
+func (this *Migrator) Create(name string) (upFile, downFile string, err error) {
+	if !regexp.MustCompile(`^\w+$`).MatchString(name) {
+		return "", "", fmt.Errorf("migrate: name %s must be letters, digits or _", name)
+	}
+
+	err = os.MkdirAll(this.dir, os.ModePerm)
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := filepath.Join(this.dir, time.Now().Format(versionFormat)+"_"+name)
+	upFile = prefix + ".up.sql"
+	downFile = prefix + ".down.sql"
+
+	err = ioutil.WriteFile(upFile, []byte("-- "+name+" up\n"), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = ioutil.WriteFile(downFile, []byte("-- "+name+" down\n"), 0644)
+	if err != nil {
+		return "", "", err
+	}
+
+	return upFile, downFile, nil
+}
+
+// Status returns all migrations in order, with the applied time of the applied ones.
+func (this *Migrator) Status(ctx context.Context) ([]*Migration, error) {
+	err := this.init(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return this.migrations(ctx)
+}
+
+// Up applies steps pending migrations, all of them if steps <= 0.
+func (this *Migrator) Up(ctx context.Context, steps int) error {
+	return this.locked(ctx, func(migrations []*Migration) error {
+		applied := 0
+		for _, migration := range migrations {
+			if steps > 0 && applied >= steps {
+				break
+			}
+
+			if migration.AppliedAt != nil {
+				continue
+			}
+
+			err := this.apply(ctx, migration, true)
+			if err != nil {
+				return err
+			}
+			applied++
+		}
+
+		return nil
+	})
+}
+
+// Down reverts steps applied migrations from the latest, 1 if steps <= 0,
+// it stops at a migration without down sql.
+func (this *Migrator) Down(ctx context.Context, steps int) error {
+	if steps <= 0 {
+		steps = 1
+	}
+
+	return this.locked(ctx, func(migrations []*Migration) error {
+		reverted := 0
+		for i := len(migrations) - 1; i >= 0 && reverted < steps; i-- {
+			if migrations[i].AppliedAt == nil {
+				continue
+			}
+
+			err := this.apply(ctx, migrations[i], false)
+			if err != nil {
+				return err
+			}
+			reverted++
+		}
+
+		return nil
+	})
+}
+
+// Goto applies the pending migrations up to version and reverts the applied ones after it,
+// version 0 reverts all, it stops at a migration without down sql like Down.
+func (this *Migrator) Goto(ctx context.Context, version int64) error {
+	return this.locked(ctx, func(migrations []*Migration) error {
+		if version != 0 {
+			found := false
+			for _, migration := range migrations {
+				if migration.Version == version {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				return fmt.Errorf("migrate: version %d not found in %s", version, this.dir)
+			}
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if migrations[i].Version > version && migrations[i].AppliedAt != nil {
+				if err := this.apply(ctx, migrations[i], false); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, migration := range migrations {
+			if migration.Version <= version && migration.AppliedAt == nil {
+				if err := this.apply(ctx, migration, true); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// locked runs fn with the lock held.
+func (this *Migrator) locked(ctx context.Context, fn func([]*Migration) error) (err error) {
+	err = this.init(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = this.lock(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		unlockErr := this.unlock()
+		if err == nil {
+			err = unlockErr
+		}
+	}()
+
+	//read after locking, another instance may have migrated
+	migrations, err := this.migrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	return fn(migrations)
+}
+
+func (this *Migrator) init(ctx context.Context) error {
+	if this.db == nil {
+		return errors.New("migrate: db is nil")
+	}
+
+	_, err := this.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+versionTable+
+		" (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at BIGINT NOT NULL)")
+	if err != nil {
+		return err
+	}
+
+	_, err = this.db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+lockTable+
+		" (id INT NOT NULL PRIMARY KEY, holder VARCHAR(255) NOT NULL, locked_at BIGINT NOT NULL)")
+
+	return err
+}
+
+// lock inserts the only row of the lock table, it waits for lockTimeout if the row exists.
+func (this *Migrator) lock(ctx context.Context) error {
+	hostname, _ := os.Hostname()
+	holder := hostname + ":" + strconv.Itoa(os.Getpid())
+
+	deadline := time.Now().Add(this.lockTimeout)
+	for {
+		_, err := this.db.ExecContext(ctx, this.bind("INSERT INTO "+lockTable+
+			" (id, holder, locked_at) VALUES (1, ?, ?)"), holder, time.Now().Unix())
+		if err == nil {
+			return nil
+		}
+
+		var lockHolder string
+		var lockedAt int64
+		scanErr := this.db.QueryRowContext(ctx, "SELECT holder, locked_at FROM "+lockTable+
+			" WHERE id = 1").Scan(&lockHolder, &lockedAt)
+		if scanErr == sql.ErrNoRows {
+			//released just now
+			continue
+		}
+		if scanErr != nil {
+			return err
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w : %s since %s, delete the row of %s if it crashed", ErrLocked,
+				lockHolder, time.Unix(lockedAt, 0).Format(time.RFC3339), lockTable)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (this *Migrator) unlock() error {
+	_, err := this.db.Exec("DELETE FROM " + lockTable + " WHERE id = 1")
+	return err
+}
+
+// migrations reads the migration files and the applied versions.
+func (this *Migrator) migrations(ctx context.Context) ([]*Migration, error) {
+	migrations, err := readMigrations(this.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := this.db.QueryContext(ctx, "SELECT version, name, applied_at FROM "+versionTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byVersion := make(map[int64]*Migration, len(migrations))
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+
+	for rows.Next() {
+		var version, appliedAt int64
+		var name string
+		if err = rows.Scan(&version, &name, &appliedAt); err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			//applied, but the files are gone, it can't be reverted
+			this.logger.Warnf("[migrate] %d_%s is applied but not found in %s", version, name, this.dir)
+			migration = &Migration{Version: version, Name: name}
+			migrations = append(migrations, migration)
+		}
+		t := time.Unix(appliedAt, 0)
+		migration.AppliedAt = &t
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// apply runs the up or down sql of migration and records it.
+func (this *Migrator) apply(ctx context.Context, migration *Migration, up bool) error {
+	query, direction := migration.Up, "up"
+	if !up {
+		query, direction = migration.Down, "down"
+	}
+
+	statements := splitStatements(query, this.driver)
+	if !up && len(statements) == 0 {
+		return fmt.Errorf("migrate: %d_%s has no down sql, it can't be reverted",
+			migration.Version, migration.Name)
+	}
+
+	startTime := time.Now()
+	for _, statement := range statements {
+		_, err := this.db.ExecContext(ctx, statement)
+		if err != nil {
+			return fmt.Errorf("migrate: %d_%s %s : %s", migration.Version, migration.Name, direction, err.Error())
+		}
+	}
+
+	var err error
+	if up {
+		_, err = this.db.ExecContext(ctx, this.bind("INSERT INTO "+versionTable+
+			" (version, name, applied_at) VALUES (?, ?, ?)"), migration.Version, migration.Name, time.Now().Unix())
+	} else {
+		_, err = this.db.ExecContext(ctx, this.bind("DELETE FROM "+versionTable+
+			" WHERE version = ?"), migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if up {
+		migration.AppliedAt = &now
+	} else {
+		migration.AppliedAt = nil
+	}
+
+	this.logger.Infof("[migrate] %d_%s %s %s", migration.Version, migration.Name,
+		direction, now.Sub(startTime).String())
+
+	return nil
+}
+
+// readMigrations reads the migration files of dir in order of version.
+func readMigrations(dir string) ([]*Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, file := range files {
+		matches := fileNameReg.FindStringSubmatch(file.Name())
+		if file.IsDir() || matches == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = migration
+		} else if migration.Name != matches[2] {
+			return nil, fmt.Errorf("migrate: version %d has two names %s and %s",
+				version, migration.Name, matches[2])
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if matches[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// splitStatements splits query by the ; out of quotes and comments of driver,
+// empty statements and comments are dropped.
+// # comments and \ escapes are of mysql, dollar-quoted strings and escapes in E'...' of postgres.
+func splitStatements(query string, driver string) []string {
+	mysql, postgres := isMysql(driver), isPostgres(driver)
+	var statements []string
+	var builder strings.Builder
+
+	flush := func() {
+		statement := strings.TrimSpace(builder.String())
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+		builder.Reset()
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			escape := c != '`' && (mysql ||
+				postgres && c == '\'' && i > 0 && (query[i-1] == 'E' || query[i-1] == 'e'))
+			end := i + 1
+			for end < len(query) && query[end] != c {
+				if query[end] == '\\' && escape {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				end = len(query) - 1
+			}
+			builder.WriteString(query[i : end+1])
+			i = end
+		case postgres && c == '$' && dollarTagReg.MatchString(query[i:]):
+			tag := dollarTagReg.FindString(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				end = len(query)
+			} else {
+				end = i + len(tag) + end + len(tag)
+			}
+			builder.WriteString(query[i:end])
+			i = end - 1
+		case c == '-' && i+1 < len(query) && query[i+1] == '-', mysql && c == '#':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			builder.WriteByte('\n')
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			builder.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	flush()
+
+	return statements
+}
@@ -0,0 +1,259 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jukylin/esim/log"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMigrator(t *testing.T, dir string) (*Migrator, *sql.DB) {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "test.db"))
+	assert.Nil(t, err)
+
+	migrator := NewMigrator(
+		MigratorOptions{}.WithDB(db),
+		MigratorOptions{}.WithDir(filepath.Join(dir, "migrations")),
+		MigratorOptions{}.WithLogger(log.NewNullLogger()),
+		MigratorOptions{}.WithLockTimeout(100*time.Millisecond),
+	)
+
+	return migrator, db
+}
+
+func writeMigration(t *testing.T, dir, name, up, down string) {
+	assert.Nil(t, os.MkdirAll(dir, os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".up.sql"), []byte(up), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".down.sql"), []byte(down), 0644))
+}
+
+func tableExists(db *sql.DB, table string) bool {
+	var name string
+	err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+	return err == nil
+}
+
+func appliedVersions(migrations []*Migration) []int64 {
+	var versions []int64
+	for _, migration := range migrations {
+		if migration.AppliedAt != nil {
+			versions = append(versions, migration.Version)
+		}
+	}
+
+	return versions
+}
+
+func TestMigrator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	migrator, db := newTestMigrator(t, dir)
+	defer db.Close()
+
+	migrationDir := filepath.Join(dir, "migrations")
+	writeMigration(t, migrationDir, "1_create_user",
+		"-- users; of the service\nCREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT);\n"+
+			"INSERT INTO user (name) VALUES ('a;b');",
+		"DROP TABLE user;")
+	writeMigration(t, migrationDir, "2_create_order",
+		"CREATE TABLE `order` (id INTEGER PRIMARY KEY);",
+		"DROP TABLE `order`;")
+	writeMigration(t, migrationDir, "3_create_item",
+		"CREATE TABLE item (id INTEGER PRIMARY KEY);",
+		"DROP TABLE item;")
+
+	assert.Nil(t, migrator.Up(ctx, 1))
+	assert.True(t, tableExists(db, "user"))
+	assert.False(t, tableExists(db, "order"))
+
+	var name string
+	assert.Nil(t, db.QueryRow("SELECT name FROM user").Scan(&name))
+	assert.Equal(t, "a;b", name)
+
+	assert.Nil(t, migrator.Up(ctx, 0))
+	migrations, err := migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, appliedVersions(migrations))
+
+	assert.Nil(t, migrator.Down(ctx, 0))
+	assert.False(t, tableExists(db, "item"))
+	assert.True(t, tableExists(db, "order"))
+
+	assert.Nil(t, migrator.Goto(ctx, 1))
+	migrations, err = migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, appliedVersions(migrations))
+	assert.False(t, tableExists(db, "order"))
+
+	assert.Nil(t, migrator.Goto(ctx, 3))
+	assert.True(t, tableExists(db, "item"))
+
+	assert.NotNil(t, migrator.Goto(ctx, 4))
+
+	assert.Nil(t, migrator.Goto(ctx, 0))
+	migrations, err = migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Len(t, migrations, 3)
+	assert.Empty(t, appliedVersions(migrations))
+	assert.False(t, tableExists(db, "user"))
+}
+
+func TestMigrator_FailedMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	migrator, db := newTestMigrator(t, dir)
+	defer db.Close()
+
+	migrationDir := filepath.Join(dir, "migrations")
+	writeMigration(t, migrationDir, "1_create_user",
+		"CREATE TABLE user (id INTEGER PRIMARY KEY);", "DROP TABLE user;")
+	writeMigration(t, migrationDir, "2_broken",
+		"CREATE TABLE broken (;", "")
+
+	err = migrator.Up(ctx, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "2_broken")
+
+	migrations, err := migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, appliedVersions(migrations))
+
+	//the lock is released after the failure
+	assert.Nil(t, migrator.Down(ctx, 1))
+}
+
+func TestMigrator_NoDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	migrator, db := newTestMigrator(t, dir)
+	defer db.Close()
+
+	migrationDir := filepath.Join(dir, "migrations")
+	writeMigration(t, migrationDir, "1_create_a", "CREATE TABLE a (id INTEGER PRIMARY KEY);", "-- a down\n")
+	writeMigration(t, migrationDir, "2_create_b", "CREATE TABLE b (id INTEGER PRIMARY KEY);", "DROP TABLE b;")
+	assert.Nil(t, migrator.Up(ctx, 0))
+
+	err = migrator.Goto(ctx, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "1_create_a has no down sql")
+	assert.False(t, tableExists(db, "b"))
+	assert.True(t, tableExists(db, "a"))
+	migrations, err := migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, appliedVersions(migrations))
+
+	//the files are gone
+	assert.Nil(t, os.RemoveAll(migrationDir))
+	assert.NotNil(t, migrator.Down(ctx, 1))
+	migrations, err = migrator.Status(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, appliedVersions(migrations))
+}
+
+func TestMigrator_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	migrator, db := newTestMigrator(t, dir)
+	defer db.Close()
+
+	writeMigration(t, filepath.Join(dir, "migrations"), "1_create_user",
+		"CREATE TABLE user (id INTEGER PRIMARY KEY);", "DROP TABLE user;")
+
+	assert.Nil(t, migrator.init(ctx))
+	assert.Nil(t, migrator.lock(ctx))
+
+	err = migrator.Up(ctx, 0)
+	assert.True(t, errors.Is(err, ErrLocked))
+	assert.False(t, tableExists(db, "user"))
+
+	assert.Nil(t, migrator.unlock())
+	assert.Nil(t, migrator.Up(ctx, 0))
+	assert.True(t, tableExists(db, "user"))
+}
+
+func TestMigrator_Create(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	migrator := NewMigrator(MigratorOptions{}.WithDir(filepath.Join(dir, "migrations")))
+
+	upFile, downFile, err := migrator.Create("create_user")
+	assert.Nil(t, err)
+	assert.FileExists(t, upFile)
+	assert.FileExists(t, downFile)
+
+	migrations, err := readMigrations(filepath.Join(dir, "migrations"))
+	assert.Nil(t, err)
+	assert.Len(t, migrations, 1)
+	assert.Equal(t, "create_user", migrations[0].Name)
+
+	_, _, err = migrator.Create("create user")
+	assert.NotNil(t, err)
+}
+
+func TestSplitStatements(t *testing.T) {
+	testCases := []struct {
+		query      string
+		statements []string
+	}{
+		{"", nil},
+		{"-- only comment", nil},
+		{"SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"INSERT INTO a VALUES ('x;y', \"it\\\"s;\")", []string{"INSERT INTO a VALUES ('x;y', \"it\\\"s;\")"}},
+		{"/* a; b */ SELECT 1;# c;\nSELECT `a;b`", []string{"SELECT 1", "SELECT `a;b`"}},
+	}
+
+	for _, test := range testCases {
+		assert.Equal(t, test.statements, splitStatements(test.query, ""), test.query)
+	}
+
+	pgCases := []struct {
+		query      string
+		statements []string
+	}{
+		{"SELECT data #> '{a,b}' FROM t; SELECT 2", []string{"SELECT data #> '{a,b}' FROM t", "SELECT 2"}},
+		{"CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN NEW.a := ';'; RETURN NEW; END; $$ LANGUAGE plpgsql;" +
+			"SELECT 1",
+			[]string{"CREATE FUNCTION f() RETURNS trigger AS $$ BEGIN NEW.a := ';'; RETURN NEW; END; $$ " +
+				"LANGUAGE plpgsql", "SELECT 1"}},
+		{"DO $body$ BEGIN PERFORM 1; END $body$; SELECT $1", []string{"DO $body$ BEGIN PERFORM 1; END $body$",
+			"SELECT $1"}},
+		{"SELECT 'C:\\'; SELECT E'it\\'s;'", []string{"SELECT 'C:\\'", "SELECT E'it\\'s;'"}},
+	}
+
+	for _, test := range pgCases {
+		assert.Equal(t, test.statements, splitStatements(test.query, "postgres"), test.query)
+	}
+}
+
+func TestMigrator_Bind(t *testing.T) {
+	query := "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"
+
+	migrator := NewMigrator()
+	assert.Equal(t, query, migrator.bind(query))
+
+	migrator = NewMigrator(MigratorOptions{}.WithDriver("postgres"))
+	assert.Equal(t, "INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)",
+		migrator.bind(query))
+}
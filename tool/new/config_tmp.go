@@ -31,13 +31,32 @@ jaeger_local_agent_host_port: '0.0.0.0:6831'
 #mysql
 dbs:
 #- {db: 'test', dsn: 'root:123456@tcp(0.0.0.0:3306)/config?charset=utf8&parseTime=True&loc=Local',
-#  maxidle: 10, maxopen: 100, maxlifetime : 10}
-#- {db: 'test_slave', dsn: 'root:123456@tcp(0.0.0.0:3306)/config?charset=utf8&parseTime=True&loc=Local',
+#  maxidle: 10, maxopen: 100, maxlifetime : '1h',
+#  balance: 'round_robin', maxreplicalag: '10s',
+#  replicas: [{dsn: 'root:123456@tcp(0.0.0.0:3307)/config?charset=utf8&parseTime=True&loc=Local'}]}
+#- {db: 'analytics', host: '0.0.0.0', port: 3306, user: 'root', password: '123456', database: 'analytics',
+#  connecttimeout: '1s', readtimeout: '30s', maxlifetime: '1h', proxies: ['monitor_proxy', 'guard_proxy'],
+#  replicas: [{host: '0.0.0.0', port: 3307, proxies: ['monitor_proxy']}]}
+#driver: mysql, postgres, pgx or sqlite3, import the driver except mysql in main
+#- {db: 'report', driver: 'postgres', host: '0.0.0.0', port: 5432, user: 'postgres', password: '123456',
+#  database: 'report', tls: 'false', proxies: ['monitor_proxy']}
+#- {db: 'local', driver: 'sqlite3', database: 'local.db'}
+
+#sharding, the tables of order_0 are order_0 and order_1, order_1 has order_2 and order_3
+#strategy: modulo, range with ranges: [1000000, 2000000] or consistent_hash
+#mysql_shards:
+#- {logical: 'order', dbs: ['order_0', 'order_1'], strategy: 'modulo', tables: 2}
+
+#mysql_tls_profiles:
+#  internal: {ca: '/etc/mysql/ca.pem', cert: '/etc/mysql/client.pem', key: '/etc/mysql/client.key'}
 
 
 #mongodb
 #mgos:
 #- {db: 'test', uri: 'mongodb://0.0.0.0:27017/admin?connect=direct'}
+#- {db: 'report', uri: 'mongodb://0.0.0.0:27017,0.0.0.0:27018/admin?replicaSet=rs0', database: 'analytics',
+#   readpreference: 'secondaryPreferred', maxstaleness: '90s', readconcern: 'majority',
+#   writeconcern: 'majority', journal: true, wtimeout: '1s', maxpoolsize: 50}
 
 #ms
 mgo_connect_timeout : 500
@@ -45,6 +64,15 @@ mgo_connect_timeout : 500
 mgo_max_conn_idle_time : 10
 mgo_max_pool_size : 100
 mgo_min_pool_size : 10
+#mgo_tx_max_retries : 3
+#ms
+#mgo_change_stream_max_backoff : 30000
+
+#mgo_indexes:
+#- {client: 'test', coll: 'user', keys: ['phone', '-created_at'], unique: true}
+#- {client: 'test', coll: 'session', keys: ['expire_at'], expireafter: '0s'}
+#mgo_sync_indexes : true
+#mgo_drop_indexes : false
 
 # http请求 单位：s
 http_client_time_out : 3
@@ -104,6 +132,21 @@ grpc_client_debug: {{bool}}
 mysql_check_slow : {{bool}}
 # 大于 slow_sql_time 为慢sql 单位：ms
 mysql_slow_time : 500
+#慢 select 在后台执行 EXPLAIN，每个库用只有 1 个连接的独立连接池，不占用业务连接，计划摘要写入日志，缓存后写入慢sql日志和 span true/false
+#mysql_explain : false
+#两次 EXPLAIN 的最小间隔 单位：ms
+#mysql_explain_interval : 1000
+#mysql_explain_timeout : 1000
+#同一指纹的计划缓存时间 单位：s
+#mysql_explain_ttl : 600
+#缓存命中指纹或 NewCacheContext 的 select 结果集，dbs 的 proxies 需加 cache_proxy，写同表时失效
+#mysql_cache_fingerprints : ['select * from config where (name = ?)']
+#缓存时间 单位：s
+#mysql_cache_ttl : 60
+#local 或 redis，local 只感知本进程的写
+#mysql_cache_store : local
+#local 缓存的结果集数
+#mysql_cache_size : 10000
 #开启 tracer true/false
 mysql_tracer : {{bool}}
 #启动metrice true/false
@@ -30,9 +30,9 @@ func (this *UserDao) GetDb(ctx context.Context) *gorm.DB {
 	return this.mysql.GetCtxDb(ctx, "passport").Table("user")
 }
 
-//slave
+//slave, reads are routed to the replicas by MysqlClient
 func (this *UserDao) GetSlaveDb(ctx context.Context) *gorm.DB {
-	return this.mysql.GetCtxDb(ctx, "passport_slave").Table("user")
+	return this.mysql.GetCtxDb(ctx, "passport").Table("user")
 }
 
 
@@ -93,6 +93,13 @@ func provideDb(esim *container.Esim) *mysql.MysqlClient {
 					monitorProxyOptions.WithTracer(esim.Tracer),
 				)
 			},
+			func() interface{} {
+				guardProxyOptions := mysql.GuardProxyOptions{}
+				return mysql.NewGuardProxy(
+					guardProxyOptions.WithLogger(esim.Logger),
+					guardProxyOptions.WithConf(esim.Conf),
+				)
+			},
 		),
 	)
 